@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/TunnelWork/Ulysses/src/server"
+)
+
+// Job kinds operating on accounts, enqueued by admin/Account with async=true.
+
+const (
+	jobKindProvision        = `provision`
+	jobKindDeleteAccount    = `delete_account`
+	jobKindSuspendAccount   = `suspend_account`
+	jobKindUnsuspendAccount = `unsuspend_account`
+)
+
+var (
+	jobHandlers = map[string]jobHandler{
+		jobKindProvision:        runProvisionJob,
+		jobKindDeleteAccount:    runAccountJob,
+		jobKindSuspendAccount:   runAccountJob,
+		jobKindUnsuspendAccount: runAccountJob,
+	}
+)
+
+// provisionJobPayload is the input of a provision job.
+type provisionJobPayload struct {
+	Uid      uint                   `json:"uid"`
+	ServerID uint                   `json:"server_id"`
+	Aconf    []server.Configurables `json:"aconf"`
+	Indexes  []int                  `json:"indexes,omitempty"`   // Positions of Aconf in the aconf first enqueued, if narrowed
+	InFlight []int                  `json:"in_flight,omitempty"` // Positions of accounts passed to the backend, not recorded yet
+}
+
+// index returns the position of Aconf[i] in the aconf first enqueued.
+func (p provisionJobPayload) index(i int) int {
+	if p.Indexes == nil {
+		return i
+	}
+	return p.Indexes[i]
+}
+
+type provisionJobFailure struct {
+	Index     int    `json:"index"` // in the aconf first enqueued
+	Error     string `json:"error"`
+	Retriable bool   `json:"retriable"`
+}
+
+// provisionJobResult accumulates over all attempts of a provision job.
+type provisionJobResult struct {
+	IDs     []uint                `json:"ids"`               // Records of accounts created
+	Failed  []provisionJobFailure `json:"failed,omitempty"`  // in the last attempt
+	Unknown []provisionJobFailure `json:"unknown,omitempty"` // Accounts which may have been created, never tried again
+}
+
+type provisionJobItem struct {
+	index int // in the aconf first enqueued
+	conf  server.Configurables
+}
+
+// runProvisionJob creates accounts one by one. Before an account is passed to the backend, the job is saved with it
+// in flight and out of the payload. So neither a retry, another worker claiming the job after this one died, nor an admin
+// retrying the dead job creates an account twice. Accounts which may have been created, as the call timed out, the worker
+// died during it or the account can't be recorded, are reported in Unknown for an admin to check on the backend.
+// The job is retried only if all failures are retriable.
+func runProvisionJob(ctx context.Context, job *Job) error {
+	var payload provisionJobPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+	var result provisionJobResult
+	if len(job.Result) > 0 {
+		json.Unmarshal(job.Result, &result)
+	}
+	result.Failed = nil
+
+	var err, firstErr error
+	allRetriable, unknown := true, 0
+
+	// Left by a worker died during the call
+	for _, index := range payload.InFlight {
+		result.Unknown = append(result.Unknown, provisionJobFailure{Index: index, Error: ErrJobAbandoned.Error()})
+		unknown++
+		firstErr = ErrJobAbandoned
+	}
+
+	pending := []provisionJobItem{}
+	for i, conf := range payload.Aconf {
+		pending = append(pending, provisionJobItem{index: payload.index(i), conf: conf})
+	}
+	remaining := []provisionJobItem{} // to try on a retry
+
+	// setPayload narrows job.Payload to remaining and rest, with inFlight.
+	setPayload := func(rest []provisionJobItem, inFlight []int) (err error) {
+		narrowed := provisionJobPayload{
+			Uid:      payload.Uid,
+			ServerID: payload.ServerID,
+			Aconf:    []server.Configurables{},
+			Indexes:  []int{},
+			InFlight: inFlight,
+		}
+		for _, item := range append(append([]provisionJobItem{}, remaining...), rest...) {
+			narrowed.Aconf = append(narrowed.Aconf, item.conf)
+			narrowed.Indexes = append(narrowed.Indexes, item.index)
+		}
+		if job.Payload, err = json.Marshal(narrowed); err != nil {
+			return err
+		}
+		job.Result, err = json.Marshal(result)
+		return err
+	}
+
+	am := NewAccountManager(dbConnector).WithContext(ctx)
+	for n, item := range pending {
+		if err = ctx.Err(); err == nil {
+			if err = setPayload(pending[n+1:], []int{item.index}); err == nil {
+				err = job.save()
+			}
+		}
+		if err != nil {
+			// Not passed to the backend
+			remaining = append(remaining, pending[n:]...)
+			break
+		}
+
+		ids, batch, provisionErr := am.ProvisionBatch(payload.Uid, payload.ServerID, []server.Configurables{item.conf}, server.ContinueOnError)
+		if len(batch.Items) == 0 {
+			// Not passed to the backend, e.g., no such server
+			remaining = append(remaining, pending[n:]...)
+			err = provisionErr
+			break
+		}
+
+		outcome := batch.Items[0]
+		switch {
+		case outcome.Done && provisionErr == nil:
+			result.IDs = append(result.IDs, ids...)
+			continue
+		case outcome.Done:
+			outcome.Err = fmt.Errorf("account %d is created but can't be recorded: %w", outcome.AccID, provisionErr)
+			fallthrough
+		case outcome.Unknown:
+			result.Unknown = append(result.Unknown, provisionJobFailure{Index: item.index, Error: outcome.Err.Error()})
+			unknown++
+		default:
+			remaining = append(remaining, item)
+			result.Failed = append(result.Failed, provisionJobFailure{Index: item.index, Error: outcome.Err.Error(), Retriable: outcome.Retriable})
+			allRetriable = allRetriable && outcome.Retriable
+		}
+		if firstErr == nil {
+			firstErr = outcome.Err
+		}
+	}
+
+	if payloadErr := setPayload(nil, nil); payloadErr != nil {
+		return payloadErr
+	}
+	if err != nil {
+		return err
+	}
+	if len(result.Failed) == 0 && unknown == 0 {
+		return nil
+	}
+
+	err = fmt.Errorf("%d of %d accounts failed: %w", len(result.Failed)+unknown, len(pending)+len(payload.InFlight), firstErr)
+	if allRetriable && unknown == 0 {
+		return server.RetriableError(err)
+	}
+	return err
+}
+
+// accountJobPayload is the input of a job on a single account record.
+type accountJobPayload struct {
+	ID uint `json:"id"`
+}
+
+func runAccountJob(ctx context.Context, job *Job) error {
+	var payload accountJobPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	am := NewAccountManager(dbConnector).WithContext(ctx)
+	switch job.Kind {
+	case jobKindDeleteAccount:
+		return am.Delete(payload.ID)
+	case jobKindSuspendAccount:
+		return am.Suspend(payload.ID)
+	case jobKindUnsuspendAccount:
+		return am.Unsuspend(payload.ID)
+	}
+	return ErrJobUnknownKind
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/internal/db"
+	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/TunnelWork/Ulysses/src/server"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	accountTableName = `accounts`
+
+	accountStatusActive    = `active`
+	accountStatusSuspended = `suspended`
+	accountStatusDeleted   = `deleted`
+)
+
+var (
+	ErrAccountNotFound  = errors.New("ulysses/account: no such account")
+	ErrAccountBadStatus = errors.New("ulysses/account: bad account status")
+	ErrAccountNoData    = errors.New("ulysses/account: backend server returned nothing for the account")
+)
+
+// AccountInfo links an account on a backend server to the Ulysses user owning it.
+// ServerID refers to the server row managed by ServerManager, and AccID is the ID returned by Server.AddAccount().
+type AccountInfo struct {
+	ID           uint   `json:"id"`
+	Uid          uint   `json:"uid"`
+	ServerID     uint   `json:"server_id"`
+	AccID        int    `json:"acc_id"`
+	Status       string `json:"status"`
+	CreationTime int64  `json:"creation_time"`
+	LastUpdate   int64  `json:"last_update"`
+}
+
+// AccountManager is capable of performing database CRUD operations to
+// - Account Ownership Info
+type AccountManager struct {
+	dbConnector db.Connector
+	tx          *sql.Tx         // If set, all operations run in this transaction
+	ctx         context.Context // Parent of ctx of operations on backend servers. See backendContext().
+}
+
+// NewAccountManager shares the connection pool of dbConnector
+func NewAccountManager(dbConnector db.Connector) *AccountManager {
+	return &AccountManager{
+		dbConnector: dbConnector,
+		ctx:         context.Background(),
+	}
+}
+
+// InTx() returns an AccountManager running all operations in tx, e.g., from db.WithTx().
+func (am *AccountManager) InTx(tx *sql.Tx) *AccountManager {
+	return &AccountManager{
+		dbConnector: am.dbConnector,
+		tx:          tx,
+		ctx:         am.ctx,
+	}
+}
+
+// WithContext() returns an AccountManager canceling operations on backend servers once ctx is done,
+// e.g., the context of the HTTP request asking for them.
+func (am *AccountManager) WithContext(ctx context.Context) *AccountManager {
+	return &AccountManager{
+		dbConnector: am.dbConnector,
+		tx:          am.tx,
+		ctx:         ctx,
+	}
+}
+
+func (am *AccountManager) conn() (db.Querier, error) {
+	if am.tx != nil {
+		return am.tx, nil
+	}
+	return am.dbConnector.Conn()
+}
+
+// Add() records accounts already created on server serverID as owned by uid.
+// It returns the IDs of the records in the same order as accIDs.
+func (am *AccountManager) Add(uid uint, serverID uint, accIDs []int) (ids []uint, err error) {
+	dbConn, err := am.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := am.dbConnector.WithTimeout(am.ctx)
+	defer cancel()
+
+	stmtInsertAccount, err := dbConn.PrepareContext(ctx, `INSERT INTO `+masterConfig.DB.TblPrefix+accountTableName+` (uid, server_id, acc_id, status, creation_time, last_update) VALUES( ?, ?, ?, ?, ?, ? )`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtInsertAccount.Close()
+
+	now := time.Now().Unix()
+	for _, accID := range accIDs {
+		result, err := stmtInsertAccount.ExecContext(ctx, uid, serverID, accID, accountStatusActive, now, now)
+		if err != nil {
+			return ids, err
+		}
+		idint64, err := result.LastInsertId()
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, uint(idint64))
+	}
+
+	logger.Info("*AccountManager.Add(): recorded ", len(ids), " accounts on server ", serverID, " for uid ", uid)
+	return ids, nil
+}
+
+// Provision() creates accounts with aconf on server serverID and records them as owned by uid.
+// Accounts created before an error are still recorded.
+func (am *AccountManager) Provision(uid uint, serverID uint, aconf []server.Configurables) (ids []uint, err error) {
+	ids, result, err := am.ProvisionBatch(uid, serverID, aconf, server.StopOnError)
+	if err != nil {
+		return ids, err
+	}
+	return ids, result.Err()
+}
+
+// ProvisionBatch() is Provision() reporting each of aconf in result. With server.ContinueOnError, a failed account
+// doesn't stop the rest, and the caller may retry only aconf at result.RetriableIndexes().
+// ids are the records of succeeded accounts in order. err is set only if no account is tried, or created ones can't be recorded.
+func (am *AccountManager) ProvisionBatch(uid uint, serverID uint, aconf []server.Configurables, mode server.BatchMode) (ids []uint, result server.BatchResult, err error) {
+	s, err := loadServer(serverID)
+	if err != nil {
+		return nil, result, err
+	}
+	serverType, err := loadServerType(serverID)
+	if err != nil {
+		return nil, result, err
+	}
+	if aconf, err = server.ValidateAccountConf(serverType, aconf); err != nil {
+		return nil, result, err
+	}
+
+	ctx, cancel := backendContext(am.ctx)
+	defer cancel()
+	result = server.AddAccountBatch(ctx, s, aconf, mode)
+	accIDs := result.Succeeded()
+	ids, err = am.Add(uid, serverID, accIDs)
+	if err != nil {
+		logger.Error("*AccountManager.ProvisionBatch(): created accounts ", accIDs, " on server ", serverID, " but can't record them. error: ", err)
+		return ids, result, err
+	}
+	if !result.OK() {
+		logger.Warning("*AccountManager.ProvisionBatch(): ", len(result.Failed()), " of ", len(aconf), " accounts failed on server ", serverID, ". first error: ", result.Err())
+	}
+	return ids, result, nil
+}
+
+// Lookup() returns the account record id unless it is deleted
+func (am *AccountManager) Lookup(id uint) (AccountInfo, error) {
+	dbConn, err := am.conn()
+	if err != nil {
+		return AccountInfo{}, err
+	}
+
+	ctx, cancel := am.dbConnector.WithTimeout(am.ctx)
+	defer cancel()
+
+	stmtLookupAccount, err := dbConn.PrepareContext(ctx, `SELECT id, uid, server_id, acc_id, status, creation_time, last_update FROM `+masterConfig.DB.TblPrefix+accountTableName+` WHERE id = ? AND status <> ?`)
+	if err != nil {
+		return AccountInfo{}, err
+	}
+	defer stmtLookupAccount.Close()
+
+	var acc AccountInfo
+	err = stmtLookupAccount.QueryRowContext(ctx, id, accountStatusDeleted).Scan(&acc.ID, &acc.Uid, &acc.ServerID, &acc.AccID, &acc.Status, &acc.CreationTime, &acc.LastUpdate)
+	if err == sql.ErrNoRows {
+		return AccountInfo{}, ErrAccountNotFound
+	}
+	return acc, err
+}
+
+// ListByUser() returns all accounts of uid not deleted
+func (am *AccountManager) ListByUser(uid uint) ([]AccountInfo, error) {
+	dbConn, err := am.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := am.dbConnector.WithTimeout(am.ctx)
+	defer cancel()
+
+	stmtListAccount, err := dbConn.PrepareContext(ctx, `SELECT id, uid, server_id, acc_id, status, creation_time, last_update FROM `+masterConfig.DB.TblPrefix+accountTableName+` WHERE uid = ? AND status <> ? ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtListAccount.Close()
+
+	rows, err := stmtListAccount.QueryContext(ctx, uid, accountStatusDeleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []AccountInfo{}
+	for rows.Next() {
+		var acc AccountInfo
+		if err = rows.Scan(&acc.ID, &acc.Uid, &acc.ServerID, &acc.AccID, &acc.Status, &acc.CreationTime, &acc.LastUpdate); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, acc)
+	}
+	return accounts, rows.Err()
+}
+
+// SetStatus() changes the status recorded for account id. It doesn't touch the backend server.
+func (am *AccountManager) SetStatus(id uint, status string) error {
+	if status != accountStatusActive && status != accountStatusSuspended && status != accountStatusDeleted {
+		return ErrAccountBadStatus
+	}
+
+	dbConn, err := am.conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := am.dbConnector.WithTimeout(am.ctx)
+	defer cancel()
+
+	stmtSetStatus, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+accountTableName+` SET status = ?, last_update = ? WHERE id = ? AND status <> ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtSetStatus.Close()
+
+	result, err := stmtSetStatus.ExecContext(ctx, status, time.Now().Unix(), id, accountStatusDeleted)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrAccountNotFound
+	}
+
+	logger.Info("*AccountManager.SetStatus(): set account ", id, " to ", status)
+	return nil
+}
+
+// Delete() deletes the account from the backend server, then marks the record deleted.
+func (am *AccountManager) Delete(id uint) error {
+	acc, err := am.Lookup(id)
+	if err != nil {
+		return err
+	}
+
+	s, err := loadServer(acc.ServerID)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := backendContext(am.ctx)
+	defer cancel()
+	if _, err = server.WithContext(s).DeleteAccountContext(ctx, []int{acc.AccID}); err != nil {
+		return err
+	}
+
+	return am.SetStatus(id, accountStatusDeleted)
+}
+
+// onBackend() runs op on the backend server of account id, and sets the recorded status to status if it is not empty.
+func (am *AccountManager) onBackend(id uint, status string, op func(ctx context.Context, s server.Server, accID []int) error) error {
+	acc, err := am.Lookup(id)
+	if err != nil {
+		return err
+	}
+
+	s, err := loadServer(acc.ServerID)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := backendContext(am.ctx)
+	defer cancel()
+	if err = op(ctx, s, []int{acc.AccID}); err != nil {
+		return err
+	}
+
+	if status == "" {
+		return nil
+	}
+	return am.SetStatus(id, status)
+}
+
+// Suspend() stops the account on the backend server without deleting its data, then marks the record suspended.
+func (am *AccountManager) Suspend(id uint) error {
+	return am.onBackend(id, accountStatusSuspended, func(ctx context.Context, s server.Server, accID []int) error {
+		_, err := server.SuspendAccount(ctx, s, accID)
+		return err
+	})
+}
+
+// Unsuspend() resumes the account on the backend server, then marks the record active.
+func (am *AccountManager) Unsuspend(id uint) error {
+	return am.onBackend(id, accountStatusActive, func(ctx context.Context, s server.Server, accID []int) error {
+		_, err := server.UnsuspendAccount(ctx, s, accID)
+		return err
+	})
+}
+
+// Renew() extends the expiry of the account on the backend server by period.
+func (am *AccountManager) Renew(id uint, period time.Duration) error {
+	return am.onBackend(id, "", func(ctx context.Context, s server.Server, accID []int) error {
+		_, err := server.RenewAccount(ctx, s, accID, period)
+		return err
+	})
+}
+
+// ChangePackage() moves the account on the backend server to package pkg.
+func (am *AccountManager) ChangePackage(id uint, pkg string) error {
+	return am.onBackend(id, "", func(ctx context.Context, s server.Server, accID []int) error {
+		_, err := server.ChangeAccountPackage(ctx, s, accID, pkg)
+		return err
+	})
+}
+
+// ResetPassword() sets a new password for the account on the backend server, and returns the new Credential.
+func (am *AccountManager) ResetPassword(id uint) (credential server.Credential, err error) {
+	err = am.onBackend(id, "", func(ctx context.Context, s server.Server, accID []int) error {
+		credentials, err := server.ResetAccountPassword(ctx, s, accID)
+		if err == nil && len(credentials) > 0 {
+			credential = credentials[0]
+		}
+		return err
+	})
+	return credential, err
+}
+
+// Credentials() returns the credential of the account from the backend server.
+func (am *AccountManager) Credentials(id uint) (credential server.Credential, err error) {
+	err = am.onBackend(id, "", func(ctx context.Context, s server.Server, accID []int) error {
+		credentials, err := server.WithContext(s).GetCredentialsContext(ctx, accID)
+		if err == nil && len(credentials) == 0 {
+			return ErrAccountNoData
+		} else if err == nil {
+			credential = credentials[0]
+		}
+		return err
+	})
+	return credential, err
+}
+
+// Usage() returns the usage of the account from the backend server.
+func (am *AccountManager) Usage(id uint) (usage server.AccountUsage, err error) {
+	err = am.onBackend(id, "", func(ctx context.Context, s server.Server, accID []int) error {
+		usages, err := server.WithContext(s).GetUsageContext(ctx, accID)
+		if err == nil && len(usages) == 0 {
+			return ErrAccountNoData
+		} else if err == nil {
+			usage = usages[0]
+		}
+		return err
+	})
+	return usage, err
+}
+
+// Capabilities() returns the optional operations supported by the backend server of account id.
+func (am *AccountManager) Capabilities(id uint) ([]string, error) {
+	acc, err := am.Lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	s, err := loadServer(acc.ServerID)
+	if err != nil {
+		return nil, err
+	}
+	return server.Capabilities(s), nil
+}
+
+// ownedAccount returns the account specified by query id if it belongs to the requesting user.
+// Accounts of others look the same as nonexistent ones.
+func ownedAccount(c *gin.Context) (AccountInfo, bool) {
+	uid, ok := authedUid(c)
+	if !ok {
+		return AccountInfo{}, false
+	}
+	iduint64, err := strconv.ParseUint(c.Query("id"), 10, 32)
+	if err != nil {
+		return AccountInfo{}, false
+	}
+
+	acc, err := NewAccountManager(dbConnector).Lookup(uint(iduint64))
+	if err != nil {
+		if err != ErrAccountNotFound {
+			logger.Error("ownedAccount(): can't look up account. error: ", err)
+		}
+		return AccountInfo{}, false
+	}
+	if acc.Uid != uid {
+		return AccountInfo{}, false
+	}
+	return acc, true
+}
+
+// _handlerAccountList returns all accounts of current user
+func _handlerAccountList(c *gin.Context) {
+	uid, _ := authedUid(c)
+
+	accounts, err := NewAccountManager(dbConnector).ListByUser(uid)
+	if err != nil {
+		logger.Error("_handlerAccountList(): can't list accounts. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"accounts": accounts,
+	})
+}
+
+// _handlerAccountCredentials returns the client view of credentials of an account owned by current user
+func _handlerAccountCredentials(c *gin.Context) {
+	acc, ok := ownedAccount(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	credential, err := NewAccountManager(dbConnector).WithContext(c.Request.Context()).Credentials(acc.ID)
+	if err != nil {
+		logger.Error("_handlerAccountCredentials(): can't get credentials of account ", acc.ID, ". error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "success",
+		"credential": server.ClientCredentialView(credential),
+	})
+}
+
+// _handlerAccountUsage returns the client view of usage of an account owned by current user
+func _handlerAccountUsage(c *gin.Context) {
+	acc, ok := ownedAccount(c)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	usage, err := NewAccountManager(dbConnector).WithContext(c.Request.Context()).Usage(acc.ID)
+	if err != nil {
+		logger.Error("_handlerAccountUsage(): can't get usage of account ", acc.ID, ". error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"usage":  server.ClientUsageView(usage),
+	})
+}
+
+// _adminHandlerAccountManager is registered for api.ROLE_ADMIN only.
+func _adminHandlerAccountManager(c *gin.Context) {
+	adminAccountManager := NewAccountManager(dbConnector).WithContext(c.Request.Context())
+	op := c.Query("op")
+
+	parseUint := func(key string) (uint, bool) {
+		v, err := strconv.ParseUint(c.PostForm(key), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"op":     op,
+				"status": "error",
+				"error":  "bad " + key,
+			})
+			return 0, false
+		}
+		return uint(v), true
+	}
+
+	var err error
+	resp := gin.H{
+		"op":     op,
+		"status": "success",
+	}
+
+	// With async=true, provision, delete, suspend and unsuspend are enqueued as jobs to poll at admin/Job.
+	async := c.PostForm("async") == "true"
+	enqueue := func(kind string, payload interface{}) {
+		operatorUid, _ := authedUid(c)
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			key = c.PostForm("idempotency_key")
+		}
+		job, existed, err := NewJobQueue(dbConnector).Enqueue(kind, key, operatorUid, payload)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if err == ErrJobKeyConflict {
+				status = http.StatusConflict
+			} else if err == ErrJobKeyTooLong {
+				status = http.StatusBadRequest
+			} else {
+				logger.Error("_adminHandlerAccountManager(): can't enqueue job of op ", op, ". error: ", err)
+			}
+			c.JSON(status, gin.H{
+				"op":     op,
+				"status": "error",
+				"error":  err.Error(),
+			})
+			return
+		}
+		resp["status"] = "queued"
+		resp["job"] = job
+		resp["existed"] = existed
+		c.JSON(http.StatusAccepted, resp)
+	}
+
+	switch op {
+	case "provision":
+		uid, ok := parseUint("uid")
+		if !ok {
+			return
+		}
+		serverID, ok := parseUint("server_id")
+		if !ok {
+			return
+		}
+		var aconf []server.Configurables
+		if err = json.Unmarshal([]byte(c.PostForm("aconf_json")), &aconf); err != nil {
+			err = server.ErrBadJsonArray
+			break
+		}
+		if async {
+			// Reject bad aconf now rather than in a dead job
+			var serverType string
+			if serverType, err = loadServerType(serverID); err != nil {
+				break
+			}
+			if _, err = server.ValidateAccountConf(serverType, aconf); err != nil {
+				break
+			}
+			enqueue(jobKindProvision, provisionJobPayload{Uid: uid, ServerID: serverID, Aconf: aconf})
+			return
+		}
+		mode := server.StopOnError
+		if c.PostForm("continue_on_error") == "true" {
+			mode = server.ContinueOnError
+		}
+		var ids []uint
+		var result server.BatchResult
+		ids, result, err = adminAccountManager.ProvisionBatch(uid, serverID, aconf, mode)
+		resp["ids"] = ids
+		resp["results"] = result.Items
+		if err == nil && !result.OK() {
+			if mode == server.StopOnError {
+				err = result.Err()
+				break
+			}
+			// Some failed but the rest went on: tell which to retry
+			resp["status"] = "partial"
+			resp["retriable"] = result.RetriableIndexes()
+			c.JSON(http.StatusMultiStatus, resp)
+			return
+		}
+	case "assign":
+		uid, ok := parseUint("uid")
+		if !ok {
+			return
+		}
+		serverID, ok := parseUint("server_id")
+		if !ok {
+			return
+		}
+		var accIDs []int
+		if err = json.Unmarshal([]byte(c.PostForm("acc_ids")), &accIDs); err != nil {
+			err = server.ErrBadJsonArray
+			break
+		}
+		var ids []uint
+		ids, err = adminAccountManager.Add(uid, serverID, accIDs)
+		resp["ids"] = ids
+	case "list":
+		uid, ok := parseUint("uid")
+		if !ok {
+			return
+		}
+		var accounts []AccountInfo
+		accounts, err = adminAccountManager.ListByUser(uid)
+		resp["accounts"] = accounts
+	case "set_status":
+		id, ok := parseUint("id")
+		if !ok {
+			return
+		}
+		err = adminAccountManager.SetStatus(id, c.PostForm("status"))
+	case "delete":
+		id, ok := parseUint("id")
+		if !ok {
+			return
+		}
+		if async {
+			enqueue(jobKindDeleteAccount, accountJobPayload{ID: id})
+			return
+		}
+		err = adminAccountManager.Delete(id)
+	case "suspend":
+		id, ok := parseUint("id")
+		if !ok {
+			return
+		}
+		if async {
+			enqueue(jobKindSuspendAccount, accountJobPayload{ID: id})
+			return
+		}
+		err = adminAccountManager.Suspend(id)
+	case "unsuspend":
+		id, ok := parseUint("id")
+		if !ok {
+			return
+		}
+		if async {
+			enqueue(jobKindUnsuspendAccount, accountJobPayload{ID: id})
+			return
+		}
+		err = adminAccountManager.Unsuspend(id)
+	case "renew":
+		id, ok := parseUint("id")
+		if !ok {
+			return
+		}
+		period, perr := time.ParseDuration(c.PostForm("period")) // e.g., 720h
+		if perr != nil || period <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"op":     op,
+				"status": "error",
+				"error":  "bad period",
+			})
+			return
+		}
+		err = adminAccountManager.Renew(id, period)
+	case "change_package":
+		id, ok := parseUint("id")
+		if !ok {
+			return
+		}
+		err = adminAccountManager.ChangePackage(id, c.PostForm("package"))
+	case "reset_password":
+		id, ok := parseUint("id")
+		if !ok {
+			return
+		}
+		var credential server.Credential
+		if credential, err = adminAccountManager.ResetPassword(id); err == nil && credential != nil {
+			resp["credential"] = server.AdminCredentialView(credential)
+		}
+	case "credentials":
+		id, ok := parseUint("id")
+		if !ok {
+			return
+		}
+		var credential server.Credential
+		credential, err = adminAccountManager.Credentials(id)
+		resp["credential"] = server.AdminCredentialView(credential)
+	case "usage":
+		id, ok := parseUint("id")
+		if !ok {
+			return
+		}
+		var usage server.AccountUsage
+		usage, err = adminAccountManager.Usage(id)
+		resp["usage"] = server.AdminUsageView(usage)
+	case "capabilities":
+		id, ok := parseUint("id")
+		if !ok {
+			return
+		}
+		var capabilities []string
+		capabilities, err = adminAccountManager.Capabilities(id)
+		resp["capabilities"] = capabilities
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"op":     op,
+			"status": "error",
+			"error":  "unknown op",
+		})
+		return
+	}
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		var verr *server.ValidationError
+		switch {
+		case err == ErrAccountNotFound, err == sql.ErrNoRows, err == ErrServerNotFound:
+			status = http.StatusNotFound
+		case err == ErrAccountBadStatus, err == server.ErrBadJsonArray, errors.Is(err, server.ErrAccountConfigurables):
+			status = http.StatusBadRequest
+		case err == server.ErrCapabilityUnsupported:
+			status = http.StatusNotImplemented
+		case errors.Is(err, context.DeadlineExceeded):
+			status = http.StatusGatewayTimeout
+			logger.Warning("_adminHandlerAccountManager(): op ", op, " timed out on backend server. error: ", err)
+		default:
+			logger.Error("_adminHandlerAccountManager(): op ", op, " failed. error: ", err)
+		}
+		if errors.As(err, &verr) {
+			resp["problems"] = verr.Problems
+		}
+		resp["status"] = "error"
+		resp["error"] = err.Error()
+		c.JSON(status, resp)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
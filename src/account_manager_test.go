@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/TunnelWork/Ulysses/src/server"
+	"github.com/gin-gonic/gin"
+)
+
+type ledgerCredential struct{ accID int }
+
+func (c ledgerCredential) ForClient() string { return "client-" + strconv.Itoa(c.accID) }
+func (c ledgerCredential) ForAdmin() string  { return "admin-" + strconv.Itoa(c.accID) }
+
+type ledgerUsage struct{ accID int }
+
+func (u ledgerUsage) ForClient() string { return "usage-" + strconv.Itoa(u.accID) }
+func (u ledgerUsage) ForAdmin() string  { return "usage-" + strconv.Itoa(u.accID) }
+
+// ledgerServer counts the calls reaching it. Accounts with "fail" set are refused.
+type ledgerServer struct {
+	mutex  sync.Mutex
+	nextID int
+	calls  int
+}
+
+func (s *ledgerServer) called() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls
+}
+
+func (s *ledgerServer) UpdateServer(sconf server.Configurables) error { return nil }
+
+func (s *ledgerServer) AddAccount(aconf []server.Configurables) ([]int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls++
+	accID := []int{}
+	for _, conf := range aconf {
+		if fail, _ := conf.GetString("fail"); fail != "" {
+			return accID, errors.New("backend refused")
+		}
+		s.nextID++
+		accID = append(accID, s.nextID)
+	}
+	return accID, nil
+}
+
+func (s *ledgerServer) UpdateAccount(accID []int, aconf []server.Configurables) ([]int, error) {
+	return accID, nil
+}
+
+func (s *ledgerServer) DeleteAccount(accID []int) ([]int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls++
+	return accID, nil
+}
+
+func (s *ledgerServer) GetCredentials(accID []int) ([]server.Credential, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls++
+	credentials := []server.Credential{}
+	for _, id := range accID {
+		credentials = append(credentials, ledgerCredential{accID: id})
+	}
+	return credentials, nil
+}
+
+func (s *ledgerServer) GetUsage(accID []int) ([]server.AccountUsage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls++
+	usages := []server.AccountUsage{}
+	for _, id := range accID {
+		usages = append(usages, ledgerUsage{accID: id})
+	}
+	return usages, nil
+}
+
+type ledgerRegistrar struct {
+	server *ledgerServer
+}
+
+func (r ledgerRegistrar) NewServer(sconf server.Configurables) (server.Server, error) {
+	return r.server, nil
+}
+
+// useLedgerServer adds a server backed by a new ledgerServer and returns both.
+func useLedgerServer(t *testing.T) (uint, *ledgerServer) {
+	t.Helper()
+	ledger := &ledgerServer{}
+	server.AddServerRegistrar("ledger", ledgerRegistrar{server: ledger})
+	serverID, err := NewServerManager(dbConnector).Add("ledger", server.Configurables{})
+	if err != nil {
+		t.Fatalf("Add() returns error:%s\n", err)
+	}
+	return serverID, ledger
+}
+
+// newAccountContext returns a gin.Context of uid asking for account id.
+func newAccountContext(uid uint, id uint) (*gin.Context, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("GET", "/?id="+strconv.FormatUint(uint64(id), 10), nil)
+	c.Set(ctxKeyAuthUid, uid)
+	return c, recorder
+}
+
+func TestAccountManagerStatus(t *testing.T) {
+	useTestConnector(t)
+	am := NewAccountManager(dbConnector)
+
+	ids, err := am.Add(7, 1, []int{101, 102, 103})
+	if err != nil || len(ids) != 3 {
+		t.Fatalf("Add() returns %v, %v\n", ids, err)
+	}
+
+	if err = am.SetStatus(ids[0], accountStatusSuspended); err != nil {
+		t.Fatalf("SetStatus() returns error:%s\n", err)
+	}
+	if acc, err := am.Lookup(ids[0]); err != nil || acc.Status != accountStatusSuspended || acc.Uid != 7 || acc.AccID != 101 {
+		t.Errorf("Lookup() after SetStatus() returns %+v, %v\n", acc, err)
+	}
+	if err = am.SetStatus(ids[0], "gone"); err != ErrAccountBadStatus {
+		t.Errorf("SetStatus() to unknown status returns %v, want %v\n", err, ErrAccountBadStatus)
+	}
+
+	// Deleted records are kept but hidden, and stay deleted
+	if err = am.SetStatus(ids[1], accountStatusDeleted); err != nil {
+		t.Fatalf("SetStatus() returns error:%s\n", err)
+	}
+	if _, err = am.Lookup(ids[1]); err != ErrAccountNotFound {
+		t.Errorf("Lookup() of deleted account returns %v, want %v\n", err, ErrAccountNotFound)
+	}
+	if err = am.SetStatus(ids[1], accountStatusActive); err != ErrAccountNotFound {
+		t.Errorf("SetStatus() of deleted account returns %v, want %v\n", err, ErrAccountNotFound)
+	}
+	if err = am.SetStatus(9999, accountStatusActive); err != ErrAccountNotFound {
+		t.Errorf("SetStatus() of unknown account returns %v, want %v\n", err, ErrAccountNotFound)
+	}
+
+	accounts, err := am.ListByUser(7)
+	if err != nil || len(accounts) != 2 || accounts[0].ID != ids[0] || accounts[1].ID != ids[2] {
+		t.Errorf("ListByUser() returns %+v, %v, want accounts %d and %d\n", accounts, err, ids[0], ids[2])
+	}
+	if accounts, _ = am.ListByUser(8); len(accounts) != 0 {
+		t.Errorf("ListByUser() of another user returns %+v\n", accounts)
+	}
+}
+
+func TestAccountManagerProvisionBatch(t *testing.T) {
+	useTestConnector(t)
+	serverID, _ := useLedgerServer(t)
+	am := NewAccountManager(dbConnector)
+
+	ids, result, err := am.ProvisionBatch(7, serverID, []server.Configurables{{}, {"fail": "yes"}, {}}, server.ContinueOnError)
+	if err != nil {
+		t.Fatalf("ProvisionBatch() returns error:%s\n", err)
+	}
+	if result.OK() || len(result.Failed()) != 1 || len(ids) != 2 {
+		t.Fatalf("ProvisionBatch() records %v with failed %v, want 2 records and 1 failure\n", ids, result.Failed())
+	}
+
+	// Only the created accounts are recorded
+	accounts, _ := am.ListByUser(7)
+	if len(accounts) != 2 {
+		t.Fatalf("ListByUser() after ProvisionBatch() returns %+v\n", accounts)
+	}
+	succeeded := result.Succeeded()
+	for i, acc := range accounts {
+		if acc.ID != ids[i] || acc.AccID != succeeded[i] || acc.ServerID != serverID || acc.Status != accountStatusActive {
+			t.Errorf("account #%d is %+v, want record %d of backend account %d\n", i, acc, ids[i], succeeded[i])
+		}
+	}
+}
+
+func TestAccountHandlersOwnership(t *testing.T) {
+	useTestConnector(t)
+	serverID, ledger := useLedgerServer(t)
+	am := NewAccountManager(dbConnector)
+
+	ids, err := am.Add(7, serverID, []int{101, 102})
+	if err != nil {
+		t.Fatalf("Add() returns error:%s\n", err)
+	}
+	othersIDs, err := am.Add(8, serverID, []int{201})
+	if err != nil {
+		t.Fatalf("Add() returns error:%s\n", err)
+	}
+	if err = am.SetStatus(ids[1], accountStatusDeleted); err != nil {
+		t.Fatalf("SetStatus() returns error:%s\n", err)
+	}
+
+	handlers := map[string]gin.HandlerFunc{
+		"_handlerAccountCredentials": _handlerAccountCredentials,
+		"_handlerAccountUsage":       _handlerAccountUsage,
+	}
+	for name, handler := range handlers {
+		// Own account
+		c, recorder := newAccountContext(7, ids[0])
+		handler(c)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s() of own account responds %d\n", name, recorder.Code)
+		}
+
+		// Someone else's, deleted or nonexistent accounts look the same, and the backend is never asked
+		calls := ledger.called()
+		for _, id := range []uint{othersIDs[0], ids[1], 9999} {
+			c, recorder = newAccountContext(7, id)
+			handler(c)
+			if recorder.Code != http.StatusNotFound {
+				t.Errorf("%s() of account %d responds %d, want %d\n", name, id, recorder.Code, http.StatusNotFound)
+			}
+		}
+		if ledger.called() != calls {
+			t.Errorf("%s() calls backend %d times for accounts not owned\n", name, ledger.called()-calls)
+		}
+	}
+}
+
+func TestAccountManagerEnqueueKeyTooLong(t *testing.T) {
+	useTestConnector(t)
+
+	for _, tc := range []struct {
+		key  string
+		code int
+	}{
+		{strings.Repeat("k", jobKeyMaxLen), http.StatusAccepted},
+		{strings.Repeat("k", jobKeyMaxLen+1), http.StatusBadRequest},
+	} {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest("POST", "/?op=delete", strings.NewReader("id=1&async=true"))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		c.Request.Header.Set("Idempotency-Key", tc.key)
+		c.Set(ctxKeyAuthUid, uint(1))
+		_adminHandlerAccountManager(c)
+		if recorder.Code != tc.code {
+			t.Errorf("_adminHandlerAccountManager() with a key of %d bytes responds %d, want %d\n", len(tc.key), recorder.Code, tc.code)
+		}
+	}
+}
@@ -9,11 +9,56 @@ import (
 var (
 	// MUST REGISTER ALL FUNCTION HERE
 	mapSystemApiPostHandlers = map[string](*gin.HandlerFunc){
-		"MFA":  &handlerCheckMFA,
-		"Auth": &handlerAuth,
+		"MFA":       &handlerCheckMFA,
+		"Auth":      &handlerAuth,
+		"Logout":    &handlerLogout,
+		"LogoutAll": &handlerLogoutAll,
+
+		"ChangePassword": &handlerChangePassword,
+		"PasswordReset":  &handlerPasswordReset,
+
+		"MFA/TOTP/Enroll":  &handlerEnrollTOTP,
+		"MFA/TOTP/Confirm": &handlerConfirmTOTP,
+		"MFA/TOTP/Disable": &handlerDisableTOTP,
+
+		"MFA/WebAuthn/RegisterBegin":  &handlerWebAuthnRegisterBegin,
+		"MFA/WebAuthn/RegisterFinish": &handlerWebAuthnRegisterFinish,
+		"MFA/WebAuthn/Challenge":      &handlerWebAuthnChallenge,
+		"MFA/WebAuthn/Remove":         &handlerWebAuthnRemove,
+	}
+
+	mapSystemApiGetHandlers = map[string](*gin.HandlerFunc){
+		"PubKey": &handlerServerPubKey,
 	}
 
-	mapSystemApiGetHandlers = map[string](*gin.HandlerFunc){}
+	// Customer endpoints are reachable by any logged-in user
+	mapCustomerApiGetHandlers = map[string](*gin.HandlerFunc){
+		"Account/List":        &handlerAccountList,
+		"Account/Credentials": &handlerAccountCredentials,
+		"Account/Usage":       &handlerAccountUsage,
+	}
+
+	// Admin and debug endpoints are reachable only by api.ROLE_ADMIN
+	mapAdminPost = map[string](*gin.HandlerFunc){
+		"admin/User":    &handlerAdminUM,
+		"admin/Unlock":  &handlerAdminLoginUnlock,
+		"admin/Account": &handlerAdminAM,
+
+		"admin/Server/Rollback":      &handlerAdminServerRollback,
+		"admin/Server/ResealSecrets": &handlerAdminServerResealSecrets,
+
+		"admin/Job/Retry": &handlerAdminJobRetry,
+	}
+
+	mapAdminGet = map[string](*gin.HandlerFunc){
+		"admin/Server/List":    &handlerAdminServerList,
+		"admin/Server/History": &handlerAdminServerHistory,
+		"admin/Server/Diff":    &handlerAdminServerDiff,
+		"admin/Server/Schema":  &handlerAdminServerSchema,
+
+		"admin/Job":      &handlerAdminJob,
+		"admin/Job/List": &handlerAdminJobList,
+	}
 
 	mapDebugPost = map[string](*gin.HandlerFunc){
 		"debug/SM": &handlerDebugSM,
@@ -21,9 +66,41 @@ var (
 	mapDebugGet = map[string](*gin.HandlerFunc){}
 
 	// MUST CREATE FUNCTION VARIABLE AS POINTER
-	handlerCheckMFA gin.HandlerFunc = _handlerCheckMFA
-	handlerAuth     gin.HandlerFunc = _handlerAuth
-	handlerDebugSM  gin.HandlerFunc = _debugHandlerServerManager
+	handlerCheckMFA  gin.HandlerFunc = _handlerCheckMFA
+	handlerAuth      gin.HandlerFunc = _handlerAuth
+	handlerLogout    gin.HandlerFunc = _handlerLogout
+	handlerLogoutAll gin.HandlerFunc = _handlerLogoutAll
+
+	handlerChangePassword gin.HandlerFunc = _handlerChangePassword
+	handlerPasswordReset  gin.HandlerFunc = _handlerPasswordReset
+	handlerServerPubKey   gin.HandlerFunc = _handlerServerPubKey
+
+	handlerEnrollTOTP  gin.HandlerFunc = _handlerEnrollTOTP
+	handlerConfirmTOTP gin.HandlerFunc = _handlerConfirmTOTP
+	handlerDisableTOTP gin.HandlerFunc = _handlerDisableTOTP
+
+	handlerWebAuthnRegisterBegin  gin.HandlerFunc = _handlerWebAuthnRegisterBegin
+	handlerWebAuthnRegisterFinish gin.HandlerFunc = _handlerWebAuthnRegisterFinish
+	handlerWebAuthnChallenge      gin.HandlerFunc = _handlerWebAuthnChallenge
+	handlerWebAuthnRemove         gin.HandlerFunc = _handlerWebAuthnRemove
+
+	handlerAccountList        gin.HandlerFunc = _handlerAccountList
+	handlerAccountCredentials gin.HandlerFunc = _handlerAccountCredentials
+	handlerAccountUsage       gin.HandlerFunc = _handlerAccountUsage
+
+	handlerAdminAM                  gin.HandlerFunc = _adminHandlerAccountManager
+	handlerAdminServerList          gin.HandlerFunc = _adminHandlerServerList
+	handlerAdminServerHistory       gin.HandlerFunc = _adminHandlerServerHistory
+	handlerAdminServerDiff          gin.HandlerFunc = _adminHandlerServerDiff
+	handlerAdminServerRollback      gin.HandlerFunc = _adminHandlerServerRollback
+	handlerAdminServerResealSecrets gin.HandlerFunc = _adminHandlerServerResealSecrets
+	handlerAdminServerSchema        gin.HandlerFunc = _adminHandlerServerSchema
+	handlerAdminJob                 gin.HandlerFunc = _adminHandlerJob
+	handlerAdminJobList             gin.HandlerFunc = _adminHandlerJobList
+	handlerAdminJobRetry            gin.HandlerFunc = _adminHandlerJobRetry
+	handlerAdminUM                  gin.HandlerFunc = _adminHandlerUserManager
+	handlerAdminLoginUnlock         gin.HandlerFunc = _adminHandlerLoginUnlock
+	handlerDebugSM                  gin.HandlerFunc = _debugHandlerServerManager
 )
 
 // registerSystemAPIs() is just an additional step to prevent API endpoints confliction.
@@ -38,21 +115,42 @@ func registerSystemAPIs() {
 	}
 
 	for route, handler := range mapSystemApiGetHandlers {
-		api.RegisterApiEndpoint(api.HTTP_METHOD_GET, route, handler)
+		err = api.RegisterApiEndpoint(api.HTTP_METHOD_GET, route, handler)
 		if err != nil {
 			logger.Fatal("registerSystemAPIs(): Cannot register GET route", route, " due to error: ", err)
 		}
 	}
 
-	for route, handler := range mapDebugGet {
-		err = api.RegisterApiEndpoint(api.HTTP_METHOD_GET, route, handler)
+	for route, handler := range mapCustomerApiGetHandlers {
+		err = api.RegisterApiEndpointWithRoles(api.HTTP_METHOD_GET, route, handler, api.ROLE_AUTHENTICATED)
+		if err != nil {
+			logger.Fatal("registerSystemAPIs(): Cannot register GET route", route, " due to error: ", err)
+		}
+	}
+
+	for route, handler := range mapAdminPost {
+		err = api.RegisterApiEndpointWithRoles(api.HTTP_METHOD_POST, route, handler, api.ROLE_ADMIN)
 		if err != nil {
 			logger.Fatal("registerSystemAPIs(): Cannot register POST route", route, " due to error: ", err)
 		}
 	}
 
+	for route, handler := range mapAdminGet {
+		err = api.RegisterApiEndpointWithRoles(api.HTTP_METHOD_GET, route, handler, api.ROLE_ADMIN)
+		if err != nil {
+			logger.Fatal("registerSystemAPIs(): Cannot register GET route", route, " due to error: ", err)
+		}
+	}
+
+	for route, handler := range mapDebugGet {
+		err = api.RegisterApiEndpointWithRoles(api.HTTP_METHOD_GET, route, handler, api.ROLE_ADMIN)
+		if err != nil {
+			logger.Fatal("registerSystemAPIs(): Cannot register GET route", route, " due to error: ", err)
+		}
+	}
+
 	for route, handler := range mapDebugPost {
-		err = api.RegisterApiEndpoint(api.HTTP_METHOD_POST, route, handler)
+		err = api.RegisterApiEndpointWithRoles(api.HTTP_METHOD_POST, route, handler, api.ROLE_ADMIN)
 		if err != nil {
 			logger.Fatal("registerSystemAPIs(): Cannot register POST route", route, " due to error: ", err)
 		}
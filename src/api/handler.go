@@ -11,6 +11,9 @@ var (
 
 	apiGETMap  map[string]*gin.HandlerFunc = map[string]*gin.HandlerFunc{}
 	apiPOSTMap map[string]*gin.HandlerFunc = map[string]*gin.HandlerFunc{}
+
+	apiGETRoles  map[string]Role = map[string]Role{}
+	apiPOSTRoles map[string]Role = map[string]Role{}
 )
 
 func ImportToGinEngine(router *gin.Engine, urlPath string) {
@@ -31,11 +34,11 @@ func ImportToGinEngine(router *gin.Engine, urlPath string) {
 	}
 
 	for path, handler := range apiGETMap {
-		router.GET(urlPath+path, *handler)
+		router.GET(urlPath+path, roleGuard(apiGETRoles[path]), *handler)
 	}
 
 	for path, handler := range apiPOSTMap {
-		router.POST(urlPath+path, *handler)
+		router.POST(urlPath+path, roleGuard(apiPOSTRoles[path]), *handler)
 	}
 }
 
@@ -20,51 +20,68 @@ var (
 	ErrRepeatPostPath        error = errors.New("api.RegisterApiEndpoint(): repeated path for POST method")
 )
 
+// calledFromMain() tells if the caller of the exported function calling it is in main package.
+func calledFromMain() bool {
+	var packageName string
+	pc, _, _, ok := runtime.Caller(2)
+	details := runtime.FuncForPC(pc)
+	if ok && details != nil {
+		packageName = strings.Split(details.Name(), ".")[0]
+	}
+	return packageName == "main"
+}
+
 // RegisterNewAPIEndpoint() allows only one single handler function,
 // unlike with direct Gin.Router access.
 // note: this is overpowered and makes the system vulnerable to malicious code.
 // in this version, I made it callable ONLY from main package.
+// The endpoint is open to ROLE_ANY. The handler is responsible for its own access control.
 func RegisterApiEndpoint(method uint, relativePath string, handler *gin.HandlerFunc) error {
-	var packageName string
-	pc, _, _, ok := runtime.Caller(1)
-	details := runtime.FuncForPC(pc)
-	if ok && details != nil {
-		packageName = strings.Split(details.Name(), ".")[0]
+	if calledFromMain() {
+		return registerApiEndpoint(method, relativePath, handler, ROLE_ANY)
+	} else {
+		return ErrNotAllowDirectFuncReg
 	}
+}
 
-	if packageName == "main" {
-		return registerApiEndpoint(method, relativePath, handler)
+// RegisterApiEndpointWithRoles() is RegisterApiEndpoint() with access restricted to allowedRoles.
+// Roles are checked before handler runs.
+func RegisterApiEndpointWithRoles(method uint, relativePath string, handler *gin.HandlerFunc, allowedRoles Role) error {
+	if calledFromMain() {
+		return registerApiEndpoint(method, relativePath, handler, allowedRoles)
 	} else {
 		return ErrNotAllowDirectFuncReg
 	}
 }
 
-func registerApiEndpoint(method uint, relativePath string, handler *gin.HandlerFunc) error {
+func registerApiEndpoint(method uint, relativePath string, handler *gin.HandlerFunc, allowedRoles Role) error {
 	mapMutex.Lock()
 	defer mapMutex.Unlock()
 
 	switch method {
 	case HTTP_METHOD_GET:
-		return registerApiGETEndpoint(relativePath, handler)
+		return registerApiGETEndpoint(relativePath, handler, allowedRoles)
 	case HTTP_METHOD_POST:
-		return registerApiPOSTEndpoint(relativePath, handler)
+		return registerApiPOSTEndpoint(relativePath, handler, allowedRoles)
 	default:
 		return ErrBadMethod
 	}
 }
 
-func registerApiGETEndpoint(relativePath string, handler *gin.HandlerFunc) error {
+func registerApiGETEndpoint(relativePath string, handler *gin.HandlerFunc, allowedRoles Role) error {
 	if _, ok := apiGETMap[relativePath]; ok {
 		return ErrRepeatGetPath
 	}
 	apiGETMap[relativePath] = handler
+	apiGETRoles[relativePath] = allowedRoles
 	return nil
 }
 
-func registerApiPOSTEndpoint(relativePath string, handler *gin.HandlerFunc) error {
+func registerApiPOSTEndpoint(relativePath string, handler *gin.HandlerFunc, allowedRoles Role) error {
 	if _, ok := apiPOSTMap[relativePath]; ok {
 		return ErrRepeatPostPath
 	}
 	apiPOSTMap[relativePath] = handler
+	apiPOSTRoles[relativePath] = allowedRoles
 	return nil
 }
@@ -15,6 +15,11 @@ type LessContext struct {
 
 // This function should wrap the JSON and StatCode returned from handler, register it
 func RegisterApiEndpointJSON(method uint, relativePath string, handler HandlerFuncJSON) error {
+	return RegisterApiEndpointJSONWithRoles(method, relativePath, handler, ROLE_ANY)
+}
+
+// RegisterApiEndpointJSONWithRoles() is RegisterApiEndpointJSON() with access restricted to allowedRoles.
+func RegisterApiEndpointJSONWithRoles(method uint, relativePath string, handler HandlerFuncJSON, allowedRoles Role) error {
 	var wrappedHandlerFunc gin.HandlerFunc = func(c *gin.Context) {
 		lc := &LessContext{
 			Request: c.Request,
@@ -23,5 +28,5 @@ func RegisterApiEndpointJSON(method uint, relativePath string, handler HandlerFu
 		c.JSON(status, json)
 	}
 
-	return registerApiEndpoint(method, relativePath, &wrappedHandlerFunc)
+	return registerApiEndpoint(method, relativePath, &wrappedHandlerFunc, allowedRoles)
 }
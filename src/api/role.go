@@ -0,0 +1,135 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Role is a bitmask. An endpoint is registered with the set of roles allowed to access it,
+// and a request is let through if the roles of its user intersect with that set.
+type Role uint
+
+const (
+	ROLE_ANONYMOUS Role = 1 << iota // anyone, including users not logged in
+	ROLE_CUSTOMER
+	ROLE_RESELLER
+	ROLE_ADMIN
+
+	ROLE_AUTHENTICATED Role = ROLE_CUSTOMER | ROLE_RESELLER | ROLE_ADMIN
+	ROLE_ANY           Role = ROLE_ANONYMOUS | ROLE_AUTHENTICATED
+)
+
+var (
+	ErrNotAllowRoleResolverSet error = errors.New("api.SetRoleResolver(): only main package may set the role resolver")
+	ErrBadRoleName             error = errors.New("api.ParseRoles(): bad role name")
+
+	roleNames = map[Role]string{
+		ROLE_ANONYMOUS: "anonymous",
+		ROLE_CUSTOMER:  "customer",
+		ROLE_RESELLER:  "reseller",
+		ROLE_ADMIN:     "admin",
+	}
+
+	// roleResolver is set by main package. Without it, only ROLE_ANONYMOUS endpoints are reachable.
+	roleResolver RoleResolver
+)
+
+// RoleResolver tells if the request comes from an authenticated user and which roles the user has.
+type RoleResolver func(c *gin.Context) (authenticated bool, roles Role)
+
+// SetRoleResolver() is callable ONLY from main package.
+func SetRoleResolver(resolver RoleResolver) error {
+	if !calledFromMain() {
+		return ErrNotAllowRoleResolverSet
+	}
+
+	mapMutex.Lock()
+	defer mapMutex.Unlock()
+	roleResolver = resolver
+	return nil
+}
+
+// ParseRoles() parses comma-separated role names, e.g., "customer,reseller".
+func ParseRoles(names string) (Role, error) {
+	var roles Role
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for role, roleName := range roleNames {
+			if roleName == name {
+				roles |= role
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, ErrBadRoleName
+		}
+	}
+	return roles, nil
+}
+
+// String() returns comma-separated role names, e.g., "customer,reseller".
+func (r Role) String() string {
+	names := []string{}
+	for role := ROLE_ANONYMOUS; role <= ROLE_ADMIN; role <<= 1 {
+		if r&role != 0 {
+			names = append(names, roleNames[role])
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	roles, err := ParseRoles(string(text))
+	if err != nil {
+		return err
+	}
+	*r = roles
+	return nil
+}
+
+// roleGuard() runs before the registered handler and aborts the request
+// with 401 if a login is required, or 403 if the user lacks the roles.
+func roleGuard(allowed Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if allowed&ROLE_ANONYMOUS != 0 {
+			c.Next()
+			return
+		}
+
+		mapMutex.RLock()
+		resolver := roleResolver
+		mapMutex.RUnlock()
+
+		var authenticated bool
+		var roles Role
+		if resolver != nil {
+			authenticated, roles = resolver(c)
+		}
+
+		if !authenticated {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"status": "error",
+			})
+			return
+		}
+		if roles&allowed == 0 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"status": "error",
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRoles(t *testing.T) {
+	roles, err := ParseRoles("customer, admin")
+	if err != nil {
+		t.Fatalf("ParseRoles() returns error:%s\n", err)
+	}
+	if roles != ROLE_CUSTOMER|ROLE_ADMIN {
+		t.Errorf("ParseRoles() returns %d, want %d\n", roles, ROLE_CUSTOMER|ROLE_ADMIN)
+	}
+	if roles.String() != "customer,admin" {
+		t.Errorf("Role.String() returns %s, want customer,admin\n", roles.String())
+	}
+
+	if _, err = ParseRoles("root"); err != ErrBadRoleName {
+		t.Errorf("ParseRoles() with bad name returns %v, want %v\n", err, ErrBadRoleName)
+	}
+}
+
+func TestRoleGuard(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// X-Test-Roles carries the roles of the requesting user, none if missing
+	roleResolver = func(c *gin.Context) (bool, Role) {
+		if c.GetHeader("X-Test-Roles") == "" {
+			return false, 0
+		}
+		roles, _ := ParseRoles(c.GetHeader("X-Test-Roles"))
+		return true, roles
+	}
+	defer func() { roleResolver = nil }()
+
+	router := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router.GET("/public", roleGuard(ROLE_ANY), ok)
+	router.GET("/admin", roleGuard(ROLE_ADMIN), ok)
+	router.GET("/staff", roleGuard(ROLE_RESELLER|ROLE_ADMIN), ok)
+
+	for _, tc := range []struct {
+		path  string
+		roles string
+		want  int
+	}{
+		{"/public", "", http.StatusOK},
+		{"/admin", "", http.StatusUnauthorized},
+		{"/admin", "customer", http.StatusForbidden},
+		{"/admin", "admin", http.StatusOK},
+		{"/staff", "customer,reseller", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.roles != "" {
+			req.Header.Set("X-Test-Roles", tc.roles)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("GET %s with roles %q returns %d, want %d\n", tc.path, tc.roles, w.Code, tc.want)
+		}
+	}
+}
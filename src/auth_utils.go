@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"net/http"
+	"time"
 
+	"github.com/TunnelWork/Ulysses/src/api"
+	"github.com/TunnelWork/Ulysses/src/internal/auth"
 	"github.com/TunnelWork/Ulysses/src/internal/logger"
 	"github.com/gin-gonic/gin"
 )
@@ -11,28 +15,94 @@ import (
 const (
 	userAuthTableName = `users`
 	userMFATableName  = `user_mfa`
+
+	// dummyPasswordHash is verified against when login doesn't exist.
+	dummyPasswordHash = `$argon2id$v=19$m=65536,t=1,p=4$VWx5c3Nlc0R1bW15U2FsdA$0G8VnZVNVGYdC6NQ2hlTgb4uE9bDL9lqY5bMZ1ll0MI`
 )
 
+// hasValidAuth checks the session token carried by the request.
+// On success, the uid is available to the handler via authedUid(c).
 func hasValidAuth(c *gin.Context) bool {
-	return false
+	if _, ok := authedUid(c); ok {
+		return true // Already validated for this request
+	}
+
+	token := sessionTokenFromRequest(c)
+	if token == "" {
+		return false
+	}
+
+	uid, err := validateSession(c, token)
+	if err != nil {
+		logger.Debug("hasValidAuth(): rejected session. error: ", err)
+		return false
+	}
+
+	c.Set(ctxKeyAuthUid, uid)
+	c.Set(ctxKeyAuthTokenHash, sessionTokenHash(token))
+	return true
 }
 
-func checkMFARegistration(login string, passhash string) (bool, []gin.H) {
+// resolveRoles is the api.RoleResolver. Roles of a user are stored as a bitmask of api.Role in users.roles.
+func resolveRoles(c *gin.Context) (authenticated bool, roles api.Role) {
+	if !hasValidAuth(c) {
+		return false, 0
+	}
+	uid, _ := authedUid(c)
+
+	roles, err := userRoles(c.Request.Context(), uid)
+	if err != nil {
+		logger.Error("resolveRoles(): can't look up roles. error: ", err)
+		return true, 0
+	}
+	return true, roles
+}
+
+func userRoles(parent context.Context, uid uint) (api.Role, error) {
 	db, err := dbConnector.Conn()
-	if err == nil {
-		logger.Error("authLoginPass(): can't connect database. error: ", err)
-		return false, nil
+	if err != nil {
+		return 0, err
 	}
+	ctx, cancel := dbConnector.WithTimeout(parent)
+	defer cancel()
 
-	_, err = db.Prepare(`SELECT mfa_config FROM ` + masterConfig.DB.TblPrefix + userAuthTableName + ` WHERE uid = (
-		SELECT uid FROM ` + masterConfig.DB.TblPrefix + userAuthTableName + ` WHERE login = ? AND password = ? AND disabled = 0
-	)`)
-	if err == nil {
-		logger.Error("authLoginPass(): can't prepare statement. error: ", err)
-		return false, nil
+	stmtLookupRoles, err := db.PrepareContext(ctx, `SELECT roles FROM `+masterConfig.DB.TblPrefix+userAuthTableName+` WHERE uid = ? AND disabled = 0 AND deletion_time = 0`)
+	if err != nil {
+		return 0, err
 	}
+	defer stmtLookupRoles.Close()
 
-	return true, nil
+	var roles uint
+	err = stmtLookupRoles.QueryRowContext(ctx, uid).Scan(&roles)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return api.Role(roles), err
+}
+
+// checkMFARegistration returns the list of confirmed MFA methods if login and passhash are correct.
+// retryAfter is positive if the login or client is locked out.
+func checkMFARegistration(c *gin.Context, login string, passhash string) (bool, []gin.H, time.Duration) {
+	authed, uid, retryAfter := authLoginPassThrottled(c, login, passhash)
+	if !authed {
+		return false, nil, retryAfter
+	}
+
+	mfaMap, err := loadUserMFA(uid)
+	if err != nil {
+		logger.Error("checkMFARegistration(): can't load MFA. error: ", err)
+		return false, nil, 0
+	}
+
+	mfaList := []gin.H{}
+	for mfaType, mfa := range mfaMap {
+		if mfa.confirmed {
+			mfaList = append(mfaList, gin.H{
+				"type": mfaType,
+			})
+		}
+	}
+	return true, mfaList, 0
 }
 
 // _handlerCheckMFA shall return an array of JSON objects of each supported MFA
@@ -41,77 +111,166 @@ func _handlerCheckMFA(c *gin.Context) {
 	authPasshash := c.DefaultPostForm("auth_passhash", "")
 
 	// Special case: "anonymous":""
-	if authLogin != "anonymous" && authPasshash == "" {
+	if authLogin == "anonymous" || authPasshash == "" {
 		c.JSON(http.StatusOK, []gin.H{}) // Empty JSON array
 		return
 	}
 
+	// Failed login gets the same empty array, so this endpoint doesn't tell if password is correct.
+	ok, mfaList, retryAfter := checkMFARegistration(c, authLogin, authPasshash)
+	if retryAfter > 0 {
+		respondLoginThrottled(c, retryAfter)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusOK, []gin.H{})
+		return
+	}
+	c.JSON(http.StatusOK, mfaList)
 }
 
 // authLoginPass is the real login function which checks with DB
 func authLoginPass(login string, passhash string) (bool, uint) {
 	db, err := dbConnector.Conn()
-	if err == nil {
+	if err != nil {
 		logger.Error("authLoginPass(): can't connect database. error: ", err)
 		return false, 0
 	}
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
 
-	stmtCheckLogin, err := db.Prepare(`SELECT uid, password FROM ` + masterConfig.DB.TblPrefix + userAuthTableName + ` WHERE login = ?`)
-	if err == nil {
+	stmtCheckLogin, err := db.PrepareContext(ctx, `SELECT uid, password FROM `+masterConfig.DB.TblPrefix+userAuthTableName+` WHERE login = ? AND disabled = 0 AND deletion_time = 0`)
+	if err != nil {
 		logger.Error("authLoginPass(): can't prepare statement. error: ", err)
 		return false, 0
 	}
+	defer stmtCheckLogin.Close()
 
 	var uid uint
 	var passOnRecord string
 
-	err = stmtCheckLogin.QueryRow(login).Scan(&uid, &passOnRecord)
-	if err == nil {
+	err = stmtCheckLogin.QueryRowContext(ctx, login).Scan(&uid, &passOnRecord)
+	if err != nil {
 		if err != sql.ErrNoRows { // Expect to see ErrNoRows a lot. Not even an error.
 			logger.Error("authLoginPass(): can't query or scan. error: ", err)
 		} else {
 			logger.Debug("authLoginPass(): no matching rows.")
+			// Burn the same amount of time as a real verification, so response time doesn't reveal
+			// whether the login exists.
+			auth.VerifyPassword(passhash, dummyPasswordHash)
 		}
 		return false, 0
 	}
 
-	if passhash != passOnRecord {
+	ok, needsRehash := auth.VerifyPassword(passhash, passOnRecord)
+	if !ok {
 		logger.Debug("authLoginPass(): wrong password.")
 		return false, 0
 	}
 
+	if needsRehash {
+		// Legacy or outdated record. Replace it now that we know the plain passhash.
+		if err := rehashPassword(ctx, db, uid, passhash); err != nil {
+			logger.Warning("authLoginPass(): can't rehash password for uid ", uid, ". error: ", err)
+		} else {
+			logger.Info("authLoginPass(): rehashed password for uid ", uid)
+		}
+	}
+
 	return true, uid
 }
 
+// rehashPassword replaces the password on record for uid with a freshly hashed passhash
+func rehashPassword(ctx context.Context, db *sql.DB, uid uint, passhash string) error {
+	newHash, err := auth.HashPassword(passhash)
+	if err != nil {
+		return err
+	}
+
+	stmtRehash, err := db.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userAuthTableName+` SET password = ? WHERE uid = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtRehash.Close()
+
+	_, err = stmtRehash.ExecContext(ctx, newHash, uid)
+	return err
+}
+
 // _handlerAuth() is the underlying authentication mechanism.
 // it verifies the hashed password for unique login game
 // and create authToken for user to keep
 func _handlerAuth(c *gin.Context) {
-	// authLogin := c.DefaultPostForm("auth_login", "anonymous")
-	// authPasshash := c.DefaultPostForm("auth_passhash", "")
-	// authMFA := c.DefaultPostForm("auth_mfa", "{}")
-
-	var mfaRequired bool = false
-
-	if mfaRequired {
+	authLogin := c.DefaultPostForm("auth_login", "anonymous")
+	authPasshash := c.DefaultPostForm("auth_passhash", "")
+	authMFA := c.DefaultPostForm("auth_mfa", "{}")
 
+	var authed bool = false
+	var uid uint
+	var retryAfter time.Duration
+	if authPasshash != "" {
+		authed, uid, retryAfter = authLoginPassThrottled(c, authLogin, authPasshash)
+	}
+	if retryAfter > 0 {
+		respondLoginThrottled(c, retryAfter)
+		return
 	}
 
-	// TODO: Check with database see if passhash matches
-	var authed bool = false
+	var mfaRequired bool = false
+	if authed {
+		var err error
+		mfaRequired, err = userRequiresMFA(uid)
+		if err != nil {
+			logger.Error("_handlerAuth(): can't check MFA. error: ", err)
+			authed = false
+		} else if mfaRequired && verifyMFA(uid, authMFA) {
+			mfaRequired = false
+		} else if mfaRequired && authMFA != "{}" {
+			// A wrong MFA code counts as a failure too, or codes could be brute-forced.
+			if err = recordLoginFailure(loginThrottleKeys(c, authLogin)); err != nil {
+				logger.Error("_handlerAuth(): can't record failure. error: ", err)
+			}
+		}
+	}
 
 	if authed && !mfaRequired {
-		// TODO: Add bearer token here
-		var authToken string = ""
-		// var serverPubKey string                                                              // This PubKey is not ENCRYPTED
-		var userPrivKey string // This PrivKey is ENCRYPTED WITH USER PASSWORD
+		if err := clearLoginFailures(loginThrottleKeyLogin + authLogin); err != nil {
+			logger.Error("_handlerAuth(): can't clear login failures. error: ", err)
+		}
+
+		authToken, err := issueSession(c, uid)
+		if err != nil {
+			logger.Error("_handlerAuth(): can't issue session. error: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+			})
+			return
+		}
+		var serverPubKey string = serverPubKeyPEM                // This PubKey is not ENCRYPTED
+		userPrivKey, err := ensureUserKeypair(uid, authPasshash) // This PrivKey is ENCRYPTED WITH USER PASSWORD
+		if err != nil {
+			logger.Error("_handlerAuth(): can't load user keypair. error: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+			})
+			return
+		}
 
 		c.JSON(http.StatusOK, gin.H{
 			"status":     "success",
 			"auth_token": authToken, // Client should save this to Cookie.
 			// Client use privkey.decrypt(password) to decrypt data from server
 			// and to sign requests (optional for TLS?)
-			"privkey": userPrivKey, // Client should save this state to LocalStorage.
+			"privkey":       userPrivKey,  // Client should save this state to LocalStorage.
+			"server_pubkey": serverPubKey, // Client should pin this to authenticate the server.
+		})
+		return
+	}
+
+	if authed && mfaRequired {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status":       "error",
+			"mfa_required": true, // Client should ask for MFA and try again.
 		})
 		return
 	}
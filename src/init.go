@@ -4,14 +4,24 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"sync"
+	"time"
 
+	"github.com/TunnelWork/Ulysses/src/api"
+	"github.com/TunnelWork/Ulysses/src/internal/auth"
 	"github.com/TunnelWork/Ulysses/src/internal/conf"
 	"github.com/TunnelWork/Ulysses/src/internal/db"
 	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/TunnelWork/Ulysses/src/internal/secret"
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	dbHealthCheckSignature tickEventSignature = 0xDB0C4EC4
+	dbHealthCheckPeriod                       = 1 * time.Minute
+)
+
 var (
 	configPath   string
 	masterConfig conf.Config
@@ -24,8 +34,15 @@ var (
 	noTick     bool
 	noApi      bool
 
+	// Schema Migration: "up", "down" (one step) or "dry-run". Exit after migrating.
+	migrateCmd string
+	// Add a new primary key to the secret keyring and reseal all servers with it. Exit after resealing.
+	rotateSecretKey bool
+
 	// Global Shared Objects
-	dbConnector *db.MysqlConnector
+	dbConnector db.Connector = db.NoConnector // Holds the one connection pool. Never close what its Conn() returns.
+
+	lastDBHealthCheck time.Time
 )
 
 func parseArgs() {
@@ -34,19 +51,11 @@ func parseArgs() {
 	flag.BoolVar(&noLogger, "no-log", false, "Not to use logger. Thus logging functions will do literally nothing.")
 	flag.BoolVar(&noTick, "no-tick", false, "Not to use ticker. No system ticking.")
 	flag.BoolVar(&noApi, "no-api", false, "Not to register API endpoints. No gin-gonic/gin ability.")
+	flag.StringVar(&migrateCmd, "migrate", "", "Migrate database schema then exit. up: apply all pending, down: revert the last one, dry-run: print SQL of pending.")
+	flag.BoolVar(&rotateSecretKey, "rotate-secret-key", false, "Add a new primary key to the secret keyring file, reseal secrets of all servers and their history with it, then exit.")
 	flag.Parse()
 }
 
-func init() {
-	/*** GLOBAL INIT BEGIN ***/
-	parseArgs()
-	globalInit()
-	/*** GLOBAL INIT END ***/
-
-	// initUlyssesServer()
-
-}
-
 func globalInit() {
 	/*** Sync ***/
 	initWaitGroup()
@@ -59,8 +68,13 @@ func globalInit() {
 	} else {
 		fmt.Println("initLogger(): --no-log detected, skipping. What Age is this, Dark Age?")
 	}
+	initServerKey()
+	initSecretKeyring()
+
 	if !noDatabase {
 		initDB()
+		initSchema()
+		resealSecretsOnRotation()
 	} else {
 		logger.Warning("initDB(): --no-db detected, skipping.")
 	}
@@ -72,6 +86,12 @@ func globalInit() {
 		logger.Warning("initSystemTicking(): --no-tick detected, skipping.")
 	}
 
+	if !noDatabase {
+		initUlyssesServer()
+		initJobQueue()
+		registerTickEvent(dbHealthCheckSignature, checkDBHealth)
+	}
+
 	if !noApi {
 		initApiHandler()
 	} else {
@@ -109,16 +129,136 @@ func initLogger() {
 
 // initDB() SHOULD be called after initLogger()
 func initDB() {
-	// DB Conn Livess Test, block until fail. No timeout.
-	dbConnector = db.NewMysqlConnector(masterConfig.DB)
-	if dbConnector == nil {
-		logger.Fatal("initDB(): cannot establish database connection")
+	// DB Conn Liveness Test, retry with backoff until db.startup_max_wait_sec passed.
+	var err error
+	maxWait := time.Duration(masterConfig.DB.StartupMaxWaitSecond) * time.Second
+	dbConnector, err = db.NewConnectorWithRetry(masterConfig.DB, maxWait, func(attempt int, err error, wait time.Duration) {
+		logger.Warning("initDB(): attempt ", attempt, " to connect database failed, retry in ", wait, ". error: ", err)
+	})
+	if err != nil {
+		logger.Fatal("initDB(): cannot establish database connection. error: ", err)
 		return
 	} else {
 		logger.Info("initDB(): success")
 	}
 }
 
+// checkDBHealth() pings the shared pool once per dbHealthCheckPeriod as a tick event.
+func checkDBHealth() {
+	if time.Since(lastDBHealthCheck) < dbHealthCheckPeriod {
+		return
+	}
+	lastDBHealthCheck = time.Now()
+
+	if err := dbConnector.Ping(); err != nil {
+		logger.Error("checkDBHealth(): database is unreachable. error: ", err)
+	}
+}
+
+// initSchema() SHOULD be called after initDB()
+// It exits after migrating if -migrate is given.
+func initSchema() {
+	if migrateCmd == "" && !masterConfig.DB.AutoMigrate {
+		return
+	}
+
+	dbConn, err := dbConnector.Conn()
+	if err != nil {
+		logger.Fatal("initSchema(): cannot connect database. error: ", err)
+		return
+	}
+
+	migrator, err := db.NewMigrator(dbConn, dbConnector.Dialect(), masterConfig.DB.TblPrefix)
+	if err != nil {
+		logger.Fatal("initSchema(): cannot load migrations. error: ", err)
+		return
+	}
+
+	var versions []uint
+	switch migrateCmd {
+	case "", "up":
+		versions, err = migrator.Up()
+	case "down":
+		versions, err = migrator.Down(1)
+	case "dry-run":
+		migrator.DryRun = true
+		migrator.Out = os.Stdout
+		versions, err = migrator.Up()
+	default:
+		logger.Fatal("initSchema(): unknown migrate command ", migrateCmd)
+		return
+	}
+	if err != nil {
+		logger.Fatal("initSchema(): migration failed after ", versions, ". error: ", err)
+		return
+	}
+	logger.Info("initSchema(): migrated ", migrateCmd, " with versions ", versions)
+
+	if migrateCmd != "" {
+		fmt.Println("initSchema(): migrated", migrateCmd, "with versions", versions)
+		os.Exit(0)
+	}
+}
+
+// initServerKey() SHOULD be called after initLogger()
+func initServerKey() {
+	var err error
+	serverKey, err = auth.LoadOrGenerateKeyPair(masterConfig.Sys.ServerKeyPath)
+	if err != nil {
+		logger.Fatal("initServerKey(): can't load server key at ", masterConfig.Sys.ServerKeyPath, ". error: ", err)
+		return
+	}
+	serverPubKeyPEM, err = auth.MarshalPublicKeyPEM(&serverKey.PublicKey)
+	if err != nil {
+		logger.Fatal("initServerKey(): can't marshal server public key. error: ", err)
+		return
+	}
+	logger.Info("initServerKey(): success")
+}
+
+// initSecretKeyring() loads the keyring from env ULYSSES_SECRET_KEYS, or else sys.secret_key_path.
+// With -rotate-secret-key, a new primary key is added to the file.
+func initSecretKeyring() {
+	var err error
+	secretKeyring, err = secret.LoadKeyring(masterConfig.Sys.SecretKeyPath, secretKeyringEnv)
+	if err != nil {
+		logger.Fatal("initSecretKeyring(): can't load secret keyring. error: ", err)
+		return
+	}
+
+	if rotateSecretKey {
+		if os.Getenv(secretKeyringEnv) != "" {
+			logger.Fatal("initSecretKeyring(): keyring is set by ", secretKeyringEnv, ", put a new key as its first line instead.")
+			return
+		}
+		if err = secretKeyring.Rotate(); err != nil {
+			logger.Fatal("initSecretKeyring(): can't generate new key. error: ", err)
+			return
+		}
+		if err = ioutil.WriteFile(masterConfig.Sys.SecretKeyPath, []byte(secretKeyring.String()), 0600); err != nil {
+			logger.Fatal("initSecretKeyring(): can't save rotated keyring. error: ", err)
+			return
+		}
+	}
+	logger.Info("initSecretKeyring(): success, primary key ", secretKeyring.Primary())
+}
+
+// resealSecretsOnRotation() SHOULD be called after initDB()
+// It exits after resealing if -rotate-secret-key is given.
+func resealSecretsOnRotation() {
+	if !rotateSecretKey {
+		return
+	}
+
+	resealed, err := NewServerManager(dbConnector).ResealSecrets()
+	if err != nil {
+		logger.Fatal("resealSecretsOnRotation(): resealed ", resealed, " servers before error: ", err)
+		return
+	}
+	fmt.Println("resealSecretsOnRotation(): resealed", resealed, "servers with key", secretKeyring.Primary())
+	os.Exit(0)
+}
+
 func initSystemTicking() {
 	tickEventMutex = &sync.Mutex{}
 	if masterConfig.Sys.SystemTickPeriodMillisecond == 0 {
@@ -129,19 +269,15 @@ func initSystemTicking() {
 	tickEventMap = map[tickEventSignature]tickEvent{}
 }
 
-// func initUlyssesServer() {
-// 	if serverConfMapMutex == nil {
-// 		serverConfMapMutex = &sync.Mutex{}
-// 	}
-// 	serverConfMapDirty = true
-// 	reloadUlyssesServer()
-
-// 	registerTickEvent(reloadUlyssesServerSignature, reloadUlyssesServer)
-// }
-
 func initApiHandler() {
 	ginRouter = gin.New()
-	ginRouter.Use(gin.LoggerWithWriter(logger.NewCustomWriter("", "")), gin.Recovery())
+	ginRouter.Use(gin.LoggerWithWriter(logger.NewCustomWriter("", "")), gin.Recovery(), responseSignatureMiddleware, requestSignatureMiddleware)
+
+	if err := api.SetRoleResolver(resolveRoles); err != nil {
+		logger.Fatal("initApiHandler(): Cannot set role resolver due to error: ", err)
+	}
 
 	registerSystemAPIs()
+	registerTickEvent(purgeLoginAttemptsSignature, purgeLoginAttempts)
+	registerTickEvent(purgeRequestNoncesSignature, purgeRequestNonces)
 }
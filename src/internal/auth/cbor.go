@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"encoding/binary"
+)
+
+// A minimal CBOR (RFC 7049) decoder covering what WebAuthn authenticators produce:
+// integers, byte/text strings, arrays, maps and simple values. No tags, no indefinite length.
+//
+// Decoded types:
+// - major 0/1: int64
+// - major 2:   []byte
+// - major 3:   string
+// - major 4:   []interface{}
+// - major 5:   map[interface{}]interface{}
+// - major 7:   bool or nil
+
+const (
+	cborMaxDepth = 16
+)
+
+// cborDecode decodes the first CBOR item in data and returns it with the number of bytes consumed.
+func cborDecode(data []byte) (item interface{}, n int, err error) {
+	return cborDecodeDepth(data, 0)
+}
+
+func cborDecodeDepth(data []byte, depth int) (interface{}, int, error) {
+	if depth > cborMaxDepth || len(data) == 0 {
+		return nil, 0, ErrBadCBOR
+	}
+
+	major := data[0] >> 5
+	val, n, err := cborArgument(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch major {
+	case 0:
+		if val > 1<<63-1 {
+			return nil, 0, ErrBadCBOR
+		}
+		return int64(val), n, nil
+	case 1:
+		if val > 1<<63-1 {
+			return nil, 0, ErrBadCBOR
+		}
+		return -1 - int64(val), n, nil
+	case 2, 3:
+		if uint64(len(data)-n) < val {
+			return nil, 0, ErrBadCBOR
+		}
+		end := n + int(val)
+		if major == 2 {
+			b := make([]byte, val)
+			copy(b, data[n:end])
+			return b, end, nil
+		}
+		return string(data[n:end]), end, nil
+	case 4:
+		if uint64(len(data)-n) < val { // each item takes at least 1 byte
+			return nil, 0, ErrBadCBOR
+		}
+		arr := make([]interface{}, 0, val)
+		for i := uint64(0); i < val; i++ {
+			elem, m, err := cborDecodeDepth(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			arr = append(arr, elem)
+			n += m
+		}
+		return arr, n, nil
+	case 5:
+		if uint64(len(data)-n) < 2*val {
+			return nil, 0, ErrBadCBOR
+		}
+		m := make(map[interface{}]interface{}, val)
+		for i := uint64(0); i < val; i++ {
+			key, kn, err := cborDecodeDepth(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += kn
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, ErrBadCBOR // unhashable or unexpected key type
+			}
+			value, vn, err := cborDecodeDepth(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += vn
+			m[key] = value
+		}
+		return m, n, nil
+	case 7:
+		switch data[0] & 0x1f {
+		case 20:
+			return false, 1, nil
+		case 21:
+			return true, 1, nil
+		case 22, 23:
+			return nil, 1, nil
+		}
+	}
+	return nil, 0, ErrBadCBOR
+}
+
+// cborArgument parses the initial byte and the following argument, if any.
+func cborArgument(data []byte) (val uint64, n int, err error) {
+	info := data[0] & 0x1f
+	switch {
+	case info < 24:
+		return uint64(info), 1, nil
+	case info == 24 && len(data) >= 2:
+		return uint64(data[1]), 2, nil
+	case info == 25 && len(data) >= 3:
+		return uint64(binary.BigEndian.Uint16(data[1:3])), 3, nil
+	case info == 26 && len(data) >= 5:
+		return uint64(binary.BigEndian.Uint32(data[1:5])), 5, nil
+	case info == 27 && len(data) >= 9:
+		return binary.BigEndian.Uint64(data[1:9]), 9, nil
+	}
+	return 0, 0, ErrBadCBOR
+}
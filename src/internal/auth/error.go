@@ -0,0 +1,20 @@
+package auth
+
+import (
+	"errors"
+)
+
+var (
+	ErrBadPasswordHash = errors.New("internal/auth: malformed password hash")
+
+	ErrBadCBOR                = errors.New("internal/auth: malformed CBOR data")
+	ErrWebAuthnClientData     = errors.New("internal/auth: WebAuthn client data mismatch")
+	ErrWebAuthnAuthData       = errors.New("internal/auth: WebAuthn authenticator data mismatch")
+	ErrWebAuthnSignature      = errors.New("internal/auth: WebAuthn signature mismatch")
+	ErrWebAuthnSignCount      = errors.New("internal/auth: WebAuthn signature counter didn't increase, authenticator might be cloned")
+	ErrWebAuthnUnsupportedKey = errors.New("internal/auth: WebAuthn credential key type is not supported")
+
+	ErrBadKey           = errors.New("internal/auth: malformed or unsupported key")
+	ErrBadWrappedKey    = errors.New("internal/auth: malformed wrapped private key")
+	ErrWrongWrappingKey = errors.New("internal/auth: can't unwrap private key with given passhash")
+)
@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// User and server keys are ECDSA on P-256, which is available in WebCrypto for clients.
+// A user private key is stored and delivered wrapped with a key derived from the user's passhash:
+// scrypt-aes256gcm$N=32768,r=8,p=1$<salt>$<nonce>$<ciphertext of PKCS#8 DER>
+
+const (
+	scryptN      int = 32768
+	scryptR      int = 8
+	scryptP      int = 1
+	scryptKeyLen int = 32
+	scryptSalt   int = 16
+
+	wrappedKeyPrefix = "scrypt-aes256gcm$"
+)
+
+// GenerateKeyPair returns a new P-256 private key.
+func GenerateKeyPair() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// MarshalPublicKeyPEM returns the PKIX public key in PEM format.
+func MarshalPublicKeyPEM(pub *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// ParsePublicKeyPEM parses a PKIX public key in PEM format produced by MarshalPublicKeyPEM().
+func ParsePublicKeyPEM(pubPEM string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pubPEM))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, ErrBadKey
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, ErrBadKey
+	}
+	return ecdsaPub, nil
+}
+
+// WrapPrivateKey encrypts priv with a key derived from passhash.
+func WrapPrivateKey(priv *ecdsa.PrivateKey, passhash string) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, scryptSalt)
+	if _, err = rand.Read(salt); err != nil {
+		return "", err
+	}
+	aead, err := wrappingAEAD(passhash, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%sN=%d,r=%d,p=%d$%s$%s$%s",
+		wrappedKeyPrefix,
+		scryptN, scryptR, scryptP,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(nonce),
+		base64.RawStdEncoding.EncodeToString(aead.Seal(nil, nonce, der, nil)),
+	), nil
+}
+
+// UnwrapPrivateKey decrypts a WrapPrivateKey() result with passhash.
+func UnwrapPrivateKey(wrapped string, passhash string) (*ecdsa.PrivateKey, error) {
+	if !strings.HasPrefix(wrapped, wrappedKeyPrefix) {
+		return nil, ErrBadWrappedKey
+	}
+	// "N=..,r=..,p=..", "<salt>", "<nonce>", "<ciphertext>"
+	parts := strings.Split(wrapped[len(wrappedKeyPrefix):], "$")
+	if len(parts) != 4 {
+		return nil, ErrBadWrappedKey
+	}
+
+	var n, r, p int
+	if _, err := fmt.Sscanf(parts[0], "N=%d,r=%d,p=%d", &n, &r, &p); err != nil {
+		return nil, ErrBadWrappedKey
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[1])
+	nonce, err2 := base64.RawStdEncoding.DecodeString(parts[2])
+	ciphertext, err3 := base64.RawStdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, ErrBadWrappedKey
+	}
+
+	aead, err := wrappingAEAD(passhash, salt, n, r, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, ErrBadWrappedKey
+	}
+	der, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongWrappingKey
+	}
+
+	priv, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaPriv, ok := priv.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, ErrBadKey
+	}
+	return ecdsaPriv, nil
+}
+
+// RewrapPrivateKey re-encrypts a wrapped private key for a new passhash, e.g., on password change.
+func RewrapPrivateKey(wrapped string, oldPasshash string, newPasshash string) (string, error) {
+	priv, err := UnwrapPrivateKey(wrapped, oldPasshash)
+	if err != nil {
+		return "", err
+	}
+	return WrapPrivateKey(priv, newPasshash)
+}
+
+func wrappingAEAD(passhash string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passhash), salt, n, r, p, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Sign returns an ASN.1 ECDSA signature over SHA-256 of msg, as VerifySignature checks.
+func Sign(priv *ecdsa.PrivateKey, msg []byte) ([]byte, error) {
+	digest := sha256.Sum256(msg)
+	return ecdsa.SignASN1(rand.Reader, priv, digest[:])
+}
+
+// VerifySignature checks an ASN.1 ECDSA signature over SHA-256 of msg.
+func VerifySignature(pub *ecdsa.PublicKey, msg []byte, signature []byte) bool {
+	digest := sha256.Sum256(msg)
+	return ecdsa.VerifyASN1(pub, digest[:], signature)
+}
+
+// LoadOrGenerateKeyPair reads the PKCS#8 PEM private key at path,
+// or generates and saves a new one if the file doesn't exist.
+func LoadOrGenerateKeyPair(path string) (*ecdsa.PrivateKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		priv, err := GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return nil, err
+		}
+		return priv, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, ErrBadKey
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaPriv, ok := priv.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, ErrBadKey
+	}
+	return ecdsaPriv, nil
+}
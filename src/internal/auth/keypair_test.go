@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+)
+
+func TestWrapPrivateKey(t *testing.T) {
+	priv, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() returns error:%s\n", err)
+	}
+
+	wrapped, err := WrapPrivateKey(priv, "passhash")
+	if err != nil {
+		t.Fatalf("WrapPrivateKey() returns error:%s\n", err)
+	}
+
+	unwrapped, err := UnwrapPrivateKey(wrapped, "passhash")
+	if err != nil {
+		t.Fatalf("UnwrapPrivateKey() returns error:%s\n", err)
+	}
+	if !unwrapped.Equal(priv) {
+		t.Errorf("UnwrapPrivateKey() returns a different key\n")
+	}
+
+	if _, err = UnwrapPrivateKey(wrapped, "wrongpasshash"); err != ErrWrongWrappingKey {
+		t.Errorf("UnwrapPrivateKey() with wrong passhash returns %v, want %v\n", err, ErrWrongWrappingKey)
+	}
+
+	rewrapped, err := RewrapPrivateKey(wrapped, "passhash", "newpasshash")
+	if err != nil {
+		t.Fatalf("RewrapPrivateKey() returns error:%s\n", err)
+	}
+	if unwrapped, err = UnwrapPrivateKey(rewrapped, "newpasshash"); err != nil || !unwrapped.Equal(priv) {
+		t.Errorf("UnwrapPrivateKey() can't unwrap rewrapped key, error: %v\n", err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	priv, _ := GenerateKeyPair()
+	pubPEM, err := MarshalPublicKeyPEM(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPublicKeyPEM() returns error:%s\n", err)
+	}
+	pub, err := ParsePublicKeyPEM(pubPEM)
+	if err != nil {
+		t.Fatalf("ParsePublicKeyPEM() returns error:%s\n", err)
+	}
+
+	msg := []byte("POST\n/api/Auth\n1634400000\n")
+	digest := sha256.Sum256(msg)
+	signature, _ := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+
+	if !VerifySignature(pub, msg, signature) {
+		t.Errorf("VerifySignature() rejects valid signature\n")
+	}
+	if signature, err = Sign(priv, msg); err != nil || !VerifySignature(pub, msg, signature) {
+		t.Errorf("VerifySignature() rejects signature by Sign(), error: %v\n", err)
+	}
+	if VerifySignature(pub, append(msg, '!'), signature) {
+		t.Errorf("VerifySignature() accepts signature for another message\n")
+	}
+}
+
+func TestLoadOrGenerateKeyPair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.key")
+
+	generated, err := LoadOrGenerateKeyPair(path)
+	if err != nil {
+		t.Fatalf("LoadOrGenerateKeyPair() returns error:%s\n", err)
+	}
+	loaded, err := LoadOrGenerateKeyPair(path)
+	if err != nil {
+		t.Fatalf("LoadOrGenerateKeyPair() returns error:%s\n", err)
+	}
+	if !loaded.Equal(generated) {
+		t.Errorf("LoadOrGenerateKeyPair() doesn't load the saved key\n")
+	}
+}
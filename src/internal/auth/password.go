@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters for newly hashed passwords.
+// Records hashed with different parameters will be reported as needsRehash.
+const (
+	argon2idTime    uint32 = 1
+	argon2idMemory  uint32 = 64 * 1024 // KiB
+	argon2idThreads uint8  = 4
+	argon2idKeyLen  uint32 = 32
+	argon2idSaltLen int    = 16
+
+	argon2idPrefix = "$argon2id$"
+
+	// Bounds of parameters accepted from a stored hash, so a bad record can't
+	// make verification panic or take unbounded memory.
+	argon2idMaxMemory uint32 = 256 * 1024 // KiB
+	argon2idMinKeyLen int    = 16
+	argon2idMaxKeyLen int    = 64
+)
+
+// HashPassword returns an encoded Argon2id hash of password with a freshly generated salt.
+// The format is compatible with the PHC string format:
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2idSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash := argon2.IDKey([]byte(password), salt, argon2idTime, argon2idMemory, argon2idThreads, argon2idKeyLen)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		argon2idMemory,
+		argon2idTime,
+		argon2idThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
+}
+
+// VerifyPassword checks password against encoded in constant time.
+// encoded could be either an Argon2id hash generated by HashPassword() or
+// a legacy record storing the passhash as-is.
+// needsRehash is true if the password matches but encoded should be replaced
+// by a new HashPassword() result, e.g., legacy record or outdated parameters.
+func VerifyPassword(password string, encoded string) (ok bool, needsRehash bool) {
+	if !strings.HasPrefix(encoded, argon2idPrefix) {
+		// Legacy record: plain passhash stored in database.
+		if subtle.ConstantTimeCompare([]byte(password), []byte(encoded)) == 1 {
+			return true, true
+		}
+		return false, false
+	}
+
+	version, memory, time, threads, salt, hash, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, false
+	}
+
+	otherHash := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	if subtle.ConstantTimeCompare(hash, otherHash) != 1 {
+		return false, false
+	}
+
+	needsRehash = version != argon2.Version ||
+		memory != argon2idMemory ||
+		time != argon2idTime ||
+		threads != argon2idThreads ||
+		uint32(len(hash)) != argon2idKeyLen ||
+		len(salt) != argon2idSaltLen
+	return true, needsRehash
+}
+
+func decodeArgon2id(encoded string) (version int, memory uint32, time uint32, threads uint8, salt []byte, hash []byte, err error) {
+	// "", "argon2id", "v=19", "m=65536,t=1,p=4", "<salt>", "<hash>"
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		err = ErrBadPasswordHash
+		return
+	}
+
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		err = ErrBadPasswordHash
+		return
+	}
+
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		err = ErrBadPasswordHash
+		return
+	}
+	if time < 1 || threads < 1 || memory > argon2idMaxMemory {
+		err = ErrBadPasswordHash
+		return
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		err = ErrBadPasswordHash
+		return
+	}
+
+	if hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(hash) < argon2idMinKeyLen || len(hash) > argon2idMaxKeyLen {
+		err = ErrBadPasswordHash
+		return
+	}
+
+	return
+}
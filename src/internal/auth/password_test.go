@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	encoded, err := HashPassword("passhash")
+	if err != nil {
+		t.Fatalf("HashPassword() returns error:%s\n", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=65536,t=1,p=4$") {
+		t.Errorf("HashPassword() returns unexpected encoding: %s\n", encoded)
+	}
+
+	other, _ := HashPassword("passhash")
+	if other == encoded {
+		t.Errorf("HashPassword() returns same hash for two calls, salt not random?\n")
+	}
+
+	if ok, needsRehash := VerifyPassword("passhash", encoded); !ok || needsRehash {
+		t.Errorf("VerifyPassword() = (%v, %v), want (true, false)\n", ok, needsRehash)
+	}
+	if ok, _ := VerifyPassword("wrongpasshash", encoded); ok {
+		t.Errorf("VerifyPassword() accepts wrong password\n")
+	}
+}
+
+func TestVerifyPasswordLegacy(t *testing.T) {
+	if ok, needsRehash := VerifyPassword("passhash", "passhash"); !ok || !needsRehash {
+		t.Errorf("VerifyPassword() = (%v, %v) for legacy record, want (true, true)\n", ok, needsRehash)
+	}
+	if ok, _ := VerifyPassword("passhash", "otherhash"); ok {
+		t.Errorf("VerifyPassword() accepts wrong password for legacy record\n")
+	}
+}
+
+func TestVerifyPasswordMalformed(t *testing.T) {
+	salt := "c29tZXNhbHRzb21lc2FsdA"
+	hash := strings.Repeat("A", 43) // 32 bytes
+	for _, encoded := range []string{
+		"$argon2id$v=19$m=65536,t=2,p=4$" + salt + "$",                           // empty hash part
+		"$argon2id$v=19$m=65536,t=0,p=4$" + salt + "$" + hash,                    // no pass
+		"$argon2id$v=19$m=65536,t=1,p=0$" + salt + "$" + hash,                    // no thread
+		"$argon2id$v=19$m=4294967295,t=1,p=4$" + salt + "$" + hash,               // 4 TiB of memory
+		"$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$" + strings.Repeat("A", 11), // 8 bytes
+		"$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$" + strings.Repeat("A", 87), // 65 bytes
+	} {
+		if _, _, _, _, _, _, err := decodeArgon2id(encoded); err != ErrBadPasswordHash {
+			t.Errorf("decodeArgon2id(%s) returns %v, want %v\n", encoded, err, ErrBadPasswordHash)
+		}
+		if ok, _ := VerifyPassword("passhash", encoded); ok {
+			t.Errorf("VerifyPassword() accepts malformed hash %s\n", encoded)
+		}
+	}
+}
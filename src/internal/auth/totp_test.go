@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 6238 Appendix B (SHA1)
+func TestTotpCodeRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+
+	for unix, want := range vectors {
+		if got := totpCode(key, unix/TOTPPeriod, 8); got != want {
+			t.Errorf("totpCode() at %d = %s, want %s\n", unix, got, want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret() returns error:%s\n", err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+
+	now := time.Now()
+	code := totpCode(key, TOTPStep(now), TOTPDigits)
+
+	step, ok := VerifyTOTP(secret, code, now, 0)
+	if !ok || step != TOTPStep(now) {
+		t.Errorf("VerifyTOTP() rejects current code\n")
+	}
+
+	// Replay
+	if _, ok := VerifyTOTP(secret, code, now, step); ok {
+		t.Errorf("VerifyTOTP() accepts replayed code\n")
+	}
+
+	// Clock drift within skew
+	if _, ok := VerifyTOTP(secret, code, now.Add(time.Duration(TOTPPeriod)*time.Second), 0); !ok {
+		t.Errorf("VerifyTOTP() rejects code from previous step\n")
+	}
+
+	// Clock drift out of skew
+	if _, ok := VerifyTOTP(secret, code, now.Add(time.Duration(3*TOTPPeriod)*time.Second), 0); ok {
+		t.Errorf("VerifyTOTP() accepts code from 3 steps ago\n")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes() returns error:%s\n", err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("GenerateRecoveryCodes() returns %d codes, want 10\n", len(codes))
+	}
+	if HashRecoveryCode(codes[0]) != HashRecoveryCode(" "+codes[0][:4]+codes[0][5:]+" ") {
+		t.Errorf("HashRecoveryCode() doesn't normalize input\n")
+	}
+}
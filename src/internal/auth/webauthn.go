@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+)
+
+// WebAuthn (Level 2) relying party operations with attestation conveyance "none":
+// the credential public key is trusted because the registration happens in an authenticated session.
+
+const (
+	webAuthnChallengeSize = 32
+
+	webAuthnTypeCreate = "webauthn.create"
+	webAuthnTypeGet    = "webauthn.get"
+
+	webAuthnFlagUP byte = 0x01 // User Present
+	webAuthnFlagAT byte = 0x40 // Attested credential data included
+
+	// COSE algorithms
+	COSEAlgES256 int64 = -7
+	COSEAlgEdDSA int64 = -8
+)
+
+// WebAuthnRP identifies the relying party, i.e., this Ulysses instance.
+type WebAuthnRP struct {
+	ID     string // e.g., "www.example.com"
+	Origin string // e.g., "https://www.example.com"
+}
+
+// WebAuthnCredential is what to store for each registered authenticator.
+type WebAuthnCredential struct {
+	ID        []byte `json:"id"`
+	PublicKey []byte `json:"public_key"` // COSE_Key
+	SignCount uint32 `json:"sign_count"`
+}
+
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type webAuthnAuthData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// Only if webAuthnFlagAT is set
+	credentialID []byte
+	publicKey    []byte
+}
+
+// NewWebAuthnChallenge returns a random challenge for a registration or assertion ceremony.
+func NewWebAuthnChallenge() ([]byte, error) {
+	challenge := make([]byte, webAuthnChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// VerifyWebAuthnRegistration verifies the response of navigator.credentials.create()
+// and returns the new credential to be saved.
+func VerifyWebAuthnRegistration(rp WebAuthnRP, challenge []byte, clientDataJSON []byte, attestationObject []byte) (*WebAuthnCredential, error) {
+	if err := verifyWebAuthnClientData(rp, webAuthnTypeCreate, challenge, clientDataJSON); err != nil {
+		return nil, err
+	}
+
+	attObj, _, err := cborDecode(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	attMap, ok := attObj.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrBadCBOR
+	}
+	rawAuthData, ok := attMap["authData"].([]byte)
+	if !ok {
+		return nil, ErrWebAuthnAuthData
+	}
+
+	authData, err := parseWebAuthnAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyWebAuthnAuthData(rp, authData); err != nil {
+		return nil, err
+	}
+	if authData.flags&webAuthnFlagAT == 0 {
+		return nil, ErrWebAuthnAuthData
+	}
+
+	// Make sure the key is usable before accepting it.
+	if _, err = parseCOSEKey(authData.publicKey); err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnCredential{
+		ID:        authData.credentialID,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// VerifyWebAuthnAssertion verifies the response of navigator.credentials.get() against cred.
+// On success, the new signature counter is returned and should be saved to cred.
+func VerifyWebAuthnAssertion(rp WebAuthnRP, challenge []byte, cred *WebAuthnCredential, clientDataJSON []byte, authenticatorData []byte, signature []byte) (uint32, error) {
+	if err := verifyWebAuthnClientData(rp, webAuthnTypeGet, challenge, clientDataJSON); err != nil {
+		return 0, err
+	}
+
+	authData, err := parseWebAuthnAuthData(authenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	if err = verifyWebAuthnAuthData(rp, authData); err != nil {
+		return 0, err
+	}
+
+	pubKey, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authenticatorData...), clientDataHash[:]...)
+
+	switch key := pubKey.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return 0, ErrWebAuthnSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, signed, signature) {
+			return 0, ErrWebAuthnSignature
+		}
+	default:
+		return 0, ErrWebAuthnUnsupportedKey
+	}
+
+	// Authenticators not supporting counter always return 0.
+	// Otherwise, a non-increasing counter means the authenticator might have been cloned.
+	if (authData.signCount != 0 || cred.SignCount != 0) && authData.signCount <= cred.SignCount {
+		return 0, ErrWebAuthnSignCount
+	}
+
+	return authData.signCount, nil
+}
+
+func verifyWebAuthnClientData(rp WebAuthnRP, ceremonyType string, challenge []byte, clientDataJSON []byte) error {
+	var clientData webAuthnClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return ErrWebAuthnClientData
+	}
+
+	if clientData.Type != ceremonyType || clientData.Origin != rp.Origin {
+		return ErrWebAuthnClientData
+	}
+
+	expected := base64.RawURLEncoding.EncodeToString(challenge)
+	if subtle.ConstantTimeCompare([]byte(clientData.Challenge), []byte(expected)) != 1 {
+		return ErrWebAuthnClientData
+	}
+	return nil
+}
+
+func verifyWebAuthnAuthData(rp WebAuthnRP, authData *webAuthnAuthData) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(authData.rpIDHash, rpIDHash[:]) != 1 {
+		return ErrWebAuthnAuthData
+	}
+	if authData.flags&webAuthnFlagUP == 0 {
+		return ErrWebAuthnAuthData
+	}
+	return nil
+}
+
+// parseWebAuthnAuthData parses rpIdHash(32) | flags(1) | signCount(4) | [attestedCredentialData] | [extensions]
+func parseWebAuthnAuthData(data []byte) (*webAuthnAuthData, error) {
+	if len(data) < 37 {
+		return nil, ErrWebAuthnAuthData
+	}
+
+	authData := &webAuthnAuthData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if authData.flags&webAuthnFlagAT != 0 {
+		// aaguid(16) | credentialIdLength(2) | credentialId | credentialPublicKey(COSE_Key)
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, ErrWebAuthnAuthData
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return nil, ErrWebAuthnAuthData
+		}
+		authData.credentialID = append([]byte{}, rest[:idLen]...)
+		rest = rest[idLen:]
+
+		_, n, err := cborDecode(rest)
+		if err != nil {
+			return nil, ErrWebAuthnAuthData
+		}
+		authData.publicKey = append([]byte{}, rest[:n]...)
+	}
+
+	return authData, nil
+}
+
+// parseCOSEKey supports ES256 (EC2 on P-256) and EdDSA (OKP on Ed25519) keys.
+func parseCOSEKey(coseKey []byte) (interface{}, error) {
+	item, _, err := cborDecode(coseKey)
+	if err != nil {
+		return nil, err
+	}
+	keyMap, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebAuthnUnsupportedKey
+	}
+
+	kty, _ := keyMap[int64(1)].(int64)
+	alg, _ := keyMap[int64(3)].(int64)
+	crv, _ := keyMap[int64(-1)].(int64)
+	x, _ := keyMap[int64(-2)].([]byte)
+
+	switch {
+	case kty == 2 && alg == COSEAlgES256 && crv == 1:
+		y, _ := keyMap[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, ErrWebAuthnUnsupportedKey
+		}
+		pubKey := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pubKey.Curve.IsOnCurve(pubKey.X, pubKey.Y) {
+			return nil, ErrWebAuthnUnsupportedKey
+		}
+		return pubKey, nil
+	case kty == 1 && alg == COSEAlgEdDSA && crv == 6:
+		if len(x) != ed25519.PublicKeySize {
+			return nil, ErrWebAuthnUnsupportedKey
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, ErrWebAuthnUnsupportedKey
+}
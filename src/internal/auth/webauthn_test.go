@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+var (
+	testRP = WebAuthnRP{
+		ID:     "www.example.com",
+		Origin: "https://www.example.com",
+	}
+)
+
+// Minimal CBOR encoder for the software authenticator below.
+// Maps are given as alternating key/value slices to keep the encoding deterministic.
+type cborMap []interface{}
+
+func cborHead(major byte, val uint64) []byte {
+	switch {
+	case val < 24:
+		return []byte{major<<5 | byte(val)}
+	case val < 1<<8:
+		return []byte{major<<5 | 24, byte(val)}
+	case val < 1<<16:
+		b := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(val))
+		return b
+	default:
+		b := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(val))
+		return b
+	}
+}
+
+func cborEncode(item interface{}) []byte {
+	switch v := item.(type) {
+	case int:
+		if v >= 0 {
+			return cborHead(0, uint64(v))
+		}
+		return cborHead(1, uint64(-1-v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case cborMap:
+		out := cborHead(5, uint64(len(v)/2))
+		for _, elem := range v {
+			out = append(out, cborEncode(elem)...)
+		}
+		return out
+	}
+	panic("cborEncode(): unsupported type")
+}
+
+// softAuthenticator is a software-only ES256 authenticator
+type softAuthenticator struct {
+	credID    []byte
+	key       *ecdsa.PrivateKey
+	signCount uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() returns error:%s\n", err)
+	}
+	return &softAuthenticator{
+		credID: []byte("soft-authenticator-credential-id"),
+		key:    key,
+	}
+}
+
+func (sa *softAuthenticator) clientData(ceremonyType string, challenge []byte) []byte {
+	clientData, _ := json.Marshal(webAuthnClientData{
+		Type:      ceremonyType,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    testRP.Origin,
+	})
+	return clientData
+}
+
+func (sa *softAuthenticator) authData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authData := append([]byte{}, rpIDHash[:]...)
+
+	flags := webAuthnFlagUP
+	if attested {
+		flags |= webAuthnFlagAT
+	}
+	authData = append(authData, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[33:37], sa.signCount)
+
+	if attested {
+		authData = append(authData, make([]byte, 16)...) // aaguid
+		authData = append(authData, byte(len(sa.credID)>>8), byte(len(sa.credID)))
+		authData = append(authData, sa.credID...)
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		sa.key.X.FillBytes(x)
+		sa.key.Y.FillBytes(y)
+		authData = append(authData, cborEncode(cborMap{1, 2, 3, -7, -1, 1, -2, x, -3, y})...)
+	}
+	return authData
+}
+
+func (sa *softAuthenticator) create(challenge []byte) (clientDataJSON []byte, attestationObject []byte) {
+	clientDataJSON = sa.clientData(webAuthnTypeCreate, challenge)
+	attestationObject = cborEncode(cborMap{
+		"fmt", "none",
+		"attStmt", cborMap{},
+		"authData", sa.authData(testRP.ID, true),
+	})
+	return
+}
+
+func (sa *softAuthenticator) get(t *testing.T, rpID string, challenge []byte) (clientDataJSON []byte, authenticatorData []byte, signature []byte) {
+	sa.signCount++
+	clientDataJSON = sa.clientData(webAuthnTypeGet, challenge)
+	authenticatorData = sa.authData(rpID, false)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authenticatorData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, sa.key, digest[:])
+	if err != nil {
+		t.Fatalf("ecdsa.SignASN1() returns error:%s\n", err)
+	}
+	return
+}
+
+func TestWebAuthnRegistrationAndAssertion(t *testing.T) {
+	sa := newSoftAuthenticator(t)
+
+	challenge, _ := NewWebAuthnChallenge()
+	clientDataJSON, attestationObject := sa.create(challenge)
+	cred, err := VerifyWebAuthnRegistration(testRP, challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		t.Fatalf("VerifyWebAuthnRegistration() returns error:%s\n", err)
+	}
+	if string(cred.ID) != string(sa.credID) {
+		t.Errorf("VerifyWebAuthnRegistration() returns credential ID %x, want %x\n", cred.ID, sa.credID)
+	}
+
+	// Registration with a different challenge
+	otherChallenge, _ := NewWebAuthnChallenge()
+	if _, err = VerifyWebAuthnRegistration(testRP, otherChallenge, clientDataJSON, attestationObject); err != ErrWebAuthnClientData {
+		t.Errorf("VerifyWebAuthnRegistration() with wrong challenge returns %v, want %v\n", err, ErrWebAuthnClientData)
+	}
+
+	challenge, _ = NewWebAuthnChallenge()
+	clientDataJSON, authenticatorData, signature := sa.get(t, testRP.ID, challenge)
+	signCount, err := VerifyWebAuthnAssertion(testRP, challenge, cred, clientDataJSON, authenticatorData, signature)
+	if err != nil {
+		t.Fatalf("VerifyWebAuthnAssertion() returns error:%s\n", err)
+	}
+	if signCount != sa.signCount {
+		t.Errorf("VerifyWebAuthnAssertion() returns sign count %d, want %d\n", signCount, sa.signCount)
+	}
+	cred.SignCount = signCount
+
+	// Replay of the same assertion, caught by sign count
+	if _, err = VerifyWebAuthnAssertion(testRP, challenge, cred, clientDataJSON, authenticatorData, signature); err != ErrWebAuthnSignCount {
+		t.Errorf("VerifyWebAuthnAssertion() replay returns %v, want %v\n", err, ErrWebAuthnSignCount)
+	}
+
+	// Tampered signature
+	challenge, _ = NewWebAuthnChallenge()
+	clientDataJSON, authenticatorData, signature = sa.get(t, testRP.ID, challenge)
+	authenticatorData[32] |= 0x04 // flip an RFU flag bit after signing
+	if _, err = VerifyWebAuthnAssertion(testRP, challenge, cred, clientDataJSON, authenticatorData, signature); err != ErrWebAuthnSignature {
+		t.Errorf("VerifyWebAuthnAssertion() with tampered data returns %v, want %v\n", err, ErrWebAuthnSignature)
+	}
+
+	// Assertion for another RP
+	challenge, _ = NewWebAuthnChallenge()
+	clientDataJSON, authenticatorData, signature = sa.get(t, "evil.example.com", challenge)
+	if _, err = VerifyWebAuthnAssertion(testRP, challenge, cred, clientDataJSON, authenticatorData, signature); err != ErrWebAuthnAuthData {
+		t.Errorf("VerifyWebAuthnAssertion() for another RP returns %v, want %v\n", err, ErrWebAuthnAuthData)
+	}
+}
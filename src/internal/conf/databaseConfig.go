@@ -3,14 +3,36 @@ package conf
 import "github.com/TunnelWork/Ulysses/src/internal/db"
 
 const (
+	defaultDriver    string = "mysql"
 	defaultTblPrefix string = "ulys_"
 
 	defaultMysqlAutoCommit bool = true
+
+	defaultConnectTimeoutMs     uint32 = 500 // If not established within timeout, will fail.
+	defaultReadTimeoutMs        uint32 = 30000
+	defaultWriteTimeoutMs       uint32 = 30000
+	defaultQueryTimeoutMs       uint32 = 10000
+	defaultStartupMaxWaitSecond uint32 = 60
+
+	defaultMaxOpenConns          int    = 32
+	defaultMaxIdleConns          int    = 8
+	defaultConnMaxLifetimeSecond uint32 = 3600 // Recycle before MySQL wait_timeout (8h by default)
+	defaultConnMaxIdleTimeSecond uint32 = 600
 )
 
 func defaultDatabaseConfig() db.DatabaseConfig {
 	return db.DatabaseConfig{
-		MysqlAutoCommit: defaultMysqlAutoCommit,
-		TblPrefix:       defaultTblPrefix,
+		Driver:                defaultDriver,
+		MysqlAutoCommit:       defaultMysqlAutoCommit,
+		TblPrefix:             defaultTblPrefix,
+		ConnectTimeoutMs:      defaultConnectTimeoutMs,
+		ReadTimeoutMs:         defaultReadTimeoutMs,
+		WriteTimeoutMs:        defaultWriteTimeoutMs,
+		QueryTimeoutMs:        defaultQueryTimeoutMs,
+		StartupMaxWaitSecond:  defaultStartupMaxWaitSecond,
+		MaxOpenConns:          defaultMaxOpenConns,
+		MaxIdleConns:          defaultMaxIdleConns,
+		ConnMaxLifetimeSecond: defaultConnMaxLifetimeSecond,
+		ConnMaxIdleTimeSecond: defaultConnMaxIdleTimeSecond,
 	}
 }
@@ -4,6 +4,15 @@ const (
 	defaultHost    string = "127.0.0.1"
 	defaultPort    uint16 = 8080
 	defaultUrlPath string = "/"
+
+	defaultSessionLifetimeSecond    uint32 = 7 * 24 * 3600 // 1 week
+	defaultSessionIdleTimeoutSecond uint32 = 2 * 3600      // 2 hours
+
+	defaultServerKeyPath string = "./conf/server.key"
+	defaultSecretKeyPath string = "./conf/secret.key"
+
+	defaultBackendTimeoutMs uint32 = 30000
+	defaultJobWorkers       uint16 = 4
 )
 
 type SystemConfig struct {
@@ -12,6 +21,16 @@ type SystemConfig struct {
 	SystemTickPeriodMillisecond uint16 `yaml:"sys_tick_per_ms"` // 1~65535ms per system tick.
 	UrlDomain                   string `yaml:"api_domain"`
 	UrlPath                     string `yaml:"api_path"` // relative to api_domain. Should align with your WebUI setup.
+
+	SessionLifetimeSecond    uint32 `yaml:"session_lifetime_sec"` // Session expires after this long, regardless of activity.
+	SessionIdleTimeoutSecond uint32 `yaml:"session_idle_sec"`     // Session expires if not used for this long.
+
+	ServerKeyPath           string `yaml:"server_key_path"`           // PEM private key of this instance. Generated if not exist.
+	RequireRequestSignature bool   `yaml:"require_request_signature"` // Reject authenticated requests not signed by user key.
+	SecretKeyPath           string `yaml:"secret_key_path"`           // Keyring sealing secrets in server configs. Generated if not exist.
+
+	BackendTimeoutMs uint32 `yaml:"backend_timeout_ms"` // Operations on backend servers fail if not completed within timeout. 0 for no timeout.
+	JobWorkers       uint16 `yaml:"job_workers"`        // Jobs run at a time by this instance. 0 to only enqueue jobs, for others to run.
 }
 
 func defaultSystemConfig() SystemConfig {
@@ -19,5 +38,14 @@ func defaultSystemConfig() SystemConfig {
 		Host:    defaultHost,
 		Port:    defaultPort,
 		UrlPath: defaultUrlPath,
+
+		SessionLifetimeSecond:    defaultSessionLifetimeSecond,
+		SessionIdleTimeoutSecond: defaultSessionIdleTimeoutSecond,
+
+		ServerKeyPath: defaultServerKeyPath,
+		SecretKeyPath: defaultSecretKeyPath,
+
+		BackendTimeoutMs: defaultBackendTimeoutMs,
+		JobWorkers:       defaultJobWorkers,
 	}
 }
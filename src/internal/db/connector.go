@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Dialect tells which SQL flavor a Connector speaks, e.g., to pick migrations.
+// Queries elsewhere should stick to the common subset of all dialects.
+type Dialect string
+
+const (
+	DialectMySQL  Dialect = "mysql"
+	DialectSQLite Dialect = "sqlite"
+
+	DriverMySQL  = "mysql"
+	DriverSQLite = "sqlite3"
+
+	retryBackoffInitial = 250 * time.Millisecond
+	retryBackoffMax     = 8 * time.Second
+)
+
+// Connector holds one *sql.DB shared by all its users.
+// The *sql.DB returned by Conn() MUST NOT be closed by callers.
+type Connector interface {
+	// Conn() returns the shared *sql.DB
+	Conn() (*sql.DB, error)
+	// Ping() checks if the database is reachable
+	Ping() error
+	// Close() closes the shared *sql.DB. Next Conn() opens a new one.
+	Close() error
+	// WithTimeout returns a context bound by the query timeout in DatabaseConfig, for *Context() methods of database/sql.
+	// With no query timeout configured, it is only bound by parent.
+	WithTimeout(parent context.Context) (context.Context, context.CancelFunc)
+	Dialect() Dialect
+}
+
+// NewConnector returns the Connector for DatabaseConfig.Driver after making sure the database is reachable.
+func NewConnector(conf DatabaseConfig) (Connector, error) {
+	switch conf.Driver {
+	case "", DriverMySQL:
+		mysqlConnector, err := connectMysql(conf)
+		if err != nil {
+			return nil, err
+		}
+		return mysqlConnector, nil
+	case DriverSQLite:
+		sqliteConnector, err := connectSqlite(conf)
+		if err != nil {
+			return nil, err
+		}
+		return sqliteConnector, nil
+	default:
+		return nil, ErrUnknownDriver
+	}
+}
+
+// NewConnectorWithRetry keeps trying to connect with exponential backoff
+// until success or maxWait has passed, e.g., while MySQL is still starting up.
+// onRetry, if not nil, is called before each wait.
+func NewConnectorWithRetry(conf DatabaseConfig, maxWait time.Duration, onRetry func(attempt int, err error, wait time.Duration)) (Connector, error) {
+	deadline := time.Now().Add(maxWait)
+	wait := retryBackoffInitial
+
+	for attempt := 1; ; attempt++ {
+		connector, err := NewConnector(conf)
+		if err == nil {
+			return connector, nil
+		} else if err == ErrUnknownDriver {
+			return nil, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("%w after %d attempts: %s", ErrNoConn, attempt, err)
+		}
+		if wait > remaining {
+			wait = remaining
+		}
+		if onRetry != nil {
+			onRetry(attempt, err, wait)
+		}
+		time.Sleep(wait)
+
+		wait *= 2
+		if wait > retryBackoffMax {
+			wait = retryBackoffMax
+		}
+	}
+}
+
+func withTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// NoConnector is the Connector to use without a database. Every operation fails with ErrNoConn.
+var NoConnector Connector = noConnector{}
+
+type noConnector struct{}
+
+func (noConnector) Conn() (*sql.DB, error) { return nil, ErrNoConn }
+func (noConnector) Ping() error            { return ErrNoConn }
+func (noConnector) Close() error           { return nil }
+func (noConnector) Dialect() Dialect       { return "" }
+func (noConnector) WithTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithCancel(parent)
+}
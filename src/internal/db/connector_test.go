@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewConnectorWithRetry(t *testing.T) {
+	// Nothing listens on port 1
+	conf := DatabaseConfig{
+		Host:             "127.0.0.1",
+		Port:             1,
+		Database:         "ulysses",
+		User:             "ulysses",
+		ConnectTimeoutMs: 100,
+	}
+
+	attempts := 0
+	start := time.Now()
+	_, err := NewConnectorWithRetry(conf, 600*time.Millisecond, func(attempt int, err error, wait time.Duration) {
+		attempts = attempt
+	})
+	if !errors.Is(err, ErrNoConn) {
+		t.Errorf("NewConnectorWithRetry() returns %v, want %v\n", err, ErrNoConn)
+	}
+	if attempts < 2 {
+		t.Errorf("NewConnectorWithRetry() retried %d times, want at least 2\n", attempts)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("NewConnectorWithRetry() took %s, longer than max wait\n", elapsed)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	mc := &MysqlConnector{timeout: 50 * time.Millisecond}
+	ctx, cancel := mc.WithTimeout(context.Background())
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > 50*time.Millisecond {
+		t.Errorf("WithTimeout() returns context without the query timeout\n")
+	}
+
+	mc = &MysqlConnector{}
+	ctx, cancel = mc.WithTimeout(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("WithTimeout() without query timeout returns context with deadline\n")
+	}
+}
+
+func TestNewConnectorUnknownDriver(t *testing.T) {
+	if _, err := NewConnectorWithRetry(DatabaseConfig{Driver: "oracle"}, time.Minute, nil); err != ErrUnknownDriver {
+		t.Errorf("NewConnectorWithRetry() returns %v, want %v\n", err, ErrUnknownDriver)
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	connector, err := NewConnector(DatabaseConfig{Driver: DriverSQLite, SqlitePath: ":memory:"})
+	if err != nil {
+		t.Fatalf("NewConnector() returns error:%s\n", err)
+	}
+	defer connector.Close()
+	db, _ := connector.Conn()
+	if _, err = db.Exec(`CREATE TABLE t (id INTEGER)`); err != nil {
+		t.Fatalf("can't create table. error:%s\n", err)
+	}
+
+	count := func() (n int) {
+		db.QueryRow(`SELECT COUNT(*) FROM t`).Scan(&n)
+		return n
+	}
+
+	errAbort := errors.New("abort")
+	err = WithTx(context.Background(), connector, func(tx *sql.Tx) error {
+		tx.Exec(`INSERT INTO t (id) VALUES (1)`)
+		return errAbort
+	})
+	if err != errAbort || count() != 0 {
+		t.Errorf("WithTx() returns %v and keeps %d rows, want %v and 0\n", err, count(), errAbort)
+	}
+
+	func() {
+		defer func() { recover() }()
+		WithTx(context.Background(), connector, func(tx *sql.Tx) error {
+			tx.Exec(`INSERT INTO t (id) VALUES (1)`)
+			panic("boom")
+		})
+	}()
+	if count() != 0 {
+		t.Errorf("WithTx() keeps %d rows after panic, want 0\n", count())
+	}
+
+	err = WithTx(context.Background(), connector, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO t (id) VALUES (1)`)
+		return err
+	})
+	if err != nil || count() != 1 {
+		t.Errorf("WithTx() returns %v and keeps %d rows, want nil and 1\n", err, count())
+	}
+}
@@ -1,7 +1,13 @@
 package db
 
 type DatabaseConfig struct {
-	// Mandatory Connection Info
+	// "mysql" (default) or "sqlite3"
+	Driver string `yaml:"driver"`
+
+	// SQLite Connection Info: path to the database file, or ":memory:"
+	SqlitePath string `yaml:"sqlite_path"`
+
+	// Mandatory MySQL Connection Info
 	Host     string `yaml:"host"` // For IPv6, use the format of [::]
 	Port     uint16 `yaml:"port"`
 	Database string `yaml:"database"`
@@ -16,6 +22,24 @@ type DatabaseConfig struct {
 	// Other MySQL Info
 	MysqlAutoCommit bool `yaml:"auto_commit"`
 
+	// Timeouts in milliseconds. 0 means none.
+	ConnectTimeoutMs uint32 `yaml:"connect_timeout_ms"` // Dial
+	ReadTimeoutMs    uint32 `yaml:"read_timeout_ms"`    // I/O read
+	WriteTimeoutMs   uint32 `yaml:"write_timeout_ms"`   // I/O write
+	QueryTimeoutMs   uint32 `yaml:"query_timeout_ms"`   // Database work of each operation, through Connector.WithTimeout()
+
+	// Keep retrying to connect on startup for up to this long
+	StartupMaxWaitSecond uint32 `yaml:"startup_max_wait_sec"`
+
+	// Connection Pool. 0 means unlimited for MaxOpenConns and the lifetimes.
+	MaxOpenConns          int    `yaml:"max_open_conns"`
+	MaxIdleConns          int    `yaml:"max_idle_conns"`
+	ConnMaxLifetimeSecond uint32 `yaml:"conn_max_lifetime_sec"`
+	ConnMaxIdleTimeSecond uint32 `yaml:"conn_max_idle_sec"`
+
 	// Table Prefix
 	TblPrefix string `yaml:"table_prefix"` // If unset, use default: "ulys_".
+
+	// Apply pending schema migrations on startup
+	AutoMigrate bool `yaml:"auto_migrate"`
 }
@@ -8,4 +8,8 @@ var (
 	ErrCannotAppendCert = errors.New("/src/internal/db: AppendCertsFromPEM() failed")
 	ErrIncompleteConf   = errors.New("/src/internal/db: configuration isn't complete")
 	ErrMySQLNoConn      = errors.New("/src/internal/db: cannot establish mysql connection")
+	ErrNoConn           = errors.New("/src/internal/db: cannot establish database connection")
+	ErrUnknownDriver    = errors.New("/src/internal/db: unknown database driver")
+	ErrBadMigration     = errors.New("/src/internal/db: bad migration")
+	ErrMigrationDirty   = errors.New("/src/internal/db: migration failed midway, fix the schema and delete its row from schema_migrations")
 )
@@ -0,0 +1,306 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are embedded SQL files in migrations/<dialect>/, named as
+// <version>_<name>.up.sql and <version>_<name>.down.sql
+// {{prefix}} in the SQL is replaced with DatabaseConfig.TblPrefix.
+// Statements are separated by a semicolon at the end of a line.
+// Every dialect has the same versions, each creating the same schema in its own flavor.
+
+const (
+	migrationPrefixPlaceholder = `{{prefix}}`
+	migrationTableName         = `schema_migrations`
+)
+
+//go:embed migrations/mysql/*.sql migrations/sqlite/*.sql
+var migrationFS embed.FS
+
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+// LoadMigrations returns all embedded migrations for dialect ordered by version.
+func LoadMigrations(dialect Dialect) ([]Migration, error) {
+	switch dialect {
+	case DialectMySQL, DialectSQLite:
+		return loadMigrations(migrationFS, "migrations/"+string(dialect))
+	default:
+		return nil, ErrUnknownDriver
+	}
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrationMap := map[uint]*Migration{}
+	for _, entry := range entries {
+		filename := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(filename, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(filename, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(filename, "."+direction+".sql")
+		sep := strings.IndexByte(base, '_')
+		if sep <= 0 {
+			return nil, fmt.Errorf("%w: %s", ErrBadMigration, filename)
+		}
+		version, err := strconv.ParseUint(base[:sep], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadMigration, filename)
+		}
+
+		content, err := fs.ReadFile(fsys, dir+"/"+filename)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := migrationMap[uint(version)]
+		if !ok {
+			m = &Migration{Version: uint(version), Name: base[sep+1:]}
+			migrationMap[uint(version)] = m
+		} else if m.Name != base[sep+1:] {
+			return nil, fmt.Errorf("%w: version %d has different names", ErrBadMigration, version)
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(migrationMap))
+	for _, m := range migrationMap {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("%w: version %d lacks up or down", ErrBadMigration, m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// splitStatements splits migration SQL into single statements with prefix filled in.
+func splitStatements(migrationSQL string, prefix string) []string {
+	migrationSQL = strings.ReplaceAll(migrationSQL, migrationPrefixPlaceholder, prefix)
+
+	statements := []string{}
+	var current strings.Builder
+	for _, line := range strings.Split(migrationSQL, "\n") {
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			if statement := strings.TrimSpace(current.String()); statement != ";" {
+				statements = append(statements, statement)
+			}
+			current.Reset()
+		}
+	}
+	if statement := strings.TrimSpace(current.String()); statement != "" {
+		statements = append(statements, statement)
+	}
+	return statements
+}
+
+// Migrator applies migrations to a database and records them in schema_migrations.
+// With DryRun set, SQL is written to Out instead of executed.
+type Migrator struct {
+	DB         *sql.DB
+	Dialect    Dialect
+	Prefix     string
+	DryRun     bool
+	Out        io.Writer
+	Migrations []Migration
+}
+
+func NewMigrator(db *sql.DB, dialect Dialect, prefix string) (*Migrator, error) {
+	migrations, err := LoadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		DB:         db,
+		Dialect:    dialect,
+		Prefix:     prefix,
+		Migrations: migrations,
+	}, nil
+}
+
+func (m *Migrator) ensureMigrationTable() error {
+	if m.DryRun {
+		return nil
+	}
+	_, err := m.DB.Exec(`CREATE TABLE IF NOT EXISTS ` + m.Prefix + migrationTableName + ` (version INT UNSIGNED NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_time BIGINT NOT NULL)`)
+	return err
+}
+
+// Applied returns the versions already applied.
+// In dry run, a missing schema_migrations table means nothing is applied.
+// ErrMigrationDirty is returned if a migration failed midway before, as nothing can be applied on top of it safely.
+func (m *Migrator) Applied() (map[uint]bool, error) {
+	applied := map[uint]bool{}
+
+	rows, err := m.DB.Query(`SELECT version, applied_time FROM ` + m.Prefix + migrationTableName)
+	if err != nil {
+		if m.DryRun {
+			return applied, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version uint
+		var appliedTime int64
+		if err = rows.Scan(&version, &appliedTime); err != nil {
+			return nil, err
+		}
+		if appliedTime == 0 {
+			return nil, fmt.Errorf("%w: version %04d", ErrMigrationDirty, version)
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// Up applies all pending migrations in order and returns the versions applied.
+func (m *Migrator) Up() ([]uint, error) {
+	if err := m.ensureMigrationTable(); err != nil {
+		return nil, err
+	}
+	applied, err := m.Applied()
+	if err != nil {
+		return nil, err
+	}
+
+	done := []uint{}
+	for _, migration := range m.Migrations {
+		if applied[migration.Version] {
+			continue
+		}
+		if err = m.apply(migration, true); err != nil {
+			return done, err
+		}
+		done = append(done, migration.Version)
+	}
+	return done, nil
+}
+
+// Down reverts the last steps applied migrations in reverse order and returns the versions reverted.
+func (m *Migrator) Down(steps int) ([]uint, error) {
+	if err := m.ensureMigrationTable(); err != nil {
+		return nil, err
+	}
+	applied, err := m.Applied()
+	if err != nil {
+		return nil, err
+	}
+
+	done := []uint{}
+	for i := len(m.Migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := m.Migrations[i]
+		if !applied[migration.Version] {
+			continue
+		}
+		if err = m.apply(migration, false); err != nil {
+			return done, err
+		}
+		done = append(done, migration.Version)
+	}
+	return done, nil
+}
+
+// apply runs migration up or down and records it in schema_migrations.
+//
+// On SQLite, DDL is transactional, so all of it runs in one transaction and a failure leaves nothing behind.
+// MySQL commits each DDL statement implicitly, so the version is marked with applied_time 0 while it runs.
+// If it fails midway, the mark stays and Applied() refuses to go on until the schema is fixed by hand
+// and the row is deleted.
+func (m *Migrator) apply(migration Migration, up bool) (err error) {
+	migrationSQL := migration.Down
+	if up {
+		migrationSQL = migration.Up
+	}
+	if m.DryRun {
+		return m.run(m.DB, migration, migrationSQL)
+	}
+
+	var q Querier = m.DB
+	if m.Dialect == DialectSQLite {
+		tx, txErr := m.DB.Begin()
+		if txErr != nil {
+			return txErr
+		}
+		defer func() {
+			if err != nil {
+				tx.Rollback()
+			} else {
+				err = tx.Commit()
+			}
+		}()
+		q = tx
+	}
+
+	table := m.Prefix + migrationTableName
+	if up {
+		_, err = q.Exec(`INSERT INTO `+table+` (version, name, applied_time) VALUES( ?, ?, 0 )`, migration.Version, migration.Name)
+	} else {
+		_, err = q.Exec(`UPDATE `+table+` SET applied_time = 0 WHERE version = ?`, migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = m.run(q, migration, migrationSQL); err != nil {
+		return err
+	}
+
+	if up {
+		_, err = q.Exec(`UPDATE `+table+` SET applied_time = ? WHERE version = ?`, time.Now().Unix(), migration.Version)
+	} else {
+		_, err = q.Exec(`DELETE FROM `+table+` WHERE version = ?`, migration.Version)
+	}
+	return err
+}
+
+func (m *Migrator) run(q Querier, migration Migration, migrationSQL string) error {
+	if m.DryRun && m.Out != nil {
+		fmt.Fprintf(m.Out, "-- %04d_%s\n", migration.Version, migration.Name)
+	}
+	for _, statement := range splitStatements(migrationSQL, m.Prefix) {
+		if m.DryRun {
+			if m.Out != nil {
+				fmt.Fprintln(m.Out, statement)
+			}
+			continue
+		}
+		if _, err := q.Exec(statement); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
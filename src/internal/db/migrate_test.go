@@ -0,0 +1,131 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	mysqlMigrations, err := LoadMigrations(DialectMySQL)
+	if err != nil {
+		t.Fatalf("LoadMigrations(mysql) returns error:%s\n", err)
+	}
+	if len(mysqlMigrations) == 0 {
+		t.Fatalf("LoadMigrations(mysql) returns no migration\n")
+	}
+	sqliteMigrations, err := LoadMigrations(DialectSQLite)
+	if err != nil {
+		t.Fatalf("LoadMigrations(sqlite) returns error:%s\n", err)
+	}
+	if len(sqliteMigrations) != len(mysqlMigrations) {
+		t.Fatalf("LoadMigrations(sqlite) returns %d migrations, want %d as mysql\n", len(sqliteMigrations), len(mysqlMigrations))
+	}
+
+	for i, m := range mysqlMigrations {
+		if m.Version != uint(i+1) {
+			t.Errorf("migration #%d has version %d, want %d\n", i, m.Version, i+1)
+		}
+		if !strings.Contains(m.Up, migrationPrefixPlaceholder) || !strings.Contains(m.Down, migrationPrefixPlaceholder) {
+			t.Errorf("migration %d doesn't use %s for table names\n", m.Version, migrationPrefixPlaceholder)
+		}
+		if sqliteMigrations[i].Version != m.Version || sqliteMigrations[i].Name != m.Name {
+			t.Errorf("sqlite migration #%d is %04d_%s, want %04d_%s\n", i, sqliteMigrations[i].Version, sqliteMigrations[i].Name, m.Version, m.Name)
+		}
+	}
+}
+
+func TestMigratorSqlite(t *testing.T) {
+	connector, err := NewConnector(DatabaseConfig{Driver: DriverSQLite, SqlitePath: ":memory:"})
+	if err != nil {
+		t.Fatalf("NewConnector() returns error:%s\n", err)
+	}
+	defer connector.Close()
+	db, _ := connector.Conn()
+
+	migrator, err := NewMigrator(db, connector.Dialect(), "test_")
+	if err != nil {
+		t.Fatalf("NewMigrator() returns error:%s\n", err)
+	}
+	versions, err := migrator.Up()
+	if err != nil {
+		t.Fatalf("Up() returns error:%s\n", err)
+	}
+	if len(versions) != len(migrator.Migrations) {
+		t.Errorf("Up() applied %d migrations, want %d\n", len(versions), len(migrator.Migrations))
+	}
+	if versions, _ = migrator.Up(); len(versions) != 0 {
+		t.Errorf("Up() again applied %v, want none\n", versions)
+	}
+
+	versions, err = migrator.Down(len(migrator.Migrations))
+	if err != nil {
+		t.Fatalf("Down() returns error:%s\n", err)
+	}
+	if len(versions) != len(migrator.Migrations) {
+		t.Errorf("Down() reverted %d migrations, want %d\n", len(versions), len(migrator.Migrations))
+	}
+}
+
+func TestMigratorFailedMidway(t *testing.T) {
+	connector, err := NewConnector(DatabaseConfig{Driver: DriverSQLite, SqlitePath: ":memory:"})
+	if err != nil {
+		t.Fatalf("NewConnector() returns error:%s\n", err)
+	}
+	defer connector.Close()
+	db, _ := connector.Conn()
+
+	broken := Migration{Version: 1, Name: "broken", Up: "CREATE TABLE {{prefix}}a (id INT);\nCREATE TABLE {{prefix}}a (id INT);", Down: "DROP TABLE {{prefix}}a;"}
+	migrator := &Migrator{DB: db, Dialect: DialectSQLite, Prefix: "test_", Migrations: []Migration{broken}}
+
+	// Rolled back as a whole
+	if _, err = migrator.Up(); err == nil {
+		t.Fatalf("Up() of a broken migration returns no error\n")
+	}
+	if _, err = db.Exec("SELECT id FROM test_a"); err == nil {
+		t.Errorf("table of the failed migration is left behind\n")
+	}
+	if applied, err := migrator.Applied(); err != nil || len(applied) != 0 {
+		t.Errorf("Applied() after a rolled back migration returns %v, %v\n", applied, err)
+	}
+
+	// Without transactional DDL, the version stays dirty
+	migrator.Dialect = DialectMySQL
+	if _, err = migrator.Up(); err == nil {
+		t.Fatalf("Up() of a broken migration returns no error\n")
+	}
+	if _, err = migrator.Up(); !errors.Is(err, ErrMigrationDirty) {
+		t.Errorf("Up() after a failure midway returns %v, want %v\n", err, ErrMigrationDirty)
+	}
+	if _, err = migrator.Down(1); !errors.Is(err, ErrMigrationDirty) {
+		t.Errorf("Down() after a failure midway returns %v, want %v\n", err, ErrMigrationDirty)
+	}
+}
+
+func TestLoadMigrationsIncomplete(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0001_a.up.sql":   {Data: []byte("CREATE TABLE {{prefix}}a (id INT);")},
+		"m/0001_a.down.sql": {Data: []byte("DROP TABLE {{prefix}}a;")},
+		"m/0002_b.up.sql":   {Data: []byte("CREATE TABLE {{prefix}}b (id INT);")},
+	}
+	if _, err := loadMigrations(fsys, "m"); !errors.Is(err, ErrBadMigration) {
+		t.Errorf("loadMigrations() without down returns %v, want %v\n", err, ErrBadMigration)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	statements := splitStatements("CREATE TABLE {{prefix}}a (\n    id INT -- no; split here\n);\n\nDROP TABLE {{prefix}}b;\n", "ulys_")
+	want := []string{
+		"CREATE TABLE ulys_a (\n    id INT -- no; split here\n);",
+		"DROP TABLE ulys_b;",
+	}
+	if len(statements) != len(want) {
+		t.Fatalf("splitStatements() returns %d statements, want %d: %q\n", len(statements), len(want), statements)
+	}
+	for i := range want {
+		if statements[i] != want[i] {
+			t.Errorf("splitStatements()[%d] = %q, want %q\n", i, statements[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,10 @@
+CREATE TABLE {{prefix}}Servers (
+    ID           INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    ServerType   VARCHAR(64)  NOT NULL,
+    ConfJson     TEXT         NOT NULL,
+    LastUpdate   BIGINT       NOT NULL DEFAULT 0,
+    Disabled     TINYINT(1)   NOT NULL DEFAULT 0,
+    DeletionTime BIGINT       NOT NULL DEFAULT 0,
+    PRIMARY KEY (ID),
+    INDEX idx_last_update (LastUpdate)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,2 @@
+DROP TABLE {{prefix}}password_resets;
+DROP TABLE {{prefix}}users;
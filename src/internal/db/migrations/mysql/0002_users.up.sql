@@ -0,0 +1,23 @@
+CREATE TABLE {{prefix}}users (
+    uid           INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    login         VARCHAR(64)  NOT NULL,
+    email         VARCHAR(255) NOT NULL DEFAULT '',
+    password      VARCHAR(255) NOT NULL,
+    pubkey        TEXT         NULL,
+    privkey       TEXT         NULL,
+    roles         INT UNSIGNED NOT NULL DEFAULT 2, -- api.ROLE_CUSTOMER
+    disabled      TINYINT(1)   NOT NULL DEFAULT 0,
+    creation_time BIGINT       NOT NULL DEFAULT 0,
+    deletion_time BIGINT       NOT NULL DEFAULT 0,
+    PRIMARY KEY (uid),
+    UNIQUE INDEX idx_login (login),
+    INDEX idx_email (email)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE {{prefix}}password_resets (
+    token_hash CHAR(64)     NOT NULL, -- hex SHA-256 of the token
+    uid        INT UNSIGNED NOT NULL,
+    expiry     BIGINT       NOT NULL,
+    PRIMARY KEY (token_hash),
+    INDEX idx_uid (uid)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
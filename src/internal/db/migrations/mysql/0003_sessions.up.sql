@@ -0,0 +1,11 @@
+CREATE TABLE {{prefix}}sessions (
+    token_hash    CHAR(64)     NOT NULL, -- hex SHA-256 of the token
+    uid           INT UNSIGNED NOT NULL,
+    fingerprint   CHAR(64)     NOT NULL,
+    creation_time BIGINT       NOT NULL,
+    last_active   BIGINT       NOT NULL,
+    expiry        BIGINT       NOT NULL,
+    revoked       TINYINT(1)   NOT NULL DEFAULT 0,
+    PRIMARY KEY (token_hash),
+    INDEX idx_uid (uid)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,7 @@
+CREATE TABLE {{prefix}}login_attempts (
+    attempt_key  VARCHAR(255) NOT NULL, -- "login:<login>" or "ip:<ip>"
+    failures     INT UNSIGNED NOT NULL DEFAULT 0,
+    last_failure BIGINT       NOT NULL DEFAULT 0,
+    locked_until BIGINT       NOT NULL DEFAULT 0,
+    PRIMARY KEY (attempt_key)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
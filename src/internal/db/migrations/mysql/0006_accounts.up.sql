@@ -0,0 +1,12 @@
+CREATE TABLE {{prefix}}accounts (
+    id            INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    uid           INT UNSIGNED NOT NULL,
+    server_id     INT UNSIGNED NOT NULL,
+    acc_id        INT          NOT NULL,
+    status        VARCHAR(16)  NOT NULL DEFAULT 'active',
+    creation_time BIGINT       NOT NULL,
+    last_update   BIGINT       NOT NULL,
+    PRIMARY KEY (id),
+    INDEX idx_uid (uid),
+    INDEX idx_server (server_id, acc_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
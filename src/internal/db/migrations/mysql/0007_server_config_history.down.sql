@@ -0,0 +1 @@
+DROP TABLE {{prefix}}server_config_history;
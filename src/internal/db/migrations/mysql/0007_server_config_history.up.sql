@@ -0,0 +1,13 @@
+CREATE TABLE {{prefix}}server_config_history (
+    id               INT UNSIGNED NOT NULL AUTO_INCREMENT, -- revision
+    server_id        INT UNSIGNED NOT NULL,
+    operator_uid     INT UNSIGNED NOT NULL DEFAULT 0, -- 0 for Ulysses itself
+    action           VARCHAR(16)  NOT NULL,
+    prev_server_type VARCHAR(64)  NOT NULL DEFAULT '',
+    prev_conf_json   TEXT         NOT NULL,
+    server_type      VARCHAR(64)  NOT NULL,
+    conf_json        TEXT         NOT NULL,
+    change_time      BIGINT       NOT NULL,
+    PRIMARY KEY (id),
+    INDEX idx_server (server_id, id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
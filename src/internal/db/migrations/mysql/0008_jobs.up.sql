@@ -0,0 +1,20 @@
+CREATE TABLE {{prefix}}jobs (
+    id              INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    kind            VARCHAR(32)  NOT NULL,
+    idempotency_key VARCHAR(128) NULL DEFAULT NULL, -- NULL if the job may be enqueued again
+    uid             INT UNSIGNED NOT NULL DEFAULT 0, -- user who enqueued the job, 0 for Ulysses itself
+    payload         TEXT         NOT NULL,
+    result          TEXT         NOT NULL,
+    status          VARCHAR(16)  NOT NULL DEFAULT 'queued',
+    attempts        INT          NOT NULL DEFAULT 0,
+    max_attempts    INT          NOT NULL,
+    last_error      TEXT         NOT NULL,
+    run_after       BIGINT       NOT NULL, -- not claimed before
+    locked_until    BIGINT       NOT NULL DEFAULT 0, -- a running job is claimed again after, e.g., its worker died
+    creation_time   BIGINT       NOT NULL,
+    last_update     BIGINT       NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE INDEX idx_idempotency_key (idempotency_key),
+    INDEX idx_status (status, run_after),
+    INDEX idx_uid (uid, id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
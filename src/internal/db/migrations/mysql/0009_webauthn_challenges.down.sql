@@ -0,0 +1 @@
+DROP TABLE {{prefix}}webauthn_challenges;
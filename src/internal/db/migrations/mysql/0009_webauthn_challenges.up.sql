@@ -0,0 +1,6 @@
+CREATE TABLE {{prefix}}webauthn_challenges (
+    challenge_key VARCHAR(255) NOT NULL, -- "reg/<uid>" or "login/<uid>"
+    challenge     VARCHAR(255) NOT NULL, -- base64url
+    expiry        BIGINT       NOT NULL,
+    PRIMARY KEY (challenge_key)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1 @@
+DROP TABLE {{prefix}}request_nonces;
@@ -0,0 +1,7 @@
+CREATE TABLE {{prefix}}request_nonces (
+    uid    INT UNSIGNED NOT NULL,
+    nonce  VARCHAR(64)  NOT NULL,
+    expiry BIGINT       NOT NULL,
+    PRIMARY KEY (uid, nonce),
+    INDEX idx_expiry (expiry)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,3 @@
+ALTER TABLE {{prefix}}users DROP INDEX idx_email, ADD INDEX idx_email (email);
+UPDATE {{prefix}}users SET email = '' WHERE email IS NULL;
+ALTER TABLE {{prefix}}users MODIFY email VARCHAR(255) NOT NULL DEFAULT '';
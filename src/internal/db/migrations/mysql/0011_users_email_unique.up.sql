@@ -0,0 +1,4 @@
+-- No email is stored as NULL, so the unique index only covers real addresses
+ALTER TABLE {{prefix}}users MODIFY email VARCHAR(255) NULL DEFAULT NULL;
+UPDATE {{prefix}}users SET email = NULL WHERE email = '';
+ALTER TABLE {{prefix}}users DROP INDEX idx_email, ADD UNIQUE INDEX idx_email (email);
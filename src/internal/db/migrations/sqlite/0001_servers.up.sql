@@ -0,0 +1,10 @@
+CREATE TABLE {{prefix}}Servers (
+    ID           INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    ServerType   VARCHAR(64)  NOT NULL,
+    ConfJson     TEXT         NOT NULL,
+    LastUpdate   BIGINT       NOT NULL DEFAULT 0,
+    Disabled     TINYINT(1)   NOT NULL DEFAULT 0,
+    DeletionTime BIGINT       NOT NULL DEFAULT 0
+);
+
+CREATE INDEX {{prefix}}Servers_last_update ON {{prefix}}Servers (LastUpdate);
@@ -0,0 +1,24 @@
+CREATE TABLE {{prefix}}users (
+    uid           INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    login         VARCHAR(64)  NOT NULL,
+    email         VARCHAR(255) NOT NULL DEFAULT '',
+    password      VARCHAR(255) NOT NULL,
+    pubkey        TEXT         NULL,
+    privkey       TEXT         NULL,
+    roles         INTEGER      NOT NULL DEFAULT 2, -- api.ROLE_CUSTOMER
+    disabled      TINYINT(1)   NOT NULL DEFAULT 0,
+    creation_time BIGINT       NOT NULL DEFAULT 0,
+    deletion_time BIGINT       NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX {{prefix}}users_login ON {{prefix}}users (login);
+
+CREATE INDEX {{prefix}}users_email ON {{prefix}}users (email);
+
+CREATE TABLE {{prefix}}password_resets (
+    token_hash CHAR(64)     NOT NULL PRIMARY KEY, -- hex SHA-256 of the token
+    uid        INTEGER      NOT NULL,
+    expiry     BIGINT       NOT NULL
+);
+
+CREATE INDEX {{prefix}}password_resets_uid ON {{prefix}}password_resets (uid);
@@ -0,0 +1,11 @@
+CREATE TABLE {{prefix}}sessions (
+    token_hash    CHAR(64)     NOT NULL PRIMARY KEY, -- hex SHA-256 of the token
+    uid           INTEGER      NOT NULL,
+    fingerprint   CHAR(64)     NOT NULL,
+    creation_time BIGINT       NOT NULL,
+    last_active   BIGINT       NOT NULL,
+    expiry        BIGINT       NOT NULL,
+    revoked       TINYINT(1)   NOT NULL DEFAULT 0
+);
+
+CREATE INDEX {{prefix}}sessions_uid ON {{prefix}}sessions (uid);
@@ -0,0 +1,8 @@
+CREATE TABLE {{prefix}}user_mfa (
+    uid           INTEGER      NOT NULL,
+    mfa_type      VARCHAR(32)  NOT NULL,
+    mfa_config    TEXT         NOT NULL,
+    confirmed     TINYINT(1)   NOT NULL DEFAULT 0,
+    creation_time BIGINT       NOT NULL,
+    PRIMARY KEY (uid, mfa_type)
+);
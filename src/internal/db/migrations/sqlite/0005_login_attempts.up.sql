@@ -0,0 +1,6 @@
+CREATE TABLE {{prefix}}login_attempts (
+    attempt_key  VARCHAR(255) NOT NULL PRIMARY KEY, -- "login:<login>" or "ip:<ip>"
+    failures     INTEGER      NOT NULL DEFAULT 0,
+    last_failure BIGINT       NOT NULL DEFAULT 0,
+    locked_until BIGINT       NOT NULL DEFAULT 0
+);
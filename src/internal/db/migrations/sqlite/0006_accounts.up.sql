@@ -0,0 +1,13 @@
+CREATE TABLE {{prefix}}accounts (
+    id            INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    uid           INTEGER      NOT NULL,
+    server_id     INTEGER      NOT NULL,
+    acc_id        INT          NOT NULL,
+    status        VARCHAR(16)  NOT NULL DEFAULT 'active',
+    creation_time BIGINT       NOT NULL,
+    last_update   BIGINT       NOT NULL
+);
+
+CREATE INDEX {{prefix}}accounts_uid ON {{prefix}}accounts (uid);
+
+CREATE INDEX {{prefix}}accounts_server ON {{prefix}}accounts (server_id, acc_id);
@@ -0,0 +1,13 @@
+CREATE TABLE {{prefix}}server_config_history (
+    id               INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT, -- revision
+    server_id        INTEGER      NOT NULL,
+    operator_uid     INTEGER      NOT NULL DEFAULT 0, -- 0 for Ulysses itself
+    action           VARCHAR(16)  NOT NULL,
+    prev_server_type VARCHAR(64)  NOT NULL DEFAULT '',
+    prev_conf_json   TEXT         NOT NULL,
+    server_type      VARCHAR(64)  NOT NULL,
+    conf_json        TEXT         NOT NULL,
+    change_time      BIGINT       NOT NULL
+);
+
+CREATE INDEX {{prefix}}server_config_history_server ON {{prefix}}server_config_history (server_id, id);
@@ -0,0 +1,22 @@
+CREATE TABLE {{prefix}}jobs (
+    id              INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    kind            VARCHAR(32)  NOT NULL,
+    idempotency_key VARCHAR(128) NULL DEFAULT NULL, -- NULL if the job may be enqueued again
+    uid             INTEGER      NOT NULL DEFAULT 0, -- user who enqueued the job, 0 for Ulysses itself
+    payload         TEXT         NOT NULL,
+    result          TEXT         NOT NULL,
+    status          VARCHAR(16)  NOT NULL DEFAULT 'queued',
+    attempts        INT          NOT NULL DEFAULT 0,
+    max_attempts    INT          NOT NULL,
+    last_error      TEXT         NOT NULL,
+    run_after       BIGINT       NOT NULL, -- not claimed before
+    locked_until    BIGINT       NOT NULL DEFAULT 0, -- a running job is claimed again after, e.g., its worker died
+    creation_time   BIGINT       NOT NULL,
+    last_update     BIGINT       NOT NULL
+);
+
+CREATE UNIQUE INDEX {{prefix}}jobs_idempotency_key ON {{prefix}}jobs (idempotency_key);
+
+CREATE INDEX {{prefix}}jobs_status ON {{prefix}}jobs (status, run_after);
+
+CREATE INDEX {{prefix}}jobs_uid ON {{prefix}}jobs (uid, id);
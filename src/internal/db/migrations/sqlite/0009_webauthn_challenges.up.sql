@@ -0,0 +1,5 @@
+CREATE TABLE {{prefix}}webauthn_challenges (
+    challenge_key VARCHAR(255) NOT NULL PRIMARY KEY, -- "reg/<uid>" or "login/<uid>"
+    challenge     VARCHAR(255) NOT NULL, -- base64url
+    expiry        BIGINT       NOT NULL
+);
@@ -0,0 +1,7 @@
+CREATE TABLE {{prefix}}request_nonces (
+    uid    INTEGER     NOT NULL,
+    nonce  VARCHAR(64) NOT NULL,
+    expiry BIGINT      NOT NULL,
+    PRIMARY KEY (uid, nonce)
+);
+CREATE INDEX {{prefix}}request_nonces_expiry ON {{prefix}}request_nonces (expiry);
@@ -0,0 +1,25 @@
+-- No email is stored as NULL, so the unique index only covers real addresses.
+-- SQLite can't drop NOT NULL from a column, so the table is rebuilt.
+CREATE TABLE {{prefix}}users_new (
+    uid           INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    login         VARCHAR(64)  NOT NULL,
+    email         VARCHAR(255) NULL DEFAULT NULL,
+    password      VARCHAR(255) NOT NULL,
+    pubkey        TEXT         NULL,
+    privkey       TEXT         NULL,
+    roles         INTEGER      NOT NULL DEFAULT 2, -- api.ROLE_CUSTOMER
+    disabled      TINYINT(1)   NOT NULL DEFAULT 0,
+    creation_time BIGINT       NOT NULL DEFAULT 0,
+    deletion_time BIGINT       NOT NULL DEFAULT 0
+);
+
+INSERT INTO {{prefix}}users_new (uid, login, email, password, pubkey, privkey, roles, disabled, creation_time, deletion_time)
+    SELECT uid, login, NULLIF(email, ''), password, pubkey, privkey, roles, disabled, creation_time, deletion_time FROM {{prefix}}users;
+
+DROP TABLE {{prefix}}users;
+
+ALTER TABLE {{prefix}}users_new RENAME TO {{prefix}}users;
+
+CREATE UNIQUE INDEX {{prefix}}users_login ON {{prefix}}users (login);
+
+CREATE UNIQUE INDEX {{prefix}}users_email ON {{prefix}}users (email);
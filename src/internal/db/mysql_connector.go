@@ -1,47 +1,131 @@
 package db
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
 	"fmt"
 	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
 )
 
-// MysqlConnect is a STATELESS struct used to generate new MySQL connections
+// MysqlConnector holds one *sql.DB, a pool of MySQL connections shared by all its users.
+// The *sql.DB returned by Conn() MUST NOT be closed by callers.
 type MysqlConnector struct {
 	conf    DatabaseConfig
-	timeout time.Duration // !unimplemented
+	timeout time.Duration // Per query, see WithTimeout(). 0 for none.
+
+	mutex sync.Mutex
+	db    *sql.DB
 }
 
 // NewMysqlConnector returns a valid pointer to a
 // MysqlConnector struct when conf is valid (able to
 // establish mysql connections)
 func NewMysqlConnector(conf DatabaseConfig) *MysqlConnector {
-	mysqlConnector := MysqlConnector{
-		conf: conf,
+	mysqlConnector, err := connectMysql(conf)
+	if err != nil {
+		return nil
 	}
+	return mysqlConnector
+}
 
-	conn, err := mysqlConnector.Conn()
-	if err != nil || conn.Ping() != nil {
-		return nil
+func connectMysql(conf DatabaseConfig) (*MysqlConnector, error) {
+	mysqlConnector := &MysqlConnector{
+		conf:    conf,
+		timeout: time.Duration(conf.QueryTimeoutMs) * time.Millisecond,
 	}
 
-	return &mysqlConnector
+	if err := mysqlConnector.Ping(); err != nil {
+		mysqlConnector.Close()
+		return nil, err
+	}
+	return mysqlConnector, nil
+}
+
+func (mc *MysqlConnector) WithTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	if mc == nil {
+		return withTimeout(parent, 0)
+	}
+	return withTimeout(parent, mc.timeout)
 }
 
-// Conn() creates the *sql.DB using the DatabaseConfig stored in
-// current MysqlConnector
+func (mc *MysqlConnector) Dialect() Dialect {
+	return DialectMySQL
+}
+
+// Conn() returns the shared *sql.DB, opening it using the DatabaseConfig
+// stored in current MysqlConnector on first call.
 func (mc *MysqlConnector) Conn() (*sql.DB, error) {
+	if mc == nil { // e.g., running with --no-db
+		return nil, ErrMySQLNoConn
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if mc.db != nil {
+		return mc.db, nil
+	}
+
+	db, err := mc.open()
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(mc.conf.MaxOpenConns)
+	if mc.conf.MaxIdleConns > 0 { // 0 would keep no idle connection at all
+		db.SetMaxIdleConns(mc.conf.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(time.Duration(mc.conf.ConnMaxLifetimeSecond) * time.Second)
+	db.SetConnMaxIdleTime(time.Duration(mc.conf.ConnMaxIdleTimeSecond) * time.Second)
+
+	mc.db = db
+	return mc.db, nil
+}
+
+// Ping() checks if the database is reachable through the shared pool.
+func (mc *MysqlConnector) Ping() error {
+	db, err := mc.Conn()
+	if err != nil {
+		return err
+	}
+	return db.Ping()
+}
+
+// Close() closes the shared pool. Next Conn() opens a new one.
+func (mc *MysqlConnector) Close() error {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if mc.db == nil {
+		return nil
+	}
+	err := mc.db.Close()
+	mc.db = nil
+	return err
+}
+
+func (mc *MysqlConnector) open() (*sql.DB, error) {
 	driverName := "mysql"
 	// dsn = fmt.Sprintf("user:password@tcp(localhost:5555)/dbname?tls=skip-verify&autocommit=true")
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?loc=Local", mc.conf.User, mc.conf.Passwd, mc.conf.Host, mc.conf.Port, mc.conf.Database)
 	if mc.conf.MysqlAutoCommit {
 		dsn += "&autocommit=true"
 	}
+	if mc.conf.ConnectTimeoutMs > 0 {
+		dsn += "&timeout=" + (time.Duration(mc.conf.ConnectTimeoutMs) * time.Millisecond).String()
+	}
+	if mc.conf.ReadTimeoutMs > 0 {
+		dsn += "&readTimeout=" + (time.Duration(mc.conf.ReadTimeoutMs) * time.Millisecond).String()
+	}
+	if mc.conf.WriteTimeoutMs > 0 {
+		dsn += "&writeTimeout=" + (time.Duration(mc.conf.WriteTimeoutMs) * time.Millisecond).String()
+	}
 	if mc.conf.CA != "" {
 		dsn += "&tls=custom"
 		rootCertPool := x509.NewCertPool()
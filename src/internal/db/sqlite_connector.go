@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteMemory = ":memory:"
+
+// SqliteConnector holds one *sql.DB on a SQLite file, for single-node deployments and tests.
+// The *sql.DB returned by Conn() MUST NOT be closed by callers.
+type SqliteConnector struct {
+	conf    DatabaseConfig
+	timeout time.Duration // Per query, see WithTimeout(). 0 for none.
+
+	mutex sync.Mutex
+	db    *sql.DB
+}
+
+func connectSqlite(conf DatabaseConfig) (*SqliteConnector, error) {
+	sqliteConnector := &SqliteConnector{
+		conf:    conf,
+		timeout: time.Duration(conf.QueryTimeoutMs) * time.Millisecond,
+	}
+
+	if err := sqliteConnector.Ping(); err != nil {
+		sqliteConnector.Close()
+		return nil, err
+	}
+	return sqliteConnector, nil
+}
+
+func (sc *SqliteConnector) Conn() (*sql.DB, error) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if sc.db != nil {
+		return sc.db, nil
+	}
+
+	if sc.conf.SqlitePath == "" {
+		return nil, ErrIncompleteConf
+	}
+	if sc.conf.SqlitePath == sqliteMemory {
+		db, err := sql.Open(DriverSQLite, sqliteMemory)
+		if err != nil {
+			return nil, err
+		}
+		// Every connection to :memory: opens a database of its own, so there must be only one, kept forever.
+		// Hold no Rows while running another query on it, or this deadlocks.
+		db.SetMaxOpenConns(1)
+		db.SetConnMaxLifetime(0)
+		db.SetConnMaxIdleTime(0)
+		sc.db = db
+		return sc.db, nil
+	}
+
+	// WAL lets readers go on while one writes. Writers wait up to the busy timeout for each other,
+	// and transactions take the write lock up front so they don't fail midway upgrading to it.
+	db, err := sql.Open(DriverSQLite, "file:"+sc.conf.SqlitePath+"?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(sc.conf.MaxOpenConns)
+	if sc.conf.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(sc.conf.MaxIdleConns)
+	}
+
+	sc.db = db
+	return sc.db, nil
+}
+
+func (sc *SqliteConnector) Ping() error {
+	db, err := sc.Conn()
+	if err != nil {
+		return err
+	}
+	return db.Ping()
+}
+
+func (sc *SqliteConnector) Close() error {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if sc.db == nil {
+		return nil
+	}
+	err := sc.db.Close()
+	sc.db = nil
+	return err
+}
+
+func (sc *SqliteConnector) WithTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(parent, sc.timeout)
+}
+
+func (sc *SqliteConnector) Dialect() Dialect {
+	return DialectSQLite
+}
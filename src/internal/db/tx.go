@@ -0,0 +1,52 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Querier is what *sql.DB and *sql.Tx have in common,
+// so the same code runs either on the shared pool or inside a transaction.
+type Querier interface {
+	Prepare(query string) (*sql.Stmt, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+var (
+	_ Querier = (*sql.DB)(nil)
+	_ Querier = (*sql.Tx)(nil)
+)
+
+// WithTx runs fn in a transaction on the shared pool of connector.
+// The transaction is committed if fn returns nil, or rolled back if fn returns an error or panics.
+// fn MUST NOT commit or roll back tx by itself.
+func WithTx(ctx context.Context, connector Connector, fn func(tx *sql.Tx) error) (err error) {
+	db, err := connector.Conn()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -150,23 +150,23 @@ func DualLogger(conf LoggerConfig, wg *sync.WaitGroup, exFn *func()) *dualLogger
 }
 
 func (dl *dualLogger) Debug(v ...interface{}) {
-	dl._debug(v)
+	dl._debug(v...)
 }
 
 func (dl *dualLogger) Info(v ...interface{}) {
-	dl._info(v)
+	dl._info(v...)
 }
 
 func (dl *dualLogger) Warning(v ...interface{}) {
-	dl._warning(v)
+	dl._warning(v...)
 }
 
 func (dl *dualLogger) Error(v ...interface{}) {
-	dl._error(v)
+	dl._error(v...)
 }
 
 func (dl *dualLogger) Fatal(v ...interface{}) {
-	dl._fatal(v)
+	dl._fatal(v...)
 }
 
 func (dl *dualLogger) Writer(prefix string, suffix string) io.Writer {
@@ -0,0 +1,178 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+)
+
+// Sealed values are strings in the form of
+//     enc:v2:<key id>:<base64 wrapped data key>:<base64 ciphertext>
+// Each value has a random data encryption key (DEK), wrapped by a key of the Keyring.
+// Both the DEK and the value are encrypted with AES-256-GCM, nonce prepended.
+// The value is bound to the associated data given to Seal, e.g., where it is stored, so it can't be moved elsewhere.
+// Rotating only needs to rewrap the DEK.
+//
+// enc:v1: values are not bound to any associated data. They are still opened, but never sealed anymore.
+
+const (
+	sealedPrefix       = `enc:v2:`
+	legacySealedPrefix = `enc:v1:`
+)
+
+// IsSealed tells if value is in the sealed form.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix) || IsLegacy(value)
+}
+
+// IsLegacy tells if value is sealed in the v1 form, not bound to associated data. Seal it again to bind it.
+func IsLegacy(value string) bool {
+	return strings.HasPrefix(value, legacySealedPrefix)
+}
+
+// SealedKeyID returns the ID of the key value is sealed with, or "" if value is not sealed.
+func SealedKeyID(value string) string {
+	_, parts, err := splitSealed(value)
+	if err != nil {
+		return ""
+	}
+	return parts[0]
+}
+
+// splitSealed returns the prefix of value and the parts after it.
+func splitSealed(value string) (prefix string, parts []string, err error) {
+	switch {
+	case strings.HasPrefix(value, sealedPrefix):
+		prefix = sealedPrefix
+	case IsLegacy(value):
+		prefix = legacySealedPrefix
+	default:
+		return "", nil, ErrBadCiphertext
+	}
+	parts = strings.Split(value[len(prefix):], ":")
+	if len(parts) != 3 || parts[0] == "" {
+		return "", nil, ErrBadCiphertext
+	}
+	return prefix, parts, nil
+}
+
+func gcmSeal(key, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func gcmOpen(key, ciphertext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrBadCiphertext
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrBadCiphertext
+	}
+	return plaintext, nil
+}
+
+// Seal encrypts plaintext with a new DEK wrapped by the primary key.
+// additionalData is not stored, but the same must be given to Open.
+func (kr *Keyring) Seal(plaintext string, additionalData []byte) (string, error) {
+	if kr == nil {
+		return "", ErrNoKeyring
+	}
+
+	dek := make([]byte, keySize)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	ciphertext, err := gcmSeal(dek, []byte(plaintext), additionalData)
+	if err != nil {
+		return "", err
+	}
+	return kr.wrap(sealedPrefix, kr.primary, dek, ciphertext)
+}
+
+// wrapped DEK is bound to the key ID, so it can't be passed off as wrapped by another key.
+func (kr *Keyring) wrap(prefix string, id string, dek []byte, ciphertext []byte) (string, error) {
+	wrappedDEK, err := gcmSeal(kr.keys[id], dek, []byte(id))
+	if err != nil {
+		return "", err
+	}
+	return prefix + id + ":" + base64.RawStdEncoding.EncodeToString(wrappedDEK) + ":" + base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (kr *Keyring) unwrap(value string) (prefix string, dek []byte, ciphertext []byte, err error) {
+	if kr == nil {
+		return "", nil, nil, ErrNoKeyring
+	}
+	prefix, parts, err := splitSealed(value)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	kek, ok := kr.keys[parts[0]]
+	if !ok {
+		return "", nil, nil, ErrUnknownKeyID
+	}
+	wrappedDEK, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, ErrBadCiphertext
+	}
+	ciphertext, err = base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, ErrBadCiphertext
+	}
+	dek, err = gcmOpen(kek, wrappedDEK, []byte(parts[0]))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return prefix, dek, ciphertext, nil
+}
+
+// Open decrypts a value returned by Seal, with whichever key in the keyring it was sealed with.
+// additionalData must be the one given to Seal. It is ignored for legacy values.
+func (kr *Keyring) Open(value string, additionalData []byte) (string, error) {
+	prefix, dek, ciphertext, err := kr.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+	if prefix == legacySealedPrefix {
+		additionalData = nil
+	}
+	plaintext, err := gcmOpen(dek, ciphertext, additionalData)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Rewrap wraps the DEK of value with the primary key, leaving the encrypted value as is.
+// Values already under the primary key are returned unchanged.
+func (kr *Keyring) Rewrap(value string) (string, error) {
+	if kr != nil && SealedKeyID(value) == kr.primary {
+		return value, nil
+	}
+	prefix, dek, ciphertext, err := kr.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+	return kr.wrap(prefix, kr.primary, dek, ciphertext)
+}
@@ -0,0 +1,124 @@
+package secret
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	kr, err := LoadKeyring(filepath.Join(t.TempDir(), "secret.key"), "ULYSSES_TEST_NO_SUCH_ENV")
+	if err != nil {
+		t.Fatalf("LoadKeyring() returns error:%s\n", err)
+	}
+
+	ad := []byte("1|password")
+	sealed, err := kr.Seal("r00tp@ss", ad)
+	if err != nil {
+		t.Fatalf("Seal() returns error:%s\n", err)
+	}
+	if !IsSealed(sealed) || SealedKeyID(sealed) != kr.Primary() {
+		t.Errorf("Seal() returns %s, not sealed with primary key %s\n", sealed, kr.Primary())
+	}
+	if again, _ := kr.Seal("r00tp@ss", ad); again == sealed {
+		t.Errorf("Seal() returns the same ciphertext twice\n")
+	}
+
+	opened, err := kr.Open(sealed, ad)
+	if err != nil || opened != "r00tp@ss" {
+		t.Errorf("Open() returns %q, %v\n", opened, err)
+	}
+	// Bound to where it is sealed for
+	for _, otherAD := range [][]byte{nil, []byte("2|password"), []byte("1|token")} {
+		if _, err = kr.Open(sealed, otherAD); err != ErrBadCiphertext {
+			t.Errorf("Open() with associated data %q returns %v, want %v\n", otherAD, err, ErrBadCiphertext)
+		}
+	}
+
+	tampered := []byte(sealed)
+	tampered[len(tampered)-2] ^= 1
+	if _, err = kr.Open(string(tampered), ad); err != ErrBadCiphertext {
+		t.Errorf("Open() tampered returns %v, want %v\n", err, ErrBadCiphertext)
+	}
+
+	other, _ := ParseKeyring("other:" + "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	if _, err = other.Open(sealed, ad); err != ErrUnknownKeyID {
+		t.Errorf("Open() with another keyring returns %v, want %v\n", err, ErrUnknownKeyID)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret.key")
+	kr, _ := LoadKeyring(path, "ULYSSES_TEST_NO_SUCH_ENV")
+	oldID := kr.Primary()
+	sealed, _ := kr.Seal("apikey", nil)
+
+	if err := kr.Rotate(); err != nil {
+		t.Fatalf("Rotate() returns error:%s\n", err)
+	}
+	if kr.Primary() == oldID {
+		t.Fatalf("Rotate() keeps primary key %s\n", oldID)
+	}
+	if opened, err := kr.Open(sealed, nil); err != nil || opened != "apikey" {
+		t.Errorf("Open() after Rotate() returns %q, %v\n", opened, err)
+	}
+
+	rewrapped, err := kr.Rewrap(sealed)
+	if err != nil {
+		t.Fatalf("Rewrap() returns error:%s\n", err)
+	}
+	if SealedKeyID(rewrapped) != kr.Primary() {
+		t.Errorf("Rewrap() returns value sealed with %s, want %s\n", SealedKeyID(rewrapped), kr.Primary())
+	}
+
+	// Text form round trip, e.g., saved back to the key file or set in env
+	os.Setenv("ULYSSES_TEST_SECRET_KEYS", kr.String())
+	defer os.Unsetenv("ULYSSES_TEST_SECRET_KEYS")
+	loaded, err := LoadKeyring(path, "ULYSSES_TEST_SECRET_KEYS")
+	if err != nil {
+		t.Fatalf("LoadKeyring() from env returns error:%s\n", err)
+	}
+	if loaded.Primary() != kr.Primary() {
+		t.Errorf("LoadKeyring() returns primary %s, want %s\n", loaded.Primary(), kr.Primary())
+	}
+	if opened, err := loaded.Open(rewrapped, nil); err != nil || opened != "apikey" {
+		t.Errorf("Open() with loaded keyring returns %q, %v\n", opened, err)
+	}
+	if opened, err := loaded.Open(sealed, nil); err != nil || opened != "apikey" {
+		t.Errorf("Open() old value with loaded keyring returns %q, %v\n", opened, err)
+	}
+}
+
+func TestOpenLegacy(t *testing.T) {
+	kr, _ := LoadKeyring(filepath.Join(t.TempDir(), "secret.key"), "ULYSSES_TEST_NO_SUCH_ENV")
+
+	// Sealed before values were bound to associated data
+	dek := make([]byte, keySize)
+	ciphertext, _ := gcmSeal(dek, []byte("apikey"), nil)
+	legacy, err := kr.wrap(legacySealedPrefix, kr.Primary(), dek, ciphertext)
+	if err != nil {
+		t.Fatalf("wrap() returns error:%s\n", err)
+	}
+	if !IsSealed(legacy) || !IsLegacy(legacy) || SealedKeyID(legacy) != kr.Primary() {
+		t.Errorf("legacy value %s is not told apart\n", legacy)
+	}
+	if opened, err := kr.Open(legacy, []byte("1|api_key")); err != nil || opened != "apikey" {
+		t.Errorf("Open() of a legacy value returns %q, %v\n", opened, err)
+	}
+
+	kr.Rotate()
+	if rewrapped, _ := kr.Rewrap(legacy); !IsLegacy(rewrapped) || SealedKeyID(rewrapped) != kr.Primary() {
+		t.Errorf("Rewrap() of a legacy value returns %s\n", rewrapped)
+	}
+	if sealed, _ := kr.Seal("apikey", nil); IsLegacy(sealed) {
+		t.Errorf("Seal() returns a legacy value %s\n", sealed)
+	}
+}
+
+func TestParseKeyringBad(t *testing.T) {
+	for _, text := range []string{"", "# only comment", "nokey", "a:notbase64!", "a:AAAA", "a:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=,a:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="} {
+		if _, err := ParseKeyring(text); err != ErrBadKeyring {
+			t.Errorf("ParseKeyring(%q) returns %v, want %v\n", text, err, ErrBadKeyring)
+		}
+	}
+}
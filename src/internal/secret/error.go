@@ -0,0 +1,12 @@
+package secret
+
+import (
+	"errors"
+)
+
+var (
+	ErrBadKeyring    = errors.New("internal/secret: malformed keyring")
+	ErrNoKeyring     = errors.New("internal/secret: no keyring to encrypt or decrypt with")
+	ErrUnknownKeyID  = errors.New("internal/secret: sealed with a key not in keyring")
+	ErrBadCiphertext = errors.New("internal/secret: malformed or tampered ciphertext")
+)
@@ -0,0 +1,123 @@
+package secret
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	keySize = 32 // AES-256
+)
+
+// Keyring holds the key encryption keys (KEK) by their IDs.
+// The primary key seals new values. The others are kept to open values sealed before a rotation.
+//
+// The text form has one key per line, as "<id>:<base64 key>", primary first.
+// Lines that are empty or start with # are ignored.
+// In an environment variable, keys may also be separated by commas.
+type Keyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// ParseKeyring reads the text form of a Keyring.
+func ParseKeyring(text string) (*Keyring, error) {
+	kr := &Keyring{keys: map[string][]byte{}}
+
+	text = strings.ReplaceAll(text, ",", "\n")
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.IndexByte(line, ':')
+		if sep <= 0 {
+			return nil, ErrBadKeyring
+		}
+		id := line[:sep]
+		key, err := base64.StdEncoding.DecodeString(line[sep+1:])
+		if err != nil || len(key) != keySize {
+			return nil, ErrBadKeyring
+		}
+		if _, ok := kr.keys[id]; ok {
+			return nil, ErrBadKeyring
+		}
+		kr.keys[id] = key
+		if kr.primary == "" {
+			kr.primary = id
+		}
+	}
+
+	if kr.primary == "" {
+		return nil, ErrBadKeyring
+	}
+	return kr, nil
+}
+
+// String returns the text form of kr, primary first.
+func (kr *Keyring) String() string {
+	lines := []string{kr.primary + ":" + base64.StdEncoding.EncodeToString(kr.keys[kr.primary])}
+	for id, key := range kr.keys {
+		if id != kr.primary {
+			lines = append(lines, id+":"+base64.StdEncoding.EncodeToString(key))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Primary returns the ID of the key sealing new values.
+func (kr *Keyring) Primary() string {
+	return kr.primary
+}
+
+// Rotate adds a newly generated key as the primary, keeping the old ones to open existing values.
+func (kr *Keyring) Rotate() error {
+	key, id, err := generateKey()
+	if err != nil {
+		return err
+	}
+	kr.keys[id] = key
+	kr.primary = id
+	return nil
+}
+
+func generateKey() (key []byte, id string, err error) {
+	key = make([]byte, keySize)
+	if _, err = rand.Read(key); err != nil {
+		return nil, "", err
+	}
+	// IDs only need to be unique within a keyring. The date tells operators which key is older.
+	suffix := make([]byte, 3)
+	if _, err = rand.Read(suffix); err != nil {
+		return nil, "", err
+	}
+	return key, time.Now().UTC().Format("20060102") + "-" + base64.RawURLEncoding.EncodeToString(suffix), nil
+}
+
+// LoadKeyring returns the Keyring from environment variable envName if set,
+// or else from the file at path, which is generated with a new key if it doesn't exist.
+func LoadKeyring(path string, envName string) (*Keyring, error) {
+	if text := os.Getenv(envName); text != "" {
+		return ParseKeyring(text)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, id, err := generateKey()
+		if err != nil {
+			return nil, err
+		}
+		kr := &Keyring{primary: id, keys: map[string][]byte{id: key}}
+		if err = ioutil.WriteFile(path, []byte(kr.String()), 0600); err != nil {
+			return nil, err
+		}
+		return kr, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(content))
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/internal/db"
+	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/TunnelWork/Ulysses/src/server"
+	"github.com/gin-gonic/gin"
+)
+
+// Operations on backend servers taking long, e.g., provisioning hundreds of accounts, are enqueued as jobs in the database
+// instead of run within the HTTP request. Workers of every Ulysses instance claim due jobs on system ticks and run them in
+// their own goroutines, up to sys.job_workers at a time.
+//
+// A job failed with a retriable error (see server.IsRetriable) is queued again with exponential backoff, until max_attempts.
+// Other failures, and the last attempt, leave it dead for an admin to look at and retry.
+// A job is claimed again if its worker doesn't finish it in time, e.g., the instance died.
+
+const (
+	jobTableName = `jobs`
+
+	jobStatusQueued    = `queued`
+	jobStatusRunning   = `running`
+	jobStatusSucceeded = `succeeded`
+	jobStatusDead      = `dead`
+
+	jobDefaultMaxAttempts = 5
+	jobBaseBackoff        = 10 * time.Second
+	jobMaxBackoff         = 1 * time.Hour
+	jobTimeout            = 10 * time.Minute // A running job is canceled after
+	jobLockMargin         = 1 * time.Minute  // and claimed again by another worker after jobTimeout + jobLockMargin
+
+	jobKeyMaxLen = 100 // Stored as uid:key in VARCHAR(128)
+
+	jobListLimitDefault = 100
+	jobListLimitMax     = 1000
+
+	runJobsSignature tickEventSignature = 0x10B5CAFE
+	runJobsPeriod                       = 1 * time.Second
+)
+
+var (
+	ErrJobNotFound    = errors.New("ulysses/job: no such job")
+	ErrJobUnknownKind = errors.New("ulysses/job: unknown job kind")
+	ErrJobKeyConflict = errors.New("ulysses/job: idempotency key is used by another job")
+	ErrJobKeyTooLong  = errors.New("ulysses/job: idempotency key is too long")
+	ErrJobNotDead     = errors.New("ulysses/job: only dead jobs can be retried")
+	ErrJobAbandoned   = errors.New("ulysses/job: worker didn't finish the job in time")
+
+	jobRunningMutex sync.Mutex
+	jobRunning      int // Jobs running on this instance
+	lastRunJobs     time.Time
+)
+
+// Job is an operation enqueued to run in background.
+// Payload is the input for its kind, and Result is set by the job as it runs, even if it fails.
+type Job struct {
+	ID             uint            `json:"id"`
+	Kind           string          `json:"kind"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	Uid            uint            `json:"uid"` // who enqueued the job
+	Payload        json.RawMessage `json:"payload"`
+	Result         json.RawMessage `json:"result,omitempty"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	MaxAttempts    int             `json:"max_attempts"`
+	LastError      string          `json:"last_error,omitempty"`
+	RunAfter       int64           `json:"run_after"`
+	LockedUntil    int64           `json:"-"`
+	CreationTime   int64           `json:"creation_time"`
+	LastUpdate     int64           `json:"last_update"`
+
+	queue *JobQueue // running it, set by run()
+}
+
+// jobHandler runs a job of a kind. It may set job.Result, and narrow job.Payload to what is left to do on a retry.
+// A handler not safe to run twice should save() its progress before each step, as the worker may die at any time.
+type jobHandler func(ctx context.Context, job *Job) error
+
+// JobQueue is capable of performing database CRUD operations to
+// - Jobs
+type JobQueue struct {
+	dbConnector db.Connector
+}
+
+// NewJobQueue shares the connection pool of dbConnector
+func NewJobQueue(dbConnector db.Connector) *JobQueue {
+	return &JobQueue{
+		dbConnector: dbConnector,
+	}
+}
+
+const jobColumns = `id, kind, idempotency_key, uid, payload, result, status, attempts, max_attempts, last_error, run_after, locked_until, creation_time, last_update`
+
+func scanJob(scanner interface{ Scan(...interface{}) error }) (Job, error) {
+	var job Job
+	var key sql.NullString
+	var payload, result string
+	if err := scanner.Scan(&job.ID, &job.Kind, &key, &job.Uid, &payload, &result, &job.Status, &job.Attempts, &job.MaxAttempts, &job.LastError, &job.RunAfter, &job.LockedUntil, &job.CreationTime, &job.LastUpdate); err != nil {
+		return job, err
+	}
+	if key.Valid {
+		job.IdempotencyKey = key.String[strings.Index(key.String, ":")+1:] // Stored as uid:key
+	}
+	job.Payload = json.RawMessage(payload)
+	if result != "" {
+		job.Result = json.RawMessage(result)
+	}
+	return job, nil
+}
+
+// Enqueue() adds a job of kind with payload, to run as soon as a worker is free.
+//
+// If key is not empty, it is the idempotency key of the job among those enqueued by uid: enqueuing again with the same key
+// returns the existing job with existed set, instead of adding a new one. ErrJobKeyConflict is returned if the existing one
+// is of another kind. ErrJobKeyTooLong is returned if key is longer than jobKeyMaxLen bytes.
+func (jq *JobQueue) Enqueue(kind string, key string, uid uint, payload interface{}) (job Job, existed bool, err error) {
+	if _, ok := jobHandlers[kind]; !ok {
+		return Job{}, false, ErrJobUnknownKind
+	}
+	if len(key) > jobKeyMaxLen {
+		return Job{}, false, ErrJobKeyTooLong
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, false, err
+	}
+
+	dbConn, err := jq.dbConnector.Conn()
+	if err != nil {
+		return Job{}, false, err
+	}
+
+	ctx, cancel := jq.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	var storedKey sql.NullString
+	if key != "" {
+		storedKey = sql.NullString{String: strconv.FormatUint(uint64(uid), 10) + ":" + key, Valid: true}
+		if job, err = jq.lookupByKey(ctx, dbConn, storedKey.String); err == nil {
+			return job, true, sameJobKind(job, kind)
+		} else if err != ErrJobNotFound {
+			return Job{}, false, err
+		}
+	}
+
+	stmtInsertJob, err := dbConn.PrepareContext(ctx, `INSERT INTO `+masterConfig.DB.TblPrefix+jobTableName+` (kind, idempotency_key, uid, payload, result, status, attempts, max_attempts, last_error, run_after, locked_until, creation_time, last_update) VALUES( ?, ?, ?, ?, '', ?, 0, ?, '', ?, 0, ?, ? )`)
+	if err != nil {
+		return Job{}, false, err
+	}
+	defer stmtInsertJob.Close()
+
+	now := time.Now().Unix()
+	result, err := stmtInsertJob.ExecContext(ctx, kind, storedKey, uid, string(payloadBytes), jobStatusQueued, jobDefaultMaxAttempts, now, now, now)
+	if err != nil {
+		// Lost a race to enqueue with the same key
+		if storedKey.Valid {
+			if job, lookupErr := jq.lookupByKey(ctx, dbConn, storedKey.String); lookupErr == nil {
+				return job, true, sameJobKind(job, kind)
+			}
+		}
+		return Job{}, false, err
+	}
+	idint64, err := result.LastInsertId()
+	if err != nil {
+		return Job{}, false, err
+	}
+
+	logger.Info("*JobQueue.Enqueue(): enqueued job ", idint64, " of kind ", kind, " for uid ", uid)
+	job, err = jq.Lookup(uint(idint64))
+	return job, false, err
+}
+
+// sameJobKind tells if a job found by idempotency key is the one enqueued of kind.
+// Payloads are not compared, as a job may narrow its payload as it runs.
+func sameJobKind(job Job, kind string) error {
+	if job.Kind != kind {
+		return ErrJobKeyConflict
+	}
+	return nil
+}
+
+func (jq *JobQueue) lookupByKey(ctx context.Context, dbConn db.Querier, storedKey string) (Job, error) {
+	stmtLookupJob, err := dbConn.PrepareContext(ctx, `SELECT `+jobColumns+` FROM `+masterConfig.DB.TblPrefix+jobTableName+` WHERE idempotency_key = ?`)
+	if err != nil {
+		return Job{}, err
+	}
+	defer stmtLookupJob.Close()
+
+	job, err := scanJob(stmtLookupJob.QueryRowContext(ctx, storedKey))
+	if err == sql.ErrNoRows {
+		return Job{}, ErrJobNotFound
+	}
+	return job, err
+}
+
+// Lookup() returns the job id
+func (jq *JobQueue) Lookup(id uint) (Job, error) {
+	dbConn, err := jq.dbConnector.Conn()
+	if err != nil {
+		return Job{}, err
+	}
+
+	ctx, cancel := jq.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtLookupJob, err := dbConn.PrepareContext(ctx, `SELECT `+jobColumns+` FROM `+masterConfig.DB.TblPrefix+jobTableName+` WHERE id = ?`)
+	if err != nil {
+		return Job{}, err
+	}
+	defer stmtLookupJob.Close()
+
+	job, err := scanJob(stmtLookupJob.QueryRowContext(ctx, id))
+	if err == sql.ErrNoRows {
+		return Job{}, ErrJobNotFound
+	}
+	return job, err
+}
+
+// List() returns up to limit latest jobs with status, or of any status if it is empty.
+func (jq *JobQueue) List(status string, limit int) ([]Job, error) {
+	if limit <= 0 {
+		limit = jobListLimitDefault
+	} else if limit > jobListLimitMax {
+		limit = jobListLimitMax
+	}
+
+	dbConn, err := jq.dbConnector.Conn()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + jobColumns + ` FROM ` + masterConfig.DB.TblPrefix + jobTableName
+	args := []interface{}{}
+	if status != "" {
+		query += ` WHERE status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	ctx, cancel := jq.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	rows, err := dbConn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Retry() queues a dead job again with all its attempts.
+func (jq *JobQueue) Retry(id uint) error {
+	dbConn, err := jq.dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := jq.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtRetryJob, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+jobTableName+` SET status = ?, attempts = 0, run_after = ?, last_update = ? WHERE id = ? AND status = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtRetryJob.Close()
+
+	now := time.Now().Unix()
+	result, err := stmtRetryJob.ExecContext(ctx, jobStatusQueued, now, now, id, jobStatusDead)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		if _, err = jq.Lookup(id); err != nil {
+			return err
+		}
+		return ErrJobNotDead
+	}
+
+	logger.Info("*JobQueue.Retry(): queued dead job ", id, " again")
+	return nil
+}
+
+// claim() marks up to n due jobs running on this worker, and returns them.
+// A job is claimed only if no other worker claimed it in between.
+func (jq *JobQueue) claim(n int) ([]Job, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	dbConn, err := jq.dbConnector.Conn()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	const due = `((status = ? AND run_after <= ?) OR (status = ? AND locked_until < ?))`
+
+	ctx, cancel := jq.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	rows, err := dbConn.QueryContext(ctx, `SELECT id FROM `+masterConfig.DB.TblPrefix+jobTableName+` WHERE `+due+` ORDER BY run_after, id LIMIT ?`, jobStatusQueued, now, jobStatusRunning, now, n)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint{}
+	for rows.Next() {
+		var id uint
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stmtClaimJob, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+jobTableName+` SET status = ?, attempts = attempts + 1, locked_until = ?, last_update = ? WHERE id = ? AND `+due)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtClaimJob.Close()
+
+	lockedUntil := time.Now().Add(jobTimeout + jobLockMargin).Unix()
+	jobs := []Job{}
+	for _, id := range ids {
+		result, err := stmtClaimJob.ExecContext(ctx, jobStatusRunning, lockedUntil, now, id, jobStatusQueued, now, jobStatusRunning, now)
+		if err != nil {
+			return jobs, err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			continue // Claimed by another worker
+		}
+		job, err := jq.Lookup(id)
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// jobBackoff returns how long to wait before the next attempt after attempts failed.
+func jobBackoff(attempts int) time.Duration {
+	backoff := jobBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= jobMaxBackoff {
+			return jobMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// finish() records the outcome of a run of job claimed by this worker.
+func (jq *JobQueue) finish(job Job, runErr error) error {
+	now := time.Now()
+	status, runAfter, attempts, lastError := jobStatusSucceeded, job.RunAfter, job.Attempts, ""
+	switch {
+	case runErr == nil:
+	case globalShutdownCtx.Err() != nil && errors.Is(runErr, context.Canceled):
+		// Interrupted by shutdown, not its fault
+		status, runAfter, attempts, lastError = jobStatusQueued, now.Unix(), job.Attempts-1, job.LastError
+	case server.IsRetriable(runErr) && job.Attempts < job.MaxAttempts:
+		status, runAfter, lastError = jobStatusQueued, now.Add(jobBackoff(job.Attempts)).Unix(), runErr.Error()
+	default:
+		status, lastError = jobStatusDead, runErr.Error()
+	}
+
+	dbConn, err := jq.dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := jq.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtFinishJob, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+jobTableName+` SET status = ?, attempts = ?, payload = ?, result = ?, last_error = ?, run_after = ?, locked_until = 0, last_update = ? WHERE id = ? AND status = ? AND attempts = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtFinishJob.Close()
+
+	result, err := stmtFinishJob.ExecContext(ctx, status, attempts, string(job.Payload), string(job.Result), lastError, runAfter, now.Unix(), job.ID, jobStatusRunning, job.Attempts)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		logger.Warning("*JobQueue.finish(): job ", job.ID, " is claimed by another worker after running too long, result discarded")
+		return nil
+	}
+
+	switch status {
+	case jobStatusSucceeded:
+		logger.Info("*JobQueue.finish(): job ", job.ID, " succeeded after ", job.Attempts, " attempts")
+	case jobStatusQueued:
+		logger.Warning("*JobQueue.finish(): job ", job.ID, " failed attempt ", job.Attempts, ", retry after ", time.Unix(runAfter, 0), ". error: ", runErr)
+	case jobStatusDead:
+		logger.Error("*JobQueue.finish(): job ", job.ID, " is dead after ", job.Attempts, " attempts. error: ", runErr)
+	}
+	return nil
+}
+
+// save() records Payload and Result of a job running on this worker, so another worker claiming it
+// after this one died goes on from there. ErrJobAbandoned is returned if it is claimed by another worker already.
+func (job *Job) save() error {
+	if job.queue == nil {
+		return nil
+	}
+
+	dbConn, err := job.queue.dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := job.queue.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtSaveJob, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+jobTableName+` SET payload = ?, result = ?, last_update = ? WHERE id = ? AND status = ? AND attempts = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtSaveJob.Close()
+
+	result, err := stmtSaveJob.ExecContext(ctx, string(job.Payload), string(job.Result), time.Now().Unix(), job.ID, jobStatusRunning, job.Attempts)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrJobAbandoned
+	}
+	return nil
+}
+
+// run() runs a job claimed by this worker, and records the outcome.
+func (jq *JobQueue) run(job Job) {
+	job.queue = jq
+	var err error
+	if handler, ok := jobHandlers[job.Kind]; !ok {
+		err = ErrJobUnknownKind
+	} else if job.Attempts > job.MaxAttempts {
+		err = ErrJobAbandoned // Claimed again after each worker lost it
+	} else {
+		ctx, cancel := context.WithTimeout(globalShutdownCtx, jobTimeout)
+		err = handler(ctx, &job)
+		cancel()
+	}
+
+	if finishErr := jq.finish(job, err); finishErr != nil {
+		logger.Error("*JobQueue.run(): can't record outcome of job ", job.ID, ". error: ", finishErr)
+	}
+}
+
+// runJobs claims due jobs for free workers of this instance and runs each in a goroutine, as a tick event.
+func runJobs() {
+	if time.Since(lastRunJobs) < runJobsPeriod || globalShutdownCtx.Err() != nil {
+		return
+	}
+	lastRunJobs = time.Now()
+
+	jobRunningMutex.Lock()
+	free := int(masterConfig.Sys.JobWorkers) - jobRunning
+	jobRunningMutex.Unlock()
+
+	jq := NewJobQueue(dbConnector)
+	jobs, err := jq.claim(free)
+	if err != nil {
+		logger.Error("runJobs(): can't claim jobs. error: ", err)
+	}
+
+	for _, job := range jobs {
+		jobRunningMutex.Lock()
+		jobRunning++
+		jobRunningMutex.Unlock()
+		globalWaitGroup.Add(1)
+
+		go func(job Job) {
+			defer globalWaitGroup.Done()
+			defer func() {
+				jobRunningMutex.Lock()
+				jobRunning--
+				jobRunningMutex.Unlock()
+			}()
+			jq.run(job)
+		}(job)
+	}
+}
+
+func initJobQueue() {
+	if masterConfig.Sys.JobWorkers == 0 {
+		logger.Info("initJobQueue(): sys.job_workers is 0, jobs are only enqueued by this instance.")
+		return
+	}
+	registerTickEvent(runJobsSignature, runJobs)
+}
+
+// _adminHandlerJob returns the job of query id, for polling its status.
+func _adminHandlerJob(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Query("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "bad id",
+		})
+		return
+	}
+
+	job, err := NewJobQueue(dbConnector).Lookup(uint(id))
+	if err == ErrJobNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	} else if err != nil {
+		logger.Error("_adminHandlerJob(): can't look up job. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"job":    job,
+	})
+}
+
+// _adminHandlerJobList returns latest jobs, filtered by query status if set, e.g., dead for the dead letters.
+func _adminHandlerJobList(c *gin.Context) {
+	status := c.Query("status")
+	switch status {
+	case "", jobStatusQueued, jobStatusRunning, jobStatusSucceeded, jobStatusDead:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "bad status",
+		})
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+
+	jobs, err := NewJobQueue(dbConnector).List(status, limit)
+	if err != nil {
+		logger.Error("_adminHandlerJobList(): can't list jobs. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"jobs":   jobs,
+	})
+}
+
+// _adminHandlerJobRetry queues the dead job of form id again.
+func _adminHandlerJobRetry(c *gin.Context) {
+	id, err := strconv.ParseUint(c.PostForm("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "bad id",
+		})
+		return
+	}
+
+	if err = NewJobQueue(dbConnector).Retry(uint(id)); err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case ErrJobNotFound:
+			status = http.StatusNotFound
+		case ErrJobNotDead:
+			status = http.StatusConflict
+		default:
+			logger.Error("_adminHandlerJobRetry(): can't retry job ", id, ". error: ", err)
+		}
+		c.JSON(status, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
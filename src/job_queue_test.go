@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/server"
+)
+
+// busyServer fails each account with "busy" set once with a retriable error, as a backend under load,
+// and takes long for each with "slow" set.
+type busyServer struct {
+	nextID int
+	busy   map[string]bool // "busy" values already refused once
+}
+
+func (s *busyServer) UpdateServer(sconf server.Configurables) error { return nil }
+
+func (s *busyServer) AddAccount(aconf []server.Configurables) ([]int, error) {
+	accID := []int{}
+	for _, conf := range aconf {
+		if slow, _ := conf.GetString("slow"); slow != "" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if key, _ := conf.GetString("busy"); key != "" && !s.busy[key] {
+			s.busy[key] = true
+			return accID, server.RetriableError(errors.New("backend busy"))
+		}
+		s.nextID++
+		accID = append(accID, s.nextID)
+	}
+	return accID, nil
+}
+
+func (s *busyServer) UpdateAccount(accID []int, aconf []server.Configurables) ([]int, error) {
+	return accID, nil
+}
+func (s *busyServer) DeleteAccount(accID []int) ([]int, error) { return accID, nil }
+func (s *busyServer) GetCredentials(accID []int) ([]server.Credential, error) {
+	return nil, nil
+}
+func (s *busyServer) GetUsage(accID []int) ([]server.AccountUsage, error) { return nil, nil }
+
+type busyRegistrar struct {
+	server *busyServer
+}
+
+func (r busyRegistrar) NewServer(sconf server.Configurables) (server.Server, error) {
+	return r.server, nil
+}
+
+// useTestConnector sets dbConnector for the duration of the test, as workers use the global one.
+func useTestConnector(t *testing.T) {
+	prev := dbConnector
+	dbConnector = newTestConnector(t)
+	t.Cleanup(func() { dbConnector = prev })
+}
+
+// makeJobDue moves run_after of job id to now, skipping its backoff.
+func makeJobDue(t *testing.T, id uint) {
+	dbConn, _ := dbConnector.Conn()
+	if _, err := dbConn.Exec(`UPDATE `+masterConfig.DB.TblPrefix+jobTableName+` SET run_after = 0 WHERE id = ?`, id); err != nil {
+		t.Fatalf("can't make job due. error:%s\n", err)
+	}
+}
+
+func TestJobQueueProvision(t *testing.T) {
+	useTestConnector(t)
+	server.AddServerRegistrar("busy", busyRegistrar{server: &busyServer{busy: map[string]bool{}}})
+	serverID, err := NewServerManager(dbConnector).Add("busy", server.Configurables{})
+	if err != nil {
+		t.Fatalf("Add() returns error:%s\n", err)
+	}
+
+	jq := NewJobQueue(dbConnector)
+	payload := provisionJobPayload{Uid: 7, ServerID: serverID, Aconf: []server.Configurables{{}, {"busy": "a"}, {}}}
+	job, existed, err := jq.Enqueue(jobKindProvision, "order-1", 1, payload)
+	if err != nil || existed {
+		t.Fatalf("Enqueue() returns %v, %v\n", existed, err)
+	}
+
+	// Idempotency keys are per uid
+	if again, existed, err := jq.Enqueue(jobKindProvision, "order-1", 1, payload); err != nil || !existed || again.ID != job.ID {
+		t.Errorf("Enqueue() with same key returns job %d, %v, %v, want %d existed\n", again.ID, existed, err, job.ID)
+	}
+	if _, _, err := jq.Enqueue(jobKindDeleteAccount, "order-1", 1, accountJobPayload{ID: 1}); err != ErrJobKeyConflict {
+		t.Errorf("Enqueue() of another kind with same key returns %v, want %v\n", err, ErrJobKeyConflict)
+	}
+	if other, existed, err := jq.Enqueue(jobKindProvision, "order-1", 2, payload); err != nil || existed || other.ID == job.ID {
+		t.Errorf("Enqueue() with same key by another uid returns job %d, %v, %v\n", other.ID, existed, err)
+	}
+	if _, _, err := jq.Enqueue("no_such_kind", "", 1, payload); err != ErrJobUnknownKind {
+		t.Errorf("Enqueue() of unknown kind returns %v, want %v\n", err, ErrJobUnknownKind)
+	}
+
+	jobs, err := jq.claim(1)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != job.ID || jobs[0].Status != jobStatusRunning || jobs[0].Attempts != 1 {
+		t.Fatalf("claim() returns %+v, %v\n", jobs, err)
+	}
+	if again, _ := jq.claim(1); len(again) != 1 || again[0].ID == job.ID {
+		t.Errorf("claim() returns a running job again: %+v\n", again)
+	}
+
+	// The busy account is retried, the others are not created again
+	jq.run(jobs[0])
+	job, _ = jq.Lookup(job.ID)
+	if job.Status != jobStatusQueued || job.RunAfter <= time.Now().Unix() || job.LastError == "" {
+		t.Fatalf("job after a retriable failure is %+v\n", job)
+	}
+	var remaining provisionJobPayload
+	json.Unmarshal(job.Payload, &remaining)
+	if len(remaining.Aconf) != 1 || remaining.index(0) != 1 {
+		t.Errorf("payload after a retriable failure is %s, want the busy account only\n", job.Payload)
+	}
+	if jobs, _ = jq.claim(4); len(jobs) != 0 {
+		t.Errorf("claim() returns %+v before backoff passed\n", jobs)
+	}
+
+	makeJobDue(t, job.ID)
+	jobs, _ = jq.claim(4)
+	if len(jobs) != 1 {
+		t.Fatalf("claim() returns %+v after backoff passed\n", jobs)
+	}
+	jq.run(jobs[0])
+	job, _ = jq.Lookup(job.ID)
+	var result provisionJobResult
+	json.Unmarshal(job.Result, &result)
+	if job.Status != jobStatusSucceeded || job.Attempts != 2 || len(result.IDs) != 3 || len(result.Failed) != 0 {
+		t.Errorf("job after retry is %+v with result %s\n", job, job.Result)
+	}
+	if accounts, _ := NewAccountManager(dbConnector).ListByUser(7); len(accounts) != 3 {
+		t.Errorf("ListByUser() returns %d accounts, want 3\n", len(accounts))
+	}
+}
+
+func TestJobQueueProvisionUnknown(t *testing.T) {
+	useTestConnector(t)
+	server.AddServerRegistrar("busy", busyRegistrar{server: &busyServer{busy: map[string]bool{}}})
+	serverID, _ := NewServerManager(dbConnector).Add("busy", server.Configurables{})
+	jq := NewJobQueue(dbConnector)
+
+	// The worker dies while the first account is passed to the backend
+	job, _, _ := jq.Enqueue(jobKindProvision, "", 1, provisionJobPayload{Uid: 8, ServerID: serverID, Aconf: []server.Configurables{{}, {}, {}}})
+	jobs, _ := jq.claim(1)
+	jobs[0].queue = jq
+	jobs[0].Payload, _ = json.Marshal(provisionJobPayload{Uid: 8, ServerID: serverID, Aconf: []server.Configurables{{}, {}}, Indexes: []int{1, 2}, InFlight: []int{0}})
+	if err := jobs[0].save(); err != nil {
+		t.Fatalf("save() returns error:%s\n", err)
+	}
+	dbConn, _ := dbConnector.Conn()
+	dbConn.Exec(`UPDATE `+masterConfig.DB.TblPrefix+jobTableName+` SET locked_until = 0 WHERE id = ?`, job.ID)
+	stale := jobs[0]
+
+	// Claimed again by another worker: the account in flight is not created again
+	jobs, _ = jq.claim(1)
+	if len(jobs) != 1 {
+		t.Fatalf("claim() returns %+v for a job of a dead worker\n", jobs)
+	}
+	if err := stale.save(); err != ErrJobAbandoned {
+		t.Errorf("save() by the dead worker returns %v, want %v\n", err, ErrJobAbandoned)
+	}
+	jq.run(jobs[0])
+	job, _ = jq.Lookup(job.ID)
+	var result provisionJobResult
+	json.Unmarshal(job.Result, &result)
+	if job.Status != jobStatusDead || len(result.IDs) != 2 || len(result.Unknown) != 1 || result.Unknown[0].Index != 0 {
+		t.Errorf("job claimed again is %+v with result %s\n", job, job.Result)
+	}
+	if accounts, _ := NewAccountManager(dbConnector).ListByUser(8); len(accounts) != 2 {
+		t.Errorf("ListByUser() returns %d accounts, want 2\n", len(accounts))
+	}
+
+	// The call of the second account is abandoned on timeout, the third is not tried
+	job, _, _ = jq.Enqueue(jobKindProvision, "", 1, provisionJobPayload{Uid: 9, ServerID: serverID, Aconf: []server.Configurables{{}, {"slow": "1"}, {}}})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := runProvisionJob(ctx, &job)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("runProvisionJob() returns %v, want %v\n", err, context.DeadlineExceeded)
+	}
+	var remaining provisionJobPayload
+	json.Unmarshal(job.Payload, &remaining)
+	result = provisionJobResult{}
+	json.Unmarshal(job.Result, &result)
+	if len(remaining.Aconf) != 1 || remaining.index(0) != 2 || len(remaining.InFlight) != 0 {
+		t.Errorf("payload after timeout is %s, want the third account only\n", job.Payload)
+	}
+	if len(result.IDs) != 1 || len(result.Unknown) != 1 || result.Unknown[0].Index != 1 {
+		t.Errorf("result after timeout is %s\n", job.Result)
+	}
+}
+
+func TestJobQueueDeadLetter(t *testing.T) {
+	useTestConnector(t)
+	jq := NewJobQueue(dbConnector)
+
+	job, _, err := jq.Enqueue(jobKindDeleteAccount, "", 1, accountJobPayload{ID: 404})
+	if err != nil {
+		t.Fatalf("Enqueue() returns error:%s\n", err)
+	}
+	jobs, _ := jq.claim(1)
+	if len(jobs) != 1 {
+		t.Fatalf("claim() returns %+v\n", jobs)
+	}
+	jq.run(jobs[0])
+
+	// Not retriable, so dead at once
+	if job, _ = jq.Lookup(job.ID); job.Status != jobStatusDead || job.LastError != ErrAccountNotFound.Error() {
+		t.Errorf("job after failure is %+v\n", job)
+	}
+	if dead, err := jq.List(jobStatusDead, 0); err != nil || len(dead) != 1 || dead[0].ID != job.ID {
+		t.Errorf("List(dead) returns %+v, %v\n", dead, err)
+	}
+
+	if err = jq.Retry(job.ID); err != nil {
+		t.Fatalf("Retry() returns error:%s\n", err)
+	}
+	if job, _ = jq.Lookup(job.ID); job.Status != jobStatusQueued || job.Attempts != 0 {
+		t.Errorf("job after Retry() is %+v\n", job)
+	}
+	if err = jq.Retry(job.ID); err != ErrJobNotDead {
+		t.Errorf("Retry() of queued job returns %v, want %v\n", err, ErrJobNotDead)
+	}
+	if err = jq.Retry(12345); err != ErrJobNotFound {
+		t.Errorf("Retry() of no such job returns %v, want %v\n", err, ErrJobNotFound)
+	}
+}
+
+func TestJobBackoff(t *testing.T) {
+	if backoff := jobBackoff(1); backoff != jobBaseBackoff {
+		t.Errorf("jobBackoff(1) returns %s, want %s\n", backoff, jobBaseBackoff)
+	}
+	if backoff := jobBackoff(3); backoff != 4*jobBaseBackoff {
+		t.Errorf("jobBackoff(3) returns %s, want %s\n", backoff, 4*jobBaseBackoff)
+	}
+	if backoff := jobBackoff(100); backoff != jobMaxBackoff {
+		t.Errorf("jobBackoff(100) returns %s, want %s\n", backoff, jobMaxBackoff)
+	}
+}
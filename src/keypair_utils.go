@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/internal/auth"
+	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	requestSignatureHeader = `X-Ulysses-Signature` // base64 ASN.1 ECDSA signature
+	requestTimestampHeader = `X-Ulysses-Timestamp` // unix seconds
+	requestNonceHeader     = `X-Ulysses-Nonce`     // unique per request of a user, at most requestNonceMaxLen
+
+	responseSignatureHeader = `X-Ulysses-Server-Signature` // base64 ASN.1 ECDSA signature by the server key
+	responseTimestampHeader = `X-Ulysses-Server-Timestamp` // unix seconds
+
+	requestSignatureMaxSkew int64 = 300 // seconds
+	requestNonceMaxLen            = 64
+
+	requestNonceTableName = `request_nonces`
+
+	purgeRequestNoncesSignature tickEventSignature = 0x40ACE5ED
+	purgeRequestNoncesPeriod                       = 10 * time.Minute
+)
+
+var (
+	ErrWrongPassword = errors.New("ulysses/auth: wrong password")
+
+	serverKey       *ecdsa.PrivateKey
+	serverPubKeyPEM string
+
+	lastRequestNoncesPurge time.Time
+)
+
+// newUserKeypair generates the keypair for a new user.
+// The private key is wrapped with passhash and the server never stores it in plain.
+func newUserKeypair(passhash string) (pubKeyPEM string, wrappedPrivKey string, err error) {
+	priv, err := auth.GenerateKeyPair()
+	if err != nil {
+		return "", "", err
+	}
+	pubKeyPEM, err = auth.MarshalPublicKeyPEM(&priv.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	wrappedPrivKey, err = auth.WrapPrivateKey(priv, passhash)
+	if err != nil {
+		return "", "", err
+	}
+	return pubKeyPEM, wrappedPrivKey, nil
+}
+
+// ensureUserKeypair returns the wrapped private key of uid.
+// Users created before keypairs were introduced get one generated here on their next login.
+func ensureUserKeypair(uid uint, passhash string) (string, error) {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtLookupKey, err := db.PrepareContext(ctx, `SELECT privkey FROM `+masterConfig.DB.TblPrefix+userAuthTableName+` WHERE uid = ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmtLookupKey.Close()
+
+	var wrappedPrivKey sql.NullString
+	if err = stmtLookupKey.QueryRowContext(ctx, uid).Scan(&wrappedPrivKey); err != nil {
+		return "", err
+	}
+	if wrappedPrivKey.Valid && wrappedPrivKey.String != "" {
+		return wrappedPrivKey.String, nil
+	}
+
+	pubKeyPEM, privKey, err := newUserKeypair(passhash)
+	if err != nil {
+		return "", err
+	}
+
+	stmtSaveKey, err := db.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userAuthTableName+` SET pubkey = ?, privkey = ? WHERE uid = ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmtSaveKey.Close()
+
+	if _, err = stmtSaveKey.ExecContext(ctx, pubKeyPEM, privKey, uid); err != nil {
+		return "", err
+	}
+
+	logger.Info("ensureUserKeypair(): generated keypair for uid ", uid)
+	return privKey, nil
+}
+
+// userPublicKey returns the public key of uid, or nil if the user has none yet.
+func userPublicKey(uid uint) (*ecdsa.PublicKey, error) {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtLookupKey, err := db.PrepareContext(ctx, `SELECT pubkey FROM `+masterConfig.DB.TblPrefix+userAuthTableName+` WHERE uid = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtLookupKey.Close()
+
+	var pubKeyPEM sql.NullString
+	if err = stmtLookupKey.QueryRowContext(ctx, uid).Scan(&pubKeyPEM); err != nil {
+		return nil, err
+	}
+	if !pubKeyPEM.Valid || pubKeyPEM.String == "" {
+		return nil, nil
+	}
+	return auth.ParsePublicKeyPEM(pubKeyPEM.String)
+}
+
+// changeUserPassword replaces the password of uid and rewraps the private key for the new passhash.
+func changeUserPassword(uid uint, oldPasshash string, newPasshash string) error {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtLookupUser, err := db.PrepareContext(ctx, `SELECT password, privkey FROM `+masterConfig.DB.TblPrefix+userAuthTableName+` WHERE uid = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtLookupUser.Close()
+
+	var passOnRecord string
+	var wrappedPrivKey sql.NullString
+	if err = stmtLookupUser.QueryRowContext(ctx, uid).Scan(&passOnRecord, &wrappedPrivKey); err != nil {
+		return err
+	}
+	if ok, _ := auth.VerifyPassword(oldPasshash, passOnRecord); !ok {
+		return ErrWrongPassword
+	}
+
+	newHash, err := auth.HashPassword(newPasshash)
+	if err != nil {
+		return err
+	}
+
+	var newPrivKey string
+	var newPubKey string
+	if wrappedPrivKey.Valid && wrappedPrivKey.String != "" {
+		newPrivKey, err = auth.RewrapPrivateKey(wrappedPrivKey.String, oldPasshash, newPasshash)
+		if err != nil {
+			return err
+		}
+	} else {
+		newPubKey, newPrivKey, err = newUserKeypair(newPasshash)
+		if err != nil {
+			return err
+		}
+	}
+
+	var stmtUpdateUser *sql.Stmt
+	if newPubKey == "" {
+		stmtUpdateUser, err = db.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userAuthTableName+` SET password = ?, privkey = ? WHERE uid = ?`)
+	} else {
+		stmtUpdateUser, err = db.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userAuthTableName+` SET password = ?, privkey = ?, pubkey = ? WHERE uid = ?`)
+	}
+	if err != nil {
+		return err
+	}
+	defer stmtUpdateUser.Close()
+
+	if newPubKey == "" {
+		_, err = stmtUpdateUser.ExecContext(ctx, newHash, newPrivKey, uid)
+	} else {
+		_, err = stmtUpdateUser.ExecContext(ctx, newHash, newPrivKey, newPubKey, uid)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info("changeUserPassword(): changed password for uid ", uid)
+	return nil
+}
+
+// requestSigningString is what a client signs with its private key:
+// METHOD \n PATH?QUERY \n TIMESTAMP \n NONCE \n hex(SHA-256(body))
+func requestSigningString(c *gin.Context, timestamp string, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(c.Request.Method + "\n" + c.Request.URL.RequestURI() + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:]))
+}
+
+// verifyRequestSignature checks the request signature headers against the public key of uid.
+// A signed request is accepted only once: its nonce is remembered until the timestamp is too old anyway.
+func verifyRequestSignature(c *gin.Context, uid uint) bool {
+	timestamp := c.GetHeader(requestTimestampHeader)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Now().Unix() - ts; skew > requestSignatureMaxSkew || skew < -requestSignatureMaxSkew {
+		return false
+	}
+
+	nonce := c.GetHeader(requestNonceHeader)
+	if nonce == "" || len(nonce) > requestNonceMaxLen {
+		return false
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(c.GetHeader(requestSignatureHeader))
+	if err != nil {
+		return false
+	}
+
+	pubKey, err := userPublicKey(uid)
+	if err != nil || pubKey == nil {
+		return false
+	}
+
+	// Read the body for hashing and put it back for the handler.
+	var body []byte
+	if c.Request.Body != nil {
+		body, err = ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			return false
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	if !auth.VerifySignature(pubKey, requestSigningString(c, timestamp, nonce, body), signature) {
+		return false
+	}
+
+	// Only a valid signature may use up a nonce, or anyone could burn the nonces of others.
+	fresh, err := useRequestNonce(uid, nonce, ts+requestSignatureMaxSkew)
+	if err != nil {
+		logger.Error("verifyRequestSignature(): can't save nonce. error: ", err)
+		return false
+	}
+	return fresh
+}
+
+// useRequestNonce remembers nonce of uid until expiry.
+// It returns false if the nonce is seen already, that is, the request is replayed.
+func useRequestNonce(uid uint, nonce string, expiry int64) (bool, error) {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtInsertNonce, err := db.PrepareContext(ctx, `INSERT INTO `+masterConfig.DB.TblPrefix+requestNonceTableName+` (uid, nonce, expiry) VALUES( ?, ?, ? )`)
+	if err != nil {
+		return false, err
+	}
+	defer stmtInsertNonce.Close()
+
+	if _, err = stmtInsertNonce.ExecContext(ctx, uid, nonce, expiry); err != nil {
+		// Tell a duplicate from other errors without relying on dialect specific codes
+		var seen int
+		if lookupErr := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+masterConfig.DB.TblPrefix+requestNonceTableName+` WHERE uid = ? AND nonce = ?`, uid, nonce).Scan(&seen); lookupErr == nil && seen > 0 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// purgeRequestNonces removes nonces whose requests would be rejected for their timestamp anyway.
+// It runs as a tick event but only once per purgeRequestNoncesPeriod.
+func purgeRequestNonces() {
+	if time.Since(lastRequestNoncesPurge) < purgeRequestNoncesPeriod {
+		return
+	}
+	lastRequestNoncesPurge = time.Now()
+
+	db, err := dbConnector.Conn()
+	if err != nil {
+		logger.Error("purgeRequestNonces(): can't connect database. error: ", err)
+		return
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtPurge, err := db.PrepareContext(ctx, `DELETE FROM `+masterConfig.DB.TblPrefix+requestNonceTableName+` WHERE expiry < ?`)
+	if err != nil {
+		logger.Error("purgeRequestNonces(): can't prepare statement. error: ", err)
+		return
+	}
+	defer stmtPurge.Close()
+
+	if _, err = stmtPurge.ExecContext(ctx, time.Now().Unix()); err != nil {
+		logger.Error("purgeRequestNonces(): can't purge. error: ", err)
+	}
+}
+
+// requestSignatureMiddleware verifies client request signatures for authenticated requests.
+// A signature is verified whenever present, and required only if sys.require_request_signature is set.
+func requestSignatureMiddleware(c *gin.Context) {
+	signed := c.GetHeader(requestSignatureHeader) != ""
+	if !signed && !masterConfig.Sys.RequireRequestSignature {
+		c.Next()
+		return
+	}
+
+	// Anonymous requests (e.g., Auth) have no key to verify against. Leave it to the handler.
+	if sessionTokenFromRequest(c) == "" || !hasValidAuth(c) {
+		c.Next()
+		return
+	}
+
+	uid, _ := authedUid(c)
+	if !verifyRequestSignature(c, uid) {
+		logger.Warning("requestSignatureMiddleware(): bad request signature from uid ", uid)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+			"error":  "bad request signature",
+		})
+		return
+	}
+	c.Next()
+}
+
+// responseSigningString is what the server signs with its private key:
+// STATUS \n PATH?QUERY \n TIMESTAMP \n NONCE \n hex(SHA-256(body))
+// NONCE is the request nonce, if any, so a response can't be passed off as the one to another request.
+func responseSigningString(c *gin.Context, status int, timestamp string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strconv.Itoa(status) + "\n" + c.Request.URL.RequestURI() + "\n" + timestamp + "\n" + c.GetHeader(requestNonceHeader) + "\n" + hex.EncodeToString(bodyHash[:]))
+}
+
+// signingResponseWriter holds back the response until it can be signed as a whole.
+type signingResponseWriter struct {
+	gin.ResponseWriter
+	body    bytes.Buffer
+	status  int
+	written bool // Anything written or the status set, i.e., there is a response to sign
+}
+
+func (w *signingResponseWriter) WriteHeader(code int) {
+	if code > 0 {
+		w.status = code
+		w.written = true
+	}
+}
+
+func (w *signingResponseWriter) WriteHeaderNow() {
+	w.written = true
+}
+
+func (w *signingResponseWriter) Write(data []byte) (int, error) {
+	w.written = true
+	return w.body.Write(data)
+}
+
+func (w *signingResponseWriter) WriteString(s string) (int, error) {
+	w.written = true
+	return w.body.WriteString(s)
+}
+
+func (w *signingResponseWriter) Status() int {
+	return w.status
+}
+
+func (w *signingResponseWriter) Size() int {
+	return w.body.Len()
+}
+
+func (w *signingResponseWriter) Written() bool {
+	return w.written
+}
+
+func (w *signingResponseWriter) Flush() {}
+
+// responseSignatureMiddleware signs every response with the server key,
+// so clients holding serverPubKeyPEM can tell it is from this Ulysses instance.
+// If the handlers leave the response untouched, e.g., on no route, it is left to gin as is.
+func responseSignatureMiddleware(c *gin.Context) {
+	if serverKey == nil {
+		c.Next()
+		return
+	}
+
+	original := c.Writer
+	writer := &signingResponseWriter{ResponseWriter: original, status: original.Status()}
+	c.Writer = writer
+	// On panic, the buffered response is dropped and gin.Recovery() writes to the original one.
+	defer func() { c.Writer = original }()
+
+	c.Next()
+
+	if !writer.written {
+		return
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	body := writer.body.Bytes()
+	signature, err := auth.Sign(serverKey, responseSigningString(c, writer.status, timestamp, body))
+	if err != nil {
+		logger.Error("responseSignatureMiddleware(): can't sign response. error: ", err)
+	} else {
+		original.Header().Set(responseTimestampHeader, timestamp)
+		original.Header().Set(responseSignatureHeader, base64.StdEncoding.EncodeToString(signature))
+	}
+	original.WriteHeader(writer.status)
+	original.WriteHeaderNow()
+	if _, err = original.Write(body); err != nil {
+		logger.Error("responseSignatureMiddleware(): can't write response. error: ", err)
+	}
+}
+
+// _handlerServerPubKey returns the public key of this Ulysses instance.
+func _handlerServerPubKey(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"pubkey": serverPubKeyPEM,
+	})
+}
+
+// _handlerChangePassword changes the password of current user and rewraps the private key.
+// All other sessions are revoked.
+func _handlerChangePassword(c *gin.Context) {
+	if !hasValidAuth(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	uid, _ := authedUid(c)
+
+	oldPasshash := c.PostForm("old_passhash")
+	newPasshash := c.PostForm("new_passhash")
+	if newPasshash == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	// The old password is as good as a login, so guessing it is throttled the same way.
+	var err error
+	changed, retryAfter := checkThrottled(c, uid, func() bool {
+		err = changeUserPassword(uid, oldPasshash, newPasshash)
+		return err != ErrWrongPassword
+	})
+	if retryAfter > 0 {
+		respondLoginThrottled(c, retryAfter)
+		return
+	}
+	if err == ErrWrongPassword {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	} else if err != nil || !changed {
+		logger.Error("_handlerChangePassword(): can't change password. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	if err = revokeOtherSessions(uid, c.GetString(ctxKeyAuthTokenHash)); err != nil {
+		logger.Error("_handlerChangePassword(): can't revoke other sessions. error: ", err)
+	}
+
+	privKey, err := ensureUserKeypair(uid, newPasshash)
+	if err != nil {
+		logger.Error("_handlerChangePassword(): can't load keypair. error: ", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"privkey": privKey,
+	})
+}
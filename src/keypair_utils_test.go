@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func TestVerifyRequestSignature(t *testing.T) {
+	useTestConnector(t)
+	uid, err := NewUserManager(dbConnector).Create("alice", "alice@example.com", "passhash")
+	if err != nil {
+		t.Fatalf("Create() returns error:%s\n", err)
+	}
+	wrapped, err := ensureUserKeypair(uid, "passhash")
+	if err != nil {
+		t.Fatalf("ensureUserKeypair() returns error:%s\n", err)
+	}
+	priv, err := auth.UnwrapPrivateKey(wrapped, "passhash")
+	if err != nil {
+		t.Fatalf("UnwrapPrivateKey() returns error:%s\n", err)
+	}
+
+	signedContext := func(nonce string) *gin.Context {
+		c := newTestContext("192.0.2.1")
+		c.Request = httptest.NewRequest("POST", "/api/test?x=1", strings.NewReader("a=b"))
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		signature, err := auth.Sign(priv, requestSigningString(c, timestamp, nonce, []byte("a=b")))
+		if err != nil {
+			t.Fatalf("Sign() returns error:%s\n", err)
+		}
+		c.Request.Header.Set(requestTimestampHeader, timestamp)
+		c.Request.Header.Set(requestNonceHeader, nonce)
+		c.Request.Header.Set(requestSignatureHeader, base64.StdEncoding.EncodeToString(signature))
+		return c
+	}
+
+	if !verifyRequestSignature(signedContext("nonce-1"), uid) {
+		t.Fatalf("verifyRequestSignature() rejects a signed request\n")
+	}
+	if verifyRequestSignature(signedContext("nonce-1"), uid) {
+		t.Errorf("verifyRequestSignature() accepts a replayed nonce\n")
+	}
+	if verifyRequestSignature(signedContext(""), uid) {
+		t.Errorf("verifyRequestSignature() accepts a request without nonce\n")
+	}
+
+	// A bad signature doesn't use up the nonce
+	c := signedContext("nonce-2")
+	c.Request.Header.Set(requestNonceHeader, "nonce-3")
+	if verifyRequestSignature(c, uid) {
+		t.Errorf("verifyRequestSignature() accepts a request with the nonce changed\n")
+	}
+	if !verifyRequestSignature(signedContext("nonce-3"), uid) {
+		t.Errorf("verifyRequestSignature() rejects a nonce only seen with a bad signature\n")
+	}
+}
+
+func TestResponseSignatureMiddleware(t *testing.T) {
+	prev := serverKey
+	t.Cleanup(func() { serverKey = prev })
+	var err error
+	if serverKey, err = auth.GenerateKeyPair(); err != nil {
+		t.Fatalf("GenerateKeyPair() returns error:%s\n", err)
+	}
+
+	router := gin.New()
+	router.Use(responseSignatureMiddleware)
+	router.GET("/api/test", func(c *gin.Context) {
+		c.JSON(http.StatusCreated, gin.H{"status": "success"})
+	})
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/test?x=1", nil)
+	req.Header.Set(requestNonceHeader, "nonce-1")
+	router.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusCreated || recorder.Body.String() != `{"status":"success"}` {
+		t.Fatalf("response is %d %s, want the one written by handler\n", recorder.Code, recorder.Body.String())
+	}
+	timestamp := recorder.Header().Get(responseTimestampHeader)
+	signature, err := base64.StdEncoding.DecodeString(recorder.Header().Get(responseSignatureHeader))
+	if err != nil || timestamp == "" {
+		t.Fatalf("response is not signed, headers: %v\n", recorder.Header())
+	}
+
+	c := newTestContext("192.0.2.1")
+	c.Request = req
+	if !auth.VerifySignature(&serverKey.PublicKey, responseSigningString(c, http.StatusCreated, timestamp, recorder.Body.Bytes()), signature) {
+		t.Errorf("response signature doesn't verify with the server key\n")
+	}
+	if auth.VerifySignature(&serverKey.PublicKey, responseSigningString(c, http.StatusOK, timestamp, recorder.Body.Bytes()), signature) {
+		t.Errorf("response signature verifies with another status\n")
+	}
+}
+
+func TestResponseSignatureMiddlewareNoRoute(t *testing.T) {
+	prev := serverKey
+	t.Cleanup(func() { serverKey = prev })
+	var err error
+	if serverKey, err = auth.GenerateKeyPair(); err != nil {
+		t.Fatalf("GenerateKeyPair() returns error:%s\n", err)
+	}
+
+	router := gin.New()
+	router.HandleMethodNotAllowed = true
+	router.Use(gin.Recovery(), responseSignatureMiddleware)
+	router.GET("/api/test", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{"GET", "/nope", http.StatusNotFound, "404 page not found"},
+		{"POST", "/api/test", http.StatusMethodNotAllowed, "405 method not allowed"},
+		{"GET", "/api/test", http.StatusNoContent, ""},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(tc.method, tc.path, nil))
+		if recorder.Code != tc.code || recorder.Body.String() != tc.body {
+			t.Errorf("%s %s responds %d %q, want %d %q\n", tc.method, tc.path, recorder.Code, recorder.Body.String(), tc.code, tc.body)
+		}
+	}
+}
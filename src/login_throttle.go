@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// Failed logins are counted per login and per client IP in the database,
+// so the count survives restarts and is shared by all Ulysses instances.
+// After some free failures, each further failure locks the key for an exponentially growing delay.
+
+const (
+	loginAttemptTableName = `login_attempts`
+
+	loginThrottleKeyLogin = `login:`
+	loginThrottleKeyIP    = `ip:`
+
+	// Failures older than this are forgotten
+	loginThrottleWindow = 1 * time.Hour
+
+	purgeLoginAttemptsSignature tickEventSignature = 0x10C0A77E
+	purgeLoginAttemptsPeriod                       = 10 * time.Minute
+)
+
+type loginThrottlePolicy struct {
+	freeFailures int
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+}
+
+var (
+	// Many users may share an IP behind NAT, so IPs get more free failures.
+	loginThrottlePolicies = map[string]loginThrottlePolicy{
+		loginThrottleKeyLogin: {freeFailures: 3, baseDelay: 2 * time.Second, maxDelay: 15 * time.Minute},
+		loginThrottleKeyIP:    {freeFailures: 20, baseDelay: 1 * time.Second, maxDelay: 15 * time.Minute},
+	}
+
+	lastLoginAttemptsPurge time.Time
+)
+
+// lockDuration returns how long a key is locked after its failures-th failure
+func (p loginThrottlePolicy) lockDuration(failures int) time.Duration {
+	if failures <= p.freeFailures {
+		return 0
+	}
+	delay := p.baseDelay
+	for i := p.freeFailures + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= p.maxDelay {
+			return p.maxDelay
+		}
+	}
+	return delay
+}
+
+func loginThrottleKeys(c *gin.Context, login string) []string {
+	return []string{
+		loginThrottleKeyLogin + login,
+		loginThrottleKeyIP + c.ClientIP(),
+	}
+}
+
+func loginThrottlePolicyOf(key string) loginThrottlePolicy {
+	for prefix, policy := range loginThrottlePolicies {
+		if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+			return policy
+		}
+	}
+	return loginThrottlePolicies[loginThrottleKeyLogin]
+}
+
+// loginLockedFor returns the longest remaining lockout of keys, or 0 if none is locked.
+func loginLockedFor(keys []string) (time.Duration, error) {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtLookupLock, err := db.PrepareContext(ctx, `SELECT locked_until FROM `+masterConfig.DB.TblPrefix+loginAttemptTableName+` WHERE attempt_key = ?`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtLookupLock.Close()
+
+	now := time.Now().Unix()
+	var longest int64
+	for _, key := range keys {
+		var lockedUntil int64
+		err = stmtLookupLock.QueryRowContext(ctx, key).Scan(&lockedUntil)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		if lockedUntil-now > longest {
+			longest = lockedUntil - now
+		}
+	}
+	return time.Duration(longest) * time.Second, nil
+}
+
+// recordLoginFailure counts a failure for each of keys and locks them according to their policy.
+func recordLoginFailure(keys []string) error {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	// Start over if the last failure is out of the window
+	stmtCountFailure, err := db.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+loginAttemptTableName+` SET failures = CASE WHEN last_failure < ? THEN 1 ELSE failures + 1 END, last_failure = ? WHERE attempt_key = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtCountFailure.Close()
+
+	stmtInsertFailure, err := db.PrepareContext(ctx, `INSERT INTO `+masterConfig.DB.TblPrefix+loginAttemptTableName+` (attempt_key, failures, last_failure, locked_until) VALUES( ?, 1, ?, 0 )`)
+	if err != nil {
+		return err
+	}
+	defer stmtInsertFailure.Close()
+
+	stmtLookupFailures, err := db.PrepareContext(ctx, `SELECT failures FROM `+masterConfig.DB.TblPrefix+loginAttemptTableName+` WHERE attempt_key = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtLookupFailures.Close()
+
+	stmtLock, err := db.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+loginAttemptTableName+` SET locked_until = ? WHERE attempt_key = ? AND locked_until < ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtLock.Close()
+
+	now := time.Now()
+	windowStart := now.Add(-loginThrottleWindow).Unix()
+	for _, key := range keys {
+		result, err := stmtCountFailure.ExecContext(ctx, windowStart, now.Unix(), key)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			if _, err = stmtInsertFailure.ExecContext(ctx, key, now.Unix()); err != nil {
+				// Another instance may have inserted it in between. Count on that row instead.
+				if _, err = stmtCountFailure.ExecContext(ctx, windowStart, now.Unix(), key); err != nil {
+					return err
+				}
+			}
+		}
+
+		var failures int
+		if err = stmtLookupFailures.QueryRowContext(ctx, key).Scan(&failures); err != nil {
+			return err
+		}
+		if lock := loginThrottlePolicyOf(key).lockDuration(failures); lock > 0 {
+			lockedUntil := now.Add(lock).Unix()
+			if _, err = stmtLock.ExecContext(ctx, lockedUntil, key, lockedUntil); err != nil {
+				return err
+			}
+			logger.Warning("recordLoginFailure(): ", key, " locked for ", lock, " after ", failures, " failures")
+		}
+	}
+	return nil
+}
+
+// clearLoginFailures forgets failures and lockout of key.
+// It is also the admin unlock operation.
+func clearLoginFailures(key string) error {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtClear, err := db.PrepareContext(ctx, `DELETE FROM `+masterConfig.DB.TblPrefix+loginAttemptTableName+` WHERE attempt_key = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtClear.Close()
+
+	_, err = stmtClear.ExecContext(ctx, key)
+	return err
+}
+
+// purgeLoginAttempts removes records which neither lock nor count anymore.
+// It runs as a tick event but only once per purgeLoginAttemptsPeriod.
+func purgeLoginAttempts() {
+	if time.Since(lastLoginAttemptsPurge) < purgeLoginAttemptsPeriod {
+		return
+	}
+	lastLoginAttemptsPurge = time.Now()
+
+	db, err := dbConnector.Conn()
+	if err != nil {
+		logger.Error("purgeLoginAttempts(): can't connect database. error: ", err)
+		return
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtPurge, err := db.PrepareContext(ctx, `DELETE FROM `+masterConfig.DB.TblPrefix+loginAttemptTableName+` WHERE last_failure < ? AND locked_until < ?`)
+	if err != nil {
+		logger.Error("purgeLoginAttempts(): can't prepare statement. error: ", err)
+		return
+	}
+	defer stmtPurge.Close()
+
+	now := time.Now()
+	if _, err = stmtPurge.ExecContext(ctx, now.Add(-loginThrottleWindow).Unix(), now.Unix()); err != nil {
+		logger.Error("purgeLoginAttempts(): can't purge. error: ", err)
+	}
+}
+
+// authLoginPassThrottled is authLoginPass with brute-force protection.
+// If the login or the client IP is locked out, the password is not even checked and retryAfter is positive.
+// A failure is recorded for a wrong password. Success doesn't clear the failures: only a complete login does.
+func authLoginPassThrottled(c *gin.Context, login string, passhash string) (authed bool, uid uint, retryAfter time.Duration) {
+	keys := loginThrottleKeys(c, login)
+
+	retryAfter, err := loginLockedFor(keys)
+	if err != nil {
+		logger.Error("authLoginPassThrottled(): can't check lockout. error: ", err)
+		return false, 0, 0
+	}
+	if retryAfter > 0 {
+		return false, 0, retryAfter
+	}
+
+	authed, uid = authLoginPass(login, passhash)
+	if !authed {
+		if err = recordLoginFailure(keys); err != nil {
+			logger.Error("authLoginPassThrottled(): can't record failure. error: ", err)
+		}
+	}
+	return authed, uid, 0
+}
+
+// checkThrottled runs check, a password or MFA code check for uid signed in already, with the same brute-force
+// protection as a login: it is not run while the login of uid or the client IP is locked out, and a failure is recorded.
+func checkThrottled(c *gin.Context, uid uint, check func() bool) (ok bool, retryAfter time.Duration) {
+	user, err := NewUserManager(dbConnector).Lookup(uid)
+	if err != nil {
+		logger.Error("checkThrottled(): can't look up uid ", uid, ". error: ", err)
+		return false, 0
+	}
+	keys := loginThrottleKeys(c, user.Login)
+
+	retryAfter, err = loginLockedFor(keys)
+	if err != nil {
+		logger.Error("checkThrottled(): can't check lockout. error: ", err)
+		return false, 0
+	}
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+
+	if ok = check(); !ok {
+		if err = recordLoginFailure(keys); err != nil {
+			logger.Error("checkThrottled(): can't record failure. error: ", err)
+		}
+	}
+	return ok, 0
+}
+
+// respondLoginThrottled tells the client to come back later
+func respondLoginThrottled(c *gin.Context, retryAfter time.Duration) {
+	seconds := int64(retryAfter / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"status":      "error",
+		"retry_after": seconds,
+	})
+}
+
+// _adminHandlerLoginUnlock clears the lockout of a login and/or an IP.
+func _adminHandlerLoginUnlock(c *gin.Context) {
+	login := c.PostForm("login")
+	ip := c.PostForm("ip")
+	if login == "" && ip == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	var keys []string
+	if login != "" {
+		keys = append(keys, loginThrottleKeyLogin+login)
+	}
+	if ip != "" {
+		keys = append(keys, loginThrottleKeyIP+ip)
+	}
+
+	for _, key := range keys {
+		if err := clearLoginFailures(key); err != nil {
+			logger.Error("_adminHandlerLoginUnlock(): can't unlock ", key, ". error: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status": "error",
+			})
+			return
+		}
+		logger.Info("_adminHandlerLoginUnlock(): unlocked ", key)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestContext returns a gin.Context of a request from ip.
+func newTestContext(ip string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/", nil)
+	c.Request.RemoteAddr = ip + ":12345"
+	return c
+}
+
+func TestCheckThrottled(t *testing.T) {
+	useTestConnector(t)
+	uid, err := NewUserManager(dbConnector).Create("alice", "alice@example.com", "passhash")
+	if err != nil {
+		t.Fatalf("Create() returns error:%s\n", err)
+	}
+
+	c := newTestContext("192.0.2.1")
+	free := loginThrottlePolicies[loginThrottleKeyLogin].freeFailures
+	for i := 0; i <= free; i++ {
+		if ok, retryAfter := checkThrottled(c, uid, func() bool { return false }); ok || retryAfter != 0 {
+			t.Fatalf("checkThrottled() of failure %d returns %v, %s\n", i+1, ok, retryAfter)
+		}
+	}
+
+	// Locked like a login, and the check is not even run
+	checked := false
+	if ok, retryAfter := checkThrottled(c, uid, func() bool { checked = true; return true }); ok || retryAfter <= 0 || checked {
+		t.Errorf("checkThrottled() after %d failures returns %v, %s, checked %v\n", free+1, ok, retryAfter, checked)
+	}
+	if lock, _ := loginLockedFor([]string{loginThrottleKeyLogin + "alice"}); lock <= 0 {
+		t.Errorf("login of uid is not locked after %d failures\n", free+1)
+	}
+}
+
+// loginFailures returns the failures counted for key, or 0 if none.
+func loginFailures(t *testing.T, key string) int {
+	t.Helper()
+	dbConn, _ := dbConnector.Conn()
+	var failures int
+	dbConn.QueryRow(`SELECT failures FROM `+masterConfig.DB.TblPrefix+loginAttemptTableName+` WHERE attempt_key = ?`, key).Scan(&failures)
+	return failures
+}
+
+func TestLoginThrottlePolicy(t *testing.T) {
+	login := loginThrottlePolicyOf(loginThrottleKeyLogin + "alice")
+	ip := loginThrottlePolicyOf(loginThrottleKeyIP + "192.0.2.1")
+	if login != loginThrottlePolicies[loginThrottleKeyLogin] || ip != loginThrottlePolicies[loginThrottleKeyIP] {
+		t.Fatalf("loginThrottlePolicyOf() returns %+v and %+v\n", login, ip)
+	}
+
+	tests := []struct {
+		policy   loginThrottlePolicy
+		failures int
+		want     time.Duration
+	}{
+		{login, login.freeFailures, 0},
+		{login, login.freeFailures + 1, login.baseDelay},
+		{login, login.freeFailures + 2, 2 * login.baseDelay},
+		{login, login.freeFailures + 4, 8 * login.baseDelay},
+		{login, login.freeFailures + 100, login.maxDelay},
+		{ip, login.freeFailures + 1, 0},
+		{ip, ip.freeFailures + 1, ip.baseDelay},
+	}
+	for _, test := range tests {
+		if lock := test.policy.lockDuration(test.failures); lock != test.want {
+			t.Errorf("lockDuration(%d) of %+v returns %s, want %s\n", test.failures, test.policy, lock, test.want)
+		}
+	}
+}
+
+func TestRecordLoginFailure(t *testing.T) {
+	useTestConnector(t)
+	loginKey, ipKey := loginThrottleKeyLogin+"alice", loginThrottleKeyIP+"192.0.2.1"
+	keys := []string{loginKey, ipKey}
+	login := loginThrottlePolicies[loginThrottleKeyLogin]
+
+	for i := 0; i < login.freeFailures; i++ {
+		if err := recordLoginFailure(keys); err != nil {
+			t.Fatalf("recordLoginFailure() returns error:%s\n", err)
+		}
+	}
+	if lock, _ := loginLockedFor(keys); lock != 0 {
+		t.Errorf("loginLockedFor() after free failures returns %s\n", lock)
+	}
+
+	// The login is locked, the IP shared by more users is not yet
+	recordLoginFailure(keys)
+	if lock, _ := loginLockedFor([]string{loginKey}); lock <= 0 || lock > login.baseDelay {
+		t.Errorf("loginLockedFor(login) returns %s, want up to %s\n", lock, login.baseDelay)
+	}
+	if lock, _ := loginLockedFor([]string{ipKey}); lock != 0 {
+		t.Errorf("loginLockedFor(ip) returns %s, want not locked\n", lock)
+	}
+
+	// Each further failure doubles the lock
+	recordLoginFailure(keys)
+	if lock, _ := loginLockedFor(keys); lock <= login.baseDelay || lock > 2*login.baseDelay {
+		t.Errorf("loginLockedFor() after another failure returns %s, want up to %s\n", lock, 2*login.baseDelay)
+	}
+
+	// Failures out of the window are forgotten
+	dbConn, _ := dbConnector.Conn()
+	dbConn.Exec(`UPDATE `+masterConfig.DB.TblPrefix+loginAttemptTableName+` SET last_failure = ?, locked_until = 0`, time.Now().Add(-loginThrottleWindow-time.Minute).Unix())
+	recordLoginFailure(keys)
+	if failures := loginFailures(t, loginKey); failures != 1 {
+		t.Errorf("failures after the window are %d, want 1\n", failures)
+	}
+	if lock, _ := loginLockedFor(keys); lock != 0 {
+		t.Errorf("loginLockedFor() after the window returns %s\n", lock)
+	}
+
+	// Only records neither locking nor counting are purged
+	dbConn.Exec(`UPDATE `+masterConfig.DB.TblPrefix+loginAttemptTableName+` SET last_failure = ? WHERE attempt_key = ?`, time.Now().Add(-loginThrottleWindow-time.Minute).Unix(), ipKey)
+	lastLoginAttemptsPurge = time.Time{}
+	purgeLoginAttempts()
+	if loginFailures(t, ipKey) != 0 || loginFailures(t, loginKey) != 1 {
+		t.Errorf("purgeLoginAttempts() left ip %d and login %d failures\n", loginFailures(t, ipKey), loginFailures(t, loginKey))
+	}
+}
+
+func TestLoginThrottlePerIP(t *testing.T) {
+	useTestConnector(t)
+	ip := loginThrottlePolicies[loginThrottleKeyIP]
+
+	// Failures on many logins from one IP lock the IP only
+	c := newTestContext("192.0.2.1")
+	for i := 0; i <= ip.freeFailures; i++ {
+		recordLoginFailure(loginThrottleKeys(c, fmt.Sprint("user", i)))
+	}
+	if lock, _ := loginLockedFor([]string{loginThrottleKeyIP + "192.0.2.1"}); lock <= 0 {
+		t.Errorf("IP is not locked after %d failures\n", ip.freeFailures+1)
+	}
+	if lock, _ := loginLockedFor(loginThrottleKeys(newTestContext("192.0.2.2"), "user0")); lock != 0 {
+		t.Errorf("loginLockedFor() from another IP returns %s\n", lock)
+	}
+}
+
+func TestAuthLoginPassThrottled(t *testing.T) {
+	useTestConnector(t)
+	if _, err := NewUserManager(dbConnector).Create("alice", "alice@example.com", "passhash"); err != nil {
+		t.Fatalf("Create() returns error:%s\n", err)
+	}
+
+	c := newTestContext("192.0.2.1")
+	free := loginThrottlePolicies[loginThrottleKeyLogin].freeFailures
+	for i := 0; i <= free; i++ {
+		if authed, _, retryAfter := authLoginPassThrottled(c, "alice", "wrong"); authed || retryAfter != 0 {
+			t.Fatalf("authLoginPassThrottled() with wrong password returns %v, %s\n", authed, retryAfter)
+		}
+	}
+	// Even the right password is refused while locked
+	if authed, _, retryAfter := authLoginPassThrottled(c, "alice", "passhash"); authed || retryAfter <= 0 {
+		t.Errorf("authLoginPassThrottled() while locked returns %v, %s\n", authed, retryAfter)
+	}
+}
+
+func TestAdminLoginUnlock(t *testing.T) {
+	useTestConnector(t)
+	keys := loginThrottleKeys(newTestContext("192.0.2.1"), "alice")
+	for i := 0; i < 30; i++ {
+		recordLoginFailure(keys)
+	}
+
+	unlock := func(form url.Values) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		_adminHandlerLoginUnlock(c)
+		return w.Code
+	}
+
+	if code := unlock(url.Values{}); code != http.StatusBadRequest {
+		t.Errorf("_adminHandlerLoginUnlock() without login or ip responds %d\n", code)
+	}
+	if code := unlock(url.Values{"login": {"alice"}}); code != http.StatusOK {
+		t.Fatalf("_adminHandlerLoginUnlock() responds %d\n", code)
+	}
+	if lock, _ := loginLockedFor(keys[:1]); lock != 0 || loginFailures(t, keys[0]) != 0 {
+		t.Errorf("login is still locked for %s after unlock\n", lock)
+	}
+	if lock, _ := loginLockedFor(keys[1:]); lock <= 0 {
+		t.Errorf("IP is unlocked with the login\n")
+	}
+	unlock(url.Values{"ip": {"192.0.2.1"}})
+	if lock, _ := loginLockedFor(keys); lock != 0 {
+		t.Errorf("loginLockedFor() after unlocking both returns %s\n", lock)
+	}
+}
@@ -5,6 +5,12 @@ import (
 )
 
 func main() {
+	/*** GLOBAL INIT BEGIN ***/
+	// Not in init(), so tests of this package don't parse flags or load config.
+	parseArgs()
+	globalInit()
+	/*** GLOBAL INIT END ***/
+
 	// Initialize Business Logic Here.
 	logger.Debug("In main()")
 	bizLogic()
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/internal/auth"
+	"github.com/TunnelWork/Ulysses/src/internal/db"
+	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	mfaTypeTOTP     = `totp`
+	mfaTypeRecovery = `recovery`
+
+	recoveryCodeCount = 10
+	totpIssuer        = `Ulysses`
+)
+
+var (
+	ErrMFAAlreadyEnrolled = errors.New("ulysses/mfa: already enrolled")
+	ErrMFANotEnrolled     = errors.New("ulysses/mfa: not enrolled")
+	ErrMFAChanged         = errors.New("ulysses/mfa: changed by another request, try again")
+)
+
+// userMFA is a row in user_mfa table. Each user has at most one row per mfaType.
+// config is a JSON object whose format depends on mfaType.
+type userMFA struct {
+	mfaType   string
+	config    string
+	confirmed bool
+}
+
+type totpConfig struct {
+	Secret   string `json:"secret"`
+	LastStep int64  `json:"last_step"` // Last used time step. Used to prevent replay.
+}
+
+type recoveryConfig struct {
+	Codes []string `json:"codes"` // auth.HashRecoveryCode() of unused codes
+}
+
+// mfaRequest is the format of auth_mfa submitted by client
+type mfaRequest struct {
+	Type string `json:"type"`
+
+	// totp, recovery
+	Code string `json:"code,omitempty"`
+
+	// webauthn, all base64url encoded
+	CredentialID      string `json:"credential_id,omitempty"`
+	ClientDataJSON    string `json:"client_data_json,omitempty"`
+	AuthenticatorData string `json:"authenticator_data,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+}
+
+// loadUserMFA returns all MFA methods registered by uid, keyed by mfaType.
+func loadUserMFA(uid uint) (map[string]userMFA, error) {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtLookupMFA, err := db.PrepareContext(ctx, `SELECT mfa_type, mfa_config, confirmed FROM `+masterConfig.DB.TblPrefix+userMFATableName+` WHERE uid = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtLookupMFA.Close()
+
+	rows, err := stmtLookupMFA.QueryContext(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mfaMap := map[string]userMFA{}
+	for rows.Next() {
+		var mfa userMFA
+		if err = rows.Scan(&mfa.mfaType, &mfa.config, &mfa.confirmed); err != nil {
+			return nil, err
+		}
+		mfaMap[mfa.mfaType] = mfa
+	}
+
+	return mfaMap, rows.Err()
+}
+
+// saveUserMFA replaces the MFA method mfaType of uid.
+func saveUserMFA(uid uint, mfaType string, config string, confirmed bool) error {
+	dbConn, err := dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	return saveUserMFATo(ctx, dbConn, uid, mfaType, config, confirmed)
+}
+
+// saveUserMFATo is saveUserMFA() running on q, e.g., a transaction from db.WithTx().
+func saveUserMFATo(ctx context.Context, q db.Querier, uid uint, mfaType string, config string, confirmed bool) error {
+	stmtDeleteMFA, err := q.PrepareContext(ctx, `DELETE FROM `+masterConfig.DB.TblPrefix+userMFATableName+` WHERE uid = ? AND mfa_type = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtDeleteMFA.Close()
+
+	stmtInsertMFA, err := q.PrepareContext(ctx, `INSERT INTO `+masterConfig.DB.TblPrefix+userMFATableName+` (uid, mfa_type, mfa_config, confirmed, creation_time) VALUES( ?, ?, ?, ?, ? )`)
+	if err != nil {
+		return err
+	}
+	defer stmtInsertMFA.Close()
+
+	if _, err = stmtDeleteMFA.ExecContext(ctx, uid, mfaType); err != nil {
+		return err
+	}
+	_, err = stmtInsertMFA.ExecContext(ctx, uid, mfaType, config, confirmed, time.Now().Unix())
+	return err
+}
+
+// swapUserMFAConfig updates the config of a confirmed MFA method only if it is still oldConfig.
+// It returns false if someone else updated it first, e.g., the same TOTP code submitted twice concurrently.
+func swapUserMFAConfig(uid uint, mfaType string, oldConfig string, newConfig string) (bool, error) {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtSwapMFA, err := db.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userMFATableName+` SET mfa_config = ? WHERE uid = ? AND mfa_type = ? AND mfa_config = ? AND confirmed = 1`)
+	if err != nil {
+		return false, err
+	}
+	defer stmtSwapMFA.Close()
+
+	result, err := stmtSwapMFA.ExecContext(ctx, newConfig, uid, mfaType, oldConfig)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// addUserMFA adds a confirmed MFA method only if uid has none of mfaType yet.
+// It returns false if someone else added it first.
+func addUserMFA(uid uint, mfaType string, config string) (bool, error) {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtInsertMFA, err := db.PrepareContext(ctx, `INSERT INTO `+masterConfig.DB.TblPrefix+userMFATableName+` (uid, mfa_type, mfa_config, confirmed, creation_time) VALUES( ?, ?, ?, 1, ? )`)
+	if err != nil {
+		return false, err
+	}
+	defer stmtInsertMFA.Close()
+
+	if _, err = stmtInsertMFA.ExecContext(ctx, uid, mfaType, config, time.Now().Unix()); err != nil {
+		// Tell a duplicate from other errors without relying on dialect specific codes
+		if mfaMap, lookupErr := loadUserMFA(uid); lookupErr == nil {
+			if _, ok := mfaMap[mfaType]; ok {
+				return false, nil
+			}
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// dropUserMFAConfig deletes a confirmed MFA method only if its config is still oldConfig.
+// It returns false if someone else updated it first.
+func dropUserMFAConfig(uid uint, mfaType string, oldConfig string) (bool, error) {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtDropMFA, err := db.PrepareContext(ctx, `DELETE FROM `+masterConfig.DB.TblPrefix+userMFATableName+` WHERE uid = ? AND mfa_type = ? AND mfa_config = ? AND confirmed = 1`)
+	if err != nil {
+		return false, err
+	}
+	defer stmtDropMFA.Close()
+
+	result, err := stmtDropMFA.ExecContext(ctx, uid, mfaType, oldConfig)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+func deleteUserMFA(uid uint, mfaType string) error {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtDeleteMFA, err := db.PrepareContext(ctx, `DELETE FROM `+masterConfig.DB.TblPrefix+userMFATableName+` WHERE uid = ? AND mfa_type = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtDeleteMFA.Close()
+
+	_, err = stmtDeleteMFA.ExecContext(ctx, uid, mfaType)
+	return err
+}
+
+// userRequiresMFA returns true if uid has at least one confirmed MFA method.
+func userRequiresMFA(uid uint) (bool, error) {
+	mfaMap, err := loadUserMFA(uid)
+	if err != nil {
+		return false, err
+	}
+	for _, mfa := range mfaMap {
+		if mfa.confirmed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// verifyMFA checks the auth_mfa submitted by client against the MFA methods registered by uid.
+func verifyMFA(uid uint, authMFA string) bool {
+	var req mfaRequest
+	if err := json.Unmarshal([]byte(authMFA), &req); err != nil {
+		logger.Debug("verifyMFA(): bad auth_mfa. error: ", err)
+		return false
+	}
+
+	mfaMap, err := loadUserMFA(uid)
+	if err != nil {
+		logger.Error("verifyMFA(): can't load MFA for uid ", uid, ". error: ", err)
+		return false
+	}
+	mfa, ok := mfaMap[req.Type]
+	if !ok || !mfa.confirmed {
+		return false
+	}
+
+	switch req.Type {
+	case mfaTypeTOTP:
+		return verifyTOTPCode(uid, mfa, req.Code)
+	case mfaTypeRecovery:
+		return consumeRecoveryCode(uid, mfa, req.Code)
+	case mfaTypeWebAuthn:
+		return verifyWebAuthnAssertion(uid, mfa, req)
+	default:
+		return false
+	}
+}
+
+func verifyTOTPCode(uid uint, mfa userMFA, code string) bool {
+	var conf totpConfig
+	if err := json.Unmarshal([]byte(mfa.config), &conf); err != nil {
+		logger.Error("verifyTOTPCode(): bad totp config for uid ", uid, ". error: ", err)
+		return false
+	}
+
+	step, ok := auth.VerifyTOTP(conf.Secret, code, time.Now(), conf.LastStep)
+	if !ok {
+		return false
+	}
+
+	// Burn the time step so the same code can't be used again.
+	conf.LastStep = step
+	newConfig, err := json.Marshal(conf)
+	if err != nil {
+		return false
+	}
+	swapped, err := swapUserMFAConfig(uid, mfaTypeTOTP, mfa.config, string(newConfig))
+	if err != nil {
+		logger.Error("verifyTOTPCode(): can't save last step for uid ", uid, ". error: ", err)
+	}
+	return swapped
+}
+
+func consumeRecoveryCode(uid uint, mfa userMFA, code string) bool {
+	var conf recoveryConfig
+	if err := json.Unmarshal([]byte(mfa.config), &conf); err != nil {
+		logger.Error("consumeRecoveryCode(): bad recovery config for uid ", uid, ". error: ", err)
+		return false
+	}
+
+	codeHash := auth.HashRecoveryCode(code)
+	for i, hash := range conf.Codes {
+		if hash != codeHash {
+			continue
+		}
+
+		conf.Codes = append(conf.Codes[:i], conf.Codes[i+1:]...)
+		newConfig, err := json.Marshal(conf)
+		if err != nil {
+			return false
+		}
+		swapped, err := swapUserMFAConfig(uid, mfaTypeRecovery, mfa.config, string(newConfig))
+		if err != nil {
+			logger.Error("consumeRecoveryCode(): can't consume code for uid ", uid, ". error: ", err)
+		}
+		if swapped {
+			logger.Warning("consumeRecoveryCode(): uid ", uid, " used a recovery code, ", len(conf.Codes), " left")
+		}
+		return swapped
+	}
+	return false
+}
+
+// newRecoveryCodes replaces all recovery codes of uid and returns the new ones in plain text.
+func newRecoveryCodes(uid uint) ([]string, error) {
+	codes, config, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	return codes, saveUserMFA(uid, mfaTypeRecovery, config, true)
+}
+
+// generateRecoveryCodes returns new recovery codes in plain text, and the recovery config storing their hashes.
+func generateRecoveryCodes() (codes []string, config string, err error) {
+	codes, err = auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conf := recoveryConfig{
+		Codes: make([]string, 0, len(codes)),
+	}
+	for _, code := range codes {
+		conf.Codes = append(conf.Codes, auth.HashRecoveryCode(code))
+	}
+	confBytes, err := json.Marshal(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	return codes, string(confBytes), nil
+}
+
+// confirmTOTP enables TOTP of uid with config, and generates recovery codes if uid has none yet.
+// Both are saved or neither is. Existing recovery codes are kept, and nil is returned for codes.
+func confirmTOTP(uid uint, config string) (codes []string, err error) {
+	mfaMap, err := loadUserMFA(uid)
+	if err != nil {
+		return nil, err
+	}
+	_, hasRecovery := mfaMap[mfaTypeRecovery]
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	err = db.WithTx(ctx, dbConnector, func(tx *sql.Tx) error {
+		if err := saveUserMFATo(ctx, tx, uid, mfaTypeTOTP, config, true); err != nil {
+			return err
+		}
+		if hasRecovery {
+			return nil
+		}
+		var recoveryConfig string
+		var err error
+		if codes, recoveryConfig, err = generateRecoveryCodes(); err != nil {
+			return err
+		}
+		return saveUserMFATo(ctx, tx, uid, mfaTypeRecovery, recoveryConfig, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// cleanupRecoveryCodes removes recovery codes if there is no other MFA method left to recover.
+func cleanupRecoveryCodes(uid uint) error {
+	mfaMap, err := loadUserMFA(uid)
+	if err != nil {
+		return err
+	}
+	for mfaType, mfa := range mfaMap {
+		if mfaType != mfaTypeRecovery && mfa.confirmed {
+			return nil
+		}
+	}
+	return deleteUserMFA(uid, mfaTypeRecovery)
+}
+
+// _handlerEnrollTOTP generates a new TOTP secret for the user.
+// The secret won't be enforced until confirmed with _handlerConfirmTOTP.
+func _handlerEnrollTOTP(c *gin.Context) {
+	if !hasValidAuth(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	uid, _ := authedUid(c)
+
+	mfaMap, err := loadUserMFA(uid)
+	if err != nil {
+		logger.Error("_handlerEnrollTOTP(): can't load MFA. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	if mfa, ok := mfaMap[mfaTypeTOTP]; ok && mfa.confirmed {
+		c.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  ErrMFAAlreadyEnrolled.Error(),
+		})
+		return
+	}
+
+	user, err := NewUserManager(dbConnector).Lookup(uid)
+	if err != nil {
+		logger.Error("_handlerEnrollTOTP(): can't lookup login. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		logger.Error("_handlerEnrollTOTP(): can't generate secret. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	confBytes, _ := json.Marshal(totpConfig{Secret: secret})
+	if err = saveUserMFA(uid, mfaTypeTOTP, string(confBytes), false); err != nil {
+		logger.Error("_handlerEnrollTOTP(): can't save MFA. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"secret": secret,
+		"uri":    auth.TOTPURI(totpIssuer, user.Login, secret),
+	})
+}
+
+// _handlerConfirmTOTP activates a pending TOTP enrollment if the submitted code is correct.
+// Recovery codes are generated and returned ONLY ONCE here, unless the user has them already, e.g., from WebAuthn.
+func _handlerConfirmTOTP(c *gin.Context) {
+	if !hasValidAuth(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	uid, _ := authedUid(c)
+
+	mfaMap, err := loadUserMFA(uid)
+	if err != nil {
+		logger.Error("_handlerConfirmTOTP(): can't load MFA. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	mfa, ok := mfaMap[mfaTypeTOTP]
+	if !ok || mfa.confirmed {
+		c.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  ErrMFANotEnrolled.Error(),
+		})
+		return
+	}
+
+	var conf totpConfig
+	if err = json.Unmarshal([]byte(mfa.config), &conf); err != nil {
+		logger.Error("_handlerConfirmTOTP(): bad totp config. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	var step int64
+	ok, retryAfter := checkThrottled(c, uid, func() (ok bool) {
+		step, ok = auth.VerifyTOTP(conf.Secret, c.PostForm("code"), time.Now(), 0)
+		return ok
+	})
+	if retryAfter > 0 {
+		respondLoginThrottled(c, retryAfter)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	conf.LastStep = step
+	confBytes, _ := json.Marshal(conf)
+	codes, err := confirmTOTP(uid, string(confBytes))
+	if err != nil {
+		logger.Error("_handlerConfirmTOTP(): can't save MFA. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	logger.Info("_handlerConfirmTOTP(): uid ", uid, " enabled TOTP")
+	resp := gin.H{
+		"status": "success",
+	}
+	if codes != nil {
+		resp["recovery_codes"] = codes
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// _handlerDisableTOTP removes TOTP, and recovery codes if no other MFA is left. A valid auth_mfa is required.
+func _handlerDisableTOTP(c *gin.Context) {
+	if !hasValidAuth(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	uid, _ := authedUid(c)
+
+	ok, retryAfter := checkThrottled(c, uid, func() bool {
+		return verifyMFA(uid, c.DefaultPostForm("auth_mfa", "{}"))
+	})
+	if retryAfter > 0 {
+		respondLoginThrottled(c, retryAfter)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	err := deleteUserMFA(uid, mfaTypeTOTP)
+	if err == nil {
+		err = cleanupRecoveryCodes(uid)
+	}
+	if err != nil {
+		logger.Error("_handlerDisableTOTP(): can't delete MFA. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	logger.Info("_handlerDisableTOTP(): uid ", uid, " disabled TOTP")
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
@@ -1,7 +1,129 @@
 package server
 
+import (
+	"strconv"
+	"strings"
+)
+
 // It is up to module designer to parse/utilize the AccountUsage.
+// An AccountUsage may also implement StructuredAccountUsage, so Ulysses can show each metric consistently.
 type AccountUsage interface {
 	ForClient() (usage string)
 	ForAdmin() (usage string)
 }
+
+// UsageUnit is the unit of Value and Limit of a UsageMetric.
+type UsageUnit string
+
+const (
+	UnitBytes      UsageUnit = "bytes"
+	UnitBitsPerSec UsageUnit = "bps"
+	UnitSeconds    UsageUnit = "seconds"
+	UnitCount      UsageUnit = "count" // e.g., connections, domains
+	UnitPercent    UsageUnit = "percent"
+)
+
+// UsageMetric is one measure of an AccountUsage, e.g., traffic of this month.
+type UsageMetric struct {
+	Key         string    `json:"key"`
+	Label       string    `json:"label"`
+	Value       float64   `json:"value"`
+	Limit       *float64  `json:"limit"` // nil for unlimited
+	Unit        UsageUnit `json:"unit"`
+	WindowStart int64     `json:"window_start,omitempty"` // Unix time the metric is counted from, 0 if not windowed
+	WindowEnd   int64     `json:"window_end,omitempty"`   // Unix time the window ends, e.g., the metric resets
+	AdminOnly   bool      `json:"admin_only,omitempty"`   // Left out of the client view
+}
+
+// Limited returns a Limit of limit, for UsageMetric literals.
+func Limited(limit float64) *float64 {
+	return &limit
+}
+
+// StructuredAccountUsage is an AccountUsage made of metrics.
+type StructuredAccountUsage interface {
+	AccountUsage
+	Metrics() []UsageMetric
+}
+
+// UsageMetrics is a ready StructuredAccountUsage for modules to return.
+type UsageMetrics []UsageMetric
+
+func (um UsageMetrics) Metrics() []UsageMetric {
+	return um
+}
+
+func (um UsageMetrics) ForClient() string {
+	return um.text(false)
+}
+
+func (um UsageMetrics) ForAdmin() string {
+	return um.text(true)
+}
+
+// text lists "Label: Value/Limit Unit" a line each.
+func (um UsageMetrics) text(admin bool) string {
+	lines := []string{}
+	for _, metric := range um {
+		if metric.AdminOnly && !admin {
+			continue
+		}
+		metric = metric.withDefaults()
+		line := metric.Label + ": " + strconv.FormatFloat(metric.Value, 'f', -1, 64)
+		if metric.Limit != nil {
+			line += "/" + strconv.FormatFloat(*metric.Limit, 'f', -1, 64)
+		}
+		line += " " + string(metric.Unit)
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// UsageView is the JSON representation of an AccountUsage given by Ulysses.
+// Metrics is empty for an AccountUsage not structured, which has only Text.
+type UsageView struct {
+	Metrics []UsageMetric `json:"metrics"`
+	Text    string        `json:"text"`
+}
+
+// ClientUsageView returns the view of u for its owner, without AdminOnly metrics.
+func ClientUsageView(u AccountUsage) UsageView {
+	view := UsageView{Metrics: []UsageMetric{}}
+	if u == nil {
+		return view
+	}
+	if su, ok := u.(StructuredAccountUsage); ok {
+		for _, metric := range su.Metrics() {
+			if !metric.AdminOnly {
+				view.Metrics = append(view.Metrics, metric.withDefaults())
+			}
+		}
+	}
+	view.Text = u.ForClient()
+	return view
+}
+
+// AdminUsageView returns the view of u for admins, with all metrics.
+func AdminUsageView(u AccountUsage) UsageView {
+	view := UsageView{Metrics: []UsageMetric{}}
+	if u == nil {
+		return view
+	}
+	if su, ok := u.(StructuredAccountUsage); ok {
+		for _, metric := range su.Metrics() {
+			view.Metrics = append(view.Metrics, metric.withDefaults())
+		}
+	}
+	view.Text = u.ForAdmin()
+	return view
+}
+
+func (m UsageMetric) withDefaults() UsageMetric {
+	if m.Label == "" {
+		m.Label = m.Key
+	}
+	if m.Unit == "" {
+		m.Unit = UnitCount
+	}
+	return m
+}
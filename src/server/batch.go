@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+)
+
+// BatchMode tells how a batch operation proceeds after an item fails.
+type BatchMode int
+
+const (
+	// StopOnError passes the whole batch to the Server at once, which returns on the first error.
+	// Items after the failed one are not tried.
+	StopOnError BatchMode = iota
+	// ContinueOnError passes items to the Server one by one, so a failed item doesn't stop the rest.
+	ContinueOnError
+)
+
+// ItemResult is the outcome of one item of a batch, in the same position as the item passed in.
+type ItemResult struct {
+	Index     int   // Position of the item in the batch
+	AccID     int   // ID of the account, as passed in or returned by AddAccount. Undefined if AddAccount failed.
+	Done      bool  // The operation succeeded on this item
+	Tried     bool  // The item is passed to the Server. false if skipped after an earlier error or ctx done.
+	Err       error // Why the item failed or is not tried
+	Retriable bool  // Trying the item again may succeed
+	Unknown   bool  // The Server may have done it anyway: the call timed out or is abandoned when ctx is done
+}
+
+func (r ItemResult) MarshalJSON() ([]byte, error) {
+	item := struct {
+		Index     int    `json:"index"`
+		AccID     int    `json:"acc_id"`
+		Done      bool   `json:"done"`
+		Tried     bool   `json:"tried"`
+		Error     string `json:"error,omitempty"`
+		Retriable bool   `json:"retriable"`
+		Unknown   bool   `json:"unknown,omitempty"`
+	}{
+		Index:     r.Index,
+		AccID:     r.AccID,
+		Done:      r.Done,
+		Tried:     r.Tried,
+		Retriable: r.Retriable,
+		Unknown:   r.Unknown,
+	}
+	if r.Err != nil {
+		item.Error = r.Err.Error()
+	}
+	return json.Marshal(item)
+}
+
+// BatchResult reports each item of a batch operation on accounts.
+type BatchResult struct {
+	Items []ItemResult `json:"items"`
+}
+
+// OK tells if all items succeeded.
+func (b BatchResult) OK() bool {
+	for _, item := range b.Items {
+		if !item.Done {
+			return false
+		}
+	}
+	return true
+}
+
+// Err returns the error of the first failed item, or nil if all succeeded.
+func (b BatchResult) Err() error {
+	for _, item := range b.Items {
+		if !item.Done {
+			return item.Err
+		}
+	}
+	return nil
+}
+
+// Succeeded returns the AccID of all items succeeded, in order.
+func (b BatchResult) Succeeded() []int {
+	accID := []int{}
+	for _, item := range b.Items {
+		if item.Done {
+			accID = append(accID, item.AccID)
+		}
+	}
+	return accID
+}
+
+// Failed returns all items not succeeded, including those not tried.
+func (b BatchResult) Failed() []ItemResult {
+	failed := []ItemResult{}
+	for _, item := range b.Items {
+		if !item.Done {
+			failed = append(failed, item)
+		}
+	}
+	return failed
+}
+
+// RetriableIndexes returns the Index of all failed items worth trying again,
+// so the caller may build a new batch from them only.
+func (b BatchResult) RetriableIndexes() []int {
+	indexes := []int{}
+	for _, item := range b.Items {
+		if !item.Done && item.Retriable {
+			indexes = append(indexes, item.Index)
+		}
+	}
+	return indexes
+}
+
+type retriableError struct {
+	err error
+}
+
+func (e *retriableError) Error() string   { return e.err.Error() }
+func (e *retriableError) Unwrap() error   { return e.err }
+func (e *retriableError) Retriable() bool { return true }
+
+// RetriableError marks err as transient, e.g., the backend is busy or unreachable.
+// A Server should return it for failures which may not happen again if the operation is retried.
+func RetriableError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retriableError{err: err}
+}
+
+// IsRetriable tells if err is transient: marked by RetriableError, or a timeout or cancellation.
+// A timed out call may have been done by the backend, so retrying is only safe for idempotent operations.
+func IsRetriable(err error) bool {
+	var retriable interface{ Retriable() bool }
+	if errors.As(err, &retriable) {
+		return retriable.Retriable()
+	}
+	return isTimeout(err)
+}
+
+// isTimeout tells if err is a timeout or cancellation, after which the outcome of the call is unknown.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// batch runs op on n items in mode. op is passed the indexes of items to try in order, and returns how many succeeded
+// from the beginning, with the AccID of each, as Server does.
+// Unless idempotent, items passed to op that timed out are Unknown and not Retriable: trying again may do them twice.
+func batch(ctx context.Context, n int, mode BatchMode, idempotent bool, op func(ctx context.Context, indexes []int) ([]int, error)) BatchResult {
+	result := BatchResult{Items: make([]ItemResult, n)}
+	for i := range result.Items {
+		result.Items[i].Index = i
+	}
+
+	var groups [][]int
+	all := make([]int, n)
+	for i := range all {
+		all[i] = i
+	}
+	if mode == ContinueOnError {
+		for _, i := range all {
+			groups = append(groups, []int{i})
+		}
+	} else if n > 0 {
+		groups = [][]int{all}
+	}
+
+	var stopErr error // Set once the remaining items are not tried
+	for _, indexes := range groups {
+		if stopErr == nil {
+			stopErr = ctx.Err()
+		}
+		if stopErr != nil {
+			for _, i := range indexes {
+				result.Items[i].Err = stopErr
+				result.Items[i].Retriable = true
+			}
+			continue
+		}
+
+		accID, err := op(ctx, indexes)
+		unknown := !idempotent && isTimeout(err)
+		for j, i := range indexes {
+			item := &result.Items[i]
+			switch {
+			case j < len(accID):
+				item.AccID = accID[j]
+				item.Done, item.Tried = true, true
+			case j == len(accID):
+				// The Server stopped on this one
+				item.Tried = true
+				item.Err = err
+				item.Retriable = IsRetriable(err)
+				if item.Err == nil {
+					item.Err = ErrBatchIncomplete
+					item.Retriable = true
+				}
+			default:
+				item.Err = ErrBatchIncomplete
+				item.Retriable = true
+			}
+			if unknown && !item.Done {
+				item.Tried, item.Unknown, item.Retriable = true, true, false
+				item.Err = err
+			}
+		}
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			stopErr = err
+		}
+	}
+	return result
+}
+
+// AddAccountBatch creates an account for each of aconf on s, and reports each. AccID of succeeded items are the new accounts.
+// Items timed out are Unknown rather than Retriable, as the accounts may have been created.
+func AddAccountBatch(ctx context.Context, s Server, aconf []Configurables, mode BatchMode) BatchResult {
+	sc := WithContext(s)
+	return batch(ctx, len(aconf), mode, false, func(ctx context.Context, indexes []int) ([]int, error) {
+		items := make([]Configurables, 0, len(indexes))
+		for _, i := range indexes {
+			items = append(items, aconf[i])
+		}
+		return sc.AddAccountContext(ctx, items)
+	})
+}
+
+// UpdateAccountBatch updates each of accID with aconf of the same position on s, and reports each.
+func UpdateAccountBatch(ctx context.Context, s Server, accID []int, aconf []Configurables, mode BatchMode) BatchResult {
+	sc := WithContext(s)
+	result := batch(ctx, len(accID), mode, true, func(ctx context.Context, indexes []int) ([]int, error) {
+		ids := make([]int, 0, len(indexes))
+		items := make([]Configurables, 0, len(indexes))
+		for _, i := range indexes {
+			ids = append(ids, accID[i])
+			if i < len(aconf) {
+				items = append(items, aconf[i])
+			}
+		}
+		return sc.UpdateAccountContext(ctx, ids, items)
+	})
+	fillAccID(result, accID)
+	return result
+}
+
+// DeleteAccountBatch deletes each of accID on s, and reports each.
+func DeleteAccountBatch(ctx context.Context, s Server, accID []int, mode BatchMode) BatchResult {
+	sc := WithContext(s)
+	result := batch(ctx, len(accID), mode, true, func(ctx context.Context, indexes []int) ([]int, error) {
+		ids := make([]int, 0, len(indexes))
+		for _, i := range indexes {
+			ids = append(ids, accID[i])
+		}
+		return sc.DeleteAccountContext(ctx, ids)
+	})
+	fillAccID(result, accID)
+	return result
+}
+
+// fillAccID sets AccID of each item to the account it is about, including those failed.
+func fillAccID(result BatchResult, accID []int) {
+	for i := range result.Items {
+		result.Items[i].AccID = accID[i]
+	}
+}
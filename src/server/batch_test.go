@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errBackendRefused = errors.New("backend refused")
+
+// flakyServer fails on accounts with "fail" set, and with a retriable error on those with "busy" set.
+type flakyServer struct {
+	slowServer
+	nextID int
+}
+
+func (s *flakyServer) AddAccount(aconf []Configurables) ([]int, error) {
+	accID := []int{}
+	for _, conf := range aconf {
+		if fail, _ := conf.GetString("fail"); fail != "" {
+			return accID, errBackendRefused
+		}
+		if busy, _ := conf.GetString("busy"); busy != "" {
+			return accID, RetriableError(errors.New("backend busy"))
+		}
+		s.nextID++
+		accID = append(accID, s.nextID)
+	}
+	return accID, nil
+}
+
+func (s *flakyServer) DeleteAccount(accID []int) ([]int, error) {
+	successAccID := []int{}
+	for _, id := range accID {
+		if id < 0 {
+			return successAccID, errBackendRefused
+		}
+		successAccID = append(successAccID, id)
+	}
+	return successAccID, nil
+}
+
+var flakyBatch = []Configurables{{}, {"fail": "1"}, {}, {"busy": "1"}, {}}
+
+func TestBatchStopOnError(t *testing.T) {
+	s := &flakyServer{}
+	result := AddAccountBatch(context.Background(), s, flakyBatch, StopOnError)
+
+	if result.OK() || !errors.Is(result.Err(), errBackendRefused) {
+		t.Fatalf("AddAccountBatch() returns error:%v\n", result.Err())
+	}
+	if succeeded := result.Succeeded(); !reflect.DeepEqual(succeeded, []int{1}) {
+		t.Errorf("Succeeded() returns %v\n", succeeded)
+	}
+	item := result.Items[1]
+	if !item.Tried || item.Retriable {
+		t.Errorf("Failed item is %+v, want tried and not retriable\n", item)
+	}
+	for _, item := range result.Items[2:] {
+		if item.Tried || !item.Retriable || item.Err != ErrBatchIncomplete {
+			t.Errorf("Item after error is %+v, want not tried and retriable\n", item)
+		}
+	}
+	if indexes := result.RetriableIndexes(); !reflect.DeepEqual(indexes, []int{2, 3, 4}) {
+		t.Errorf("RetriableIndexes() returns %v\n", indexes)
+	}
+}
+
+func TestBatchContinueOnError(t *testing.T) {
+	s := &flakyServer{}
+	result := AddAccountBatch(context.Background(), s, flakyBatch, ContinueOnError)
+
+	if succeeded := result.Succeeded(); !reflect.DeepEqual(succeeded, []int{1, 2, 3}) {
+		t.Errorf("Succeeded() returns %v\n", succeeded)
+	}
+	if failed := result.Failed(); len(failed) != 2 || failed[0].Index != 1 || failed[1].Index != 3 {
+		t.Errorf("Failed() returns %+v\n", failed)
+	}
+	// Only the busy one is worth retrying
+	if indexes := result.RetriableIndexes(); !reflect.DeepEqual(indexes, []int{3}) {
+		t.Errorf("RetriableIndexes() returns %v\n", indexes)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("json.Marshal() returns error:%s\n", err)
+	}
+	var decoded struct {
+		Items []struct {
+			Index     int    `json:"index"`
+			Error     string `json:"error"`
+			Retriable bool   `json:"retriable"`
+		} `json:"items"`
+	}
+	if err = json.Unmarshal(data, &decoded); err != nil || decoded.Items[3].Error != "backend busy" || !decoded.Items[3].Retriable {
+		t.Errorf("BatchResult is marshaled as %s\n", data)
+	}
+}
+
+func TestBatchDeleteAndCanceled(t *testing.T) {
+	s := &flakyServer{}
+	result := DeleteAccountBatch(context.Background(), s, []int{7, -1, 9}, ContinueOnError)
+	if succeeded := result.Succeeded(); !reflect.DeepEqual(succeeded, []int{7, 9}) {
+		t.Errorf("Succeeded() returns %v\n", succeeded)
+	}
+	if item := result.Items[1]; item.AccID != -1 || item.Done {
+		t.Errorf("Failed item is %+v\n", item)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result = AddAccountBatch(ctx, s, []Configurables{{}, {}}, ContinueOnError)
+	for _, item := range result.Items {
+		if item.Tried || !item.Retriable || !errors.Is(item.Err, context.Canceled) {
+			t.Errorf("Item with ctx canceled is %+v\n", item)
+		}
+	}
+
+	if result := AddAccountBatch(context.Background(), s, nil, StopOnError); !result.OK() || len(result.Items) != 0 {
+		t.Errorf("AddAccountBatch() of no item returns %+v\n", result)
+	}
+}
+
+func TestBatchTimedOut(t *testing.T) {
+	s := &slowServer{delay: 200 * time.Millisecond, calls: make(chan string, 10)}
+
+	// The abandoned AddAccount may still create the accounts, so they must not be added again
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	result := AddAccountBatch(ctx, s, []Configurables{{}, {}}, StopOnError)
+	for _, item := range result.Items {
+		if !item.Tried || !item.Unknown || item.Retriable || !errors.Is(item.Err, context.DeadlineExceeded) {
+			t.Errorf("Item of timed out AddAccount is %+v, want tried, unknown and not retriable\n", item)
+		}
+	}
+	if indexes := result.RetriableIndexes(); len(indexes) != 0 {
+		t.Errorf("RetriableIndexes() returns %v\n", indexes)
+	}
+
+	// Deleting again is harmless
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	result = DeleteAccountBatch(ctx, s, []int{7}, StopOnError)
+	if item := result.Items[0]; item.Unknown || !item.Retriable {
+		t.Errorf("Item of timed out DeleteAccount is %+v, want retriable\n", item)
+	}
+}
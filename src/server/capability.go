@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// Optional interfaces a Server may implement for account lifecycle operations beyond add/update/delete.
+// Ulysses detects them with type assertion, and reports ErrCapabilityUnsupported for server types lacking one.
+//
+// Like Server, each operates on a series of accounts in order and returns immediately upon an error,
+// with successAccID containing IDs of all accounts done before it.
+
+// AccountSuspender stops the service of accounts without deleting their data, e.g., for an overdue bill.
+type AccountSuspender interface {
+	SuspendAccount(accID []int) (successAccID []int, err error)
+	UnsuspendAccount(accID []int) (successAccID []int, err error)
+}
+
+// AccountRenewer extends the expiry of accounts by period.
+type AccountRenewer interface {
+	RenewAccount(accID []int, period time.Duration) (successAccID []int, err error)
+}
+
+// AccountPackageChanger moves accounts to another package (plan) defined by the backend, e.g., for an upgrade.
+type AccountPackageChanger interface {
+	ChangeAccountPackage(accID []int, pkg string) (successAccID []int, err error)
+}
+
+// AccountPasswordResetter sets a new password for each account, and returns the new Credentials in the same order as accID.
+type AccountPasswordResetter interface {
+	ResetAccountPassword(accID []int) ([]Credential, error)
+}
+
+// Capability names, as listed by Capabilities()
+const (
+	CapabilitySuspend       = `suspend`
+	CapabilityRenew         = `renew`
+	CapabilityChangePackage = `change_package`
+	CapabilityResetPassword = `reset_password`
+)
+
+// Capabilities returns the names of optional operations s supports.
+func Capabilities(s Server) []string {
+	capabilities := []string{}
+	if _, ok := s.(AccountSuspender); ok {
+		capabilities = append(capabilities, CapabilitySuspend)
+	}
+	if _, ok := s.(AccountRenewer); ok {
+		capabilities = append(capabilities, CapabilityRenew)
+	}
+	if _, ok := s.(AccountPackageChanger); ok {
+		capabilities = append(capabilities, CapabilityChangePackage)
+	}
+	if _, ok := s.(AccountPasswordResetter); ok {
+		capabilities = append(capabilities, CapabilityResetPassword)
+	}
+	return capabilities
+}
+
+// The functions below perform an optional operation on s if it supports it, or return ErrCapabilityUnsupported.
+// Same as the adapter of WithContext, they return ctx.Err() once ctx is done, while s may still complete the operation.
+
+func SuspendAccount(ctx context.Context, s Server, accID []int) ([]int, error) {
+	suspender, ok := s.(AccountSuspender)
+	if !ok {
+		return nil, ErrCapabilityUnsupported
+	}
+	var successAccID []int
+	completed, err := runContext(ctx, func() (err error) {
+		successAccID, err = suspender.SuspendAccount(accID)
+		return err
+	})
+	if !completed {
+		return nil, err
+	}
+	return successAccID, err
+}
+
+func UnsuspendAccount(ctx context.Context, s Server, accID []int) ([]int, error) {
+	suspender, ok := s.(AccountSuspender)
+	if !ok {
+		return nil, ErrCapabilityUnsupported
+	}
+	var successAccID []int
+	completed, err := runContext(ctx, func() (err error) {
+		successAccID, err = suspender.UnsuspendAccount(accID)
+		return err
+	})
+	if !completed {
+		return nil, err
+	}
+	return successAccID, err
+}
+
+func RenewAccount(ctx context.Context, s Server, accID []int, period time.Duration) ([]int, error) {
+	renewer, ok := s.(AccountRenewer)
+	if !ok {
+		return nil, ErrCapabilityUnsupported
+	}
+	var successAccID []int
+	completed, err := runContext(ctx, func() (err error) {
+		successAccID, err = renewer.RenewAccount(accID, period)
+		return err
+	})
+	if !completed {
+		return nil, err
+	}
+	return successAccID, err
+}
+
+func ChangeAccountPackage(ctx context.Context, s Server, accID []int, pkg string) ([]int, error) {
+	changer, ok := s.(AccountPackageChanger)
+	if !ok {
+		return nil, ErrCapabilityUnsupported
+	}
+	var successAccID []int
+	completed, err := runContext(ctx, func() (err error) {
+		successAccID, err = changer.ChangeAccountPackage(accID, pkg)
+		return err
+	})
+	if !completed {
+		return nil, err
+	}
+	return successAccID, err
+}
+
+func ResetAccountPassword(ctx context.Context, s Server, accID []int) ([]Credential, error) {
+	resetter, ok := s.(AccountPasswordResetter)
+	if !ok {
+		return nil, ErrCapabilityUnsupported
+	}
+	var credentials []Credential
+	completed, err := runContext(ctx, func() (err error) {
+		credentials, err = resetter.ResetAccountPassword(accID)
+		return err
+	})
+	if !completed {
+		return nil, err
+	}
+	return credentials, err
+}
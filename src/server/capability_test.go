@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// suspendableServer supports suspending and renewing only.
+type suspendableServer struct {
+	slowServer
+	suspended map[int]bool
+	renewed   time.Duration
+}
+
+func (s *suspendableServer) SuspendAccount(accID []int) ([]int, error) {
+	for _, id := range accID {
+		s.suspended[id] = true
+	}
+	return accID, nil
+}
+
+func (s *suspendableServer) UnsuspendAccount(accID []int) ([]int, error) {
+	for _, id := range accID {
+		delete(s.suspended, id)
+	}
+	return accID, nil
+}
+
+func (s *suspendableServer) RenewAccount(accID []int, period time.Duration) ([]int, error) {
+	s.renewed += period
+	return accID, nil
+}
+
+func TestCapabilities(t *testing.T) {
+	plain := &slowServer{calls: make(chan string, 10)}
+	if capabilities := Capabilities(plain); len(capabilities) != 0 {
+		t.Errorf("Capabilities() of plain Server returns %v\n", capabilities)
+	}
+
+	s := &suspendableServer{slowServer: *plain, suspended: map[int]bool{}}
+	if capabilities := Capabilities(s); !reflect.DeepEqual(capabilities, []string{CapabilitySuspend, CapabilityRenew}) {
+		t.Errorf("Capabilities() returns %v\n", capabilities)
+	}
+}
+
+func TestCapabilityOperations(t *testing.T) {
+	ctx := context.Background()
+	s := &suspendableServer{slowServer: slowServer{calls: make(chan string, 10)}, suspended: map[int]bool{}}
+
+	if _, err := SuspendAccount(ctx, s, []int{1, 2}); err != nil {
+		t.Fatalf("SuspendAccount() returns error:%s\n", err)
+	}
+	if _, err := UnsuspendAccount(ctx, s, []int{2}); err != nil {
+		t.Fatalf("UnsuspendAccount() returns error:%s\n", err)
+	}
+	if !s.suspended[1] || s.suspended[2] {
+		t.Errorf("Suspended accounts are %v, want only 1\n", s.suspended)
+	}
+	if _, err := RenewAccount(ctx, s, []int{1}, 24*time.Hour); err != nil || s.renewed != 24*time.Hour {
+		t.Errorf("RenewAccount() returns error:%v, renewed %s\n", err, s.renewed)
+	}
+
+	if _, err := ChangeAccountPackage(ctx, s, []int{1}, "pro"); err != ErrCapabilityUnsupported {
+		t.Errorf("ChangeAccountPackage() returns error:%v, want unsupported\n", err)
+	}
+	if _, err := ResetAccountPassword(ctx, s, []int{1}); err != ErrCapabilityUnsupported {
+		t.Errorf("ResetAccountPassword() returns error:%v, want unsupported\n", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := SuspendAccount(canceled, s, []int{3}); err != context.Canceled || s.suspended[3] {
+		t.Errorf("SuspendAccount() returns error:%v with ctx canceled\n", err)
+	}
+}
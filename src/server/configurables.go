@@ -1,27 +1,274 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // JSON utils
 
-type Configurables map[string]string
+// Configurables is a JSON object as decoded by UnmarshalJSON: values are string, json.Number, bool,
+// []interface{} or a nested Configurables. Numbers are kept as json.Number, so their text is exact,
+// and a Configurables round-trips through JSON with the type of each value unchanged.
+// Values set in Go may be of any other type json.Marshal accepts.
+// Use the typed getters below rather than reading values directly, as they take any of these forms.
+type Configurables map[string]interface{}
 
-// JsonToConfigurables returns map[string]string representing a Json Object ({, , ,})
-func JsonToConfigurables(data []byte) (map[string]string, error) {
-	var configurables map[string]string
-	if json.Unmarshal(data, &configurables) != nil {
+// UnmarshalJSON accepts a JSON object with values of any type. null values are left out.
+func (c *Configurables) UnmarshalJSON(data []byte) error {
+	var rawMap map[string]json.RawMessage
+	if err := json.Unmarshal(data, &rawMap); err != nil {
+		return err
+	}
+	if rawMap == nil { // null
+		*c = nil
+		return nil
+	}
+
+	configurables := Configurables{}
+	for key, raw := range rawMap {
+		value, err := decodeValue(raw)
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			configurables[key] = value
+		}
+	}
+	*c = configurables
+	return nil
+}
+
+// decodeValue returns raw decoded with numbers as json.Number and objects as Configurables.
+func decodeValue(raw json.RawMessage) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return normalizeValue(value), nil
+}
+
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		nested := Configurables{}
+		for key, element := range v {
+			nested[key] = normalizeValue(element)
+		}
+		return nested
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeValue(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// ValueString returns a string value as is, or any other value as its compact JSON text,
+// e.g., 8443, true, ["a","b"] or {"k":"v"}. nil is "".
+func ValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		valueBytes, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(valueBytes)
+	}
+}
+
+// rawToString returns a JSON string as is, or any other JSON value as its compact text. ok is false for null.
+func rawToString(raw json.RawMessage) (value string, ok bool, err error) {
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case bytes.Equal(raw, []byte("null")):
+		return "", false, nil
+	case len(raw) > 0 && raw[0] == '"':
+		err = json.Unmarshal(raw, &value)
+		return value, err == nil, err
+	default:
+		var compact bytes.Buffer
+		if err = json.Compact(&compact, raw); err != nil {
+			return "", false, err
+		}
+		return compact.String(), true, nil
+	}
+}
+
+// JsonToConfigurables returns the Configurables of a Json Object ({, , ,})
+func JsonToConfigurables(data []byte) (Configurables, error) {
+	var configurables Configurables
+	if json.Unmarshal(data, &configurables) != nil || configurables == nil {
 		return nil, ErrBadJsonObject
 	}
 	return configurables, nil
 }
 
-// JsonArrToConfigurablesSlice returns a slice of map[string]string representing a Json Array ([{}, {}, {}])
-func JsonArrToConfigurablesSlice(data []byte) ([]map[string]string, error) {
-	var configurablesSlice []map[string]string
+// JsonArrToConfigurablesSlice returns the Configurables of each object in a Json Array ([{}, {}, {}])
+func JsonArrToConfigurablesSlice(data []byte) ([]Configurables, error) {
+	var configurablesSlice []Configurables
 	if json.Unmarshal(data, &configurablesSlice) != nil {
 		return nil, ErrBadJsonArray
 	}
+	if configurablesSlice == nil {
+		configurablesSlice = []Configurables{}
+	}
 	return configurablesSlice, nil
 }
+
+// Typed getters. All return ErrConfigurableMissing if key is not set,
+// or ErrConfigurableType if the value can't be read as the type.
+
+// get returns the value of key as ValueString() does.
+func (c Configurables) get(key string) (string, error) {
+	value, ok := c[key]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrConfigurableMissing, key)
+	}
+	return ValueString(value), nil
+}
+
+func typeError(key string, want string, value string) error {
+	return fmt.Errorf("%w: %s is %q, not %s", ErrConfigurableType, key, value, want)
+}
+
+// GetString returns a string value as is, or any other value as its compact JSON text.
+func (c Configurables) GetString(key string) (string, error) {
+	return c.get(key)
+}
+
+// GetInt reads a decimal integer, e.g., 8443 or "8443".
+func (c Configurables) GetInt(key string) (int64, error) {
+	value, err := c.get(key)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0, typeError(key, "an integer", value)
+	}
+	return i, nil
+}
+
+// GetBool reads true or false, and the other forms accepted by strconv.ParseBool.
+func (c Configurables) GetBool(key string) (bool, error) {
+	value, err := c.get(key)
+	if err != nil {
+		return false, err
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return false, typeError(key, "a boolean", value)
+	}
+	return b, nil
+}
+
+// GetDuration reads a Go duration, e.g., "1m30s", or an integer as seconds.
+func (c Configurables) GetDuration(key string) (time.Duration, error) {
+	value, err := c.get(key)
+	if err != nil {
+		return 0, err
+	}
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, typeError(key, "a duration", value)
+	}
+	return d, nil
+}
+
+// GetStringSlice reads a JSON array, e.g., ["10.0.0.1","10.0.0.2"], or a comma-separated list.
+// Elements that are not strings are kept as their JSON text. An empty value is an empty slice.
+func (c Configurables) GetStringSlice(key string) ([]string, error) {
+	value, err := c.get(key)
+	if err != nil {
+		return nil, err
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return []string{}, nil
+	}
+
+	if strings.HasPrefix(value, "[") {
+		var rawSlice []json.RawMessage
+		if err := json.Unmarshal([]byte(value), &rawSlice); err != nil {
+			return nil, typeError(key, "a list", value)
+		}
+		slice := make([]string, 0, len(rawSlice))
+		for _, raw := range rawSlice {
+			element, ok, err := rawToString(raw)
+			if err != nil {
+				return nil, typeError(key, "a list", value)
+			}
+			if ok {
+				slice = append(slice, element)
+			}
+		}
+		return slice, nil
+	}
+
+	slice := strings.Split(value, ",")
+	for i := range slice {
+		slice[i] = strings.TrimSpace(slice[i])
+	}
+	return slice, nil
+}
+
+// GetConfigurables reads a nested JSON object, e.g., {"user":"root","port":22}.
+func (c Configurables) GetConfigurables(key string) (Configurables, error) {
+	value, err := c.get(key)
+	if err != nil {
+		return nil, err
+	}
+	var nested Configurables
+	if err := json.Unmarshal([]byte(value), &nested); err != nil || nested == nil {
+		return nil, typeError(key, "an object", value)
+	}
+	return nested, nil
+}
+
+// Typed setters, storing values as UnmarshalJSON decodes them, so they are the same after a round trip.
+
+func (c Configurables) SetInt(key string, value int64) {
+	c[key] = json.Number(strconv.FormatInt(value, 10))
+}
+
+func (c Configurables) SetBool(key string, value bool) {
+	c[key] = value
+}
+
+func (c Configurables) SetDuration(key string, value time.Duration) {
+	c[key] = value.String()
+}
+
+func (c Configurables) SetStringSlice(key string, value []string) {
+	slice := make([]interface{}, 0, len(value))
+	for _, element := range value {
+		slice = append(slice, element)
+	}
+	c[key] = slice
+}
+
+func (c Configurables) SetConfigurables(key string, value Configurables) {
+	if value == nil {
+		value = Configurables{}
+	}
+	c[key] = value
+}
@@ -1,6 +1,12 @@
 package server
 
-import "testing"
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
 
 var (
 	ExampleJson = []byte(`{
@@ -60,3 +66,106 @@ func TestJsonArrToConfigurablesSlice(t *testing.T) {
 		}
 	}
 }
+
+var ExampleTypedJson = []byte(`{
+	"host": "panel.example.com",
+	"port": 8443,
+	"tls": true,
+	"timeout": "1m30s",
+	"retry_after": 5,
+	"allowed_ips": ["10.0.0.1", "10.0.0.2"],
+	"features": "ipv6, ddos",
+	"ssh": {"user": "root", "port": 22},
+	"note": null
+}`)
+
+func TestConfigurablesTypedValues(t *testing.T) {
+	conf, err := JsonToConfigurables(ExampleTypedJson)
+	if err != nil {
+		t.Fatalf("JsonToConfigurables() returns error:%s\n", err)
+	}
+	c := Configurables(conf)
+
+	if host, err := c.GetString("host"); err != nil || host != "panel.example.com" {
+		t.Errorf("GetString() returns %q, %v\n", host, err)
+	}
+	if port, err := c.GetInt("port"); err != nil || port != 8443 {
+		t.Errorf("GetInt() returns %d, %v\n", port, err)
+	}
+	if tls, err := c.GetBool("tls"); err != nil || !tls {
+		t.Errorf("GetBool() returns %v, %v\n", tls, err)
+	}
+	if d, err := c.GetDuration("timeout"); err != nil || d != 90*time.Second {
+		t.Errorf("GetDuration() returns %s, %v\n", d, err)
+	}
+	if d, err := c.GetDuration("retry_after"); err != nil || d != 5*time.Second {
+		t.Errorf("GetDuration() of seconds returns %s, %v\n", d, err)
+	}
+	if ips, err := c.GetStringSlice("allowed_ips"); err != nil || !reflect.DeepEqual(ips, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("GetStringSlice() returns %v, %v\n", ips, err)
+	}
+	if features, err := c.GetStringSlice("features"); err != nil || !reflect.DeepEqual(features, []string{"ipv6", "ddos"}) {
+		t.Errorf("GetStringSlice() of comma-separated list returns %v, %v\n", features, err)
+	}
+	ssh, err := c.GetConfigurables("ssh")
+	if err != nil {
+		t.Fatalf("GetConfigurables() returns error:%s\n", err)
+	}
+	if port, err := ssh.GetInt("port"); err != nil || port != 22 || ssh["user"] != "root" {
+		t.Errorf("GetConfigurables() returns %v\n", ssh)
+	}
+	if _, ok := c["note"]; ok {
+		t.Errorf("null value is kept\n")
+	}
+
+	if _, err := c.GetInt("missing"); !errors.Is(err, ErrConfigurableMissing) {
+		t.Errorf("GetInt() of missing key returns %v\n", err)
+	}
+	if _, err := c.GetInt("host"); !errors.Is(err, ErrConfigurableType) {
+		t.Errorf("GetInt() of string returns %v\n", err)
+	}
+	if _, err := c.GetBool("port"); !errors.Is(err, ErrConfigurableType) {
+		t.Errorf("GetBool() of int returns %v\n", err)
+	}
+	if _, err := c.GetConfigurables("allowed_ips"); !errors.Is(err, ErrConfigurableType) {
+		t.Errorf("GetConfigurables() of list returns %v\n", err)
+	}
+}
+
+func TestConfigurablesRoundTrip(t *testing.T) {
+	c := Configurables{"name": "node-1"}
+	c.SetInt("port", 8443)
+	c.SetBool("tls", true)
+	c.SetDuration("timeout", 90*time.Second)
+	c.SetStringSlice("allowed_ips", []string{"10.0.0.1", "10.0.0.2"})
+	c.SetConfigurables("ssh", Configurables{"user": "root"})
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("json.Marshal() returns error:%s\n", err)
+	}
+	var decoded Configurables
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() returns error:%s\n", err)
+	}
+	if !reflect.DeepEqual(c, decoded) {
+		t.Errorf("Round trip changes %v into %v\n", c, decoded)
+	}
+	if ips, err := decoded.GetStringSlice("allowed_ips"); err != nil || len(ips) != 2 {
+		t.Errorf("GetStringSlice() after round trip returns %v, %v\n", ips, err)
+	}
+
+	// Types of values read from JSON are kept, so "8443" and 8443 stay apart
+	mixed := `{"big":12345678901234567890,"ips":["a","b"],"n":{"k":1,"list":[1.5,"x",null]},"port":8443,"port_text":"8443","tls":false}`
+	var mixedConf Configurables
+	if err := json.Unmarshal([]byte(mixed), &mixedConf); err != nil {
+		t.Fatalf("json.Unmarshal() returns error:%s\n", err)
+	}
+	if data, err = json.Marshal(mixedConf); err != nil || string(data) != mixed {
+		t.Errorf("Round trip changes %s into %s, %v\n", mixed, data, err)
+	}
+
+	if _, err := JsonToConfigurables([]byte(`["not", "an", "object"]`)); err != ErrBadJsonObject {
+		t.Errorf("JsonToConfigurables() of array returns %v\n", err)
+	}
+}
@@ -1,7 +1,116 @@
 package server
 
+import (
+	"strings"
+)
+
 // It is up to module designer to parse/utilize the Credential.
+// A Credential may also implement StructuredCredential, so Ulysses can show each field consistently.
 type Credential interface {
 	ForClient() (credential string)
 	ForAdmin() (credential string)
 }
+
+// CredentialFormat hints how a UI should display a CredentialField.
+type CredentialFormat string
+
+const (
+	CredentialText      CredentialFormat = "text"
+	CredentialMultiline CredentialFormat = "multiline" // e.g., a config file
+	CredentialURL       CredentialFormat = "url"       // e.g., a subscription link
+	CredentialQRCode    CredentialFormat = "qrcode"    // shown as a QR code to scan with a client app
+)
+
+// CredentialField is one item of a Credential, e.g., username, password or server address.
+type CredentialField struct {
+	Key       string           `json:"key"`
+	Label     string           `json:"label"`
+	Value     string           `json:"value"`
+	Format    CredentialFormat `json:"format"`
+	Secret    bool             `json:"secret"`               // Masked until revealed
+	Copyable  bool             `json:"copyable"`             // Offered a copy button
+	AdminOnly bool             `json:"admin_only,omitempty"` // Left out of the client view
+}
+
+// StructuredCredential is a Credential made of fields.
+type StructuredCredential interface {
+	Credential
+	Fields() []CredentialField
+}
+
+// CredentialFields is a ready StructuredCredential for modules to return.
+type CredentialFields []CredentialField
+
+func (cf CredentialFields) Fields() []CredentialField {
+	return cf
+}
+
+func (cf CredentialFields) ForClient() string {
+	return cf.text(false)
+}
+
+func (cf CredentialFields) ForAdmin() string {
+	return cf.text(true)
+}
+
+// text lists "Label: Value" a line each.
+func (cf CredentialFields) text(admin bool) string {
+	lines := []string{}
+	for _, field := range cf {
+		if field.AdminOnly && !admin {
+			continue
+		}
+		field = field.withDefaults()
+		lines = append(lines, field.Label+": "+field.Value)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// CredentialView is the JSON representation of a Credential given by Ulysses.
+// Fields is empty for a Credential not structured, which has only Text.
+type CredentialView struct {
+	Fields []CredentialField `json:"fields"`
+	Text   string            `json:"text"`
+}
+
+// ClientCredentialView returns the view of c for its owner, without AdminOnly fields.
+func ClientCredentialView(c Credential) CredentialView {
+	view := CredentialView{Fields: []CredentialField{}}
+	if c == nil {
+		return view
+	}
+	if sc, ok := c.(StructuredCredential); ok {
+		for _, field := range sc.Fields() {
+			if !field.AdminOnly {
+				view.Fields = append(view.Fields, field.withDefaults())
+			}
+		}
+	}
+	view.Text = c.ForClient()
+	return view
+}
+
+// AdminCredentialView returns the view of c for admins, with all fields.
+func AdminCredentialView(c Credential) CredentialView {
+	view := CredentialView{Fields: []CredentialField{}}
+	if c == nil {
+		return view
+	}
+	if sc, ok := c.(StructuredCredential); ok {
+		for _, field := range sc.Fields() {
+			view.Fields = append(view.Fields, field.withDefaults())
+		}
+	}
+	view.Text = c.ForAdmin()
+	return view
+}
+
+func (f CredentialField) withDefaults() CredentialField {
+	if f.Format == "" {
+		f.Format = CredentialText
+	}
+	if f.Label == "" {
+		f.Label = f.Key
+	}
+	return f
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// textCredential is a Credential of strings only, as modules written before structured credentials.
+type textCredential struct{}
+
+func (textCredential) ForClient() string { return "user:alice" }
+func (textCredential) ForAdmin() string  { return "user:alice node:10.0.0.1" }
+
+type textUsage struct{}
+
+func (textUsage) ForClient() string { return "1 GB used" }
+func (textUsage) ForAdmin() string  { return "1073741824 bytes used" }
+
+var exampleCredential = CredentialFields{
+	{Key: "username", Label: "Username", Value: "alice", Copyable: true},
+	{Key: "password", Label: "Password", Value: "s3cr3t", Secret: true, Copyable: true},
+	{Key: "node", Value: "10.0.0.1", AdminOnly: true},
+}
+
+func TestCredentialView(t *testing.T) {
+	client := ClientCredentialView(exampleCredential)
+	if len(client.Fields) != 2 || client.Fields[1].Key != "password" || !client.Fields[1].Secret {
+		t.Errorf("ClientCredentialView() returns fields %+v\n", client.Fields)
+	}
+	if client.Fields[0].Format != CredentialText {
+		t.Errorf("ClientCredentialView() returns format %q, want %q by default\n", client.Fields[0].Format, CredentialText)
+	}
+	if strings.Contains(client.Text, "10.0.0.1") || !strings.Contains(client.Text, "Password: s3cr3t") {
+		t.Errorf("ClientCredentialView() returns text %q\n", client.Text)
+	}
+
+	admin := AdminCredentialView(exampleCredential)
+	if len(admin.Fields) != 3 || admin.Fields[2].Label != "node" {
+		t.Errorf("AdminCredentialView() returns fields %+v, want all with label defaulting to key\n", admin.Fields)
+	}
+
+	// String-only Credentials keep working, with text only
+	text := ClientCredentialView(textCredential{})
+	if len(text.Fields) != 0 || text.Text != "user:alice" {
+		t.Errorf("ClientCredentialView() of text credential returns %+v\n", text)
+	}
+	if text = AdminCredentialView(textCredential{}); text.Text != "user:alice node:10.0.0.1" {
+		t.Errorf("AdminCredentialView() of text credential returns %+v\n", text)
+	}
+
+	data, err := json.Marshal(ClientCredentialView(textCredential{}))
+	if err != nil {
+		t.Fatalf("json.Marshal() returns error:%s\n", err)
+	}
+	if string(data) != `{"fields":[],"text":"user:alice"}` {
+		t.Errorf("CredentialView is marshaled as %s\n", data)
+	}
+}
+
+func TestUsageView(t *testing.T) {
+	usage := UsageMetrics{
+		{Key: "traffic", Label: "Traffic", Value: 1.5e9, Limit: Limited(1e11), Unit: UnitBytes, WindowStart: 1700000000, WindowEnd: 1702592000},
+		{Key: "connections", Label: "Connections", Value: 3},
+		{Key: "abuse_reports", Value: 1, AdminOnly: true},
+	}
+
+	client := ClientUsageView(usage)
+	if len(client.Metrics) != 2 || client.Metrics[1].Unit != UnitCount || client.Metrics[1].Limit != nil {
+		t.Errorf("ClientUsageView() returns metrics %+v\n", client.Metrics)
+	}
+	if client.Text != "Traffic: 1500000000/100000000000 bytes\nConnections: 3 count" {
+		t.Errorf("ClientUsageView() returns text %q\n", client.Text)
+	}
+	if admin := AdminUsageView(usage); len(admin.Metrics) != 3 {
+		t.Errorf("AdminUsageView() returns metrics %+v\n", admin.Metrics)
+	}
+
+	data, err := json.Marshal(client)
+	if err != nil {
+		t.Fatalf("json.Marshal() returns error:%s\n", err)
+	}
+	var decoded struct {
+		Metrics []map[string]interface{} `json:"metrics"`
+	}
+	json.Unmarshal(data, &decoded)
+	if decoded.Metrics[0]["limit"] != 1e11 || decoded.Metrics[0]["window_end"] != float64(1702592000) || decoded.Metrics[1]["limit"] != nil {
+		t.Errorf("UsageView is marshaled as %s\n", data)
+	}
+
+	if text := ClientUsageView(textUsage{}); len(text.Metrics) != 0 || text.Text != "1 GB used" {
+		t.Errorf("ClientUsageView() of text usage returns %+v\n", text)
+	}
+	if view := ClientUsageView(nil); view.Text != "" || len(view.Metrics) != 0 {
+		t.Errorf("ClientUsageView(nil) returns %+v\n", view)
+	}
+}
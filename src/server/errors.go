@@ -11,4 +11,9 @@ var (
 	ErrAccountConfigurables = errors.New("ulysses/server: bad account config")
 	ErrBadJsonObject        = errors.New("ulysses/server: bad JSON object")
 	ErrBadJsonArray         = errors.New("ulysses/server: bad JSON array")
+	ErrConfigurableMissing  = errors.New("ulysses/server: configurable not set")
+	ErrConfigurableType     = errors.New("ulysses/server: configurable has wrong type")
+
+	ErrCapabilityUnsupported = errors.New("ulysses/server: operation not supported by server type")
+	ErrBatchIncomplete       = errors.New("ulysses/server: not tried after an earlier error in batch")
 )
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldType is the type a Configurables value must parse as.
+type FieldType string
+
+const (
+	FieldString FieldType = "string"
+	FieldInt    FieldType = "int"
+	FieldBool   FieldType = "bool"
+	FieldURL    FieldType = "url"  // absolute, with scheme and host
+	FieldEnum   FieldType = "enum" // one of Field.Enum
+
+	FieldDuration FieldType = "duration" // See Configurables.GetDuration()
+	FieldList     FieldType = "list"     // See Configurables.GetStringSlice()
+	FieldObject   FieldType = "object"   // See Configurables.GetConfigurables()
+)
+
+// Field declares one key of Configurables.
+type Field struct {
+	Key         string    `json:"key"`
+	Type        FieldType `json:"type"`
+	Required    bool      `json:"required"`
+	Default     string    `json:"default,omitempty"` // Filled in if the key is missing
+	Enum        []string  `json:"enum,omitempty"`
+	Secret      bool      `json:"secret"` // Sealed before stored. See SecretKeysRegistrar.
+	Description string    `json:"description,omitempty"`
+}
+
+// Schema declares the keys a Configurables may have.
+// Keys not declared are rejected unless AllowUnknown is set, so typos are caught before reaching the backend.
+type Schema struct {
+	Fields       []Field `json:"fields"`
+	AllowUnknown bool    `json:"allow_unknown"`
+}
+
+// SchemaRegistrar is an optional interface of ServerRegistrar publishing the schema of
+// sconf passed to NewServer()/UpdateServer() and aconf passed to AddAccount()/UpdateAccount().
+// Ulysses validates against them before a server config is stored or accounts are created,
+// and admin UIs may fetch them to render forms.
+type SchemaRegistrar interface {
+	ServerSchema() Schema
+	AccountSchema() Schema
+}
+
+// FieldProblem tells why the value of Key doesn't fit the Schema.
+type FieldProblem struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// ValidationError lists all problems found in a Configurables.
+// It matches ErrServerConfigurables or ErrAccountConfigurables with errors.Is().
+type ValidationError struct {
+	Err      error
+	Problems []FieldProblem
+}
+
+func (e *ValidationError) Error() string {
+	reasons := make([]string, 0, len(e.Problems))
+	for _, problem := range e.Problems {
+		reasons = append(reasons, problem.Key+": "+problem.Reason)
+	}
+	return e.Err.Error() + ": " + strings.Join(reasons, "; ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func (f Field) check(value string) string {
+	switch f.Type {
+	case FieldInt:
+		if _, err := (Configurables{f.Key: value}).GetInt(f.Key); err != nil {
+			return "not an integer"
+		}
+	case FieldBool:
+		if _, err := (Configurables{f.Key: value}).GetBool(f.Key); err != nil {
+			return "not a boolean"
+		}
+	case FieldURL:
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			return "not an absolute URL"
+		}
+	case FieldEnum:
+		for _, option := range f.Enum {
+			if value == option {
+				return ""
+			}
+		}
+		return "not one of " + strings.Join(f.Enum, ", ")
+	case FieldDuration:
+		if _, err := (Configurables{f.Key: value}).GetDuration(f.Key); err != nil {
+			return "not a duration"
+		}
+	case FieldList:
+		if _, err := (Configurables{f.Key: value}).GetStringSlice(f.Key); err != nil {
+			return "not a list"
+		}
+	case FieldObject:
+		if _, err := (Configurables{f.Key: value}).GetConfigurables(f.Key); err != nil {
+			return "not an object"
+		}
+	}
+	return ""
+}
+
+// validate returns a copy of conf with defaults filled in, or a *ValidationError wrapping errBase.
+func (s Schema) validate(conf Configurables, errBase error) (Configurables, error) {
+	validated := Configurables{}
+	for key, value := range conf {
+		validated[key] = value
+	}
+	problems := []FieldProblem{}
+
+	declared := map[string]bool{}
+	for _, field := range s.Fields {
+		declared[field.Key] = true
+
+		value, ok := validated[field.Key]
+		if !ok && field.Default != "" {
+			value, ok = field.Default, true
+			validated[field.Key] = value
+		}
+		if !ok || ValueString(value) == "" {
+			if field.Required {
+				problems = append(problems, FieldProblem{Key: field.Key, Reason: "required"})
+			}
+			continue
+		}
+		// Secrets are sealed as strings, which keeps their type only if they are strings already
+		if _, isString := value.(string); field.Secret && !isString {
+			problems = append(problems, FieldProblem{Key: field.Key, Reason: "not a string"})
+			continue
+		}
+		if reason := field.check(ValueString(value)); reason != "" {
+			problems = append(problems, FieldProblem{Key: field.Key, Reason: reason})
+		}
+	}
+
+	if !s.AllowUnknown {
+		for key := range conf {
+			if !declared[key] {
+				problems = append(problems, FieldProblem{Key: key, Reason: "unknown key"})
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.SliceStable(problems, func(i, j int) bool {
+			return problems[i].Key < problems[j].Key
+		})
+		return nil, &ValidationError{Err: errBase, Problems: problems}
+	}
+	return validated, nil
+}
+
+// secretKeys returns the keys flagged Secret.
+func (s Schema) secretKeys() []string {
+	keys := []string{}
+	for _, field := range s.Fields {
+		if field.Secret {
+			keys = append(keys, field.Key)
+		}
+	}
+	return keys
+}
+
+// SchemaByType returns the server and account schema of serverType.
+// ok is false if serverType has no schema, and its Configurables are not validated.
+func SchemaByType(serverType string) (serverSchema Schema, accountSchema Schema, ok bool) {
+	sr, ok := regManagers[serverType].(SchemaRegistrar)
+	if !ok {
+		return Schema{}, Schema{}, false
+	}
+	return sr.ServerSchema(), sr.AccountSchema(), true
+}
+
+// ValidateServerConf checks sconf against the server schema of serverType,
+// and returns it with defaults filled in. sconf is returned as is if serverType has no schema.
+func ValidateServerConf(serverType string, sconf Configurables) (Configurables, error) {
+	serverSchema, _, ok := SchemaByType(serverType)
+	if !ok {
+		return sconf, nil
+	}
+	return serverSchema.validate(sconf, ErrServerConfigurables)
+}
+
+// ValidateAccountConf checks each of aconf against the account schema of serverType,
+// and returns them with defaults filled in. aconf is returned as is if serverType has no schema.
+func ValidateAccountConf(serverType string, aconf []Configurables) ([]Configurables, error) {
+	_, accountSchema, ok := SchemaByType(serverType)
+	if !ok {
+		return aconf, nil
+	}
+	validated := make([]Configurables, 0, len(aconf))
+	for i, conf := range aconf {
+		v, err := accountSchema.validate(conf, ErrAccountConfigurables)
+		if verr, ok := err.(*ValidationError); ok {
+			// Tell which account it is
+			for j := range verr.Problems {
+				verr.Problems[j].Key = "[" + strconv.Itoa(i) + "]." + verr.Problems[j].Key
+			}
+			return nil, verr
+		}
+		validated = append(validated, v)
+	}
+	return validated, nil
+}
+
+// RegisteredTypes returns the names of all registered server types, sorted.
+func RegisteredTypes() []string {
+	types := make([]string, 0, len(regManagers))
+	for serverType := range regManagers {
+		types = append(types, serverType)
+	}
+	sort.Strings(types)
+	return types
+}
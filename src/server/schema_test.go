@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type schemaRegistrar struct{}
+
+func (schemaRegistrar) NewServer(sconf Configurables) (Server, error) {
+	return nil, ErrServerConfigurables
+}
+
+func (schemaRegistrar) ServerSchema() Schema {
+	return Schema{
+		Fields: []Field{
+			{Key: "panel_url", Type: FieldURL, Required: true},
+			{Key: "api_key", Type: FieldString, Required: true, Secret: true},
+			{Key: "port", Type: FieldInt, Default: "443"},
+			{Key: "tls", Type: FieldBool},
+		},
+	}
+}
+
+func (schemaRegistrar) AccountSchema() Schema {
+	return Schema{
+		Fields: []Field{
+			{Key: "plan", Type: FieldEnum, Required: true, Enum: []string{"basic", "pro"}},
+		},
+		AllowUnknown: true,
+	}
+}
+
+func TestValidateServerConf(t *testing.T) {
+	AddServerRegistrar("schema_test", schemaRegistrar{})
+
+	validated, err := ValidateServerConf("schema_test", Configurables{"panel_url": "https://panel.example.com", "api_key": "k"})
+	if err != nil {
+		t.Fatalf("ValidateServerConf() returns error:%s\n", err)
+	}
+	if validated["port"] != "443" {
+		t.Errorf("ValidateServerConf() doesn't fill default port, got %q\n", validated["port"])
+	}
+
+	// Accepted as the getters read them
+	if _, err = ValidateServerConf("schema_test", Configurables{"panel_url": "https://panel.example.com", "api_key": "k", "port": " 8443\n", "tls": " true"}); err != nil {
+		t.Errorf("ValidateServerConf() with spaces around int and bool returns error:%s\n", err)
+	}
+
+	_, err = ValidateServerConf("schema_test", Configurables{"panel_url": "panel.example.com", "port": "https", "tls": "yes please", "api_kye": "k"})
+	var verr *ValidationError
+	if !errors.Is(err, ErrServerConfigurables) || !errors.As(err, &verr) {
+		t.Fatalf("ValidateServerConf() returns %v, want a ValidationError of %v\n", err, ErrServerConfigurables)
+	}
+	want := []FieldProblem{
+		{Key: "api_key", Reason: "required"},
+		{Key: "api_kye", Reason: "unknown key"},
+		{Key: "panel_url", Reason: "not an absolute URL"},
+		{Key: "port", Reason: "not an integer"},
+		{Key: "tls", Reason: "not a boolean"},
+	}
+	if len(verr.Problems) != len(want) {
+		t.Fatalf("ValidateServerConf() finds %v, want %v\n", verr.Problems, want)
+	}
+	for i := range want {
+		if verr.Problems[i] != want[i] {
+			t.Errorf("ValidateServerConf() problem #%d is %v, want %v\n", i, verr.Problems[i], want[i])
+		}
+	}
+
+	// Secrets are sealed as strings
+	_, err = ValidateServerConf("schema_test", Configurables{"panel_url": "https://panel.example.com", "api_key": json.Number("1234")})
+	if !errors.As(err, &verr) || len(verr.Problems) != 1 || verr.Problems[0] != (FieldProblem{Key: "api_key", Reason: "not a string"}) {
+		t.Errorf("ValidateServerConf() with a number as secret returns %v\n", err)
+	}
+
+	if keys := SecretKeysByType("schema_test"); len(keys) != 1 || keys[0] != "api_key" {
+		t.Errorf("SecretKeysByType() returns %v, want [api_key]\n", keys)
+	}
+
+	// Types without schema are not validated
+	if _, err = ValidateServerConf("no_schema", Configurables{"anything": "goes"}); err != nil {
+		t.Errorf("ValidateServerConf() without schema returns error:%s\n", err)
+	}
+}
+
+func TestValidateAccountConf(t *testing.T) {
+	AddServerRegistrar("schema_test", schemaRegistrar{})
+
+	if _, err := ValidateAccountConf("schema_test", []Configurables{{"plan": "pro", "note": "vip"}}); err != nil {
+		t.Errorf("ValidateAccountConf() returns error:%s\n", err)
+	}
+
+	_, err := ValidateAccountConf("schema_test", []Configurables{{"plan": "pro"}, {"plan": "gold"}})
+	var verr *ValidationError
+	if !errors.Is(err, ErrAccountConfigurables) || !errors.As(err, &verr) {
+		t.Fatalf("ValidateAccountConf() returns %v, want a ValidationError of %v\n", err, ErrAccountConfigurables)
+	}
+	if len(verr.Problems) != 1 || verr.Problems[0].Key != "[1].plan" {
+		t.Errorf("ValidateAccountConf() finds %v, want [1].plan\n", verr.Problems)
+	}
+}
@@ -4,6 +4,8 @@ package server
 // Recommended design:
 // - Pointer to struct
 // - Member pointers in struct
+//
+// Ulysses calls a Server through ServerContext. Implement it as well to honor deadlines and cancellation.
 type Server interface {
 	//// Server Settings: Alter the local information needed to interact with a backend server.
 
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+)
+
+// ServerContext is the context-accepting variant of Server. Ulysses passes a ctx carrying the deadline of
+// the request, canceled if the HTTP client disconnects or Ulysses is shutting down.
+// A Server talking to a remote backend is recommended to implement it as well, and stop waiting on the backend once ctx is done.
+//
+// Each method behaves the same as the one in Server without the Context suffix, except it
+// returns ctx.Err() if ctx is done before the operation completes.
+type ServerContext interface {
+	UpdateServerContext(ctx context.Context, sconf Configurables) (err error)
+
+	AddAccountContext(ctx context.Context, aconf []Configurables) (accID []int, err error)
+	UpdateAccountContext(ctx context.Context, accID []int, aconf []Configurables) (successAccID []int, err error)
+	DeleteAccountContext(ctx context.Context, accID []int) (successAccID []int, err error)
+
+	GetCredentialsContext(ctx context.Context, accID []int) ([]Credential, error)
+	GetUsageContext(ctx context.Context, accID []int) ([]AccountUsage, error)
+}
+
+// WithContext returns s as a ServerContext.
+// If s doesn't implement ServerContext, the returned adapter runs the Server method in a new goroutine and
+// returns ctx.Err() as soon as ctx is done. As s can't be told to stop, the operation may still complete on the backend
+// after that, with its result discarded.
+func WithContext(s Server) ServerContext {
+	if sc, ok := s.(ServerContext); ok {
+		return sc
+	}
+	return &serverContextAdapter{server: s}
+}
+
+type serverContextAdapter struct {
+	server Server
+}
+
+// runContext runs op unless ctx is already done, and waits for it until ctx is done.
+// completed is false if op is not run or abandoned, in which case err is ctx.Err() and op must not be waited for.
+func runContext(ctx context.Context, op func() error) (completed bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	done := make(chan error, 1) // Buffered, so an abandoned op doesn't block forever
+	go func() {
+		done <- op()
+	}()
+
+	select {
+	case err := <-done:
+		return true, err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// Results set by op are read only if it completed, as an abandoned op may still be writing them.
+
+func (a *serverContextAdapter) UpdateServerContext(ctx context.Context, sconf Configurables) error {
+	_, err := runContext(ctx, func() error {
+		return a.server.UpdateServer(sconf)
+	})
+	return err
+}
+
+func (a *serverContextAdapter) AddAccountContext(ctx context.Context, aconf []Configurables) ([]int, error) {
+	var accID []int
+	completed, err := runContext(ctx, func() (err error) {
+		accID, err = a.server.AddAccount(aconf)
+		return err
+	})
+	if !completed {
+		return nil, err
+	}
+	return accID, err
+}
+
+func (a *serverContextAdapter) UpdateAccountContext(ctx context.Context, accID []int, aconf []Configurables) ([]int, error) {
+	var successAccID []int
+	completed, err := runContext(ctx, func() (err error) {
+		successAccID, err = a.server.UpdateAccount(accID, aconf)
+		return err
+	})
+	if !completed {
+		return nil, err
+	}
+	return successAccID, err
+}
+
+func (a *serverContextAdapter) DeleteAccountContext(ctx context.Context, accID []int) ([]int, error) {
+	var successAccID []int
+	completed, err := runContext(ctx, func() (err error) {
+		successAccID, err = a.server.DeleteAccount(accID)
+		return err
+	})
+	if !completed {
+		return nil, err
+	}
+	return successAccID, err
+}
+
+func (a *serverContextAdapter) GetCredentialsContext(ctx context.Context, accID []int) ([]Credential, error) {
+	var credentials []Credential
+	completed, err := runContext(ctx, func() (err error) {
+		credentials, err = a.server.GetCredentials(accID)
+		return err
+	})
+	if !completed {
+		return nil, err
+	}
+	return credentials, err
+}
+
+func (a *serverContextAdapter) GetUsageContext(ctx context.Context, accID []int) ([]AccountUsage, error) {
+	var usages []AccountUsage
+	completed, err := runContext(ctx, func() (err error) {
+		usages, err = a.server.GetUsage(accID)
+		return err
+	})
+	if !completed {
+		return nil, err
+	}
+	return usages, err
+}
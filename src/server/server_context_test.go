@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// slowServer takes delay for each operation, as a backend not responding in time.
+type slowServer struct {
+	delay time.Duration
+	calls chan string
+}
+
+func (s *slowServer) wait(op string) {
+	s.calls <- op
+	time.Sleep(s.delay)
+}
+
+func (s *slowServer) UpdateServer(sconf Configurables) error {
+	s.wait("UpdateServer")
+	return nil
+}
+
+func (s *slowServer) AddAccount(aconf []Configurables) ([]int, error) {
+	s.wait("AddAccount")
+	accID := []int{}
+	for i := range aconf {
+		accID = append(accID, i+1)
+	}
+	return accID, nil
+}
+
+func (s *slowServer) UpdateAccount(accID []int, aconf []Configurables) ([]int, error) {
+	s.wait("UpdateAccount")
+	return accID, nil
+}
+
+func (s *slowServer) DeleteAccount(accID []int) ([]int, error) {
+	s.wait("DeleteAccount")
+	return accID, errors.New("backend refused")
+}
+
+func (s *slowServer) GetCredentials(accID []int) ([]Credential, error) {
+	s.wait("GetCredentials")
+	return []Credential{}, nil
+}
+
+func (s *slowServer) GetUsage(accID []int) ([]AccountUsage, error) {
+	s.wait("GetUsage")
+	return []AccountUsage{}, nil
+}
+
+// contextServer implements ServerContext itself.
+type contextServer struct {
+	slowServer
+}
+
+func (s *contextServer) UpdateServerContext(ctx context.Context, sconf Configurables) error {
+	return nil
+}
+func (s *contextServer) AddAccountContext(ctx context.Context, aconf []Configurables) ([]int, error) {
+	return nil, nil
+}
+func (s *contextServer) UpdateAccountContext(ctx context.Context, accID []int, aconf []Configurables) ([]int, error) {
+	return nil, nil
+}
+func (s *contextServer) DeleteAccountContext(ctx context.Context, accID []int) ([]int, error) {
+	return nil, nil
+}
+func (s *contextServer) GetCredentialsContext(ctx context.Context, accID []int) ([]Credential, error) {
+	return nil, nil
+}
+func (s *contextServer) GetUsageContext(ctx context.Context, accID []int) ([]AccountUsage, error) {
+	return nil, nil
+}
+
+func TestWithContextCompletes(t *testing.T) {
+	s := &slowServer{delay: time.Millisecond, calls: make(chan string, 10)}
+	sc := WithContext(s)
+
+	accID, err := sc.AddAccountContext(context.Background(), []Configurables{{}, {}})
+	if err != nil {
+		t.Fatalf("AddAccountContext() returns error:%s\n", err)
+	}
+	if len(accID) != 2 || accID[1] != 2 {
+		t.Errorf("AddAccountContext() returns %v\n", accID)
+	}
+
+	// Errors of the Server come with its results
+	successAccID, err := sc.DeleteAccountContext(context.Background(), []int{1})
+	if err == nil || len(successAccID) != 1 {
+		t.Errorf("DeleteAccountContext() returns %v, %v\n", successAccID, err)
+	}
+}
+
+func TestWithContextDeadline(t *testing.T) {
+	s := &slowServer{delay: time.Second, calls: make(chan string, 10)}
+	sc := WithContext(s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	accID, err := sc.AddAccountContext(ctx, []Configurables{{}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AddAccountContext() returns error:%v, want deadline exceeded\n", err)
+	}
+	if accID != nil {
+		t.Errorf("AddAccountContext() returns %v after deadline\n", accID)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("AddAccountContext() returns after %s, not at deadline\n", elapsed)
+	}
+}
+
+func TestWithContextCanceled(t *testing.T) {
+	s := &slowServer{delay: time.Millisecond, calls: make(chan string, 10)}
+	sc := WithContext(s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := sc.GetUsageContext(ctx, []int{1}); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetUsageContext() returns error:%v, want canceled\n", err)
+	}
+	if err := sc.UpdateServerContext(ctx, Configurables{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("UpdateServerContext() returns error:%v, want canceled\n", err)
+	}
+	select {
+	case op := <-s.calls:
+		t.Errorf("%s() is called with ctx already canceled\n", op)
+	default:
+	}
+}
+
+func TestWithContextNative(t *testing.T) {
+	s := &contextServer{}
+	if sc := WithContext(s); sc != ServerContext(s) {
+		t.Errorf("WithContext() wraps a Server already implementing ServerContext\n")
+	}
+}
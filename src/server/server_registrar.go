@@ -37,3 +37,23 @@ func NewServerByType(serverType string, sconf Configurables) (Server, error) {
 
 	return newServer, err
 }
+
+// SecretKeysRegistrar is an optional interface of ServerRegistrar
+// for server types whose sconf holds secrets, e.g., API keys or root passwords of the backend panel.
+// Values of these keys are encrypted by Ulysses before stored, and decrypted before passed to NewServer.
+type SecretKeysRegistrar interface {
+	SecretKeys() []string
+}
+
+// SecretKeysByType returns the secret keys in sconf of serverType, or nil if it has none.
+// Keys flagged Secret in the server schema are included.
+func SecretKeysByType(serverType string) []string {
+	var keys []string
+	if sr, ok := regManagers[serverType].(SecretKeysRegistrar); ok {
+		keys = append(keys, sr.SecretKeys()...)
+	}
+	if serverSchema, _, ok := SchemaByType(serverType); ok {
+		keys = append(keys, serverSchema.secretKeys()...)
+	}
+	return keys
+}
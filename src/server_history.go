@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/internal/db"
+	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/TunnelWork/Ulysses/src/internal/secret"
+	"github.com/TunnelWork/Ulysses/src/server"
+	"github.com/gin-gonic/gin"
+)
+
+// Every change to a server row is appended to server_config_history in the same transaction,
+// with the row before and after the change. The history is never updated or deleted.
+
+const (
+	serverHistoryTableName = `server_config_history`
+
+	serverActionAdd      = `add`
+	serverActionUpdate   = `update`
+	serverActionDisable  = `disable`
+	serverActionEnable   = `enable`
+	serverActionDelete   = `delete`
+	serverActionRollback = `rollback`
+
+	anyLastUpdate       int64 = -1 // For changeServer() to retry on concurrent changes instead of failing
+	serverChangeRetries       = 3
+)
+
+var (
+	ErrServerRevisionNotFound = errors.New("ulysses/server_manager: no such revision of the server")
+)
+
+// ServerRevision is one change to a server, with its configuration before and after.
+type ServerRevision struct {
+	ID             uint                 `json:"revision"`
+	ServerID       uint                 `json:"server_id"`
+	OperatorUid    uint                 `json:"operator_uid"` // 0 for Ulysses itself
+	Action         string               `json:"action"`
+	PrevServerType string               `json:"prev_server_type"`
+	PrevConf       server.Configurables `json:"prev_conf"`
+	ServerType     string               `json:"server_type"`
+	Conf           server.Configurables `json:"conf"`
+	ChangeTime     int64                `json:"change_time"`
+
+	confErr error // Set by scanServerRevision() if Conf can't be read or its secrets can't be opened
+}
+
+// ServerConfChange is one key differing between two configurations.
+type ServerConfChange struct {
+	Key  string      `json:"key"`
+	Op   string      `json:"op"` // "added", "removed" or "changed"
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// ServerConfDiff tells how the server changed from one revision to another.
+type ServerConfDiff struct {
+	ServerID       uint               `json:"server_id"`
+	FromRevision   uint               `json:"from_revision"`
+	ToRevision     uint               `json:"to_revision"`
+	FromServerType string             `json:"from_server_type"`
+	ToServerType   string             `json:"to_server_type"`
+	Changes        []ServerConfChange `json:"changes"`
+}
+
+// atomically runs fn in the transaction of sm, or in a new one if sm has none.
+func (sm *ServerManager) atomically(fn func(sm *ServerManager) error) error {
+	if sm.tx != nil {
+		return fn(sm)
+	}
+	ctx, cancel := sm.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+	return db.WithTx(ctx, sm.dbConnector, func(tx *sql.Tx) error {
+		return fn(sm.InTx(tx))
+	})
+}
+
+// row returns the server row id unless it is deleted.
+func (sm *ServerManager) row(id uint) (ServerRow, error) {
+	dbConn, err := sm.conn()
+	if err != nil {
+		return ServerRow{}, err
+	}
+
+	ctx, cancel := sm.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtLookupServerConf, err := dbConn.PrepareContext(ctx, `SELECT ID, ServerType, ConfJson, LastUpdate, Disabled, DeletionTime FROM `+masterConfig.DB.TblPrefix+serverConfigTableName+` WHERE ID = ? AND DeletionTime = 0`)
+	if err != nil {
+		return ServerRow{}, err
+	}
+	defer stmtLookupServerConf.Close()
+
+	var row ServerRow
+	err = stmtLookupServerConf.QueryRowContext(ctx, id).Scan(&row.ID, &row.ServerType, &row.ConfJson, &row.LastUpdate, &row.Disabled, &row.DeletionTime)
+	if err == sql.ErrNoRows {
+		return ServerRow{}, ErrServerNotFound
+	} else if err != nil {
+		return ServerRow{}, err
+	}
+	if row.Conf, err = unmarshalServerConf(row.ID, row.ConfJson); err != nil {
+		return ServerRow{}, err
+	}
+	return row, nil
+}
+
+// changeServer applies change to the server row id and records it in history as action.
+// change returns false if there is nothing to change.
+//
+// The row is written only if its LastUpdate is still as read, so the history always has the true previous row.
+// With expectedLastUpdate, it must also be that value or ErrServerConflict is returned with the row as read.
+// With anyLastUpdate, concurrent changes are retried a few times instead.
+// LastUpdate always moves forward, even within the same second.
+func (sm *ServerManager) changeServer(id uint, expectedLastUpdate int64, action string, change func(row *ServerRow) bool) (row ServerRow, err error) {
+	for attempt := 0; ; attempt++ {
+		err = sm.atomically(func(sm *ServerManager) error {
+			prev, err := sm.row(id)
+			if err != nil {
+				return err
+			}
+			row = prev
+			if expectedLastUpdate != anyLastUpdate && prev.LastUpdate != expectedLastUpdate {
+				return ErrServerConflict
+			}
+			if !change(&row) {
+				return nil
+			}
+
+			if row.ConfJson, err = marshalServerConf(row.ID, row.ServerType, row.Conf); err != nil {
+				return err
+			}
+			row.LastUpdate = time.Now().Unix()
+			if row.LastUpdate <= prev.LastUpdate {
+				row.LastUpdate = prev.LastUpdate + 1
+			}
+
+			dbConn, err := sm.conn()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := sm.dbConnector.WithTimeout(context.Background())
+			defer cancel()
+
+			stmtUpdateServerConf, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+serverConfigTableName+` SET ServerType = ?, ConfJson = ?, LastUpdate = ?, Disabled = ?, DeletionTime = ? WHERE ID = ? AND LastUpdate = ? AND DeletionTime = 0`)
+			if err != nil {
+				return err
+			}
+			defer stmtUpdateServerConf.Close()
+
+			result, err := stmtUpdateServerConf.ExecContext(ctx, row.ServerType, row.ConfJson, row.LastUpdate, row.Disabled, row.DeletionTime, id, prev.LastUpdate)
+			if err != nil {
+				return err
+			}
+			if affected, _ := result.RowsAffected(); affected == 0 {
+				row = prev
+				return ErrServerConflict
+			}
+
+			return sm.recordHistory(ctx, dbConn, action, prev, row)
+		})
+		if err != ErrServerConflict || expectedLastUpdate != anyLastUpdate || attempt >= serverChangeRetries {
+			return row, err
+		}
+	}
+}
+
+func (sm *ServerManager) recordHistory(ctx context.Context, dbConn db.Querier, action string, prev, next ServerRow) error {
+	stmtInsertHistory, err := dbConn.PrepareContext(ctx, `INSERT INTO `+masterConfig.DB.TblPrefix+serverHistoryTableName+` (server_id, operator_uid, action, prev_server_type, prev_conf_json, server_type, conf_json, change_time) VALUES( ?, ?, ?, ?, ?, ?, ?, ? )`)
+	if err != nil {
+		return err
+	}
+	defer stmtInsertHistory.Close()
+
+	_, err = stmtInsertHistory.ExecContext(ctx, next.ID, sm.operatorUid, action, prev.ServerType, prev.ConfJson, next.ServerType, next.ConfJson, time.Now().Unix())
+	return err
+}
+
+func scanServerRevision(scanner interface{ Scan(...interface{}) error }) (ServerRevision, error) {
+	var rev ServerRevision
+	var prevConfJson, confJson string
+	if err := scanner.Scan(&rev.ID, &rev.ServerID, &rev.OperatorUid, &rev.Action, &rev.PrevServerType, &prevConfJson, &rev.ServerType, &confJson, &rev.ChangeTime); err != nil {
+		return rev, err
+	}
+	var err error
+	if rev.PrevConf, err = unmarshalServerConf(rev.ServerID, prevConfJson); err != nil {
+		logger.Error("scanServerRevision(): can't read config of revision ", rev.ID, ". error: ", err)
+	}
+	if rev.Conf, rev.confErr = unmarshalServerConf(rev.ServerID, confJson); rev.confErr != nil {
+		logger.Error("scanServerRevision(): can't read config of revision ", rev.ID, ". error: ", rev.confErr)
+	}
+	return rev, nil
+}
+
+// History() returns up to limit latest revisions of server id, newest first.
+func (sm *ServerManager) History(id uint, limit int) ([]ServerRevision, error) {
+	if limit <= 0 {
+		limit = serverListLimitDefault
+	} else if limit > serverListLimitMax {
+		limit = serverListLimitMax
+	}
+
+	dbConn, err := sm.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := sm.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtListHistory, err := dbConn.PrepareContext(ctx, `SELECT id, server_id, operator_uid, action, prev_server_type, prev_conf_json, server_type, conf_json, change_time FROM `+masterConfig.DB.TblPrefix+serverHistoryTableName+` WHERE server_id = ? ORDER BY id DESC LIMIT `+strconv.Itoa(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer stmtListHistory.Close()
+
+	rows, err := stmtListHistory.QueryContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []ServerRevision{}
+	for rows.Next() {
+		rev, err := scanServerRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// Revision() returns the revision by its ID.
+func (sm *ServerManager) Revision(revision uint) (ServerRevision, error) {
+	dbConn, err := sm.conn()
+	if err != nil {
+		return ServerRevision{}, err
+	}
+
+	ctx, cancel := sm.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtLookupHistory, err := dbConn.PrepareContext(ctx, `SELECT id, server_id, operator_uid, action, prev_server_type, prev_conf_json, server_type, conf_json, change_time FROM `+masterConfig.DB.TblPrefix+serverHistoryTableName+` WHERE id = ?`)
+	if err != nil {
+		return ServerRevision{}, err
+	}
+	defer stmtLookupHistory.Close()
+
+	rev, err := scanServerRevision(stmtLookupHistory.QueryRowContext(ctx, revision))
+	if err == sql.ErrNoRows {
+		return ServerRevision{}, ErrServerRevisionNotFound
+	}
+	return rev, err
+}
+
+// diffConfigurables lists the keys changed from one configuration of fromType to another of toType, sorted by key.
+// Values of secret keys are left out, so only the op tells they changed.
+func diffConfigurables(fromType string, from server.Configurables, toType string, to server.Configurables) []ServerConfChange {
+	changes := []ServerConfChange{}
+	for key, fromValue := range from {
+		toValue, ok := to[key]
+		if !ok {
+			changes = append(changes, ServerConfChange{Key: key, Op: "removed", From: fromValue})
+		} else if !sameConfigurable(fromValue, toValue) {
+			changes = append(changes, ServerConfChange{Key: key, Op: "changed", From: fromValue, To: toValue})
+		}
+	}
+	for key, toValue := range to {
+		if _, ok := from[key]; !ok {
+			changes = append(changes, ServerConfChange{Key: key, Op: "added", To: toValue})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	for i, change := range changes {
+		if isSecretKey(fromType, change.Key) || isSecretKey(toType, change.Key) || secret.IsSealed(server.ValueString(change.From)) || secret.IsSealed(server.ValueString(change.To)) {
+			changes[i].From, changes[i].To = nil, nil
+		}
+	}
+	return changes
+}
+
+// sameConfigurable tells if two values of Configurables are the same JSON, type included.
+func sameConfigurable(a, b interface{}) bool {
+	aBytes, errA := json.Marshal(a)
+	bBytes, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aBytes, bBytes)
+}
+
+// Diff() compares the server as it was right after revision from and right after revision to.
+// Both revisions must be of the same server.
+func (sm *ServerManager) Diff(from, to uint) (ServerConfDiff, error) {
+	fromRev, err := sm.Revision(from)
+	if err != nil {
+		return ServerConfDiff{}, err
+	}
+	toRev, err := sm.Revision(to)
+	if err != nil {
+		return ServerConfDiff{}, err
+	}
+	if fromRev.ServerID != toRev.ServerID {
+		return ServerConfDiff{}, ErrServerRevisionNotFound
+	}
+
+	return ServerConfDiff{
+		ServerID:       fromRev.ServerID,
+		FromRevision:   from,
+		ToRevision:     to,
+		FromServerType: fromRev.ServerType,
+		ToServerType:   toRev.ServerType,
+		Changes:        diffConfigurables(fromRev.ServerType, fromRev.Conf, toRev.ServerType, toRev.Conf),
+	}, nil
+}
+
+// Rollback() sets type and configuration of server id back to what they were right after revision.
+// Disabled state is not changed, and a deleted server can't be rolled back.
+// The rollback is itself a new revision.
+func (sm *ServerManager) Rollback(id uint, revision uint) error {
+	rev, err := sm.Revision(revision)
+	if err != nil {
+		return err
+	}
+	if rev.ServerID != id {
+		return ErrServerRevisionNotFound
+	}
+	// Never write back a config still sealed, or one the current schema no longer accepts
+	if rev.confErr != nil {
+		return rev.confErr
+	}
+	conf, err := server.ValidateServerConf(rev.ServerType, rev.Conf)
+	if err != nil {
+		return err
+	}
+
+	_, err = sm.changeServer(id, anyLastUpdate, serverActionRollback, func(row *ServerRow) bool {
+		row.ServerType = rev.ServerType
+		row.Conf = conf
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Info("*ServerManager.Rollback(): rolled server ", id, " back to revision ", revision)
+	return nil
+}
+
+// _adminHandlerServerHistory lists revisions of a server, newest first.
+// Query parameters: server_id, limit (optional)
+func _adminHandlerServerHistory(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Query("server_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "bad server_id",
+		})
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+
+	revisions, err := NewServerManager(dbConnector).History(uint(id), limit)
+	if err != nil {
+		logger.Error("_adminHandlerServerHistory(): can't list history. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	for i := range revisions {
+		revisions[i].PrevConf = maskServerConf(revisions[i].PrevServerType, revisions[i].PrevConf)
+		revisions[i].Conf = maskServerConf(revisions[i].ServerType, revisions[i].Conf)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":    "success",
+		"revisions": revisions,
+	})
+}
+
+// _adminHandlerServerDiff compares two revisions of the same server.
+// Query parameters: from, to
+func _adminHandlerServerDiff(c *gin.Context) {
+	from, errFrom := strconv.ParseUint(c.Query("from"), 10, 32)
+	to, errTo := strconv.ParseUint(c.Query("to"), 10, 32)
+	if errFrom != nil || errTo != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "bad from or to",
+		})
+		return
+	}
+
+	diff, err := NewServerManager(dbConnector).Diff(uint(from), uint(to))
+	if err == ErrServerRevisionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	} else if err != nil {
+		logger.Error("_adminHandlerServerDiff(): can't diff revisions. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"diff":   diff,
+	})
+}
+
+// _adminHandlerServerRollback rolls a server back to an earlier revision.
+// Form parameters: server_id, revision
+func _adminHandlerServerRollback(c *gin.Context) {
+	id, errID := strconv.ParseUint(c.PostForm("server_id"), 10, 32)
+	revision, errRev := strconv.ParseUint(c.PostForm("revision"), 10, 32)
+	if errID != nil || errRev != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "bad server_id or revision",
+		})
+		return
+	}
+
+	operatorUid, _ := authedUid(c)
+	err := NewServerManager(dbConnector).AsOperator(operatorUid).Rollback(uint(id), uint(revision))
+	if err == ErrServerRevisionNotFound || err == ErrServerNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	} else if err != nil {
+		logger.Error("_adminHandlerServerRollback(): can't roll back server ", id, ". error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
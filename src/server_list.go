@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	serverListLimitDefault = 50
+	serverListLimitMax     = 500
+)
+
+var (
+	ErrServerListBadSort   = errors.New("ulysses/server_manager: bad sort key")
+	ErrServerListBadCursor = errors.New("ulysses/server_manager: bad cursor")
+
+	// Sort keys allowed in ServerListOptions and their columns
+	serverListSortColumns = map[string]string{
+		"id":          "ID",
+		"server_type": "ServerType",
+		"last_update": "LastUpdate",
+	}
+)
+
+// ServerListOptions filters and orders ServerManager.List().
+// Zero values mean no filtering, except that Deleted defaults to excluding deleted servers.
+type ServerListOptions struct {
+	ServerType    string
+	Disabled      *bool // nil for both
+	Deleted       *bool // nil for not deleted only
+	UpdatedAfter  int64 // LastUpdate >= UpdatedAfter, if not 0
+	UpdatedBefore int64 // LastUpdate < UpdatedBefore, if not 0
+
+	SortBy string // "id" (default), "server_type" or "last_update"
+	Desc   bool
+	Limit  int
+	Cursor string // from the previous page
+}
+
+// serverListCursor marks the last row of a page.
+// The sort value comes with ID to break ties, so rows sharing a value are neither skipped nor repeated.
+type serverListCursor struct {
+	ID         uint   `json:"id"`
+	ServerType string `json:"st,omitempty"`
+	LastUpdate int64  `json:"lu,omitempty"`
+}
+
+func encodeServerListCursor(row ServerRow) string {
+	cursorBytes, _ := json.Marshal(serverListCursor{
+		ID:         row.ID,
+		ServerType: row.ServerType,
+		LastUpdate: row.LastUpdate,
+	})
+	return base64.RawURLEncoding.EncodeToString(cursorBytes)
+}
+
+func decodeServerListCursor(cursor string) (serverListCursor, error) {
+	var c serverListCursor
+	cursorBytes, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, ErrServerListBadCursor
+	}
+	if json.Unmarshal(cursorBytes, &c) != nil {
+		return c, ErrServerListBadCursor
+	}
+	return c, nil
+}
+
+// List() returns a page of servers matching opts, and the cursor to the next page.
+// The cursor is empty on the last page.
+func (sm *ServerManager) List(opts ServerListOptions) (servers []ServerRow, nextCursor string, err error) {
+	if opts.SortBy == "" {
+		opts.SortBy = "id"
+	}
+	sortColumn, ok := serverListSortColumns[opts.SortBy]
+	if !ok {
+		return nil, "", ErrServerListBadSort
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = serverListLimitDefault
+	} else if opts.Limit > serverListLimitMax {
+		opts.Limit = serverListLimitMax
+	}
+
+	conditions := []string{}
+	args := []interface{}{}
+
+	if opts.ServerType != "" {
+		conditions = append(conditions, `ServerType = ?`)
+		args = append(args, opts.ServerType)
+	}
+	if opts.Disabled != nil {
+		conditions = append(conditions, `Disabled = ?`)
+		args = append(args, *opts.Disabled)
+	}
+	if opts.Deleted == nil || !*opts.Deleted {
+		conditions = append(conditions, `DeletionTime = 0`)
+	} else {
+		conditions = append(conditions, `DeletionTime <> 0`)
+	}
+	if opts.UpdatedAfter != 0 {
+		conditions = append(conditions, `LastUpdate >= ?`)
+		args = append(args, opts.UpdatedAfter)
+	}
+	if opts.UpdatedBefore != 0 {
+		conditions = append(conditions, `LastUpdate < ?`)
+		args = append(args, opts.UpdatedBefore)
+	}
+
+	direction, cmp := `ASC`, `>`
+	if opts.Desc {
+		direction, cmp = `DESC`, `<`
+	}
+
+	if opts.Cursor != "" {
+		cursor, err := decodeServerListCursor(opts.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		switch opts.SortBy {
+		case "id":
+			conditions = append(conditions, `ID `+cmp+` ?`)
+			args = append(args, cursor.ID)
+		case "server_type":
+			conditions = append(conditions, `(ServerType `+cmp+` ? OR (ServerType = ? AND ID `+cmp+` ?))`)
+			args = append(args, cursor.ServerType, cursor.ServerType, cursor.ID)
+		case "last_update":
+			conditions = append(conditions, `(LastUpdate `+cmp+` ? OR (LastUpdate = ? AND ID `+cmp+` ?))`)
+			args = append(args, cursor.LastUpdate, cursor.LastUpdate, cursor.ID)
+		}
+	}
+
+	query := `SELECT ID, ServerType, ConfJson, LastUpdate, Disabled, DeletionTime FROM ` + masterConfig.DB.TblPrefix + serverConfigTableName
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+	query += ` ORDER BY ` + sortColumn + ` ` + direction
+	if sortColumn != "ID" {
+		query += `, ID ` + direction
+	}
+	// One more row than asked tells if there is a next page.
+	query += ` LIMIT ` + strconv.Itoa(opts.Limit+1)
+
+	dbConn, err := sm.conn()
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := sm.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtListServerConf, err := dbConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, "", err
+	}
+	defer stmtListServerConf.Close()
+
+	rows, err := stmtListServerConf.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	servers = []ServerRow{}
+	for rows.Next() {
+		var row ServerRow
+		if err = rows.Scan(&row.ID, &row.ServerType, &row.ConfJson, &row.LastUpdate, &row.Disabled, &row.DeletionTime); err != nil {
+			return nil, "", err
+		}
+		if row.Conf, err = unmarshalServerConf(row.ID, row.ConfJson); err != nil {
+			logger.Error("*ServerManager.List(): can't open secrets of server ", row.ID, ". error: ", err)
+		}
+		servers = append(servers, row)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(servers) > opts.Limit {
+		servers = servers[:opts.Limit]
+		nextCursor = encodeServerListCursor(servers[opts.Limit-1])
+	}
+	return servers, nextCursor, nil
+}
+
+// _adminHandlerServerList lists servers. All query parameters are optional:
+// server_type, disabled (true/false), deleted (true/false), updated_after, updated_before,
+// sort (id/server_type/last_update), desc (true/false), limit, cursor
+func _adminHandlerServerList(c *gin.Context) {
+	opts := ServerListOptions{
+		ServerType: c.Query("server_type"),
+		SortBy:     c.Query("sort"),
+		Cursor:     c.Query("cursor"),
+	}
+
+	badRequest := func(param string) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  "bad " + param,
+		})
+	}
+
+	if v := c.Query("disabled"); v != "" {
+		disabled, err := strconv.ParseBool(v)
+		if err != nil {
+			badRequest("disabled")
+			return
+		}
+		opts.Disabled = &disabled
+	}
+	if v := c.Query("deleted"); v != "" {
+		deleted, err := strconv.ParseBool(v)
+		if err != nil {
+			badRequest("deleted")
+			return
+		}
+		opts.Deleted = &deleted
+	}
+	if v := c.Query("desc"); v != "" {
+		desc, err := strconv.ParseBool(v)
+		if err != nil {
+			badRequest("desc")
+			return
+		}
+		opts.Desc = desc
+	}
+
+	var err error
+	if v := c.Query("updated_after"); v != "" {
+		if opts.UpdatedAfter, err = strconv.ParseInt(v, 10, 64); err != nil {
+			badRequest("updated_after")
+			return
+		}
+	}
+	if v := c.Query("updated_before"); v != "" {
+		if opts.UpdatedBefore, err = strconv.ParseInt(v, 10, 64); err != nil {
+			badRequest("updated_before")
+			return
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil {
+			badRequest("limit")
+			return
+		}
+	}
+
+	servers, nextCursor, err := NewServerManager(dbConnector).List(opts)
+	if err == ErrServerListBadSort || err == ErrServerListBadCursor {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	} else if err != nil {
+		logger.Error("_adminHandlerServerList(): can't list servers. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	for i := range servers {
+		servers[i].Conf = maskServerConf(servers[i].ServerType, servers[i].Conf)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "success",
+		"servers":     servers,
+		"next_cursor": nextCursor,
+	})
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -14,56 +17,114 @@ import (
 
 const (
 	serverConfigTableName                           = `Servers`
-	mysqlConnectTimeout                             = 500 * time.Millisecond // If not established within timeout, will fail.
-	reloadUlyssesServerSignature tickEventSignature = 0xFEEDBEEF             // temp, we will come up with better names
+	reloadUlyssesServerSignature tickEventSignature = 0xFEEDBEEF // temp, we will come up with better names
 )
 
-// ServerManager is capable of performing MySQL CRUD operations to
+var (
+	ErrServerNotFound = errors.New("ulysses/server_manager: no such server")
+	ErrServerConflict = errors.New("ulysses/server_manager: server changed since last read")
+)
+
+// ServerManager is capable of performing database CRUD operations to
 // - Server Configuration Info
 type ServerManager struct {
-	dbConnector *db.MysqlConnector
+	dbConnector db.Connector
+	tx          *sql.Tx // If set, all operations run in this transaction
+	operatorUid uint    // Recorded in history as who made the changes. 0 for Ulysses itself.
 }
 
-func NewServerManager(dbconf db.DatabaseConfig) *ServerManager {
+// NewServerManager shares the connection pool of dbConnector
+func NewServerManager(dbConnector db.Connector) *ServerManager {
 	return &ServerManager{
-		dbConnector: db.NewMysqlConnector(dbconf),
+		dbConnector: dbConnector,
 	}
 }
 
-// Add() returns the newly inserted serverconf (id, nil), or (0, error) if any error
-func (sm *ServerManager) Add(serverType string, confJson server.Configurables) (id uint, err error) {
-	serverConfBytes, err := json.Marshal(confJson)
-	if err != nil {
-		// logger.Error("*ServerManager.Add(): cannot json.Marshal(), error: ", err)
-		return id, err
+// InTx() returns a ServerManager running all operations in tx, e.g., from db.WithTx().
+func (sm *ServerManager) InTx(tx *sql.Tx) *ServerManager {
+	return &ServerManager{
+		dbConnector: sm.dbConnector,
+		tx:          tx,
+		operatorUid: sm.operatorUid,
 	}
+}
 
-	dbConn, err := sm.dbConnector.Conn()
+// AsOperator() returns a ServerManager recording changes in history as made by user uid.
+func (sm *ServerManager) AsOperator(uid uint) *ServerManager {
+	return &ServerManager{
+		dbConnector: sm.dbConnector,
+		tx:          sm.tx,
+		operatorUid: uid,
+	}
+}
 
-	if err != nil {
-		// logger.Error("*ServerManager.Add(): cannot connect DB, error: ", err)
-		return id, err
+func (sm *ServerManager) conn() (db.Querier, error) {
+	if sm.tx != nil {
+		return sm.tx, nil
 	}
-	defer dbConn.Close()
+	return sm.dbConnector.Conn()
+}
 
-	stmtInsertServerConf, err := dbConn.Prepare(`INSERT INTO ` + masterConfig.DB.TblPrefix + serverConfigTableName + ` (ServerType, ConfJson, LastUpdate) VALUES( ?, ?, ? )`)
-	if err != nil {
-		// logger.Error("*ServerManager.Add(): cannot prepare statement. error: ", err)
+// Add() returns the newly inserted serverconf (id, nil), or (0, error) if any error
+func (sm *ServerManager) Add(serverType string, confJson server.Configurables) (id uint, err error) {
+	if confJson, err = server.ValidateServerConf(serverType, confJson); err != nil {
 		return id, err
 	}
-	defer stmtInsertServerConf.Close()
 
-	result, err := stmtInsertServerConf.Exec(serverType, string(serverConfBytes), time.Now().Unix())
-	if err != nil {
-		// logger.Error("*ServerManager.Add(): cannot execute prepared statement. error: ", err)
-		return id, err
-	} else {
+	now := time.Now().Unix()
+	err = sm.atomically(func(sm *ServerManager) error {
+		dbConn, err := sm.conn()
+		if err != nil {
+			// logger.Error("*ServerManager.Add(): cannot connect DB, error: ", err)
+			return err
+		}
+
+		ctx, cancel := sm.dbConnector.WithTimeout(context.Background())
+		defer cancel()
+
+		// Secrets are bound to the server ID, so they are sealed and written once the row has one
+		stmtInsertServerConf, err := dbConn.PrepareContext(ctx, `INSERT INTO `+masterConfig.DB.TblPrefix+serverConfigTableName+` (ServerType, ConfJson, LastUpdate) VALUES( ?, '{}', ? )`)
+		if err != nil {
+			// logger.Error("*ServerManager.Add(): cannot prepare statement. error: ", err)
+			return err
+		}
+		defer stmtInsertServerConf.Close()
+
+		result, err := stmtInsertServerConf.ExecContext(ctx, serverType, now)
+		if err != nil {
+			// logger.Error("*ServerManager.Add(): cannot execute prepared statement. error: ", err)
+			return err
+		}
 		idint64, err := result.LastInsertId()
 		if err != nil {
 			// logger.Error("*ServerManager.Add(): cannot get last inserted id. error: ", err)
-			return id, err
+			return err
 		}
 		id = uint(idint64)
+
+		storedConfJson, err := marshalServerConf(id, serverType, confJson)
+		if err != nil {
+			return err
+		}
+		stmtUpdateServerConf, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+serverConfigTableName+` SET ConfJson = ? WHERE ID = ?`)
+		if err != nil {
+			return err
+		}
+		defer stmtUpdateServerConf.Close()
+
+		if _, err = stmtUpdateServerConf.ExecContext(ctx, storedConfJson, id); err != nil {
+			return err
+		}
+
+		return sm.recordHistory(ctx, dbConn, serverActionAdd, ServerRow{ID: id, ConfJson: "{}"}, ServerRow{
+			ID:         id,
+			ServerType: serverType,
+			ConfJson:   storedConfJson,
+			LastUpdate: now,
+		})
+	})
+	if err != nil {
+		return 0, err
 	}
 
 	logger.Info("*ServerManager.Add(): added new server with type ", serverType)
@@ -73,22 +134,25 @@ func (sm *ServerManager) Add(serverType string, confJson server.Configurables) (
 func (sm *ServerManager) Lookup(id uint) (serverType string, confJson server.Configurables, err error) {
 	confJson = server.Configurables{}
 
-	dbConn, err := sm.dbConnector.Conn()
+	dbConn, err := sm.conn()
 	if err != nil {
 		// logger.Error("*ServerManager.Lookup(): cannot connect db, error: ", err)
 		return "", server.Configurables{}, err
 	}
-	defer dbConn.Close()
 
-	stmtLookupServerConf, err := dbConn.Prepare(`SELECT ServerType, ConfJson FROM ` + masterConfig.DB.TblPrefix + serverConfigTableName + ` WHERE ID = ? AND Disabled = 0 AND DeletionTime = 0`)
+	ctx, cancel := sm.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtLookupServerConf, err := dbConn.PrepareContext(ctx, `SELECT ServerType, ConfJson FROM `+masterConfig.DB.TblPrefix+serverConfigTableName+` WHERE ID = ? AND Disabled = 0 AND DeletionTime = 0`)
 	if err != nil {
 		// logger.Error("*ServerManager.Lookup(): cannot prepare statement. error: ", err)
 		return "", server.Configurables{}, err
 	}
+	defer stmtLookupServerConf.Close()
 
 	var confJsonStr string
 
-	err = stmtLookupServerConf.QueryRow(id).Scan(&serverType, &confJsonStr)
+	err = stmtLookupServerConf.QueryRowContext(ctx, id).Scan(&serverType, &confJsonStr)
 	if err != nil {
 		// if err != sql.ErrNoRows { // Expect to see ErrNoRows a lot. Not even an error.
 		// 	logger.Error("*ServerManager.Lookup(): can't query or scan. error: ", err)
@@ -98,35 +162,76 @@ func (sm *ServerManager) Lookup(id uint) (serverType string, confJson server.Con
 		return "", server.Configurables{}, err
 	}
 
-	json.Unmarshal([]byte(confJsonStr), &confJson)
+	confJson, err = unmarshalServerConf(id, confJsonStr)
+	if err != nil {
+		return "", server.Configurables{}, err
+	}
 
 	return serverType, confJson, nil
 }
 
-func (sm *ServerManager) Update(id uint, serverType string, confJson server.Configurables) error {
-	serverConfBytes, err := json.Marshal(confJson)
+// ServerRow is a full row of server configuration, including disabled and deleted ones
+type ServerRow struct {
+	ID           uint                 `json:"id"`
+	ServerType   string               `json:"server_type"`
+	ConfJson     string               `json:"-"`
+	Conf         server.Configurables `json:"conf"`
+	LastUpdate   int64                `json:"last_update"`
+	Disabled     bool                 `json:"disabled"`
+	DeletionTime int64                `json:"deletion_time"`
+
+	confErr error // Set by ChangedSince() if secrets of Conf can't be opened
+}
+
+// ChangedSince() returns all rows with LastUpdate >= since, including disabled and deleted ones
+// so the caller can tell what is gone.
+func (sm *ServerManager) ChangedSince(since int64) ([]ServerRow, error) {
+	dbConn, err := sm.conn()
 	if err != nil {
-		logger.Error("*ServerManager.Update(): cannot json.Marshal(), error: ", err)
-		return err
+		return nil, err
 	}
 
-	dbConn, err := sm.dbConnector.Conn()
+	ctx, cancel := sm.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtListServerConf, err := dbConn.PrepareContext(ctx, `SELECT ID, ServerType, ConfJson, LastUpdate, Disabled, DeletionTime FROM `+masterConfig.DB.TblPrefix+serverConfigTableName+` WHERE LastUpdate >= ? ORDER BY LastUpdate, ID`)
 	if err != nil {
-		logger.Error("*ServerManager.Update(): cannot connect DB, error: ", err)
-		return err
+		return nil, err
 	}
-	defer dbConn.Close()
+	defer stmtListServerConf.Close()
 
-	stmtUpdateServerConf, err := dbConn.Prepare(`UPDATE ` + masterConfig.DB.TblPrefix + serverConfigTableName + ` SET ServerType = ?, ConfJson = ?, LastUpdate = ? WHERE ID = ? AND DeletionTime = 0`)
+	rows, err := stmtListServerConf.QueryContext(ctx, since)
 	if err != nil {
-		logger.Error("*ServerManager.Add(): cannot prepare statement. error: ", err)
-		return err
+		return nil, err
+	}
+	defer rows.Close()
+
+	serverRows := []ServerRow{}
+	for rows.Next() {
+		var row ServerRow
+		if err = rows.Scan(&row.ID, &row.ServerType, &row.ConfJson, &row.LastUpdate, &row.Disabled, &row.DeletionTime); err != nil {
+			return nil, err
+		}
+		if row.Conf, row.confErr = unmarshalServerConf(row.ID, row.ConfJson); row.confErr != nil {
+			logger.Error("*ServerManager.ChangedSince(): can't open secrets of server ", row.ID, ". error: ", row.confErr)
+		}
+		serverRows = append(serverRows, row)
 	}
-	defer stmtUpdateServerConf.Close()
+	return serverRows, rows.Err()
+}
 
-	_, err = stmtUpdateServerConf.Exec(serverType, string(serverConfBytes), time.Now().Unix(), id)
+func (sm *ServerManager) Update(id uint, serverType string, confJson server.Configurables) error {
+	confJson, err := server.ValidateServerConf(serverType, confJson)
+	if err != nil {
+		return err
+	}
+	_, err = sm.changeServer(id, anyLastUpdate, serverActionUpdate, func(row *ServerRow) bool {
+		row.ServerType = serverType
+		row.Conf = confJson
+		return true
+	})
 	if err != nil {
-		logger.Error("*ServerManager.Update(): cannot execute prepared statement, error: ", err)
+		logger.Error("*ServerManager.Update(): cannot update server ", id, ", error: ", err)
 		return err
 	}
 
@@ -134,21 +239,33 @@ func (sm *ServerManager) Update(id uint, serverType string, confJson server.Conf
 	return nil
 }
 
-func (sm *ServerManager) Delete(id uint) error {
-	dbConn, err := sm.dbConnector.Conn()
-	if err != nil {
-		return err
+// UpdateIfUnchanged() updates the server only if its LastUpdate is still expectedLastUpdate,
+// i.e., nobody changed it since the caller read it. It returns the new LastUpdate to expect next time.
+// It returns ErrServerConflict with the current LastUpdate if the server has changed, or ErrServerNotFound if it is gone.
+func (sm *ServerManager) UpdateIfUnchanged(id uint, expectedLastUpdate int64, serverType string, confJson server.Configurables) (newLastUpdate int64, err error) {
+	if confJson, err = server.ValidateServerConf(serverType, confJson); err != nil {
+		return 0, err
 	}
-	defer dbConn.Close()
-
-	stmtDeleteServerConf, err := dbConn.Prepare(`UPDATE ` + masterConfig.DB.TblPrefix + serverConfigTableName + ` SET LastUpdate = ?, DeletionTime = ? WHERE ID = ? AND DeletionTime = 0`)
-	if err != nil {
-		return err
+	row, err := sm.changeServer(id, expectedLastUpdate, serverActionUpdate, func(row *ServerRow) bool {
+		row.ServerType = serverType
+		row.Conf = confJson
+		return true
+	})
+	if err == ErrServerConflict {
+		return row.LastUpdate, err
+	} else if err != nil {
+		return 0, err
 	}
-	defer stmtDeleteServerConf.Close()
 
-	deletionTime := time.Now().Unix()
-	_, err = stmtDeleteServerConf.Exec(deletionTime, deletionTime, id)
+	logger.Info("*ServerManager.UpdateIfUnchanged(): updated server with id ", id, " and type ", serverType)
+	return row.LastUpdate, nil
+}
+
+func (sm *ServerManager) Delete(id uint) error {
+	_, err := sm.changeServer(id, anyLastUpdate, serverActionDelete, func(row *ServerRow) bool {
+		row.DeletionTime = time.Now().Unix()
+		return true
+	})
 	if err != nil {
 		return err
 	}
@@ -158,19 +275,13 @@ func (sm *ServerManager) Delete(id uint) error {
 }
 
 func (sm *ServerManager) Disable(id uint) error {
-	dbConn, err := sm.dbConnector.Conn()
-	if err != nil {
-		return err
-	}
-	defer dbConn.Close()
-
-	stmtDisableServerConf, err := dbConn.Prepare(`UPDATE ` + masterConfig.DB.TblPrefix + serverConfigTableName + ` SET LastUpdate = ?, Disabled = 1 WHERE ID = ? AND Disabled = 0 AND DeletionTime = 0`)
-	if err != nil {
-		return err
-	}
-	defer stmtDisableServerConf.Close()
-
-	_, err = stmtDisableServerConf.Exec(time.Now().Unix(), id)
+	_, err := sm.changeServer(id, anyLastUpdate, serverActionDisable, func(row *ServerRow) bool {
+		if row.Disabled {
+			return false
+		}
+		row.Disabled = true
+		return true
+	})
 	if err != nil {
 		return err
 	}
@@ -180,29 +291,24 @@ func (sm *ServerManager) Disable(id uint) error {
 }
 
 func (sm *ServerManager) Enable(id uint) error {
-	dbConn, err := sm.dbConnector.Conn()
-	if err != nil {
-		return err
-	}
-	defer dbConn.Close()
-
-	stmtDisableServerConf, err := dbConn.Prepare(`UPDATE ` + masterConfig.DB.TblPrefix + serverConfigTableName + ` SET LastUpdate = ?, Disabled = 0 WHERE ID = ? AND Disabled = 1 AND DeletionTime = 0`)
-	if err != nil {
-		return err
-	}
-	defer stmtDisableServerConf.Close()
-
-	_, err = stmtDisableServerConf.Exec(time.Now().Unix(), id)
+	_, err := sm.changeServer(id, anyLastUpdate, serverActionEnable, func(row *ServerRow) bool {
+		if !row.Disabled {
+			return false
+		}
+		row.Disabled = false
+		return true
+	})
 	if err != nil {
 		return err
 	}
 
-	logger.Info("*ServerManager.Disable(): disabled server with id ", id)
+	logger.Info("*ServerManager.Enable(): enabled server with id ", id)
 	return nil
 }
 
 func _debugHandlerServerManager(c *gin.Context) {
-	debugServerManager := NewServerManager(masterConfig.DB)
+	operatorUid, _ := authedUid(c)
+	debugServerManager := NewServerManager(dbConnector).AsOperator(operatorUid)
 	op := c.Query("op")
 
 	switch op {
@@ -289,6 +395,41 @@ func _debugHandlerServerManager(c *gin.Context) {
 			return
 		}
 		id = uint(iduint64)
+		// With last_update as read before, only update if nobody else did in between.
+		if lastUpdateStr := c.PostForm("last_update"); lastUpdateStr != "" {
+			expectedLastUpdate, err := strconv.ParseInt(lastUpdateStr, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"op":     op,
+					"status": "error",
+					"error":  err.Error(),
+				})
+				return
+			}
+			newLastUpdate, err := debugServerManager.UpdateIfUnchanged(id, expectedLastUpdate, c.PostForm("server_type"), confJson)
+			if err == ErrServerConflict {
+				c.JSON(http.StatusConflict, gin.H{
+					"op":          op,
+					"status":      "error",
+					"error":       err.Error(),
+					"last_update": newLastUpdate,
+				})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"op":     op,
+					"status": "error",
+					"error":  err.Error(),
+				})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"op":          op,
+				"status":      "success",
+				"last_update": newLastUpdate,
+			})
+			return
+		}
 		err = debugServerManager.Update(id, c.PostForm("server_type"), confJson)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
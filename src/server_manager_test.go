@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TunnelWork/Ulysses/src/internal/db"
+	"github.com/TunnelWork/Ulysses/src/internal/secret"
+	"github.com/TunnelWork/Ulysses/src/server"
+)
+
+// newTestConnector returns a Connector to a migrated SQLite database living in a temporary directory.
+func newTestConnector(t *testing.T) db.Connector {
+	t.Helper()
+	masterConfig.DB.TblPrefix = "test_"
+
+	connector, err := db.NewConnector(db.DatabaseConfig{
+		Driver:     db.DriverSQLite,
+		SqlitePath: filepath.Join(t.TempDir(), "ulysses.db"),
+	})
+	if err != nil {
+		t.Fatalf("db.NewConnector() returns error:%s\n", err)
+	}
+	t.Cleanup(func() { connector.Close() })
+
+	dbConn, _ := connector.Conn()
+	migrator, err := db.NewMigrator(dbConn, connector.Dialect(), masterConfig.DB.TblPrefix)
+	if err != nil {
+		t.Fatalf("db.NewMigrator() returns error:%s\n", err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatalf("Migrator.Up() returns error:%s\n", err)
+	}
+	return connector
+}
+
+// timedOutConnector is a Connector whose query timeout has always run out.
+type timedOutConnector struct {
+	db.Connector
+}
+
+func (timedOutConnector) WithTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	cancel()
+	return ctx, cancel
+}
+
+func TestQueryTimeout(t *testing.T) {
+	useTestConnector(t)
+	uid, err := NewUserManager(dbConnector).Create("alice", "alice@example.com", "passhash")
+	if err != nil {
+		t.Fatalf("Create() returns error:%s\n", err)
+	}
+	serverID, err := NewServerManager(dbConnector).Add("schema_less", server.Configurables{})
+	if err != nil {
+		t.Fatalf("Add() returns error:%s\n", err)
+	}
+
+	dbConnector = timedOutConnector{dbConnector}
+	if _, err = NewUserManager(dbConnector).Lookup(uid); !errors.Is(err, context.Canceled) {
+		t.Errorf("*UserManager.Lookup() returns %v, want %v\n", err, context.Canceled)
+	}
+	if _, _, err = NewServerManager(dbConnector).Lookup(serverID); !errors.Is(err, context.Canceled) {
+		t.Errorf("*ServerManager.Lookup() returns %v, want %v\n", err, context.Canceled)
+	}
+	if _, err = NewAccountManager(dbConnector).ListByUser(uid); !errors.Is(err, context.Canceled) {
+		t.Errorf("*AccountManager.ListByUser() returns %v, want %v\n", err, context.Canceled)
+	}
+	if _, err = NewJobQueue(dbConnector).List("", 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("*JobQueue.List() returns %v, want %v\n", err, context.Canceled)
+	}
+	if _, err = loginLockedFor([]string{loginThrottleKeyLogin + "alice"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("loginLockedFor() returns %v, want %v\n", err, context.Canceled)
+	}
+}
+
+func TestServerManagerCRUD(t *testing.T) {
+	sm := NewServerManager(newTestConnector(t))
+
+	id, err := sm.Add("dummy", server.Configurables{"host": "a.example.com"})
+	if err != nil {
+		t.Fatalf("Add() returns error:%s\n", err)
+	}
+
+	serverType, conf, err := sm.Lookup(id)
+	if err != nil {
+		t.Fatalf("Lookup() returns error:%s\n", err)
+	}
+	if serverType != "dummy" || conf["host"] != "a.example.com" {
+		t.Errorf("Lookup() returns %s %v, want dummy with host a.example.com\n", serverType, conf)
+	}
+
+	if err = sm.Update(id, "dummy2", server.Configurables{"host": "b.example.com"}); err != nil {
+		t.Fatalf("Update() returns error:%s\n", err)
+	}
+	if serverType, conf, _ = sm.Lookup(id); serverType != "dummy2" || conf["host"] != "b.example.com" {
+		t.Errorf("Lookup() after Update() returns %s %v\n", serverType, conf)
+	}
+
+	if err = sm.Disable(id); err != nil {
+		t.Fatalf("Disable() returns error:%s\n", err)
+	}
+	if _, _, err = sm.Lookup(id); err == nil {
+		t.Errorf("Lookup() returns disabled server\n")
+	}
+	if err = sm.Enable(id); err != nil {
+		t.Fatalf("Enable() returns error:%s\n", err)
+	}
+	if _, _, err = sm.Lookup(id); err != nil {
+		t.Errorf("Lookup() after Enable() returns error:%s\n", err)
+	}
+
+	if err = sm.Delete(id); err != nil {
+		t.Fatalf("Delete() returns error:%s\n", err)
+	}
+	if _, _, err = sm.Lookup(id); err == nil {
+		t.Errorf("Lookup() returns deleted server\n")
+	}
+
+	rows, err := sm.ChangedSince(0)
+	if err != nil {
+		t.Fatalf("ChangedSince() returns error:%s\n", err)
+	}
+	if len(rows) != 1 || rows[0].ID != id || rows[0].DeletionTime == 0 {
+		t.Errorf("ChangedSince() returns %v, want the deleted server\n", rows)
+	}
+}
+
+func TestServerManagerList(t *testing.T) {
+	sm := NewServerManager(newTestConnector(t))
+
+	for i := 0; i < 5; i++ {
+		serverType := "even"
+		if i%2 == 1 {
+			serverType = "odd"
+		}
+		if _, err := sm.Add(serverType, server.Configurables{}); err != nil {
+			t.Fatalf("Add() returns error:%s\n", err)
+		}
+	}
+	sm.Disable(1)
+
+	// Pages of 2 sorted by server_type: even(1,3,5) then odd(2,4)
+	want := []uint{1, 3, 5, 2, 4}
+	got := []uint{}
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		servers, next, err := sm.List(ServerListOptions{SortBy: "server_type", Limit: 2, Cursor: cursor})
+		if err != nil {
+			t.Fatalf("List() returns error:%s\n", err)
+		}
+		for _, s := range servers {
+			got = append(got, s.ID)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(got) != len(want) {
+		t.Fatalf("List() pages return %v, want %v\n", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("List() pages return %v, want %v\n", got, want)
+		}
+	}
+
+	disabled := true
+	servers, _, err := sm.List(ServerListOptions{Disabled: &disabled})
+	if err != nil {
+		t.Fatalf("List() returns error:%s\n", err)
+	}
+	if len(servers) != 1 || servers[0].ID != 1 || !servers[0].Disabled {
+		t.Errorf("List() disabled returns %v, want server 1\n", servers)
+	}
+
+	if _, _, err = sm.List(ServerListOptions{SortBy: "passwd"}); err != ErrServerListBadSort {
+		t.Errorf("List() with bad sort returns %v, want %v\n", err, ErrServerListBadSort)
+	}
+}
+
+func TestServerManagerUpdateIfUnchanged(t *testing.T) {
+	sm := NewServerManager(newTestConnector(t))
+
+	id, err := sm.Add("dummy", server.Configurables{"v": "0"})
+	if err != nil {
+		t.Fatalf("Add() returns error:%s\n", err)
+	}
+	rows, _ := sm.ChangedSince(0)
+	readLastUpdate := rows[0].LastUpdate
+
+	// Two admins read the same LastUpdate. Only the first one wins, even within the same second.
+	newLastUpdate, err := sm.UpdateIfUnchanged(id, readLastUpdate, "dummy", server.Configurables{"v": "1"})
+	if err != nil {
+		t.Fatalf("UpdateIfUnchanged() returns error:%s\n", err)
+	}
+	if newLastUpdate <= readLastUpdate {
+		t.Errorf("UpdateIfUnchanged() returns LastUpdate %d, want > %d\n", newLastUpdate, readLastUpdate)
+	}
+	current, err := sm.UpdateIfUnchanged(id, readLastUpdate, "dummy", server.Configurables{"v": "2"})
+	if err != ErrServerConflict {
+		t.Fatalf("UpdateIfUnchanged() with stale LastUpdate returns %v, want %v\n", err, ErrServerConflict)
+	}
+	if current != newLastUpdate {
+		t.Errorf("UpdateIfUnchanged() conflict returns LastUpdate %d, want %d\n", current, newLastUpdate)
+	}
+	if _, conf, _ := sm.Lookup(id); conf["v"] != "1" {
+		t.Errorf("Lookup() after conflict returns %v, want v=1\n", conf)
+	}
+
+	if _, err = sm.UpdateIfUnchanged(id+1, readLastUpdate, "dummy", server.Configurables{}); err != ErrServerNotFound {
+		t.Errorf("UpdateIfUnchanged() on missing server returns %v, want %v\n", err, ErrServerNotFound)
+	}
+}
+
+func TestServerManagerInTx(t *testing.T) {
+	connector := newTestConnector(t)
+	sm := NewServerManager(connector)
+	am := NewAccountManager(connector)
+	errAbort := errors.New("abort")
+
+	// Server and accounts are created together, or not at all.
+	err := db.WithTx(context.Background(), connector, func(tx *sql.Tx) error {
+		id, err := sm.InTx(tx).Add("dummy", server.Configurables{})
+		if err != nil {
+			return err
+		}
+		if _, err = am.InTx(tx).Add(1, id, []int{1, 2}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("WithTx() returns %v, want %v\n", err, errAbort)
+	}
+	if rows, _ := sm.ChangedSince(0); len(rows) != 0 {
+		t.Errorf("ChangedSince() after rollback returns %v, want none\n", rows)
+	}
+	if accounts, _ := am.ListByUser(1); len(accounts) != 0 {
+		t.Errorf("ListByUser() after rollback returns %v, want none\n", accounts)
+	}
+
+	err = db.WithTx(context.Background(), connector, func(tx *sql.Tx) error {
+		id, err := sm.InTx(tx).Add("dummy", server.Configurables{})
+		if err != nil {
+			return err
+		}
+		_, err = am.InTx(tx).Add(1, id, []int{1, 2})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WithTx() returns error:%s\n", err)
+	}
+	if accounts, _ := am.ListByUser(1); len(accounts) != 2 {
+		t.Errorf("ListByUser() after commit returns %v, want 2 accounts\n", accounts)
+	}
+}
+
+func TestServerManagerHistory(t *testing.T) {
+	sm := NewServerManager(newTestConnector(t)).AsOperator(7)
+
+	id, err := sm.Add("dummy", server.Configurables{"host": "a.example.com", "port": "443"})
+	if err != nil {
+		t.Fatalf("Add() returns error:%s\n", err)
+	}
+	sm.Update(id, "dummy", server.Configurables{"host": "b.example.com", "tls": "on"})
+	sm.Disable(id)
+	sm.Disable(id) // Nothing to change, no revision
+
+	revisions, err := sm.History(id, 0)
+	if err != nil {
+		t.Fatalf("History() returns error:%s\n", err)
+	}
+	if len(revisions) != 3 {
+		t.Fatalf("History() returns %d revisions, want 3\n", len(revisions))
+	}
+	for i, action := range []string{serverActionDisable, serverActionUpdate, serverActionAdd} {
+		if revisions[i].Action != action || revisions[i].OperatorUid != 7 {
+			t.Errorf("History()[%d] is %s by %d, want %s by 7\n", i, revisions[i].Action, revisions[i].OperatorUid, action)
+		}
+	}
+	if revisions[1].PrevConf["host"] != "a.example.com" || revisions[1].Conf["host"] != "b.example.com" {
+		t.Errorf("History() update revision has %v -> %v\n", revisions[1].PrevConf, revisions[1].Conf)
+	}
+
+	diff, err := sm.Diff(revisions[2].ID, revisions[1].ID)
+	if err != nil {
+		t.Fatalf("Diff() returns error:%s\n", err)
+	}
+	want := []ServerConfChange{
+		{Key: "host", Op: "changed", From: "a.example.com", To: "b.example.com"},
+		{Key: "port", Op: "removed", From: "443"},
+		{Key: "tls", Op: "added", To: "on"},
+	}
+	if len(diff.Changes) != len(want) {
+		t.Fatalf("Diff() returns %v, want %v\n", diff.Changes, want)
+	}
+	for i := range want {
+		if diff.Changes[i] != want[i] {
+			t.Errorf("Diff().Changes[%d] = %v, want %v\n", i, diff.Changes[i], want[i])
+		}
+	}
+
+	if err = sm.Rollback(id, revisions[2].ID); err != nil {
+		t.Fatalf("Rollback() returns error:%s\n", err)
+	}
+	sm.Enable(id)
+	if _, conf, _ := sm.Lookup(id); conf["host"] != "a.example.com" || conf["port"] != "443" {
+		t.Errorf("Lookup() after Rollback() returns %v\n", conf)
+	}
+	if revisions, _ = sm.History(id, 1); len(revisions) != 1 || revisions[0].Action != serverActionEnable {
+		t.Errorf("History() latest is %v, want enable\n", revisions)
+	}
+
+	other, _ := sm.Add("dummy", server.Configurables{})
+	if err = sm.Rollback(other, revisions[0].ID); err != ErrServerRevisionNotFound {
+		t.Errorf("Rollback() to revision of another server returns %v, want %v\n", err, ErrServerRevisionNotFound)
+	}
+}
+
+type secretiveRegistrar struct{}
+
+func (secretiveRegistrar) NewServer(sconf server.Configurables) (server.Server, error) {
+	return nil, server.ErrServerConfigurables
+}
+
+func (secretiveRegistrar) SecretKeys() []string {
+	return []string{"api_key"}
+}
+
+func TestServerManagerSecrets(t *testing.T) {
+	sm := NewServerManager(newTestConnector(t))
+	server.AddServerRegistrar("secretive", secretiveRegistrar{})
+
+	var err error
+	secretKeyring, err = secret.LoadKeyring(filepath.Join(t.TempDir(), "secret.key"), "ULYSSES_TEST_NO_SUCH_ENV")
+	if err != nil {
+		t.Fatalf("secret.LoadKeyring() returns error:%s\n", err)
+	}
+	defer func() { secretKeyring = nil }()
+
+	id, err := sm.Add("secretive", server.Configurables{"host": "panel.example.com", "api_key": "s3cr3t"})
+	if err != nil {
+		t.Fatalf("Add() returns error:%s\n", err)
+	}
+
+	rows, _ := sm.ChangedSince(0)
+	if strings.Contains(rows[0].ConfJson, "s3cr3t") || !strings.Contains(rows[0].ConfJson, "panel.example.com") {
+		t.Errorf("stored config is %s, want api_key sealed and host in plain\n", rows[0].ConfJson)
+	}
+	if rows[0].Conf["api_key"] != "s3cr3t" {
+		t.Errorf("ChangedSince() returns api_key %q, want it opened\n", rows[0].Conf["api_key"])
+	}
+	if _, conf, err := sm.Lookup(id); err != nil || conf["api_key"] != "s3cr3t" {
+		t.Errorf("Lookup() returns %v, %v, want api_key opened\n", conf, err)
+	}
+
+	if resealed, _ := sm.ResealSecrets(); resealed != 0 {
+		t.Errorf("ResealSecrets() without rotation resealed %d servers, want 0\n", resealed)
+	}
+	oldKeyID := secretKeyring.Primary()
+	secretKeyring.Rotate()
+	if resealed, err := sm.ResealSecrets(); err != nil || resealed != 1 {
+		t.Errorf("ResealSecrets() after rotation returns %d, %v, want 1\n", resealed, err)
+	}
+	rows, _ = sm.ChangedSince(0)
+	if strings.Contains(rows[0].ConfJson, oldKeyID) || rows[0].Conf["api_key"] != "s3cr3t" {
+		t.Errorf("config after ResealSecrets() is %s\n", rows[0].ConfJson)
+	}
+
+	revisions, _ := sm.History(id, 0)
+	if len(revisions) != 2 || revisions[0].PrevConf["api_key"] != "s3cr3t" {
+		t.Errorf("History() after reseal returns %v\n", revisions)
+	}
+
+	// API views never show secrets
+	if masked := maskServerConf("secretive", rows[0].Conf); masked["api_key"] != maskedSecret || masked["host"] != "panel.example.com" {
+		t.Errorf("maskServerConf() returns %v\n", masked)
+	}
+	sealed, _ := secretKeyring.Seal("s3cr3t", nil)
+	if masked := maskServerConf("plain", server.Configurables{"token": sealed}); masked["token"] != maskedSecret {
+		t.Errorf("maskServerConf() of a sealed value returns %v\n", masked)
+	}
+	if err = sm.Update(id, "secretive", server.Configurables{"host": "panel.example.com", "api_key": "n3w"}); err != nil {
+		t.Fatalf("Update() returns error:%s\n", err)
+	}
+	revisions, _ = sm.History(id, 0)
+	diff, err := sm.Diff(revisions[1].ID, revisions[0].ID)
+	if err != nil || len(diff.Changes) != 1 || diff.Changes[0] != (ServerConfChange{Key: "api_key", Op: "changed"}) {
+		t.Errorf("Diff() of a new secret returns %+v, %v, want changed without values\n", diff.Changes, err)
+	}
+}
+
+func TestServerManagerSecretsBound(t *testing.T) {
+	connector := newTestConnector(t)
+	sm := NewServerManager(connector)
+	server.AddServerRegistrar("secretive", secretiveRegistrar{})
+
+	var err error
+	secretKeyring, err = secret.LoadKeyring(filepath.Join(t.TempDir(), "secret.key"), "ULYSSES_TEST_NO_SUCH_ENV")
+	if err != nil {
+		t.Fatalf("secret.LoadKeyring() returns error:%s\n", err)
+	}
+	defer func() { secretKeyring = nil }()
+
+	a, _ := sm.Add("secretive", server.Configurables{"api_key": "s3cr3t"})
+	b, _ := sm.Add("secretive", server.Configurables{"api_key": "other"})
+	dbConn, _ := connector.Conn()
+	setConfJson := func(id uint, confJson string) {
+		if _, err := dbConn.Exec(`UPDATE `+masterConfig.DB.TblPrefix+serverConfigTableName+` SET ConfJson = ? WHERE ID = ?`, confJson, id); err != nil {
+			t.Fatalf("can't update server. error:%s\n", err)
+		}
+	}
+
+	// A secret copied to another server doesn't open there
+	row, _ := sm.row(a)
+	setConfJson(b, row.ConfJson)
+	if _, _, err = sm.Lookup(b); err != secret.ErrBadCiphertext {
+		t.Errorf("Lookup() of a secret copied from another server returns %v, want %v\n", err, secret.ErrBadCiphertext)
+	}
+	setConfJson(b, strings.Replace(row.ConfJson, `"api_key"`, `"password"`, 1))
+	if _, _, err = sm.Lookup(b); err != secret.ErrBadCiphertext {
+		t.Errorf("Lookup() of a secret moved to another key returns %v, want %v\n", err, secret.ErrBadCiphertext)
+	}
+
+	// Secrets sealed before they were bound are opened, and bound on reseal
+	legacy, _ := secretKeyring.Seal("l3gacy", nil)
+	legacy = "enc:v1:" + strings.TrimPrefix(legacy, "enc:v2:")
+	setConfJson(b, `{"api_key":"`+legacy+`"}`)
+	if _, conf, err := sm.Lookup(b); err != nil || conf["api_key"] != "l3gacy" {
+		t.Errorf("Lookup() of a legacy secret returns %v, %v\n", conf, err)
+	}
+	if resealed, err := sm.ResealSecrets(); err != nil || resealed != 1 {
+		t.Errorf("ResealSecrets() of a legacy secret returns %d, %v, want 1\n", resealed, err)
+	}
+	if row, _ = sm.row(b); strings.Contains(row.ConfJson, "enc:v1:") || row.Conf["api_key"] != "l3gacy" {
+		t.Errorf("config after ResealSecrets() is %s\n", row.ConfJson)
+	}
+
+	// History is resealed too, so the old key can go
+	secretKeyring.Rotate()
+	if _, err = sm.ResealSecrets(); err != nil {
+		t.Fatalf("ResealSecrets() returns error:%s\n", err)
+	}
+	secretKeyring, err = secret.ParseKeyring(strings.SplitN(secretKeyring.String(), "\n", 2)[0])
+	if err != nil {
+		t.Fatalf("secret.ParseKeyring() returns error:%s\n", err)
+	}
+	revisions, err := sm.History(a, 0)
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("History() returns %v, %v\n", revisions, err)
+	}
+	if revisions[1].Conf["api_key"] != "s3cr3t" || revisions[0].PrevConf["api_key"] != "s3cr3t" {
+		t.Errorf("History() with only the new key returns %+v\n", revisions)
+	}
+	if err = sm.Rollback(a, revisions[1].ID); err != nil {
+		t.Errorf("Rollback() to a resealed revision returns error:%s\n", err)
+	}
+}
+
+type schemaRegistrar struct{}
+
+func (schemaRegistrar) NewServer(sconf server.Configurables) (server.Server, error) {
+	return nil, server.ErrServerConfigurables
+}
+
+func (schemaRegistrar) ServerSchema() server.Schema {
+	return server.Schema{
+		Fields: []server.Field{
+			{Key: "panel_url", Type: server.FieldURL, Required: true},
+			{Key: "port", Type: server.FieldInt, Default: "443"},
+		},
+	}
+}
+
+func (schemaRegistrar) AccountSchema() server.Schema {
+	return server.Schema{AllowUnknown: true}
+}
+
+func TestServerManagerValidation(t *testing.T) {
+	sm := NewServerManager(newTestConnector(t))
+	server.AddServerRegistrar("schematic", schemaRegistrar{})
+
+	if _, err := sm.Add("schematic", server.Configurables{"panel_url": "panel.example.com"}); !errors.Is(err, server.ErrServerConfigurables) {
+		t.Errorf("Add() with bad config returns %v, want %v\n", err, server.ErrServerConfigurables)
+	}
+	if rows, _ := sm.ChangedSince(0); len(rows) != 0 {
+		t.Errorf("Add() with bad config stored %v\n", rows)
+	}
+
+	id, err := sm.Add("schematic", server.Configurables{"panel_url": "https://panel.example.com"})
+	if err != nil {
+		t.Fatalf("Add() returns error:%s\n", err)
+	}
+	if _, conf, _ := sm.Lookup(id); conf["port"] != "443" {
+		t.Errorf("Lookup() returns %v, want default port filled in\n", conf)
+	}
+
+	if err = sm.Update(id, "schematic", server.Configurables{"panel_url": "https://panel.example.com", "prot": "8443"}); !errors.Is(err, server.ErrServerConfigurables) {
+		t.Errorf("Update() with typo returns %v, want %v\n", err, server.ErrServerConfigurables)
+	}
+}
+
+func TestServerManagerRollbackUnreadable(t *testing.T) {
+	connector := newTestConnector(t)
+	sm := NewServerManager(connector)
+	server.AddServerRegistrar("secretive", secretiveRegistrar{})
+	server.AddServerRegistrar("schematic", schemaRegistrar{})
+
+	var err error
+	secretKeyring, err = secret.LoadKeyring(filepath.Join(t.TempDir(), "secret.key"), "ULYSSES_TEST_NO_SUCH_ENV")
+	if err != nil {
+		t.Fatalf("secret.LoadKeyring() returns error:%s\n", err)
+	}
+	defer func() { secretKeyring = nil }()
+
+	id, err := sm.Add("secretive", server.Configurables{"host": "panel.example.com", "api_key": "s3cr3t"})
+	if err != nil {
+		t.Fatalf("Add() returns error:%s\n", err)
+	}
+	if err = sm.Update(id, "schematic", server.Configurables{"panel_url": "https://panel.example.com"}); err != nil {
+		t.Fatalf("Update() returns error:%s\n", err)
+	}
+	revisions, _ := sm.History(id, 0)
+	if len(revisions) != 2 {
+		t.Fatalf("History() returns %d revisions, want 2\n", len(revisions))
+	}
+	sealedRev, schematicRev := revisions[1].ID, revisions[0].ID
+
+	// The key sealing the revision is gone
+	secretKeyring, err = secret.LoadKeyring(filepath.Join(t.TempDir(), "other.key"), "ULYSSES_TEST_NO_SUCH_ENV")
+	if err != nil {
+		t.Fatalf("secret.LoadKeyring() returns error:%s\n", err)
+	}
+	if err = sm.Rollback(id, sealedRev); err == nil {
+		t.Errorf("Rollback() to a revision sealed with a lost key returns no error\n")
+	}
+
+	// A garbled revision, and one the schema doesn't accept
+	dbConn, _ := connector.Conn()
+	for conf, want := range map[string]error{
+		`{"panel_url":`:           nil,
+		`{"panel_url":"nowhere"}`: server.ErrServerConfigurables,
+	} {
+		if _, err = dbConn.Exec(`UPDATE `+masterConfig.DB.TblPrefix+serverHistoryTableName+` SET conf_json = ? WHERE id = ?`, conf, schematicRev); err != nil {
+			t.Fatalf("can't update revision. error:%s\n", err)
+		}
+		err = sm.Rollback(id, schematicRev)
+		if err == nil || (want != nil && !errors.Is(err, want)) {
+			t.Errorf("Rollback() to revision %s returns %v\n", conf, err)
+		}
+	}
+
+	if _, conf, _ := sm.Lookup(id); conf["panel_url"] != "https://panel.example.com" {
+		t.Errorf("Lookup() after refused Rollback() returns %v\n", conf)
+	}
+}
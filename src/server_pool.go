@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/TunnelWork/Ulysses/src/server"
+)
+
+// The server pool keeps a ready server.Server for every enabled server row, keyed by ID.
+// It is reloaded on each tick with only the rows whose LastUpdate moved since the last reload.
+//
+// The watermark is the time the last reload started, not the greatest LastUpdate read: LastUpdate of a row changed
+// several times within a second runs ahead of the clock, and must not hide rows written after it at the real time.
+
+type pooledServer struct {
+	serverType string
+	confJson   string // with secrets opened, to tell if the config changed
+	lastUpdate int64
+	instance   server.Server
+}
+
+type serverPoolFailure struct {
+	lastUpdate int64 // of the row failed to apply
+	retryAfter time.Time
+}
+
+const (
+	serverPoolClockSkew   = 5 * time.Second
+	serverPoolRetryPeriod = 30 * time.Second
+)
+
+var (
+	serverPoolMutex      *sync.RWMutex
+	serverPool           map[uint]*pooledServer
+	serverPoolLastUpdate int64                          // Watermark: rows with LastUpdate >= it are read on next reload
+	serverPoolDirty      bool                           // Set to reload all rows on next reload
+	serverPoolFailed     = map[uint]serverPoolFailure{} // Rows failed to apply, kept below the watermark
+)
+
+func initUlyssesServer() {
+	if serverPoolMutex == nil {
+		serverPoolMutex = &sync.RWMutex{}
+	}
+	serverPool = map[uint]*pooledServer{}
+	serverPoolDirty = true
+	reloadUlyssesServer()
+
+	registerTickEvent(reloadUlyssesServerSignature, reloadUlyssesServer)
+}
+
+// reloadUlyssesServer applies changed server rows to the pool:
+// - disabled or deleted rows are dropped
+// - rows with a new ServerType are instantiated again
+// - rows with only a new config get UpdateServer() on the existing instance
+//
+// The backend is called without holding serverPoolMutex, and the results are swapped in afterwards.
+// Rows failed to apply, including those with secrets that can't be opened, are read again on each reload
+// and retried after serverPoolRetryPeriod, or at once if they changed again.
+func reloadUlyssesServer() {
+	since := serverPoolLastUpdate
+	if serverPoolDirty {
+		since = 0
+	}
+	for _, failure := range serverPoolFailed {
+		if failure.lastUpdate < since {
+			since = failure.lastUpdate
+		}
+	}
+
+	// LastUpdate has a resolution of 1 second. Rows updated within the same second as the last reload,
+	// or by instances with a clock slightly behind, are read again and skipped below if nothing changed.
+	reloadStart := time.Now().Add(-serverPoolClockSkew).Unix()
+	rows, err := NewServerManager(dbConnector).ChangedSince(since)
+	if err != nil {
+		logger.Error("reloadUlyssesServer(): can't load server rows. error: ", err)
+		return
+	}
+
+	// Only reloadUlyssesServer() replaces or drops pooled servers, so a snapshot is enough to plan.
+	dirty := serverPoolDirty
+	current := map[uint]*pooledServer{}
+	serverPoolMutex.RLock()
+	if !dirty {
+		for _, row := range rows {
+			if pooled, ok := serverPool[row.ID]; ok {
+				current[row.ID] = pooled
+			}
+		}
+	}
+	serverPoolMutex.RUnlock()
+
+	now := time.Now()
+	applied := map[uint]*pooledServer{} // nil to drop
+	failed := map[uint]serverPoolFailure{}
+	for _, row := range rows {
+		if failure, ok := serverPoolFailed[row.ID]; ok && !dirty && failure.lastUpdate == row.LastUpdate && now.Before(failure.retryAfter) {
+			failed[row.ID] = failure
+			continue
+		}
+
+		if row.Disabled || row.DeletionTime != 0 {
+			if _, ok := current[row.ID]; ok {
+				logger.Info("reloadUlyssesServer(): dropped server ", row.ID)
+			}
+			applied[row.ID] = nil
+			continue
+		}
+
+		pooled, err := applyServerRow(current[row.ID], row)
+		if err != nil {
+			// A failed update leaves the server as is, still usable with the old config.
+			logger.Error("reloadUlyssesServer(): can't apply server ", row.ID, " with type ", row.ServerType, ". error: ", err)
+			failed[row.ID] = serverPoolFailure{lastUpdate: row.LastUpdate, retryAfter: now.Add(serverPoolRetryPeriod)}
+			continue
+		}
+		applied[row.ID] = pooled
+	}
+
+	serverPoolMutex.Lock()
+	defer serverPoolMutex.Unlock()
+
+	if dirty {
+		serverPool = map[uint]*pooledServer{}
+		serverPoolFailed = map[uint]serverPoolFailure{}
+		serverPoolDirty = false
+	}
+	for id, pooled := range applied {
+		delete(serverPoolFailed, id)
+		if pooled == nil {
+			delete(serverPool, id)
+		} else {
+			serverPool[id] = pooled
+		}
+	}
+	for id, failure := range failed {
+		serverPoolFailed[id] = failure
+	}
+
+	if reloadStart > serverPoolLastUpdate {
+		serverPoolLastUpdate = reloadStart
+	}
+}
+
+// applyServerRow returns the pooledServer for row, updating or replacing pooled (nil if not pooled).
+// It talks to the backend, so it must not be called with serverPoolMutex held.
+func applyServerRow(pooled *pooledServer, row ServerRow) (*pooledServer, error) {
+	// Passing sealed secrets to the backend as the config would do no good.
+	if row.confErr != nil {
+		return nil, row.confErr
+	}
+
+	// Sealed secrets differ each time they are written, so compare the opened config.
+	confJson, _ := json.Marshal(row.Conf)
+
+	if pooled != nil && pooled.serverType == row.ServerType {
+		if pooled.confJson == string(confJson) {
+			return &pooledServer{
+				serverType: pooled.serverType,
+				confJson:   pooled.confJson,
+				lastUpdate: row.LastUpdate,
+				instance:   pooled.instance,
+			}, nil
+		}
+
+		ctx, cancel := backendContext(context.Background())
+		defer cancel()
+		if err := server.WithContext(pooled.instance).UpdateServerContext(ctx, row.Conf); err != nil {
+			return nil, err
+		}
+		logger.Info("reloadUlyssesServer(): updated server ", row.ID)
+		return &pooledServer{
+			serverType: row.ServerType,
+			confJson:   string(confJson),
+			lastUpdate: row.LastUpdate,
+			instance:   pooled.instance,
+		}, nil
+	}
+
+	instance, err := server.NewServerByType(row.ServerType, row.Conf)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("reloadUlyssesServer(): loaded server ", row.ID, " with type ", row.ServerType)
+	return &pooledServer{
+		serverType: row.ServerType,
+		confJson:   string(confJson),
+		lastUpdate: row.LastUpdate,
+		instance:   instance,
+	}, nil
+}
+
+// loadServerType returns the ServerType of the server row id, from the pool if it has it.
+func loadServerType(id uint) (string, error) {
+	if serverPoolMutex != nil {
+		serverPoolMutex.RLock()
+		pooled, ok := serverPool[id]
+		serverPoolMutex.RUnlock()
+		if ok {
+			return pooled.serverType, nil
+		}
+	}
+
+	serverType, _, err := NewServerManager(dbConnector).Lookup(id)
+	return serverType, err
+}
+
+// loadServer returns the Server for the server row id.
+// It is served from the pool, and falls back to ServerManager if the pool doesn't have it (yet).
+func loadServer(id uint) (server.Server, error) {
+	if serverPoolMutex != nil {
+		serverPoolMutex.RLock()
+		pooled, ok := serverPool[id]
+		serverPoolMutex.RUnlock()
+		if ok {
+			return pooled.instance, nil
+		}
+	}
+
+	serverType, sconf, err := NewServerManager(dbConnector).Lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := server.NewServerByType(serverType, sconf)
+	if err != nil {
+		return nil, err
+	}
+
+	if serverPoolMutex != nil {
+		confJson, _ := json.Marshal(sconf)
+		serverPoolMutex.Lock()
+		if _, ok := serverPool[id]; !ok {
+			serverPool[id] = &pooledServer{
+				serverType: serverType,
+				confJson:   string(confJson),
+				instance:   instance,
+			}
+		}
+		serverPoolMutex.Unlock()
+	}
+	return instance, nil
+}
+
+// backendContext returns a ctx for operations on backend servers, done when parent is done,
+// after sys.backend_timeout_ms, or once Ulysses is shutting down. cancel must be called when the operation completes.
+// sys.backend_timeout_ms doesn't apply if parent has its own deadline, e.g., of a job.
+func backendContext(parent context.Context) (ctx context.Context, cancel context.CancelFunc) {
+	_, hasDeadline := parent.Deadline()
+	if timeoutMs := masterConfig.Sys.BackendTimeoutMs; timeoutMs > 0 && !hasDeadline {
+		ctx, cancel = context.WithTimeout(parent, time.Duration(timeoutMs)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+
+	go func() {
+		select {
+		case <-globalShutdownCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
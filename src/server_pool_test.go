@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/server"
+)
+
+// recordingServer keeps the last sconf it is given.
+type recordingServer struct {
+	mutex sync.Mutex
+	sconf server.Configurables
+}
+
+func (s *recordingServer) UpdateServer(sconf server.Configurables) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sconf = sconf
+	return nil
+}
+
+func (s *recordingServer) conf(key string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, _ := s.sconf.GetString(key)
+	return value
+}
+
+func (s *recordingServer) AddAccount(aconf []server.Configurables) ([]int, error) { return nil, nil }
+func (s *recordingServer) UpdateAccount(accID []int, aconf []server.Configurables) ([]int, error) {
+	return accID, nil
+}
+func (s *recordingServer) DeleteAccount(accID []int) ([]int, error) { return accID, nil }
+func (s *recordingServer) GetCredentials(accID []int) ([]server.Credential, error) {
+	return nil, nil
+}
+func (s *recordingServer) GetUsage(accID []int) ([]server.AccountUsage, error) { return nil, nil }
+
+type recordingRegistrar struct{}
+
+var (
+	errBackendDown       = errors.New("backend down")
+	recordingBackendDown bool
+)
+
+func (recordingRegistrar) NewServer(sconf server.Configurables) (server.Server, error) {
+	if recordingBackendDown {
+		return nil, errBackendDown
+	}
+	s := &recordingServer{}
+	s.UpdateServer(sconf)
+	return s, nil
+}
+
+// useTestServerPool starts an empty server pool for the duration of the test.
+func useTestServerPool(t *testing.T) {
+	serverPoolMutex = &sync.RWMutex{}
+	serverPool = map[uint]*pooledServer{}
+	serverPoolLastUpdate = 0
+	serverPoolDirty = true
+	serverPoolFailed = map[uint]serverPoolFailure{}
+	t.Cleanup(func() {
+		serverPoolMutex = nil
+		serverPool = nil
+	})
+}
+
+func pooledConf(t *testing.T, id uint, key string) string {
+	t.Helper()
+	serverPoolMutex.RLock()
+	pooled, ok := serverPool[id]
+	serverPoolMutex.RUnlock()
+	if !ok {
+		t.Fatalf("server %d is not in the pool\n", id)
+	}
+	return pooled.instance.(*recordingServer).conf(key)
+}
+
+func TestServerPoolReloadAfterBurst(t *testing.T) {
+	useTestConnector(t)
+	useTestServerPool(t)
+	server.AddServerRegistrar("recording", recordingRegistrar{})
+	sm := NewServerManager(dbConnector)
+
+	a, _ := sm.Add("recording", server.Configurables{"host": "a0"})
+	b, _ := sm.Add("recording", server.Configurables{"host": "b0"})
+	reloadUlyssesServer()
+
+	// Each edit within the same second moves LastUpdate of A one second ahead of the clock
+	for _, host := range []string{"a1", "a2", "a3", "a4", "a5"} {
+		if err := sm.Update(a, "recording", server.Configurables{"host": host}); err != nil {
+			t.Fatalf("Update() returns error:%s\n", err)
+		}
+	}
+	reloadUlyssesServer()
+	if host := pooledConf(t, a, "host"); host != "a5" {
+		t.Errorf("server A in the pool has host %s, want a5\n", host)
+	}
+
+	// B is written at the real time, behind LastUpdate of A
+	if err := sm.Update(b, "recording", server.Configurables{"host": "b1"}); err != nil {
+		t.Fatalf("Update() returns error:%s\n", err)
+	}
+	reloadUlyssesServer()
+	if host := pooledConf(t, b, "host"); host != "b1" {
+		t.Errorf("server B in the pool has host %s, want b1\n", host)
+	}
+}
+
+func TestServerPoolRetryFailed(t *testing.T) {
+	useTestConnector(t)
+	useTestServerPool(t)
+	server.AddServerRegistrar("recording", recordingRegistrar{})
+	sm := NewServerManager(dbConnector)
+
+	recordingBackendDown = true
+	t.Cleanup(func() { recordingBackendDown = false })
+	a, _ := sm.Add("recording", server.Configurables{"host": "a0"})
+	reloadUlyssesServer()
+	if _, ok := serverPool[a]; ok {
+		t.Fatalf("server A failed to instantiate is in the pool\n")
+	}
+	if _, ok := serverPoolFailed[a]; !ok {
+		t.Fatalf("server A failed to instantiate is not kept for retry\n")
+	}
+
+	// The backend comes back without the row changing: retried once the retry period passed
+	recordingBackendDown = false
+	reloadUlyssesServer()
+	if _, ok := serverPool[a]; ok {
+		t.Errorf("server A is retried before the retry period passed\n")
+	}
+	failure := serverPoolFailed[a]
+	failure.retryAfter = time.Now()
+	serverPoolFailed[a] = failure
+	// Failed rows are read again however far the watermark moved
+	serverPoolLastUpdate = time.Now().Add(time.Hour).Unix()
+	reloadUlyssesServer()
+	if host := pooledConf(t, a, "host"); host != "a0" {
+		t.Errorf("server A in the pool has host %s, want a0\n", host)
+	}
+	if _, ok := serverPoolFailed[a]; ok {
+		t.Errorf("server A is still kept for retry after it is loaded\n")
+	}
+}
+
+func TestServerPoolSkipSealed(t *testing.T) {
+	row := ServerRow{ID: 1, ServerType: "recording", Conf: server.Configurables{"password": "enc:v1:sealed"}, confErr: errors.New("no key")}
+	if _, err := applyServerRow(nil, row); err != row.confErr {
+		t.Errorf("applyServerRow() of a row with sealed secrets returns %v, want %v\n", err, row.confErr)
+	}
+}
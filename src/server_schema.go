@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/TunnelWork/Ulysses/src/server"
+	"github.com/gin-gonic/gin"
+)
+
+// serverTypeSchema is what admin UIs need to render the forms of a server type.
+type serverTypeSchema struct {
+	ServerType    string         `json:"server_type"`
+	HasSchema     bool           `json:"has_schema"` // Configurables are not validated if false
+	ServerSchema  *server.Schema `json:"server_schema,omitempty"`
+	AccountSchema *server.Schema `json:"account_schema,omitempty"`
+}
+
+func schemaOfServerType(serverType string) serverTypeSchema {
+	serverSchema, accountSchema, ok := server.SchemaByType(serverType)
+	if !ok {
+		return serverTypeSchema{ServerType: serverType}
+	}
+	return serverTypeSchema{
+		ServerType:    serverType,
+		HasSchema:     true,
+		ServerSchema:  &serverSchema,
+		AccountSchema: &accountSchema,
+	}
+}
+
+// _adminHandlerServerSchema returns the schema of server_type, or of all registered server types if not given.
+func _adminHandlerServerSchema(c *gin.Context) {
+	if serverType := c.Query("server_type"); serverType != "" {
+		for _, registered := range server.RegisteredTypes() {
+			if registered == serverType {
+				c.JSON(http.StatusOK, gin.H{
+					"status": "success",
+					"schema": schemaOfServerType(serverType),
+				})
+				return
+			}
+		}
+		c.JSON(http.StatusNotFound, gin.H{
+			"status": "error",
+			"error":  server.ErrServerUnknown.Error(),
+		})
+		return
+	}
+
+	schemas := []serverTypeSchema{}
+	for _, serverType := range server.RegisteredTypes() {
+		schemas = append(schemas, schemaOfServerType(serverType))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "success",
+		"schemas": schemas,
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/TunnelWork/Ulysses/src/internal/secret"
+	"github.com/TunnelWork/Ulysses/src/server"
+	"github.com/gin-gonic/gin"
+)
+
+// Values of secret keys declared by server.SecretKeysRegistrar are sealed by secretKeyring before a server row is written,
+// and every sealed value is opened when a row is read. ConfJson of ServerRow and history keeps the sealed form.
+// Each value is bound to its server ID and key, so it can't be copied into another server or key and opened there.
+//
+// To rotate the key, run with -rotate-secret-key, or put a new key as the first line of the keyring and call
+// admin/Server/ResealSecrets. Both reseal servers and their history, after which old keys may be removed from the keyring.
+
+const (
+	secretKeyringEnv = `ULYSSES_SECRET_KEYS` // Overrides sys.secret_key_path if set
+
+	serverActionReseal = `reseal`
+
+	maskedSecret = `******` // in place of secret values in API views
+)
+
+var (
+	secretKeyring *secret.Keyring
+)
+
+// secretAssociatedData is what a secret value of key of server serverID is bound to.
+func secretAssociatedData(serverID uint, key string) []byte {
+	return []byte(strconv.FormatUint(uint64(serverID), 10) + "|" + key)
+}
+
+// sealConfigurables returns a copy of sconf of server serverID with values of secret keys of serverType sealed.
+func sealConfigurables(serverID uint, serverType string, sconf server.Configurables) (server.Configurables, error) {
+	secretKeys := server.SecretKeysByType(serverType)
+	if len(secretKeys) == 0 {
+		return sconf, nil
+	}
+
+	sealed := server.Configurables{}
+	for key, value := range sconf {
+		sealed[key] = value
+	}
+	for _, key := range secretKeys {
+		// Schemas only accept strings for secret keys. Anything else is sealed as its JSON text.
+		rawValue, ok := sealed[key]
+		value := server.ValueString(rawValue)
+		if !ok || value == "" || secret.IsSealed(value) {
+			continue
+		}
+		sealedValue, err := secretKeyring.Seal(value, secretAssociatedData(serverID, key))
+		if err != nil {
+			return nil, err
+		}
+		sealed[key] = sealedValue
+	}
+	return sealed, nil
+}
+
+// openConfigurables returns a copy of sconf of server serverID with all sealed values opened.
+func openConfigurables(serverID uint, sconf server.Configurables) (server.Configurables, error) {
+	opened := server.Configurables{}
+	for key, value := range sconf {
+		if sealedValue, ok := value.(string); ok && secret.IsSealed(sealedValue) {
+			openedValue, err := secretKeyring.Open(sealedValue, secretAssociatedData(serverID, key))
+			if err != nil {
+				return nil, err
+			}
+			value = openedValue
+		}
+		opened[key] = value
+	}
+	return opened, nil
+}
+
+// isSecretKey tells if key of serverType is a secret key.
+func isSecretKey(serverType string, key string) bool {
+	for _, secretKey := range server.SecretKeysByType(serverType) {
+		if secretKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// maskServerConf returns a copy of sconf for API views, with values of secret keys of serverType
+// and values still sealed masked.
+func maskServerConf(serverType string, sconf server.Configurables) server.Configurables {
+	if sconf == nil {
+		return nil
+	}
+	masked := server.Configurables{}
+	for key, value := range sconf {
+		if text := server.ValueString(value); text != "" && (secret.IsSealed(text) || isSecretKey(serverType, key)) {
+			value = maskedSecret
+		}
+		masked[key] = value
+	}
+	return masked
+}
+
+// marshalServerConf returns the JSON of sconf of server serverID as stored, with secrets sealed.
+func marshalServerConf(serverID uint, serverType string, sconf server.Configurables) (string, error) {
+	sealed, err := sealConfigurables(serverID, serverType, sconf)
+	if err != nil {
+		return "", err
+	}
+	serverConfBytes, err := json.Marshal(sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(serverConfBytes), nil
+}
+
+// unmarshalServerConf returns the Configurables stored as confJson for server serverID with secrets opened.
+// On error, the Configurables still has the values it could read, with secrets sealed.
+func unmarshalServerConf(serverID uint, confJson string) (server.Configurables, error) {
+	sconf := server.Configurables{}
+	if err := json.Unmarshal([]byte(confJson), &sconf); err != nil {
+		return sconf, err
+	}
+	opened, err := openConfigurables(serverID, sconf)
+	if err != nil {
+		return sconf, err
+	}
+	return opened, nil
+}
+
+// needsResealing tells if the stored confJson has a secret in plain, in the legacy form, or sealed with a key other than the primary.
+func needsResealing(serverType string, confJson string) bool {
+	sconf := server.Configurables{}
+	json.Unmarshal([]byte(confJson), &sconf)
+	for _, key := range server.SecretKeysByType(serverType) {
+		if value := server.ValueString(sconf[key]); value != "" && !secret.IsSealed(value) {
+			return true
+		}
+	}
+	for _, rawValue := range sconf {
+		if value, ok := rawValue.(string); ok && secret.IsSealed(value) && (secret.IsLegacy(value) || secret.SealedKeyID(value) != secretKeyring.Primary()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResealSecrets() seals again the secrets of all servers stored in plain, in the legacy form or with an old key,
+// e.g., after a key rotation or a server type starting to declare secret keys. It returns how many servers are resealed.
+// Secrets in history are resealed too, so old keys are no longer needed after.
+func (sm *ServerManager) ResealSecrets() (resealed int, err error) {
+	if secretKeyring == nil {
+		return 0, secret.ErrNoKeyring
+	}
+
+	rows, err := sm.ChangedSince(0)
+	if err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		if row.DeletionTime != 0 || !needsResealing(row.ServerType, row.ConfJson) {
+			continue
+		}
+		_, err = sm.changeServer(row.ID, anyLastUpdate, serverActionReseal, func(row *ServerRow) bool {
+			return true
+		})
+		if err != nil {
+			return resealed, err
+		}
+		resealed++
+	}
+
+	resealedRevisions, err := sm.resealHistory()
+	if err != nil {
+		return resealed, err
+	}
+
+	logger.Info("*ServerManager.ResealSecrets(): resealed ", resealed, " servers and ", resealedRevisions, " revisions with key ", secretKeyring.Primary())
+	return resealed, nil
+}
+
+// resealHistory seals again the secrets of all revisions needing it, in place. It returns how many revisions are resealed.
+// Revisions with secrets that can't be opened are left as they are.
+func (sm *ServerManager) resealHistory() (resealed int, err error) {
+	dbConn, err := sm.conn()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := sm.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtListHistory, err := dbConn.PrepareContext(ctx, `SELECT id, server_id, prev_server_type, prev_conf_json, server_type, conf_json FROM `+masterConfig.DB.TblPrefix+serverHistoryTableName+` ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtListHistory.Close()
+
+	type storedRevision struct {
+		id, serverID               uint
+		prevServerType, serverType string
+		prevConfJson, confJson     string
+	}
+	rows, err := stmtListHistory.QueryContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	revisions := []storedRevision{}
+	for rows.Next() {
+		var rev storedRevision
+		if err = rows.Scan(&rev.id, &rev.serverID, &rev.prevServerType, &rev.prevConfJson, &rev.serverType, &rev.confJson); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if needsResealing(rev.prevServerType, rev.prevConfJson) || needsResealing(rev.serverType, rev.confJson) {
+			revisions = append(revisions, rev)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	stmtUpdateHistory, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+serverHistoryTableName+` SET prev_conf_json = ?, conf_json = ? WHERE id = ?`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtUpdateHistory.Close()
+
+	reseal := func(serverID uint, serverType string, confJson string) (string, error) {
+		sconf, err := unmarshalServerConf(serverID, confJson)
+		if err != nil {
+			return "", err
+		}
+		return marshalServerConf(serverID, serverType, sconf)
+	}
+	for _, rev := range revisions {
+		prevConfJson, err := reseal(rev.serverID, rev.prevServerType, rev.prevConfJson)
+		if err != nil {
+			logger.Error("*ServerManager.resealHistory(): can't reseal revision ", rev.id, ". error: ", err)
+			continue
+		}
+		confJson, err := reseal(rev.serverID, rev.serverType, rev.confJson)
+		if err != nil {
+			logger.Error("*ServerManager.resealHistory(): can't reseal revision ", rev.id, ". error: ", err)
+			continue
+		}
+		if _, err = stmtUpdateHistory.ExecContext(ctx, prevConfJson, confJson, rev.id); err != nil {
+			return resealed, err
+		}
+		resealed++
+	}
+	return resealed, nil
+}
+
+// _adminHandlerServerResealSecrets seals secrets of all servers with the primary key.
+func _adminHandlerServerResealSecrets(c *gin.Context) {
+	operatorUid, _ := authedUid(c)
+	resealed, err := NewServerManager(dbConnector).AsOperator(operatorUid).ResealSecrets()
+	if err != nil {
+		logger.Error("_adminHandlerServerResealSecrets(): can't reseal secrets. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status":   "error",
+			"resealed": resealed,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "success",
+		"resealed": resealed,
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	userSessionTableName = `sessions`
+
+	sessionTokenBytes  = 32
+	sessionCookieName  = `auth_token`
+	sessionHeaderName  = `Authorization`
+	sessionHeaderToken = `Bearer `
+
+	// Keys set in *gin.Context by hasValidAuth()
+	ctxKeyAuthUid       = `ulysses_auth_uid`
+	ctxKeyAuthTokenHash = `ulysses_auth_token_hash`
+)
+
+var (
+	ErrSessionNotFound = errors.New("ulysses/session: token not found or revoked")
+	ErrSessionExpired  = errors.New("ulysses/session: token expired")
+	ErrSessionMismatch = errors.New("ulysses/session: client fingerprint mismatch")
+)
+
+// sessionFingerprint identifies the client a session is issued to.
+// Only the User-Agent is used since client IP changes frequently for mobile users.
+func sessionFingerprint(c *gin.Context) string {
+	sum := sha256.Sum256([]byte(c.Request.UserAgent()))
+	return hex.EncodeToString(sum[:])
+}
+
+func sessionTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionTokenFromRequest looks for the token in Authorization header first, then the Cookie.
+func sessionTokenFromRequest(c *gin.Context) string {
+	if header := c.GetHeader(sessionHeaderName); strings.HasPrefix(header, sessionHeaderToken) {
+		return strings.TrimSpace(header[len(sessionHeaderToken):])
+	}
+	if cookie, err := c.Cookie(sessionCookieName); err == nil {
+		return cookie
+	}
+	return ""
+}
+
+// issueSession creates a new opaque session token for uid bound to the requesting client.
+// Only the SHA-256 of the token is stored, so a database leak doesn't leak usable tokens.
+func issueSession(c *gin.Context, uid uint) (token string, err error) {
+	tokenBytes := make([]byte, sessionTokenBytes)
+	if _, err = rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(c.Request.Context())
+	defer cancel()
+
+	// Clean up this user's dead sessions while we are here.
+	now := time.Now().Unix()
+	stmtPurgeSession, err := db.PrepareContext(ctx, `DELETE FROM `+masterConfig.DB.TblPrefix+userSessionTableName+` WHERE uid = ? AND (revoked = 1 OR expiry < ?)`)
+	if err != nil {
+		return "", err
+	}
+	defer stmtPurgeSession.Close()
+	if _, err = stmtPurgeSession.ExecContext(ctx, uid, now); err != nil {
+		return "", err
+	}
+
+	stmtInsertSession, err := db.PrepareContext(ctx, `INSERT INTO `+masterConfig.DB.TblPrefix+userSessionTableName+` (token_hash, uid, fingerprint, creation_time, last_active, expiry) VALUES( ?, ?, ?, ?, ?, ? )`)
+	if err != nil {
+		return "", err
+	}
+	defer stmtInsertSession.Close()
+
+	_, err = stmtInsertSession.ExecContext(ctx, sessionTokenHash(token), uid, sessionFingerprint(c), now, now, now+int64(masterConfig.Sys.SessionLifetimeSecond))
+	if err != nil {
+		return "", err
+	}
+
+	logger.Info("issueSession(): new session for uid ", uid)
+	return token, nil
+}
+
+// validateSession returns the uid owning token if the session is still alive.
+// A successful validation refreshes the idle timer of the session.
+func validateSession(c *gin.Context, token string) (uid uint, err error) {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := dbConnector.WithTimeout(c.Request.Context())
+	defer cancel()
+
+	stmtLookupSession, err := db.PrepareContext(ctx, `SELECT uid, fingerprint, last_active, expiry FROM `+masterConfig.DB.TblPrefix+userSessionTableName+` WHERE token_hash = ? AND revoked = 0`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtLookupSession.Close()
+
+	var fingerprint string
+	var lastActive, expiry int64
+	tokenHash := sessionTokenHash(token)
+	err = stmtLookupSession.QueryRowContext(ctx, tokenHash).Scan(&uid, &fingerprint, &lastActive, &expiry)
+	if err == sql.ErrNoRows {
+		return 0, ErrSessionNotFound
+	} else if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+	if now >= expiry || now-lastActive > int64(masterConfig.Sys.SessionIdleTimeoutSecond) {
+		return 0, ErrSessionExpired
+	}
+	if subtle.ConstantTimeCompare([]byte(fingerprint), []byte(sessionFingerprint(c))) != 1 {
+		return 0, ErrSessionMismatch
+	}
+
+	stmtTouchSession, err := db.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userSessionTableName+` SET last_active = ? WHERE token_hash = ?`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtTouchSession.Close()
+	if _, err = stmtTouchSession.ExecContext(ctx, now, tokenHash); err != nil {
+		return 0, err
+	}
+
+	return uid, nil
+}
+
+// revokeSession revokes a single session by its token hash.
+func revokeSession(tokenHash string) error {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtRevokeSession, err := db.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userSessionTableName+` SET revoked = 1 WHERE token_hash = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtRevokeSession.Close()
+
+	_, err = stmtRevokeSession.ExecContext(ctx, tokenHash)
+	return err
+}
+
+// revokeAllSessions revokes every session owned by uid.
+func revokeAllSessions(uid uint) error {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtRevokeSessions, err := db.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userSessionTableName+` SET revoked = 1 WHERE uid = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtRevokeSessions.Close()
+
+	_, err = stmtRevokeSessions.ExecContext(ctx, uid)
+	if err == nil {
+		logger.Info("revokeAllSessions(): revoked all sessions for uid ", uid)
+	}
+	return err
+}
+
+// revokeOtherSessions revokes every session owned by uid except the one with keepTokenHash.
+func revokeOtherSessions(uid uint, keepTokenHash string) error {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtRevokeSessions, err := db.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userSessionTableName+` SET revoked = 1 WHERE uid = ? AND token_hash <> ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtRevokeSessions.Close()
+
+	_, err = stmtRevokeSessions.ExecContext(ctx, uid, keepTokenHash)
+	return err
+}
+
+// authedUid returns the uid set by a successful hasValidAuth() call.
+func authedUid(c *gin.Context) (uint, bool) {
+	uid, ok := c.Get(ctxKeyAuthUid)
+	if !ok {
+		return 0, false
+	}
+	return uid.(uint), true
+}
+
+// _handlerLogout revokes the session used for this request.
+func _handlerLogout(c *gin.Context) {
+	if !hasValidAuth(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	if err := revokeSession(c.GetString(ctxKeyAuthTokenHash)); err != nil {
+		logger.Error("_handlerLogout(): can't revoke session. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// _handlerLogoutAll revokes all sessions of the user making this request, including itself.
+func _handlerLogoutAll(c *gin.Context) {
+	if !hasValidAuth(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	uid, _ := authedUid(c)
+	if err := revokeAllSessions(uid); err != nil {
+		logger.Error("_handlerLogoutAll(): can't revoke sessions. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useTestSessionConfig sets session lifetimes for the test and restores them after.
+func useTestSessionConfig(t *testing.T) {
+	prevLifetime, prevIdle := masterConfig.Sys.SessionLifetimeSecond, masterConfig.Sys.SessionIdleTimeoutSecond
+	masterConfig.Sys.SessionLifetimeSecond = 3600
+	masterConfig.Sys.SessionIdleTimeoutSecond = 600
+	t.Cleanup(func() {
+		masterConfig.Sys.SessionLifetimeSecond, masterConfig.Sys.SessionIdleTimeoutSecond = prevLifetime, prevIdle
+	})
+}
+
+// newSessionContext returns a gin.Context of a request from userAgent carrying token, if any.
+func newSessionContext(userAgent string, token string) (*gin.Context, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("POST", "/", nil)
+	c.Request.Header.Set("User-Agent", userAgent)
+	if token != "" {
+		c.Request.Header.Set(sessionHeaderName, sessionHeaderToken+token)
+	}
+	return c, recorder
+}
+
+func newTestSession(t *testing.T, uid uint, userAgent string) string {
+	t.Helper()
+	c, _ := newSessionContext(userAgent, "")
+	token, err := issueSession(c, uid)
+	if err != nil {
+		t.Fatalf("issueSession() returns error:%s\n", err)
+	}
+	return token
+}
+
+// setSessionTimes overwrites last_active and expiry of the session of token.
+func setSessionTimes(t *testing.T, token string, lastActive int64, expiry int64) {
+	t.Helper()
+	dbConn, _ := dbConnector.Conn()
+	if _, err := dbConn.Exec(`UPDATE `+masterConfig.DB.TblPrefix+userSessionTableName+` SET last_active = ?, expiry = ? WHERE token_hash = ?`, lastActive, expiry, sessionTokenHash(token)); err != nil {
+		t.Fatalf("can't update session. error:%s\n", err)
+	}
+}
+
+func TestIssueSession(t *testing.T) {
+	useTestConnector(t)
+	useTestSessionConfig(t)
+
+	token := newTestSession(t, 7, "agent/1.0")
+
+	// Only the hash is stored
+	dbConn, _ := dbConnector.Conn()
+	var plain, hashed int
+	dbConn.QueryRow(`SELECT COUNT(*) FROM `+masterConfig.DB.TblPrefix+userSessionTableName+` WHERE token_hash = ?`, token).Scan(&plain)
+	dbConn.QueryRow(`SELECT COUNT(*) FROM `+masterConfig.DB.TblPrefix+userSessionTableName+` WHERE token_hash = ?`, sessionTokenHash(token)).Scan(&hashed)
+	if plain != 0 || hashed != 1 {
+		t.Errorf("sessions has %d rows of the token and %d of its hash, want 0 and 1\n", plain, hashed)
+	}
+
+	c, _ := newSessionContext("agent/1.0", token)
+	if uid, err := validateSession(c, token); err != nil || uid != 7 {
+		t.Errorf("validateSession() returns %d, %v, want 7\n", uid, err)
+	}
+	if _, err := validateSession(c, token+"x"); err != ErrSessionNotFound {
+		t.Errorf("validateSession() of unknown token returns %v, want %v\n", err, ErrSessionNotFound)
+	}
+
+	// Bound to the client it is issued to
+	c, _ = newSessionContext("agent/2.0", token)
+	if _, err := validateSession(c, token); err != ErrSessionMismatch {
+		t.Errorf("validateSession() from another client returns %v, want %v\n", err, ErrSessionMismatch)
+	}
+}
+
+func TestValidateSessionExpiry(t *testing.T) {
+	useTestConnector(t)
+	useTestSessionConfig(t)
+	now := time.Now().Unix()
+	idle := int64(masterConfig.Sys.SessionIdleTimeoutSecond)
+
+	// Use refreshes the idle timer
+	token := newTestSession(t, 7, "agent/1.0")
+	setSessionTimes(t, token, now-idle+5, now+3600)
+	c, _ := newSessionContext("agent/1.0", token)
+	if _, err := validateSession(c, token); err != nil {
+		t.Fatalf("validateSession() of a session close to idle timeout returns error:%s\n", err)
+	}
+	dbConn, _ := dbConnector.Conn()
+	var lastActive int64
+	dbConn.QueryRow(`SELECT last_active FROM `+masterConfig.DB.TblPrefix+userSessionTableName+` WHERE token_hash = ?`, sessionTokenHash(token)).Scan(&lastActive)
+	if lastActive < now {
+		t.Errorf("validateSession() leaves last_active at %d, want at least %d\n", lastActive, now)
+	}
+
+	// Idle for too long
+	setSessionTimes(t, token, now-idle-1, now+3600)
+	if _, err := validateSession(c, token); err != ErrSessionExpired {
+		t.Errorf("validateSession() of an idle session returns %v, want %v\n", err, ErrSessionExpired)
+	}
+
+	// Expired however active
+	setSessionTimes(t, token, now, now)
+	if _, err := validateSession(c, token); err != ErrSessionExpired {
+		t.Errorf("validateSession() of an expired session returns %v, want %v\n", err, ErrSessionExpired)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	useTestConnector(t)
+	useTestSessionConfig(t)
+
+	token := newTestSession(t, 7, "agent/1.0")
+	other := newTestSession(t, 7, "agent/1.0")
+
+	c, recorder := newSessionContext("agent/1.0", token)
+	_handlerLogout(c)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("_handlerLogout() responds %d\n", recorder.Code)
+	}
+	c, _ = newSessionContext("agent/1.0", token)
+	if _, err := validateSession(c, token); err != ErrSessionNotFound {
+		t.Errorf("validateSession() after logout returns %v, want %v\n", err, ErrSessionNotFound)
+	}
+	if _, err := validateSession(c, other); err != nil {
+		t.Errorf("validateSession() of another session after logout returns error:%s\n", err)
+	}
+
+	// The revoked token can't log out again
+	c, recorder = newSessionContext("agent/1.0", token)
+	_handlerLogout(c)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("_handlerLogout() with a revoked token responds %d, want %d\n", recorder.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	useTestConnector(t)
+	useTestSessionConfig(t)
+
+	token := newTestSession(t, 7, "agent/1.0")
+	other := newTestSession(t, 7, "agent/2.0")
+	someoneElse := newTestSession(t, 8, "agent/1.0")
+
+	c, recorder := newSessionContext("agent/1.0", token)
+	_handlerLogoutAll(c)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("_handlerLogoutAll() responds %d\n", recorder.Code)
+	}
+	for _, tc := range []struct {
+		userAgent string
+		token     string
+		want      error
+	}{
+		{"agent/1.0", token, ErrSessionNotFound},
+		{"agent/2.0", other, ErrSessionNotFound},
+		{"agent/1.0", someoneElse, nil},
+	} {
+		c, _ = newSessionContext(tc.userAgent, tc.token)
+		if _, err := validateSession(c, tc.token); err != tc.want {
+			t.Errorf("validateSession() after logout of all returns %v, want %v\n", err, tc.want)
+		}
+	}
+}
+
+func TestSessionsOfDisabledOrDeletedUser(t *testing.T) {
+	useTestConnector(t)
+	useTestSessionConfig(t)
+
+	um := NewUserManager(dbConnector)
+	disabledUid, err := um.Create("alice", "alice@example.com", "passhash")
+	if err != nil {
+		t.Fatalf("Create() returns error:%s\n", err)
+	}
+	deletedUid, err := um.Create("bob", "bob@example.com", "passhash")
+	if err != nil {
+		t.Fatalf("Create() returns error:%s\n", err)
+	}
+	disabledToken := newTestSession(t, disabledUid, "agent/1.0")
+	deletedToken := newTestSession(t, deletedUid, "agent/1.0")
+
+	if err = um.Disable(disabledUid); err != nil {
+		t.Fatalf("Disable() returns error:%s\n", err)
+	}
+	if err = um.Delete(deletedUid); err != nil {
+		t.Fatalf("Delete() returns error:%s\n", err)
+	}
+
+	for _, token := range []string{disabledToken, deletedToken} {
+		c, recorder := newSessionContext("agent/1.0", token)
+		if _, err = validateSession(c, token); err != ErrSessionNotFound {
+			t.Errorf("validateSession() of a disabled or deleted user returns %v, want %v\n", err, ErrSessionNotFound)
+		}
+		_handlerLogoutAll(c)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("_handlerLogoutAll() of a disabled or deleted user responds %d, want %d\n", recorder.Code, http.StatusUnauthorized)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"sync"
 
 	"github.com/TunnelWork/Ulysses/src/internal/logger"
@@ -16,6 +17,9 @@ var (
 	//
 	globalTickGroup   sync.WaitGroup
 	globalExitChannel chan bool
+
+	// globalShutdownCtx is canceled by globalExitSignal(), to stop in-flight operations on backend servers.
+	globalShutdownCtx, globalShutdown = context.WithCancel(context.Background())
 )
 
 // globalExitSignal() should write to the globalExitChannel
@@ -25,6 +29,7 @@ func globalExitSignal() {
 	// Signal up to 100 routines to quit.
 	// globalWaitGroup.Add(1)
 	logger.Debug("globalExitSignal(): everybody get out!")
+	globalShutdown()
 	go func() {
 		// defer globalWaitGroup.Done()
 		for i := 0; i < 100; i++ {
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/api"
+	"github.com/TunnelWork/Ulysses/src/internal/auth"
+	"github.com/TunnelWork/Ulysses/src/internal/db"
+	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	userPasswordResetTableName = `password_resets`
+
+	passwordResetTokenBytes    = 32
+	passwordResetTokenLifetime = 1 * time.Hour
+
+	userDefaultRoles = api.ROLE_CUSTOMER
+)
+
+var (
+	ErrUserNotFound          = errors.New("ulysses/user: no such user")
+	ErrUserLoginTaken        = errors.New("ulysses/user: login is already taken")
+	ErrUserEmailTaken        = errors.New("ulysses/user: email is already taken")
+	ErrUserBadLogin          = errors.New("ulysses/user: login can't be empty or anonymous")
+	ErrPasswordResetTokenBad = errors.New("ulysses/user: password reset token is invalid or expired")
+)
+
+// UserInfo is the non-sensitive part of a user record
+type UserInfo struct {
+	Uid          uint     `json:"uid"`
+	Login        string   `json:"login"`
+	Email        string   `json:"email"`
+	Roles        api.Role `json:"roles"`
+	Disabled     bool     `json:"disabled"`
+	CreationTime int64    `json:"creation_time"`
+}
+
+// UserManager is capable of performing database CRUD operations to
+// - User Account Info
+type UserManager struct {
+	dbConnector db.Connector
+}
+
+// NewUserManager shares the connection pool of dbConnector
+func NewUserManager(dbConnector db.Connector) *UserManager {
+	return &UserManager{
+		dbConnector: dbConnector,
+	}
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// storedEmail is email as stored in the database. No email is NULL, so it is left out of the unique index.
+func storedEmail(email string) sql.NullString {
+	return sql.NullString{String: email, Valid: email != ""}
+}
+
+// checkUnique returns ErrUserLoginTaken or ErrUserEmailTaken if any user other than exceptUid uses login or email.
+// Soft-deleted users still hold their login and email.
+//
+// The unique indexes on login and email are what really guard against a concurrent insert;
+// this only gives a friendly error before trying, and tells which one is taken after a failed write.
+func (um *UserManager) checkUnique(ctx context.Context, dbConn *sql.DB, login string, email string, exceptUid uint) error {
+	stmtCheckLogin, err := dbConn.PrepareContext(ctx, `SELECT COUNT(*) FROM `+masterConfig.DB.TblPrefix+userAuthTableName+` WHERE login = ? AND uid <> ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtCheckLogin.Close()
+
+	var count int
+	if err = stmtCheckLogin.QueryRowContext(ctx, login, exceptUid).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrUserLoginTaken
+	}
+
+	if email == "" {
+		return nil
+	}
+
+	stmtCheckEmail, err := dbConn.PrepareContext(ctx, `SELECT COUNT(*) FROM `+masterConfig.DB.TblPrefix+userAuthTableName+` WHERE email = ? AND uid <> ?`)
+	if err != nil {
+		return err
+	}
+	defer stmtCheckEmail.Close()
+
+	if err = stmtCheckEmail.QueryRowContext(ctx, email, exceptUid).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrUserEmailTaken
+	}
+	return nil
+}
+
+// Create() returns the newly inserted user (uid, nil), or (0, error) if any error
+func (um *UserManager) Create(login string, email string, passhash string) (uid uint, err error) {
+	login = strings.TrimSpace(login)
+	email = normalizeEmail(email)
+	if login == "" || login == "anonymous" {
+		return 0, ErrUserBadLogin
+	}
+
+	dbConn, err := um.dbConnector.Conn()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := um.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	if err = um.checkUnique(ctx, dbConn, login, email, 0); err != nil {
+		return 0, err
+	}
+
+	passwordHash, err := auth.HashPassword(passhash)
+	if err != nil {
+		return 0, err
+	}
+	pubKeyPEM, wrappedPrivKey, err := newUserKeypair(passhash)
+	if err != nil {
+		return 0, err
+	}
+
+	stmtInsertUser, err := dbConn.PrepareContext(ctx, `INSERT INTO `+masterConfig.DB.TblPrefix+userAuthTableName+` (login, email, password, pubkey, privkey, roles, creation_time) VALUES( ?, ?, ?, ?, ?, ?, ? )`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtInsertUser.Close()
+
+	result, err := stmtInsertUser.ExecContext(ctx, login, storedEmail(email), passwordHash, pubKeyPEM, wrappedPrivKey, uint(userDefaultRoles), time.Now().Unix())
+	if err != nil {
+		// Lost a race to another insert of the same login or email
+		if uniqueErr := um.checkUnique(ctx, dbConn, login, email, 0); uniqueErr == ErrUserLoginTaken || uniqueErr == ErrUserEmailTaken {
+			return 0, uniqueErr
+		}
+		return 0, err
+	}
+	uidint64, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	uid = uint(uidint64)
+
+	logger.Info("*UserManager.Create(): created user ", login, " with uid ", uid)
+	return uid, nil
+}
+
+func (um *UserManager) Lookup(uid uint) (UserInfo, error) {
+	dbConn, err := um.dbConnector.Conn()
+	if err != nil {
+		return UserInfo{}, err
+	}
+
+	ctx, cancel := um.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtLookupUser, err := dbConn.PrepareContext(ctx, `SELECT uid, login, COALESCE(email, ''), roles, disabled, creation_time FROM `+masterConfig.DB.TblPrefix+userAuthTableName+` WHERE uid = ? AND deletion_time = 0`)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	defer stmtLookupUser.Close()
+
+	var user UserInfo
+	err = stmtLookupUser.QueryRowContext(ctx, uid).Scan(&user.Uid, &user.Login, &user.Email, &user.Roles, &user.Disabled, &user.CreationTime)
+	if err == sql.ErrNoRows {
+		return UserInfo{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+// List() returns all users not deleted, ordered by uid
+func (um *UserManager) List() ([]UserInfo, error) {
+	dbConn, err := um.dbConnector.Conn()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := um.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtListUser, err := dbConn.PrepareContext(ctx, `SELECT uid, login, COALESCE(email, ''), roles, disabled, creation_time FROM `+masterConfig.DB.TblPrefix+userAuthTableName+` WHERE deletion_time = 0 ORDER BY uid`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtListUser.Close()
+
+	rows, err := stmtListUser.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserInfo{}
+	for rows.Next() {
+		var user UserInfo
+		if err = rows.Scan(&user.Uid, &user.Login, &user.Email, &user.Roles, &user.Disabled, &user.CreationTime); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// Update() changes login and email of uid
+func (um *UserManager) Update(uid uint, login string, email string) error {
+	login = strings.TrimSpace(login)
+	email = normalizeEmail(email)
+	if login == "" || login == "anonymous" {
+		return ErrUserBadLogin
+	}
+
+	dbConn, err := um.dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := um.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	if err = um.checkUnique(ctx, dbConn, login, email, uid); err != nil {
+		return err
+	}
+
+	stmtUpdateUser, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userAuthTableName+` SET login = ?, email = ? WHERE uid = ? AND deletion_time = 0`)
+	if err != nil {
+		return err
+	}
+	defer stmtUpdateUser.Close()
+
+	result, err := stmtUpdateUser.ExecContext(ctx, login, storedEmail(email), uid)
+	if err != nil {
+		// Lost a race to another write of the same login or email
+		if uniqueErr := um.checkUnique(ctx, dbConn, login, email, uid); uniqueErr == ErrUserLoginTaken || uniqueErr == ErrUserEmailTaken {
+			return uniqueErr
+		}
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		// Could be no such user, or nothing changed. Tell them apart.
+		if _, err = um.Lookup(uid); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("*UserManager.Update(): updated user with uid ", uid)
+	return nil
+}
+
+// SetRoles() replaces the roles of uid. ROLE_ANONYMOUS is meaningless for a user and is dropped.
+func (um *UserManager) SetRoles(uid uint, roles api.Role) error {
+	roles &= api.ROLE_AUTHENTICATED
+
+	dbConn, err := um.dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := um.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtSetRoles, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userAuthTableName+` SET roles = ? WHERE uid = ? AND deletion_time = 0`)
+	if err != nil {
+		return err
+	}
+	defer stmtSetRoles.Close()
+
+	result, err := stmtSetRoles.ExecContext(ctx, uint(roles), uid)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		// Could be no such user, or roles unchanged. Tell them apart.
+		if _, err = um.Lookup(uid); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("*UserManager.SetRoles(): set roles of uid ", uid, " to ", roles.String())
+	return nil
+}
+
+// Delete() is a soft deletion. The record is kept, and the login/email stays taken.
+func (um *UserManager) Delete(uid uint) error {
+	dbConn, err := um.dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := um.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtDeleteUser, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userAuthTableName+` SET disabled = 1, deletion_time = ? WHERE uid = ? AND deletion_time = 0`)
+	if err != nil {
+		return err
+	}
+	defer stmtDeleteUser.Close()
+
+	result, err := stmtDeleteUser.ExecContext(ctx, time.Now().Unix(), uid)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrUserNotFound
+	}
+	if err = revokeAllSessions(uid); err != nil {
+		return err
+	}
+
+	logger.Info("*UserManager.Delete(): removed user with uid ", uid)
+	return nil
+}
+
+func (um *UserManager) Disable(uid uint) error {
+	dbConn, err := um.dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := um.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtDisableUser, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userAuthTableName+` SET disabled = 1 WHERE uid = ? AND disabled = 0 AND deletion_time = 0`)
+	if err != nil {
+		return err
+	}
+	defer stmtDisableUser.Close()
+
+	result, err := stmtDisableUser.ExecContext(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		// Could be no such user, or disabled already. Tell them apart.
+		if _, err = um.Lookup(uid); err != nil {
+			return err
+		}
+	}
+	if err = revokeAllSessions(uid); err != nil {
+		return err
+	}
+
+	logger.Info("*UserManager.Disable(): disabled user with uid ", uid)
+	return nil
+}
+
+func (um *UserManager) Enable(uid uint) error {
+	dbConn, err := um.dbConnector.Conn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := um.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtEnableUser, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userAuthTableName+` SET disabled = 0 WHERE uid = ? AND disabled = 1 AND deletion_time = 0`)
+	if err != nil {
+		return err
+	}
+	defer stmtEnableUser.Close()
+
+	result, err := stmtEnableUser.ExecContext(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		// Could be no such user, or enabled already. Tell them apart.
+		if _, err = um.Lookup(uid); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("*UserManager.Enable(): enabled user with uid ", uid)
+	return nil
+}
+
+// NewPasswordResetToken() returns a one-time token for uid to set a new password without the old one.
+// Only the hash of the token is stored. Previous tokens of uid are invalidated.
+func (um *UserManager) NewPasswordResetToken(uid uint) (string, error) {
+	if _, err := um.Lookup(uid); err != nil {
+		return "", err
+	}
+
+	tokenBytes := make([]byte, passwordResetTokenBytes)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	dbConn, err := um.dbConnector.Conn()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := um.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtDeleteToken, err := dbConn.PrepareContext(ctx, `DELETE FROM `+masterConfig.DB.TblPrefix+userPasswordResetTableName+` WHERE uid = ?`)
+	if err != nil {
+		return "", err
+	}
+	defer stmtDeleteToken.Close()
+
+	stmtInsertToken, err := dbConn.PrepareContext(ctx, `INSERT INTO `+masterConfig.DB.TblPrefix+userPasswordResetTableName+` (token_hash, uid, expiry) VALUES( ?, ?, ? )`)
+	if err != nil {
+		return "", err
+	}
+	defer stmtInsertToken.Close()
+
+	if _, err = stmtDeleteToken.ExecContext(ctx, uid); err != nil {
+		return "", err
+	}
+	if _, err = stmtInsertToken.ExecContext(ctx, sessionTokenHash(token), uid, time.Now().Add(passwordResetTokenLifetime).Unix()); err != nil {
+		return "", err
+	}
+
+	logger.Info("*UserManager.NewPasswordResetToken(): issued password reset token for uid ", uid)
+	return token, nil
+}
+
+// ResetPassword() sets a new password for the owner of token and burns the token.
+// The old private key can't be unwrapped without the old password, so a new keypair is generated.
+func (um *UserManager) ResetPassword(token string, newPasshash string) (uid uint, err error) {
+	dbConn, err := um.dbConnector.Conn()
+	if err != nil {
+		return 0, err
+	}
+
+	tokenHash := sessionTokenHash(token)
+
+	ctx, cancel := um.dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtLookupToken, err := dbConn.PrepareContext(ctx, `SELECT uid, expiry FROM `+masterConfig.DB.TblPrefix+userPasswordResetTableName+` WHERE token_hash = ?`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtLookupToken.Close()
+
+	var expiry int64
+	err = stmtLookupToken.QueryRowContext(ctx, tokenHash).Scan(&uid, &expiry)
+	if err == sql.ErrNoRows {
+		return 0, ErrPasswordResetTokenBad
+	} else if err != nil {
+		return 0, err
+	}
+
+	// Burn the token first. If someone else burnt it in between, they win.
+	stmtDeleteToken, err := dbConn.PrepareContext(ctx, `DELETE FROM `+masterConfig.DB.TblPrefix+userPasswordResetTableName+` WHERE token_hash = ?`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtDeleteToken.Close()
+
+	result, err := stmtDeleteToken.ExecContext(ctx, tokenHash)
+	if err != nil {
+		return 0, err
+	}
+	if affected, _ := result.RowsAffected(); affected != 1 || time.Now().Unix() >= expiry {
+		return 0, ErrPasswordResetTokenBad
+	}
+
+	passwordHash, err := auth.HashPassword(newPasshash)
+	if err != nil {
+		return 0, err
+	}
+	pubKeyPEM, wrappedPrivKey, err := newUserKeypair(newPasshash)
+	if err != nil {
+		return 0, err
+	}
+
+	stmtResetPassword, err := dbConn.PrepareContext(ctx, `UPDATE `+masterConfig.DB.TblPrefix+userAuthTableName+` SET password = ?, pubkey = ?, privkey = ? WHERE uid = ? AND deletion_time = 0`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmtResetPassword.Close()
+
+	if _, err = stmtResetPassword.ExecContext(ctx, passwordHash, pubKeyPEM, wrappedPrivKey, uid); err != nil {
+		return 0, err
+	}
+	if err = revokeAllSessions(uid); err != nil {
+		return 0, err
+	}
+
+	logger.Info("*UserManager.ResetPassword(): reset password for uid ", uid)
+	return uid, nil
+}
+
+// _handlerPasswordReset lets a user with a valid reset token set a new password.
+func _handlerPasswordReset(c *gin.Context) {
+	userManager := NewUserManager(dbConnector)
+
+	newPasshash := c.PostForm("new_passhash")
+	if newPasshash == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	_, err := userManager.ResetPassword(c.PostForm("token"), newPasshash)
+	if err == ErrPasswordResetTokenBad {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	} else if err != nil {
+		logger.Error("_handlerPasswordReset(): can't reset password. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
+
+// userManagerErrorStatus maps UserManager errors to HTTP status codes
+func userManagerErrorStatus(err error) int {
+	switch err {
+	case ErrUserNotFound:
+		return http.StatusNotFound
+	case ErrUserLoginTaken, ErrUserEmailTaken:
+		return http.StatusConflict
+	case ErrUserBadLogin, api.ErrBadRoleName:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// _adminHandlerUserManager is registered for api.ROLE_ADMIN only.
+func _adminHandlerUserManager(c *gin.Context) {
+	adminUserManager := NewUserManager(dbConnector)
+	op := c.Query("op")
+
+	// Every op except add and list works on an existing uid
+	var uid uint
+	if op != "add" && op != "list" {
+		uiduint64, err := strconv.ParseUint(c.PostForm("uid"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"op":     op,
+				"status": "error",
+				"error":  err.Error(),
+			})
+			return
+		}
+		uid = uint(uiduint64)
+	}
+
+	var err error
+	resp := gin.H{
+		"op":     op,
+		"status": "success",
+	}
+
+	switch op {
+	case "add":
+		uid, err = adminUserManager.Create(c.PostForm("login"), c.PostForm("email"), c.PostForm("passhash"))
+		resp["uid"] = uid
+	case "lookup":
+		var user UserInfo
+		user, err = adminUserManager.Lookup(uid)
+		resp["user"] = user
+	case "list":
+		var users []UserInfo
+		users, err = adminUserManager.List()
+		resp["users"] = users
+	case "update":
+		err = adminUserManager.Update(uid, c.PostForm("login"), c.PostForm("email"))
+	case "set_roles":
+		var roles api.Role
+		roles, err = api.ParseRoles(c.PostForm("roles"))
+		if err == nil {
+			err = adminUserManager.SetRoles(uid, roles)
+		}
+	case "delete":
+		err = adminUserManager.Delete(uid)
+	case "disable":
+		err = adminUserManager.Disable(uid)
+	case "enable":
+		err = adminUserManager.Enable(uid)
+	case "reset_token":
+		var token string
+		token, err = adminUserManager.NewPasswordResetToken(uid)
+		resp["token"] = token // Deliver it to the user in a trusted way.
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"op":     op,
+			"status": "error",
+			"error":  "unknown op",
+		})
+		return
+	}
+
+	if err != nil {
+		status := userManagerErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			logger.Error("_adminHandlerUserManager(): op ", op, " failed. error: ", err)
+		}
+		c.JSON(status, gin.H{
+			"op":     op,
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/TunnelWork/Ulysses/src/api"
+)
+
+func TestUserManagerNotFound(t *testing.T) {
+	useTestConnector(t)
+	um := NewUserManager(dbConnector)
+
+	uid, err := um.Create("alice", "alice@example.com", "passhash")
+	if err != nil {
+		t.Fatalf("Create() returns error:%s\n", err)
+	}
+
+	// Nothing to change is not an error
+	if err = um.Enable(uid); err != nil {
+		t.Errorf("Enable() of an enabled user returns error:%s\n", err)
+	}
+	if err = um.Disable(uid); err != nil {
+		t.Fatalf("Disable() returns error:%s\n", err)
+	}
+	if err = um.Disable(uid); err != nil {
+		t.Errorf("Disable() of a disabled user returns error:%s\n", err)
+	}
+	if err = um.Delete(uid); err != nil {
+		t.Fatalf("Delete() returns error:%s\n", err)
+	}
+
+	ops := map[string]func(uid uint) error{
+		"SetRoles": func(uid uint) error { return um.SetRoles(uid, api.ROLE_ADMIN) },
+		"Delete":   um.Delete,
+		"Disable":  um.Disable,
+		"Enable":   um.Enable,
+	}
+	for name, op := range ops {
+		for _, missing := range []uint{uid, uid + 100} {
+			if err = op(missing); err != ErrUserNotFound {
+				t.Errorf("%s() of uid %d returns %v, want %v\n", name, missing, err, ErrUserNotFound)
+			}
+		}
+	}
+}
+
+func TestUserManagerUnique(t *testing.T) {
+	useTestConnector(t)
+	um := NewUserManager(dbConnector)
+
+	if _, err := um.Create("alice", "alice@example.com", "passhash"); err != nil {
+		t.Fatalf("Create() returns error:%s\n", err)
+	}
+	// Any number of users may have no email
+	var noEmail []uint
+	for _, login := range []string{"bob", "carol"} {
+		uid, err := um.Create(login, "", "passhash")
+		if err != nil {
+			t.Fatalf("Create() without email returns error:%s\n", err)
+		}
+		noEmail = append(noEmail, uid)
+	}
+	if user, err := um.Lookup(noEmail[0]); err != nil || user.Email != "" {
+		t.Errorf("Lookup() of a user without email returns %+v, %v\n", user, err)
+	}
+
+	if _, err := um.Create("alice", "other@example.com", "passhash"); err != ErrUserLoginTaken {
+		t.Errorf("Create() with a taken login returns %v, want %v\n", err, ErrUserLoginTaken)
+	}
+	if _, err := um.Create("dave", " ALICE@example.com", "passhash"); err != ErrUserEmailTaken {
+		t.Errorf("Create() with a taken email returns %v, want %v\n", err, ErrUserEmailTaken)
+	}
+	if err := um.Update(noEmail[0], "bob", "alice@example.com"); err != ErrUserEmailTaken {
+		t.Errorf("Update() to a taken email returns %v, want %v\n", err, ErrUserEmailTaken)
+	}
+
+	// The database refuses a duplicate email that gets past the check
+	dbConn, _ := dbConnector.Conn()
+	if _, err := dbConn.Exec(`INSERT INTO `+masterConfig.DB.TblPrefix+userAuthTableName+` (login, email, password) VALUES( ?, ?, ? )`, "mallory", "alice@example.com", "x"); err == nil {
+		t.Errorf("users accepts a duplicate email\n")
+	}
+
+	// Racing creates of the same login: one wins, the others are told the login is taken
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := um.Create("eve", "eve"+strconv.Itoa(i)+"@example.com", "passhash")
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+		} else if err != ErrUserLoginTaken {
+			t.Errorf("racing Create() returns %v, want %v\n", err, ErrUserLoginTaken)
+		}
+	}
+	if created != 1 {
+		t.Errorf("racing Create() created %d users, want 1\n", created)
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TunnelWork/Ulysses/src/internal/auth"
+	"github.com/TunnelWork/Ulysses/src/internal/logger"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	mfaTypeWebAuthn = `webauthn`
+
+	webAuthnChallengeTableName = `webauthn_challenges`
+
+	webAuthnTimeout = 5 * time.Minute // How long a challenge stays valid
+)
+
+type webAuthnConfig struct {
+	Credentials []webAuthnCredentialRecord `json:"credentials"`
+}
+
+type webAuthnCredentialRecord struct {
+	auth.WebAuthnCredential
+	Name         string `json:"name"`
+	CreationTime int64  `json:"creation_time"`
+}
+
+func webAuthnRP() auth.WebAuthnRP {
+	return auth.WebAuthnRP{
+		ID:     masterConfig.Sys.UrlDomain,
+		Origin: "https://" + masterConfig.Sys.UrlDomain,
+	}
+}
+
+// Pending challenges are one-shot, and kept in the database so any instance can finish what another began.
+// Key: "reg/<uid>" or "login/<uid>"
+
+// putWebAuthnChallenge creates a new challenge for key, replacing any pending one.
+func putWebAuthnChallenge(key string) ([]byte, error) {
+	challenge, err := auth.NewWebAuthnChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := dbConnector.Conn()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	// Drop expired challenges while we are here.
+	now := time.Now()
+	stmtDeleteChallenge, err := db.PrepareContext(ctx, `DELETE FROM `+masterConfig.DB.TblPrefix+webAuthnChallengeTableName+` WHERE challenge_key = ? OR expiry < ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtDeleteChallenge.Close()
+	if _, err = stmtDeleteChallenge.ExecContext(ctx, key, now.Unix()); err != nil {
+		return nil, err
+	}
+
+	stmtInsertChallenge, err := db.PrepareContext(ctx, `INSERT INTO `+masterConfig.DB.TblPrefix+webAuthnChallengeTableName+` (challenge_key, challenge, expiry) VALUES( ?, ?, ? )`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmtInsertChallenge.Close()
+	if _, err = stmtInsertChallenge.ExecContext(ctx, key, base64.RawURLEncoding.EncodeToString(challenge), now.Add(webAuthnTimeout).Unix()); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// takeWebAuthnChallenge returns the pending challenge for key and removes it, so it can be used only once.
+func takeWebAuthnChallenge(key string) ([]byte, bool) {
+	db, err := dbConnector.Conn()
+	if err != nil {
+		logger.Error("takeWebAuthnChallenge(): can't connect to database. error: ", err)
+		return nil, false
+	}
+
+	ctx, cancel := dbConnector.WithTimeout(context.Background())
+	defer cancel()
+
+	stmtLookupChallenge, err := db.PrepareContext(ctx, `SELECT challenge, expiry FROM `+masterConfig.DB.TblPrefix+webAuthnChallengeTableName+` WHERE challenge_key = ?`)
+	if err != nil {
+		logger.Error("takeWebAuthnChallenge(): can't prepare statement. error: ", err)
+		return nil, false
+	}
+	defer stmtLookupChallenge.Close()
+
+	var encoded string
+	var expiry int64
+	if err = stmtLookupChallenge.QueryRowContext(ctx, key).Scan(&encoded, &expiry); err != nil {
+		if err != sql.ErrNoRows {
+			logger.Error("takeWebAuthnChallenge(): can't look up challenge. error: ", err)
+		}
+		return nil, false
+	}
+
+	// Only the one deleting it takes it, if two requests race for the same challenge.
+	stmtDeleteChallenge, err := db.PrepareContext(ctx, `DELETE FROM `+masterConfig.DB.TblPrefix+webAuthnChallengeTableName+` WHERE challenge_key = ? AND challenge = ?`)
+	if err != nil {
+		logger.Error("takeWebAuthnChallenge(): can't prepare statement. error: ", err)
+		return nil, false
+	}
+	defer stmtDeleteChallenge.Close()
+	result, err := stmtDeleteChallenge.ExecContext(ctx, key, encoded)
+	if err != nil {
+		logger.Error("takeWebAuthnChallenge(): can't delete challenge. error: ", err)
+		return nil, false
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil, false
+	}
+
+	if time.Now().Unix() > expiry {
+		return nil, false
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+	return challenge, true
+}
+
+// decodeWebAuthnBase64 accepts base64url with or without padding, as browsers differ.
+func decodeWebAuthnBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func loadWebAuthnConfig(uid uint) (userMFA, webAuthnConfig, bool, error) {
+	var conf webAuthnConfig
+
+	mfaMap, err := loadUserMFA(uid)
+	if err != nil {
+		return userMFA{}, conf, false, err
+	}
+	mfa, ok := mfaMap[mfaTypeWebAuthn]
+	if !ok {
+		return userMFA{}, conf, false, nil
+	}
+	if err = json.Unmarshal([]byte(mfa.config), &conf); err != nil {
+		return userMFA{}, conf, false, err
+	}
+	return mfa, conf, true, nil
+}
+
+// verifyWebAuthnAssertion verifies the assertion in auth_mfa with the pending login challenge of uid.
+func verifyWebAuthnAssertion(uid uint, mfa userMFA, req mfaRequest) bool {
+	challenge, ok := takeWebAuthnChallenge(fmt.Sprint("login/", uid))
+	if !ok {
+		return false
+	}
+
+	var conf webAuthnConfig
+	if err := json.Unmarshal([]byte(mfa.config), &conf); err != nil {
+		logger.Error("verifyWebAuthnAssertion(): bad webauthn config for uid ", uid, ". error: ", err)
+		return false
+	}
+
+	credID, err1 := decodeWebAuthnBase64(req.CredentialID)
+	clientDataJSON, err2 := decodeWebAuthnBase64(req.ClientDataJSON)
+	authenticatorData, err3 := decodeWebAuthnBase64(req.AuthenticatorData)
+	signature, err4 := decodeWebAuthnBase64(req.Signature)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return false
+	}
+
+	for i := range conf.Credentials {
+		cred := &conf.Credentials[i]
+		if !bytes.Equal(cred.ID, credID) {
+			continue
+		}
+
+		signCount, err := auth.VerifyWebAuthnAssertion(webAuthnRP(), challenge, &cred.WebAuthnCredential, clientDataJSON, authenticatorData, signature)
+		if err != nil {
+			logger.Warning("verifyWebAuthnAssertion(): rejected assertion for uid ", uid, ". error: ", err)
+			return false
+		}
+
+		cred.SignCount = signCount
+		newConfig, err := json.Marshal(conf)
+		if err != nil {
+			return false
+		}
+		swapped, err := swapUserMFAConfig(uid, mfaTypeWebAuthn, mfa.config, string(newConfig))
+		if err != nil {
+			logger.Error("verifyWebAuthnAssertion(): can't save sign count for uid ", uid, ". error: ", err)
+		}
+		return swapped
+	}
+	return false
+}
+
+// _handlerWebAuthnRegisterBegin returns PublicKeyCredentialCreationOptions for navigator.credentials.create().
+// Binary fields are base64url encoded.
+func _handlerWebAuthnRegisterBegin(c *gin.Context) {
+	if !hasValidAuth(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	uid, _ := authedUid(c)
+
+	user, err := NewUserManager(dbConnector).Lookup(uid)
+	if err != nil {
+		logger.Error("_handlerWebAuthnRegisterBegin(): can't lookup login. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	_, conf, _, err := loadWebAuthnConfig(uid)
+	if err != nil {
+		logger.Error("_handlerWebAuthnRegisterBegin(): can't load MFA. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	challenge, err := putWebAuthnChallenge(fmt.Sprint("reg/", uid))
+	if err != nil {
+		logger.Error("_handlerWebAuthnRegisterBegin(): can't generate challenge. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	excludeCredentials := []gin.H{}
+	for _, cred := range conf.Credentials {
+		excludeCredentials = append(excludeCredentials, gin.H{
+			"type": "public-key",
+			"id":   base64.RawURLEncoding.EncodeToString(cred.ID),
+		})
+	}
+
+	rp := webAuthnRP()
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"public_key": gin.H{
+			"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+			"rp": gin.H{
+				"id":   rp.ID,
+				"name": totpIssuer,
+			},
+			"user": gin.H{
+				"id":          base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprint(uid))),
+				"name":        user.Login,
+				"displayName": user.Login,
+			},
+			"pubKeyCredParams": []gin.H{
+				{"type": "public-key", "alg": auth.COSEAlgES256},
+				{"type": "public-key", "alg": auth.COSEAlgEdDSA},
+			},
+			"excludeCredentials": excludeCredentials,
+			"attestation":        "none",
+			"timeout":            webAuthnTimeout.Milliseconds(),
+		},
+	})
+}
+
+// _handlerWebAuthnRegisterFinish verifies the attestation and saves the new credential.
+// If the user has no recovery codes yet, they are generated and returned ONLY ONCE here.
+func _handlerWebAuthnRegisterFinish(c *gin.Context) {
+	if !hasValidAuth(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	uid, _ := authedUid(c)
+
+	challenge, ok := takeWebAuthnChallenge(fmt.Sprint("reg/", uid))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	clientDataJSON, err1 := decodeWebAuthnBase64(c.PostForm("client_data_json"))
+	attestationObject, err2 := decodeWebAuthnBase64(c.PostForm("attestation_object"))
+	if err1 != nil || err2 != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	cred, err := auth.VerifyWebAuthnRegistration(webAuthnRP(), challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	mfa, conf, found, err := loadWebAuthnConfig(uid)
+	if err != nil {
+		logger.Error("_handlerWebAuthnRegisterFinish(): can't load MFA. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	for _, existing := range conf.Credentials {
+		if bytes.Equal(existing.ID, cred.ID) {
+			c.JSON(http.StatusConflict, gin.H{
+				"status": "error",
+				"error":  ErrMFAAlreadyEnrolled.Error(),
+			})
+			return
+		}
+	}
+	conf.Credentials = append(conf.Credentials, webAuthnCredentialRecord{
+		WebAuthnCredential: *cred,
+		Name:               c.DefaultPostForm("name", "Security Key"),
+		CreationTime:       time.Now().Unix(),
+	})
+	confBytes, _ := json.Marshal(conf)
+	// Another credential registered or used concurrently must not be lost
+	var saved bool
+	if found {
+		saved, err = swapUserMFAConfig(uid, mfaTypeWebAuthn, mfa.config, string(confBytes))
+	} else {
+		saved, err = addUserMFA(uid, mfaTypeWebAuthn, string(confBytes))
+	}
+	if err != nil {
+		logger.Error("_handlerWebAuthnRegisterFinish(): can't save MFA. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	if !saved {
+		c.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  ErrMFAChanged.Error(),
+		})
+		return
+	}
+	logger.Info("_handlerWebAuthnRegisterFinish(): uid ", uid, " registered a WebAuthn credential")
+
+	resp := gin.H{
+		"status":        "success",
+		"credential_id": base64.RawURLEncoding.EncodeToString(cred.ID),
+	}
+
+	mfaMap, err := loadUserMFA(uid)
+	if err == nil {
+		if _, ok := mfaMap[mfaTypeRecovery]; !ok {
+			if codes, err := newRecoveryCodes(uid); err == nil {
+				resp["recovery_codes"] = codes
+			} else {
+				logger.Error("_handlerWebAuthnRegisterFinish(): can't generate recovery codes. error: ", err)
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// _handlerWebAuthnChallenge starts an assertion ceremony for login.
+// It returns PublicKeyCredentialRequestOptions for navigator.credentials.get() if login and passhash are correct.
+func _handlerWebAuthnChallenge(c *gin.Context) {
+	authLogin := c.DefaultPostForm("auth_login", "anonymous")
+	authPasshash := c.DefaultPostForm("auth_passhash", "")
+
+	var authed bool = false
+	var uid uint
+	var retryAfter time.Duration
+	if authPasshash != "" {
+		authed, uid, retryAfter = authLoginPassThrottled(c, authLogin, authPasshash)
+	}
+	if retryAfter > 0 {
+		respondLoginThrottled(c, retryAfter)
+		return
+	}
+	if !authed {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	mfa, conf, ok, err := loadWebAuthnConfig(uid)
+	if err != nil {
+		logger.Error("_handlerWebAuthnChallenge(): can't load MFA. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	if !ok || !mfa.confirmed || len(conf.Credentials) == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  ErrMFANotEnrolled.Error(),
+		})
+		return
+	}
+
+	challenge, err := putWebAuthnChallenge(fmt.Sprint("login/", uid))
+	if err != nil {
+		logger.Error("_handlerWebAuthnChallenge(): can't generate challenge. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	allowCredentials := []gin.H{}
+	for _, cred := range conf.Credentials {
+		allowCredentials = append(allowCredentials, gin.H{
+			"type": "public-key",
+			"id":   base64.RawURLEncoding.EncodeToString(cred.ID),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"public_key": gin.H{
+			"challenge":        base64.RawURLEncoding.EncodeToString(challenge),
+			"rpId":             webAuthnRP().ID,
+			"allowCredentials": allowCredentials,
+			"userVerification": "discouraged",
+			"timeout":          webAuthnTimeout.Milliseconds(),
+		},
+	})
+}
+
+// _handlerWebAuthnRemove removes one credential specified by credential_id. A valid auth_mfa is required.
+func _handlerWebAuthnRemove(c *gin.Context) {
+	if !hasValidAuth(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+	uid, _ := authedUid(c)
+
+	ok, retryAfter := checkThrottled(c, uid, func() bool {
+		return verifyMFA(uid, c.DefaultPostForm("auth_mfa", "{}"))
+	})
+	if retryAfter > 0 {
+		respondLoginThrottled(c, retryAfter)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	credID, err := decodeWebAuthnBase64(c.PostForm("credential_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	mfa, conf, found, err := loadWebAuthnConfig(uid)
+	if err != nil {
+		logger.Error("_handlerWebAuthnRemove(): can't load MFA. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	remaining := []webAuthnCredentialRecord{}
+	for _, cred := range conf.Credentials {
+		if !bytes.Equal(cred.ID, credID) {
+			remaining = append(remaining, cred)
+		}
+	}
+	conf.Credentials = remaining
+
+	saved := true
+	switch {
+	case found && len(remaining) == 0:
+		saved, err = dropUserMFAConfig(uid, mfaTypeWebAuthn, mfa.config)
+	case found:
+		confBytes, _ := json.Marshal(conf)
+		saved, err = swapUserMFAConfig(uid, mfaTypeWebAuthn, mfa.config, string(confBytes))
+	}
+	if err == nil && !saved {
+		c.JSON(http.StatusConflict, gin.H{
+			"status": "error",
+			"error":  ErrMFAChanged.Error(),
+		})
+		return
+	}
+	if err == nil {
+		err = cleanupRecoveryCodes(uid)
+	}
+	if err != nil {
+		logger.Error("_handlerWebAuthnRemove(): can't save MFA. error: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status": "error",
+		})
+		return
+	}
+
+	logger.Info("_handlerWebAuthnRemove(): uid ", uid, " removed a WebAuthn credential")
+	c.JSON(http.StatusOK, gin.H{
+		"status": "success",
+	})
+}
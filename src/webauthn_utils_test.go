@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWebAuthnChallenge(t *testing.T) {
+	useTestConnector(t)
+
+	challenge, err := putWebAuthnChallenge("login/1")
+	if err != nil {
+		t.Fatalf("putWebAuthnChallenge() returns error:%s\n", err)
+	}
+	// Another instance sharing the database takes it, only once
+	if taken, ok := takeWebAuthnChallenge("login/1"); !ok || !bytes.Equal(taken, challenge) {
+		t.Errorf("takeWebAuthnChallenge() returns %x, %v, want %x\n", taken, ok, challenge)
+	}
+	if _, ok := takeWebAuthnChallenge("login/1"); ok {
+		t.Errorf("takeWebAuthnChallenge() returns a challenge taken already\n")
+	}
+
+	// A new one replaces the pending one
+	putWebAuthnChallenge("reg/1")
+	challenge, _ = putWebAuthnChallenge("reg/1")
+	if taken, ok := takeWebAuthnChallenge("reg/1"); !ok || !bytes.Equal(taken, challenge) {
+		t.Errorf("takeWebAuthnChallenge() returns %x, %v, want the latest %x\n", taken, ok, challenge)
+	}
+
+	putWebAuthnChallenge("reg/2")
+	dbConn, _ := dbConnector.Conn()
+	dbConn.Exec(`UPDATE `+masterConfig.DB.TblPrefix+webAuthnChallengeTableName+` SET expiry = 1 WHERE challenge_key = ?`, "reg/2")
+	if _, ok := takeWebAuthnChallenge("reg/2"); ok {
+		t.Errorf("takeWebAuthnChallenge() returns an expired challenge\n")
+	}
+}
+
+func TestUserMFACompareAndSwap(t *testing.T) {
+	useTestConnector(t)
+
+	if added, err := addUserMFA(1, mfaTypeWebAuthn, `{"credentials":[1]}`); err != nil || !added {
+		t.Fatalf("addUserMFA() returns %v, %v\n", added, err)
+	}
+	if added, err := addUserMFA(1, mfaTypeWebAuthn, `{"credentials":[2]}`); err != nil || added {
+		t.Errorf("addUserMFA() of an enrolled type returns %v, %v, want false\n", added, err)
+	}
+	if dropped, err := dropUserMFAConfig(1, mfaTypeWebAuthn, `{"credentials":[]}`); err != nil || dropped {
+		t.Errorf("dropUserMFAConfig() of a stale config returns %v, %v, want false\n", dropped, err)
+	}
+	if dropped, err := dropUserMFAConfig(1, mfaTypeWebAuthn, `{"credentials":[1]}`); err != nil || !dropped {
+		t.Errorf("dropUserMFAConfig() returns %v, %v\n", dropped, err)
+	}
+}
+
+func TestConfirmTOTPRecoveryCodes(t *testing.T) {
+	useTestConnector(t)
+
+	// The first MFA method gets recovery codes
+	codes, err := confirmTOTP(1, `{"secret":"A"}`)
+	if err != nil || len(codes) != recoveryCodeCount {
+		t.Fatalf("confirmTOTP() returns %v, %v, want %d codes\n", codes, err, recoveryCodeCount)
+	}
+	mfaMap, _ := loadUserMFA(1)
+	if mfa := mfaMap[mfaTypeTOTP]; !mfa.confirmed || mfa.config != `{"secret":"A"}` {
+		t.Errorf("TOTP after confirmTOTP() is %+v\n", mfa)
+	}
+	if !consumeRecoveryCode(1, mfaMap[mfaTypeRecovery], codes[0]) {
+		t.Errorf("consumeRecoveryCode() rejects a code returned by confirmTOTP()\n")
+	}
+
+	// Codes from WebAuthn stay valid
+	addUserMFA(2, mfaTypeWebAuthn, `{"credentials":[1]}`)
+	webAuthnCodes, err := newRecoveryCodes(2)
+	if err != nil {
+		t.Fatalf("newRecoveryCodes() returns error:%s\n", err)
+	}
+	if codes, err = confirmTOTP(2, `{"secret":"B"}`); err != nil || codes != nil {
+		t.Errorf("confirmTOTP() with recovery codes returns %v, %v, want no new codes\n", codes, err)
+	}
+	mfaMap, _ = loadUserMFA(2)
+	if !mfaMap[mfaTypeTOTP].confirmed || !consumeRecoveryCode(2, mfaMap[mfaTypeRecovery], webAuthnCodes[0]) {
+		t.Errorf("existing recovery codes are replaced by confirmTOTP(): %+v\n", mfaMap)
+	}
+}